@@ -0,0 +1,143 @@
+package summon
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// How much of the output of a command is kept in memory for errors. Commands
+// like pacman and rsync can produce hundreds of megabytes, so only the start
+// and the end are kept, and the complete output spills over into a temporary
+// file.
+const (
+	captureHead = 64 << 10
+	captureTail = 256 << 10
+)
+
+// A capture keeps the head and tail of what is written to it, and spills the
+// complete output into a temporary file once the middle would be dropped.
+// It is safe for concurrent use.
+type capture struct {
+	mu    sync.Mutex
+	head  []byte
+	tail  []byte // ring buffer, with next as the oldest byte once full
+	next  int
+	total int64
+	spill bool
+	file  *os.File
+	err   error
+}
+
+func newCapture(spill bool) *capture {
+	return &capture{spill: spill}
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := len(p)
+	c.total += int64(n)
+	if room := captureHead - len(c.head); room > 0 {
+		k := min(room, len(p))
+		c.head = append(c.head, p[:k]...)
+		p = p[k:]
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if c.file != nil {
+		c.writeFile(p)
+	} else if c.spill && len(c.tail)+len(p) > captureTail {
+		c.startSpill()
+		c.writeFile(p)
+	}
+	c.appendTail(p)
+	return n, nil
+}
+
+func (c *capture) appendTail(p []byte) {
+	if len(p) >= captureTail {
+		c.tail = append(c.tail[:0], p[len(p)-captureTail:]...)
+		c.next = 0
+		return
+	}
+	for len(p) > 0 {
+		if len(c.tail) < captureTail {
+			k := min(captureTail-len(c.tail), len(p))
+			c.tail = append(c.tail, p[:k]...)
+			p = p[k:]
+			continue
+		}
+		k := copy(c.tail[c.next:], p)
+		c.next = (c.next + k) % captureTail
+		p = p[k:]
+	}
+}
+
+// The tail in order.
+func (c *capture) orderedTail() []byte {
+	if len(c.tail) < captureTail {
+		return c.tail
+	}
+	return append(append([]byte{}, c.tail[c.next:]...), c.tail[:c.next]...)
+}
+
+// Start spilling, with everything written so far. Failing to spill only
+// means the middle of the output is lost.
+func (c *capture) startSpill() {
+	c.file, c.err = os.CreateTemp("", "summon-output-")
+	if c.err != nil {
+		c.file = nil
+		return
+	}
+	c.writeFile(c.head)
+	c.writeFile(c.orderedTail())
+}
+
+func (c *capture) writeFile(p []byte) {
+	if c.err == nil {
+		_, c.err = c.file.Write(p)
+	}
+}
+
+// The total bytes written.
+func (c *capture) Len() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// Bytes returns the captured output, with a note where the middle was left
+// out.
+func (c *capture) Bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	kept := int64(len(c.head) + len(c.tail))
+	if c.total == kept {
+		return append(append([]byte{}, c.head...), c.tail...)
+	}
+	b := append([]byte{}, c.head...)
+	note := fmt.Sprintf("\n[... %d bytes left out", c.total-kept)
+	if c.file != nil && c.err == nil {
+		note += ", the complete output is in " + c.file.Name()
+	}
+	b = append(b, note+" ...]\n"...)
+	return append(b, c.orderedTail()...)
+}
+
+// Close the spill file, removing it unless it should be kept, returning its
+// name if it was kept.
+func (c *capture) Close(keep bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return ""
+	}
+	c.file.Close()
+	if !keep || c.err != nil {
+		os.Remove(c.file.Name())
+		return ""
+	}
+	return c.file.Name()
+}
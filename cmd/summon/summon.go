@@ -1,13 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/daaku/errgroup"
+	"github.com/daaku/summon"
+	"github.com/daaku/summon/summonconsole"
+	"github.com/daaku/summon/summoneta"
+	"github.com/daaku/summon/summonjournal"
+	"github.com/daaku/summon/summonmetrics"
+	"github.com/daaku/summon/summonserver"
+	"github.com/daaku/summon/summonssh"
 	"github.com/daaku/summon/system"
-	"github.com/segmentio/go-prompt"
 	"github.com/voxelbrain/goptions"
 )
 
@@ -16,45 +34,414 @@ type Step struct {
 	Defer func(kill chan bool) error
 }
 
-func (s Step) LoggedDefer(kill chan bool) {
+// The name of the Do function, like Config.GptSetup, for tracing.
+func (s Step) Name() string {
+	name := runtime.FuncForPC(reflect.ValueOf(s.Do).Pointer()).Name()
+	name = strings.TrimSuffix(name, "-fm")
+	parts := strings.Split(name[strings.LastIndex(name, "/")+1:], ".")
+	// drop the package and any closure suffixes like func1
+	for len(parts) > 2 && strings.HasPrefix(parts[len(parts)-1], "func") {
+		parts = parts[:len(parts)-1]
+	}
+	name = strings.Join(parts[1:], ".")
+	return strings.NewReplacer("(", "", ")", "", "*", "").Replace(name)
+}
+
+// Names of the steps to run or skip, as given by --only and --skip.
+var only, skip []string
+
+// Whether the step name is like the names, which may leave out the type, like
+// GenFstab for Config.GenFstab.
+func matchStep(name string, names []string) bool {
+	for _, n := range names {
+		if name == n || strings.HasSuffix(name, "."+n) {
+			return true
+		}
+	}
+	return false
+}
+
+// Steps without a Defer which --only keeps, since opening the disks and
+// running commands in the target need them.
+var setupSteps = []string{"ResolveSecrets", "PromptDiskPassword", "SetupEmulation", "SetupProxy"}
+
+// Whether the step is filtered out by --only or --skip. Steps with a Defer,
+// like mounting the disks, set up what later steps need, so --only keeps
+// them, while they can still be skipped along with their Defer.
+func (s Step) skipped() bool {
+	name := s.Name()
+	if matchStep(name, skip) {
+		return true
+	}
+	if len(only) == 0 || s.Defer != nil || matchStep(name, setupSteps) {
+		return false
+	}
+	return !matchStep(name, only)
+}
+
+// Run the Do function as a summon.Task, so it is traced.
+func (s Step) Run(kill chan bool) error {
+	return summon.Run(context.Background(), summon.Task{
+		Name: s.Name(),
+		Do:   func(context.Context) error { return s.Do(kill) },
+	})
+}
+
+// Run the Defer function as a summon.Task, so a panic is returned as an
+// error, and undoing the other steps carries on.
+func (s Step) RunDefer(kill chan bool) error {
 	if s.Defer == nil {
-		return
+		return nil
 	}
-	if err := s.Defer(kill); err != nil {
+	return summon.Run(context.Background(), summon.Task{
+		Name:  s.Name(),
+		Defer: func(context.Context) error { return s.Defer(kill) },
+	})
+}
+
+func (s Step) LoggedDefer(kill chan bool) {
+	if err := s.RunDefer(kill); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
 
+// The steps in order as a single step, which is undone in reverse. If one
+// fails, the ones before it are undone before returning.
+func serial(steps ...Step) Step {
+	var done []Step
+	undo := func(kill chan bool) error {
+		var errs []error
+		for i := len(done) - 1; i >= 0; i-- {
+			errs = append(errs, done[i].RunDefer(kill))
+		}
+		done = nil
+		return errgroup.NewMultiError(errs...)
+	}
+	return Step{
+		Do: func(kill chan bool) error {
+			for _, s := range steps {
+				if s.skipped() {
+					continue
+				}
+				if err := s.Run(kill); err != nil {
+					if uerr := undo(nil); uerr != nil {
+						fmt.Fprintln(os.Stderr, uerr)
+					}
+					return err
+				}
+				done = append(done, s)
+			}
+			return nil
+		},
+		Defer: undo,
+	}
+}
+
+// The independent steps run concurrently as a single step, like preparing
+// different disks. If any fail, the others are undone before returning.
+func parallel(steps ...Step) Step {
+	var done []Step
+	var mu sync.Mutex
+	undo := func(kill chan bool) error {
+		var eg errgroup.Group
+		eg.Add(len(done))
+		for _, s := range done {
+			go func() {
+				defer eg.Done()
+				eg.Error(s.RunDefer(kill))
+			}()
+		}
+		err := eg.Wait()
+		done = nil
+		return err
+	}
+	return Step{
+		Do: func(kill chan bool) error {
+			var eg errgroup.Group
+			steps := slices.DeleteFunc(slices.Clone(steps), Step.skipped)
+			eg.Add(len(steps))
+			for _, s := range steps {
+				go func() {
+					defer eg.Done()
+					if err := s.Run(kill); err != nil {
+						eg.Error(err)
+						return
+					}
+					mu.Lock()
+					done = append(done, s)
+					mu.Unlock()
+				}()
+			}
+			if err := eg.Wait(); err != nil {
+				if uerr := undo(nil); uerr != nil {
+					fmt.Fprintln(os.Stderr, uerr)
+				}
+				return err
+			}
+			return nil
+		},
+		Defer: undo,
+	}
+}
+
 func main() {
 	options := struct {
-		Name string        `goptions:"-n, --name, obligatory, description='system name'"`
-		Help goptions.Help `goptions:"-h, --help, description='show this help'"`
+		Name    string        `goptions:"-n, --name, obligatory, description='system name'"`
+		Quiet   bool          `goptions:"-q, --quiet, description='show only failures'"`
+		Verbose bool          `goptions:"-v, --verbose, description='show each command, and the output of the ones which fail'"`
+		Debug   bool          `goptions:"--debug, description='show the output of commands as they run'"`
+		Metrics string        `goptions:"--metrics, description='serve Prometheus metrics on this address, like :9100'"`
+		Journal bool          `goptions:"--journal, description='log tasks and commands to the systemd journal'"`
+		Remote  string        `goptions:"--remote, description='run commands on this host over SSH, like root@archiso'"`
+		SSHOpt  []string      `goptions:"--ssh-option, description='additional ssh argument for --remote'"`
+		Server  string        `goptions:"--server, description='provisioning server to report installs to, and fetch the command line from for provision'"`
+		Token   string        `goptions:"--server-token, description='bearer token the provisioning server requires, also for serve'"`
+		Shared  bool          `goptions:"--shared-mounts, description='mount in the mount namespace of the host instead of a private one'"`
+		Only    []string      `goptions:"--only, description='run only this step, like GenFstab, along with the ones setting up the disks'"`
+		Skip    []string      `goptions:"--skip, description='skip this step, like Benchmark'"`
+		Help    goptions.Help `goptions:"-h, --help, description='show this help'"`
 
 		goptions.Verbs
 		Create struct {
-			FSType      string `goptions:"-f, --fs, obligatory, description='file system'"`
-			Disk        string `goptions:"-d, --disk, obligatory, description='target disk'"`
-			User        string `goptions:"-u, --user, description='user to set password for'"`
-			Package     string `goptions:"-p, --package, description='package to install'"`
-			EnableCrypt bool   `goptions:"--enable-crypt, description='enable encrypted disk'"`
-			EnableSwap  bool   `goptions:"--enable-swap, description='enable swap'"`
-			EnableOSX   bool   `goptions:"--enable-osx, description='create OS X partitions'"`
-			KeepGPT     bool   `goptions:"--keep-gpt, description='keep the existing GPT'"`
+			FSType      string   `goptions:"-f, --fs, obligatory, description='file system'"`
+			Disk        string   `goptions:"-d, --disk, obligatory, description='target disk'"`
+			User        string   `goptions:"-u, --user, description='user to set password for'"`
+			Package     string   `goptions:"-p, --package, description='package to install'"`
+			Pacstrap    bool     `goptions:"--pacstrap, description='install base packages instead of a meta-package'"`
+			Install     []string `goptions:"--install, description='explicit package to install'"`
+			Group       []string `goptions:"--group, description='package group to install'"`
+			Ignore      []string `goptions:"--ignore, description='package to ignore in the target'"`
+			Offline     string   `goptions:"--offline, description='install only from this package cache'"`
+			Lockfile    string   `goptions:"--lockfile, description='package versions to install from the offline cache'"`
+			Archive     bool     `goptions:"--archive, description='fetch locked packages missing from the offline cache from the Arch Linux Archive'"`
+			RecordLock  string   `goptions:"--record-lockfile, description='record installed package versions to this file'"`
+			Debootstrap string   `goptions:"--debootstrap, description='install this Debian suite instead of Arch Linux'"`
+			Alpine      string   `goptions:"--alpine, description='install this Alpine Linux branch instead of Arch Linux'"`
+			Fedora      string   `goptions:"--fedora, description='install this Fedora release instead of Arch Linux'"`
+			FedoraRepos string   `goptions:"--fedora-repos, description='directory with .repo files to install Fedora from, instead of the Fedora mirrors'"`
+			Void        bool     `goptions:"--void, description='install Void Linux instead of Arch Linux'"`
+			ALARM       string   `goptions:"--alarm, description='install Arch Linux ARM for this board type: rpi, uboot or efi'"`
+			Mirror      string   `goptions:"--mirror, description='mirror to install Debian, Alpine, Void Linux or Arch Linux ARM from'"`
+			ImageSize   string   `goptions:"--image-size, description='create the target disk as a loop image file of this size'"`
+			Locale      []string `goptions:"--locale, description='locale to generate, the first is the default'"`
+			Timezone    string   `goptions:"--timezone, description='timezone like Europe/Berlin'"`
+			Keymap      string   `goptions:"--keymap, description='console keymap'"`
+			Font        string   `goptions:"--font, description='console font'"`
+			Enable      []string `goptions:"--enable, description='systemd unit to enable'"`
+			Mask        []string `goptions:"--mask, description='systemd unit to mask'"`
+			DHCP        bool     `goptions:"--dhcp, description='configure systemd-networkd for DHCP on ethernet interfaces'"`
+			NTP         []string `goptions:"--ntp, description='NTP server for the target'"`
+			Laptop      bool     `goptions:"--laptop, description='enable the laptop power management profile'"`
+			Pretty      string   `goptions:"--pretty-hostname, description='descriptive hostname reported by hostnamectl, like Work Laptop'"`
+			Chassis     string   `goptions:"--chassis, description='chassis type reported by hostnamectl, like laptop or server'"`
+			Deployment  string   `goptions:"--deployment, description='deployment environment reported by hostnamectl, like production'"`
+			Location    string   `goptions:"--location, description='location reported by hostnamectl, like rack 4'"`
+			Drivers     bool     `goptions:"--drivers, description='install GPU drivers, firmware and microcode for the detected hardware'"`
+			Cache       string   `goptions:"--cache, description='reuse downloaded packages and the installed base system from this directory'"`
+			HostCache   bool     `goptions:"--host-cache, description='share the package cache of the host with the target'"`
+			Parallel    int      `goptions:"--parallel-downloads, description='number of packages to download concurrently'"`
+			NoTimeout   bool     `goptions:"--disable-download-timeout, description='allow slow package downloads'"`
+			DownloadAs  string   `goptions:"--download-user, description='user to download packages as, like alpm'"`
+			Proxy       string   `goptions:"--proxy, description='HTTP proxy for the install, like http://proxy:3128, instead of the one in the environment'"`
+			NoProxy     []string `goptions:"--no-proxy, description='host to reach without the proxy'"`
+			Xfer        string   `goptions:"--xfer-command, description='pacman XferCommand to download with, like for a proxy libcurl cannot use'"`
+			Chroot      bool     `goptions:"--chroot, description='use chroot instead of systemd-nspawn for post install'"`
+			EnableCrypt bool     `goptions:"--enable-crypt, description='enable encrypted disk'"`
+			DiskSecret  string   `goptions:"--disk-secret, description='disk password reference like pass:machines/boe/disk'"`
+			Escrow      []string `goptions:"--escrow, description='generate the disk password and escrow it like file:/media/usb or pass:machines'"`
+			UserSecret  string   `goptions:"--user-secret, description='user password reference like env:BOE_PASSWORD'"`
+			Deny        []string `goptions:"--deny-password, description='word passwords must not contain'"`
+			KeyDevice   string   `goptions:"--key-device, description='removable device with a keyfile also required to unlock the disk'"`
+			KeyFile     string   `goptions:"--key-file, description='path of the keyfile on the key device, created if missing'"`
+			EnableSwap  bool     `goptions:"--enable-swap, description='enable swap'"`
+			SwapDisk    string   `goptions:"--swap-disk, description='disk to use for swap instead of a partition on the target disk'"`
+			SwapPri     int      `goptions:"--swap-priority, description='priority of the swap partition or disk'"`
+			Zram        int      `goptions:"--zram, description='enable zram swap with this priority, like 100 to use it before the swap partition'"`
+			SwapFile    []string `goptions:"--swap-file, description='swap file with a size and optional priority, like /swap/file:8G:10'"`
+			Tmpfs       bool     `goptions:"--tmpfs, description='mount /tmp as a tmpfs'"`
+			TmpfsSize   string   `goptions:"--tmpfs-size, description='size of the /tmp tmpfs, like 2G or 25%'"`
+			VarTmpAge   string   `goptions:"--var-tmp-age, description='remove files unused in /var/tmp for this long, like 30d'"`
+			Data        []string `goptions:"--data, description='disk for a mount point, like /home:/dev/sdb'"`
+			EnableOSX   bool     `goptions:"--enable-osx, description='create OS X partitions'"`
+			HybridMBR   bool     `goptions:"--hybrid-mbr, description='hybrid MBR with the OS X partitions'"`
+			KeepGPT     bool     `goptions:"--keep-gpt, description='keep the existing GPT'"`
+			Reinstall   bool     `goptions:"--reinstall, description='replace only the active btrfs subvolume, keeping the partitions and other subvolumes'"`
+			Subvolume   []string `goptions:"--subvolume, description='btrfs subvolume kept when reinstalling, like __home:/home'"`
+			NativeGPT   bool     `goptions:"--native-gpt, description='write the GPT directly instead of using sgdisk'"`
+			PartType    []string `goptions:"--partition-type, description='partition type code or GUID, like root=8304'"`
+			PartUUID    []string `goptions:"--partition-uuid, description='fixed PARTUUID, like root=<uuid>'"`
+			DPS         bool     `goptions:"--dps, description='discoverable partition types, without root= or a root fstab entry'"`
+			FstabUUID   bool     `goptions:"--fstab-uuid, description='refer to file systems by UUID in the fstab'"`
+			ESP         string   `goptions:"--esp, description='where to mount the ESP in the target, like /efi'"`
+			EFIVendor   string   `goptions:"--efi-vendor, description='directory under EFI in the ESP for the kernel and initramfs'"`
+			Automount   bool     `goptions:"--esp-automount, description='mount the ESP on first access instead of at boot'"`
+			BtrfsMaint  bool     `goptions:"--btrfs-maintenance, description='scrub and balance a btrfs root on a schedule'"`
+			DiskKind    string   `goptions:"--disk-kind, description='hdd, ssd or nvme instead of detecting it for the mount options'"`
+			Commit      int      `goptions:"--commit, description='seconds between file system commits'"`
+			Benchmark   bool     `goptions:"--benchmark, description='benchmark the installed root using fio, for the report'"`
+			BackupJob   string   `goptions:"--backup-job, description='install this JSON backup job to run on a schedule in the target'"`
+			Manifest    string   `goptions:"--manifest, description='JSON manifest of files to render into the target'"`
+			EtcGit      string   `goptions:"--etc-git, description='commit /etc in the target with git or etckeeper'"`
+			Identity    string   `goptions:"--restore-identity, description='restore SSH host keys and machine-id from this directory'"`
+			BlankID     bool     `goptions:"--blank-machine-id, description='generate the machine-id on first boot'"`
+			VerifyBoot  bool     `goptions:"--verify-boot, description='boot the installed system in QEMU to check it comes up'"`
+			Notify      []string `goptions:"--notify, description='notify this target once done, like ntfy:https://ntfy.sh/topic or mailto:ops@example.com'"`
 		} `goptions:"create"`
+		RunBackup struct {
+			Job string `goptions:"--job, obligatory, description='JSON backup job to run'"`
+		} `goptions:"run-backup"`
+		SaveIdentity struct {
+			Dir string `goptions:"--dir, obligatory, description='directory to save SSH host keys and machine-id to'"`
+		} `goptions:"save-identity"`
+		Restore struct {
+			FSType       string   `goptions:"-f, --fs, obligatory, description='file system'"`
+			Disk         string   `goptions:"-d, --disk, obligatory, description='target disk'"`
+			EnableCrypt  bool     `goptions:"--enable-crypt, description='enable encrypted disk'"`
+			DiskSecret   string   `goptions:"--disk-secret, description='disk password reference like pass:machines/boe/disk'"`
+			Escrow       []string `goptions:"--escrow, description='generate the disk password and escrow it like file:/media/usb or pass:machines'"`
+			KeyDevice    string   `goptions:"--key-device, description='removable device with a keyfile also required to unlock the disk'"`
+			KeyFile      string   `goptions:"--key-file, description='path of the keyfile on the key device, created if missing'"`
+			EnableSwap   bool     `goptions:"--enable-swap, description='enable swap'"`
+			SwapDisk     string   `goptions:"--swap-disk, description='disk to use for swap instead of a partition on the target disk'"`
+			SwapPri      int      `goptions:"--swap-priority, description='priority of the swap partition or disk'"`
+			Zram         int      `goptions:"--zram, description='enable zram swap with this priority, like 100 to use it before the swap partition'"`
+			SwapFile     []string `goptions:"--swap-file, description='swap file with a size and optional priority, like /swap/file:8G:10'"`
+			Data         []string `goptions:"--data, description='disk for a mount point, like /home:/dev/sdb'"`
+			KeepGPT      bool     `goptions:"--keep-gpt, description='keep the existing GPT'"`
+			NativeGPT    bool     `goptions:"--native-gpt, description='write the GPT directly instead of using sgdisk'"`
+			PartType     []string `goptions:"--partition-type, description='partition type code or GUID, like root=8304'"`
+			PartUUID     []string `goptions:"--partition-uuid, description='fixed PARTUUID, like root=<uuid>'"`
+			DPS          bool     `goptions:"--dps, description='discoverable partition types, without root= or a root fstab entry'"`
+			FstabUUID    bool     `goptions:"--fstab-uuid, description='refer to file systems by UUID in the fstab'"`
+			Keymap       string   `goptions:"--keymap, description='console keymap to type the disk password with'"`
+			Font         string   `goptions:"--font, description='console font'"`
+			Rsync        string   `goptions:"--rsync, description='restore from this rsync backup directory'"`
+			Dated        bool     `goptions:"--dated, description='restore the latest dated rsync backup'"`
+			Restic       string   `goptions:"--restic, description='restore from this restic repository'"`
+			Borg         string   `goptions:"--borg, description='restore from this borg repository'"`
+			PasswordFile string   `goptions:"--password-file, description='file containing the backup repository password'"`
+			Tag          []string `goptions:"--tag, description='restore the latest restic backup with these tags'"`
+			Prefix       string   `goptions:"--prefix, description='restore the latest borg archive with this prefix'"`
+			Path         string   `goptions:"--path, description='backed up path containing the system'"`
+			Notify       []string `goptions:"--notify, description='notify this target once done, like ntfy:https://ntfy.sh/topic or mailto:ops@example.com'"`
+		} `goptions:"restore"`
 		Backup struct {
+			Exclude      []string `goptions:"--exclude, description='pattern to exclude, replacing the default cache excludes'"`
+			BWLimit      int      `goptions:"--bwlimit, description='bandwidth limit in KiB/s'"`
+			Live         bool     `goptions:"--live, description='back up the live file system instead of btrfs snapshots'"`
+			Idle         bool     `goptions:"--idle, description='run with idle IO priority and lowest CPU priority'"`
+			Window       string   `goptions:"--window, description='only start during this daily window, like 22:00-06:00'"`
+			LogDir       string   `goptions:"--log-dir, description='write a manifest of the backup to this directory'"`
+			Webhook      string   `goptions:"--webhook, description='POST the backup manifest to this URL'"`
+			Healthchecks string   `goptions:"--healthchecks, description='healthchecks.io ping URL to report the backup to'"`
+			Notify       []string `goptions:"--notify, description='notify this target once done, like ntfy:https://ntfy.sh/topic or mailto:ops@example.com'"`
+			Rsync        []string `goptions:"--rsync, description='back up the remaining paths to this rsync destination'"`
+			Dated        bool     `goptions:"--dated, description='hard link incremental rsync backups into dated directories'"`
+			Restic       []string `goptions:"--restic, description='back up the remaining paths to this restic repository'"`
+			Borg         []string `goptions:"--borg, description='back up the remaining paths to this borg repository'"`
+			Prefix       string   `goptions:"--prefix, description='borg archive name prefix'"`
+			PasswordFile string   `goptions:"--password-file, description='file containing the backup repository password'"`
+			Tag          []string `goptions:"--tag, description='tag for the backup'"`
+			KeepLast     int      `goptions:"--keep-last, description='prune all but this many of the latest backups'"`
+			KeepDaily    int      `goptions:"--keep-daily, description='keep the last backup of this many days'"`
+			KeepWeekly   int      `goptions:"--keep-weekly, description='keep the last backup of this many weeks'"`
+			KeepMonthly  int      `goptions:"--keep-monthly, description='keep the last backup of this many months'"`
 			goptions.Remainder
 		} `goptions:"backup"`
+		Prune struct {
+			Rsync        []string `goptions:"--rsync, description='prune dated backups in this local rsync destination'"`
+			Restic       []string `goptions:"--restic, description='prune this restic repository'"`
+			Borg         []string `goptions:"--borg, description='prune this borg repository'"`
+			Prefix       string   `goptions:"--prefix, description='borg archive name prefix'"`
+			PasswordFile string   `goptions:"--password-file, description='file containing the backup repository password'"`
+			Tag          []string `goptions:"--tag, description='only prune restic backups with these tags'"`
+			KeepLast     int      `goptions:"--keep-last, description='prune all but this many of the latest backups'"`
+			KeepDaily    int      `goptions:"--keep-daily, description='keep the last backup of this many days'"`
+			KeepWeekly   int      `goptions:"--keep-weekly, description='keep the last backup of this many weeks'"`
+			KeepMonthly  int      `goptions:"--keep-monthly, description='keep the last backup of this many months'"`
+			DryRun       bool     `goptions:"--dry-run, description='list the backups which would be pruned'"`
+		} `goptions:"prune"`
 		Exec struct {
 			goptions.Remainder
 		} `goptions:"exec"`
 		NSpawn struct {
 			goptions.Remainder
 		} `goptions:"nspawn"`
+		Serve struct {
+			Listen string `goptions:"--listen, obligatory, description='address to serve the provisioning API on, like :8443'"`
+			Cert   string `goptions:"--tls-cert, description='TLS certificate to serve with, recommended since configs and the token are otherwise sent in the clear'"`
+			Key    string `goptions:"--tls-key, description='TLS private key for --tls-cert'"`
+		} `goptions:"serve"`
+		Provision struct {
+		} `goptions:"provision"`
+		Netboot struct {
+			Dir    string `goptions:"--dir, obligatory, description='directory to write the kernel, initramfs and iPXE script to'"`
+			URL    string `goptions:"--url, description='URL the directory is served from, if not relative to the iPXE script'"`
+			Binary string `goptions:"--binary, description='summon binary to include instead of this one'"`
+			goptions.Remainder
+		} `goptions:"netboot"`
 	}{}
 	goptions.ParseAndFail(&options)
+	only, skip = options.Only, options.Skip
+	// everything but the provisioning server mounts the system somewhere
+	if options.Verbs != "serve" && options.Remote == "" && !options.Shared {
+		if err := system.Isolate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if options.Remote != "" {
+		// the control master exits on its own once idle
+		summon.SetRunner(summonssh.New(options.Remote, options.SSHOpt...))
+	}
+
+	level := summonconsole.Normal
+	switch {
+	case options.Debug:
+		level = summonconsole.Debug
+	case options.Verbose:
+		level = summonconsole.Verbose
+	case options.Quiet:
+		level = summonconsole.Quiet
+	}
+	console := summonconsole.New(os.Stderr, level)
 
 	sys := system.New(options.Name)
-	var steps []Step
+	sys.Reporter = console.Report
+	var tracers []summon.Tracer
+	install := options.Verbs == "create" || options.Verbs == "restore"
+	if install {
+		sys.Audit = system.NewAuditTrail()
+		tracers = append(tracers, sys.Audit)
+	}
+	var eta *summoneta.ETA
+	if install {
+		eta = newETA(sys.Name, console)
+		tracers = append(tracers, eta)
+	}
+	// after the ETA, so a task is shown as done before the time remaining
+	tracers = append(tracers, console)
+	var metrics *summonmetrics.Metrics
+	if options.Metrics != "" {
+		metrics = serveMetrics(sys, options.Metrics)
+		tracers = append(tracers, metrics)
+	}
+	if options.Journal {
+		j, err := summonjournal.New(sys.Name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		tracers = append(tracers, j)
+	}
+	var client *summonserver.Client
+	if options.Server != "" && install {
+		client = &summonserver.Client{URL: options.Server, Machine: sys.Name, Token: options.Token}
+		sys.Reporter = client.Reporter(sys.Reporter)
+		tracers = append(tracers, client)
+	}
+	summon.SetTracer(summon.Tracers(tracers...))
+	var steps, after []Step
 
 	switch options.Verbs {
 	case "":
@@ -67,53 +454,466 @@ func main() {
 		os.Exit(2)
 	case "create":
 		sys.EnableOSX = options.Create.EnableOSX
+		sys.HybridMBR = options.Create.HybridMBR
+		sys.Notify = options.Create.Notify
+		sys.PasswordPolicy = &system.PasswordPolicy{
+			MinLength:  minPasswordLength,
+			MinEntropy: minEntropy,
+			Denylist:   options.Create.Deny,
+		}
 		sys.Disk = options.Create.Disk
+		if options.Create.NativeGPT {
+			sys.GPT = &system.GPT{}
+		}
+		sys.FstabUUID = options.Create.FstabUUID
+		sys.PartitionTypes = partitionFlags(sys, options.Create.PartType)
+		sys.PartUUIDs = partitionFlags(sys, options.Create.PartUUID)
+		sys.DPS = options.Create.DPS
+		if options.Create.ESP != "" {
+			sys.SetESP(options.Create.ESP)
+		}
+		sys.EFI.Vendor = options.Create.EFIVendor
+		sys.EFI.Automount = options.Create.Automount
+		sys.DiskKind = system.DiskKind(options.Create.DiskKind)
+		sys.Commit = options.Create.Commit
+		if options.Create.BtrfsMaint {
+			sys.BtrfsMaintenance = &system.BtrfsMaintenance{}
+		}
 		sys.Package = options.Create.Package
+		if options.Create.Pacstrap {
+			sys.Packages = append(sys.Packages, system.DefaultPackages...)
+		}
+		sys.Packages = append(sys.Packages, options.Create.Install...)
+		sys.Groups = options.Create.Group
+		sys.IgnorePkg = options.Create.Ignore
+		sys.Chroot = options.Create.Chroot
+		if options.Create.Cache != "" {
+			sys.Cache = &system.BuildCache{Dir: options.Create.Cache}
+		}
+		sys.HostCache = options.Create.HostCache
+		if options.Create.Parallel > 0 || options.Create.NoTimeout || options.Create.DownloadAs != "" || options.Create.Xfer != "" {
+			sys.Pacman = &system.PacmanConf{
+				ParallelDownloads:      options.Create.Parallel,
+				DisableDownloadTimeout: options.Create.NoTimeout,
+				DownloadUser:           options.Create.DownloadAs,
+				XferCommand:            options.Create.Xfer,
+			}
+		}
+		sys.Proxy = system.ProxyFromEnvironment()
+		if options.Create.Proxy != "" {
+			sys.Proxy = &system.Proxy{HTTP: options.Create.Proxy}
+		}
+		if sys.Proxy != nil && len(options.Create.NoProxy) > 0 {
+			sys.Proxy.NoProxy = options.Create.NoProxy
+		}
+		sys.DetectDrivers = options.Create.Drivers
+		sys.EnableUnits = options.Create.Enable
+		sys.MaskUnits = options.Create.Mask
+		sys.NTPServers = options.Create.NTP
+		if options.Create.DHCP {
+			sys.Network = &system.Network{
+				Interfaces: []system.Interface{{Match: "en*", DHCP: true}},
+			}
+		}
+		sys.Locales = options.Create.Locale
+		sys.Timezone = options.Create.Timezone
+		sys.Keymap = options.Create.Keymap
+		sys.Font = options.Create.Font
+		loadConsole(sys, options.Remote != "")
+		if options.Create.Offline != "" {
+			if options.Create.Lockfile == "" {
+				fmt.Fprintln(os.Stderr, "--offline requires a --lockfile")
+				os.Exit(2)
+			}
+			sys.Offline = &system.Offline{
+				CacheDir: options.Create.Offline,
+				Lockfile: options.Create.Lockfile,
+			}
+			if options.Create.Archive {
+				sys.Offline.Archive = system.DefaultArchive
+			}
+		}
 		sys.Root.FSType = system.FSType(options.Create.FSType)
+		if options.Create.Debootstrap != "" {
+			sys.Installer = system.Debootstrap{
+				Suite:  options.Create.Debootstrap,
+				Mirror: options.Create.Mirror,
+			}
+		}
+		if options.Create.Alpine != "" {
+			sys.Installer = system.Alpine{
+				Branch: options.Create.Alpine,
+				Mirror: options.Create.Mirror,
+			}
+		}
+		if options.Create.Fedora != "" {
+			sys.Installer = system.Fedora{
+				Release: options.Create.Fedora,
+				Repos:   options.Create.FedoraRepos,
+			}
+		}
+		if options.Create.Void {
+			sys.Installer = system.Void{Mirror: options.Create.Mirror}
+		}
+		if options.Create.ALARM != "" {
+			sys.Installer = system.ALARM{
+				Board:  options.Create.ALARM,
+				Mirror: options.Create.Mirror,
+			}
+		}
+		if options.Create.ImageSize != "" {
+			sys.Image = &system.LoopImage{
+				File: options.Create.Disk,
+				Size: options.Create.ImageSize,
+			}
+		}
+		if options.Create.BackupJob != "" {
+			job, err := system.ReadBackupJob(options.Create.BackupJob)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			sys.BackupJob = job
+		}
+		sys.EtcGit = system.EtcGit(options.Create.EtcGit)
+		if options.Create.Manifest != "" {
+			m, err := system.ReadManifest(options.Create.Manifest)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			sys.Manifest = m
+		}
+		if options.Create.Laptop {
+			sys.EnableLaptop(system.DefaultLaptop)
+		}
+		if options.Create.Pretty != "" || options.Create.Chassis != "" || options.Create.Deployment != "" || options.Create.Location != "" {
+			sys.MachineInfo = &system.MachineInfo{
+				PrettyHostname: options.Create.Pretty,
+				Chassis:        options.Create.Chassis,
+				Deployment:     options.Create.Deployment,
+				Location:       options.Create.Location,
+			}
+		}
 		if options.Create.EnableSwap {
 			sys.EnableSwap(options.Create.EnableCrypt)
+			sys.Swap.Disk = options.Create.SwapDisk
 		}
-		if options.Create.EnableCrypt {
-			sys.Root.Password = passwordConfirm("%s disk password: ", sys.Name)
+		addSwaps(sys, options.Create.SwapPri, options.Create.Zram, options.Create.SwapFile)
+		if options.Create.Tmpfs || options.Create.TmpfsSize != "" || options.Create.VarTmpAge != "" {
+			sys.Tmp = &system.TmpPolicy{
+				Tmpfs:     options.Create.Tmpfs || options.Create.TmpfsSize != "",
+				Size:      options.Create.TmpfsSize,
+				VarTmpAge: options.Create.VarTmpAge,
+			}
 		}
-		userpass := passwordConfirm("%s user password: ", sys.Name)
-
-		if !options.Create.KeepGPT {
-			steps = append(steps, Step{Do: sys.GptSetup})
+		addDataDisks(sys, options.Create.Data, options.Create.EnableCrypt)
+		var userpass string
+		if options.Create.UserSecret != "" {
+			var err error
+			if userpass, err = system.LookupSecret(options.Create.UserSecret); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		} else {
+			userpass = passwordConfirm("%s user password", sys.Name)
 		}
 
+		if options.Create.EnableCrypt {
+			steps = append(steps, diskPassword(sys, options.Create.DiskSecret, options.Create.Escrow)...)
+		}
+		if options.Create.KeyDevice != "" {
+			sys.TwoFactor = &system.TwoFactor{
+				Device: options.Create.KeyDevice,
+				Path:   options.Create.KeyFile,
+			}
+		}
+		addSubvolumes(sys, options.Create.Subvolume)
+		planFirmware(sys, options.Remote != "")
+		steps = append(steps, Step{Do: sys.SetupProxy})
+		if options.Create.Reinstall {
+			steps = append(steps, reinstall(sys)...)
+		} else {
+			steps = append(steps, prepare(sys, options.Create.KeepGPT)...)
+		}
 		steps = append(
 			steps,
-			Step{Do: sys.Root.LuksFormat},
-			Step{Do: sys.Root.LuksOpen, Defer: sys.Root.LuksClose},
-			Step{Do: sys.Root.MakeFS},
-			Step{Do: sys.Root.Mount, Defer: sys.Root.Umount},
-			Step{Do: sys.Swap.LuksFormat},
-			Step{Do: sys.Swap.LuksOpen, Defer: sys.Swap.LuksClose},
-			Step{Do: sys.Swap.MakeFS},
-			Step{Do: sys.EFI.MakeFS},
-			Step{Do: sys.EFI.Mount, Defer: sys.EFI.Umount},
+			Step{Do: sys.MountSubvolumes, Defer: sys.UmountSubvolumes},
+			Step{Do: sys.SetupEmulation},
+			Step{Do: sys.GenPacmanConf},
+			Step{Do: sys.BindHostCache, Defer: sys.UnbindHostCache},
 			Step{Do: sys.InstallFileSystem},
 			Step{Do: sys.VirtualFS.Mount, Defer: sys.VirtualFS.Umount},
 			Step{Do: sys.InstallSystem},
+			Step{Do: sys.InstallDrivers},
+			Step{Do: sys.VerifyEmulation},
 			Step{Do: sys.GenEtcHostname},
+			Step{Do: sys.GenMachineInfo},
+			Step{Do: sys.GenEtcHosts},
+			Step{Do: sys.GenLocale},
+			Step{Do: sys.GenLocaltime},
+			Step{Do: sys.GenVConsole},
 			Step{Do: sys.GenRefind},
 			Step{Do: sys.GenFstab},
+			Step{Do: sys.GenSwap},
+			Step{Do: sys.GenCrypttab},
+			Step{Do: sys.GenSysctl},
+			Step{Do: sys.GenTmpfiles},
+			Step{Do: sys.GenModprobe},
+			Step{Do: sys.GenLogind},
+			Step{Do: sys.GenTwoFactorHook},
 			Step{Do: sys.PostInstall},
 			Step{Do: sys.Passwd("root", userpass)},
+			Step{Do: sys.CreateUsers},
+			Step{Do: sys.GenSudoers},
+			Step{Do: sys.InstallAuthorizedKeys},
+			Step{Do: sys.InstallDotfiles},
+			Step{Do: sys.GenSSHD},
+			Step{Do: sys.GenNetwork},
+			Step{Do: sys.GenTimesync},
+			Step{Do: sys.ConfigureUnits},
+			Step{Do: sys.GenFirstBoot},
+			Step{Do: sys.GenBackupTimer},
+			Step{Do: sys.GenBtrfsMaintenance},
+			Step{Do: sys.InstallManifest},
+		)
+		// rolling back to the as-installed snapshot keeps the identity
+		if options.Create.Identity != "" {
+			sys.MachineID = system.MachineIDRestored
+			steps = append(steps, Step{Do: sys.RestoreIdentity(options.Create.Identity)})
+		}
+		if options.Create.BlankID {
+			sys.MachineID = system.MachineIDBlank
+		}
+		steps = append(
+			steps,
+			Step{Do: sys.GenMachineID},
+			// once everything is installed, so all of it is checked
+			Step{Do: sys.Validate},
 			Step{Do: sys.Root.Snapshot("as-installed")},
 		)
+		if options.Create.RecordLock != "" {
+			steps = append(steps, Step{Do: sys.RecordLockfile(options.Create.RecordLock)})
+		}
+		if options.Create.Benchmark {
+			steps = append(steps, Step{Do: sys.Benchmark})
+		}
+		if options.Create.VerifyBoot {
+			steps = append(steps, Step{Do: sys.GenBootCheck})
+			// the disks must be unmounted and closed first
+			after = append(after, Step{Do: sys.VerifyBoot(system.BootCheck{})})
+		}
 		if options.Create.User != "" {
 			steps = append(steps, Step{Do: sys.Passwd(options.Create.User, userpass)})
 		}
+		steps = append(steps, Step{Do: sys.CommitEtc})
 	case "exec":
 		steps = exec(sys, Step{Do: sys.Exec(options.Exec.Remainder)})
+	case "save-identity":
+		steps = exec(sys, Step{Do: sys.SaveIdentity(options.SaveIdentity.Dir)})
+	case "run-backup":
+		job, err := system.ReadBackupJob(options.RunBackup.Job)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		// running from a timer, there's no terminal to show progress on
+		sys.Reporter = nil
+		steps = []Step{Step{Do: sys.RunBackupJob(job)}}
+	case "restore":
+		sys.Notify = options.Restore.Notify
+		var backend system.BackupBackend
+		switch {
+		case options.Restore.Rsync != "":
+			backend = system.Rsync{
+				Destination: options.Restore.Rsync,
+				Dated:       options.Restore.Dated,
+			}
+		case options.Restore.Restic != "":
+			backend = system.Restic{
+				Repository:   options.Restore.Restic,
+				PasswordFile: options.Restore.PasswordFile,
+				Tags:         options.Restore.Tag,
+			}
+		case options.Restore.Borg != "":
+			backend = system.Borg{
+				Repository:     options.Restore.Borg,
+				PassphraseFile: options.Restore.PasswordFile,
+				Prefix:         options.Restore.Prefix,
+			}
+		default:
+			fmt.Fprintln(os.Stderr, "one of --rsync, --restic or --borg is required")
+			os.Exit(2)
+		}
+		path := options.Restore.Path
+		if path == "" {
+			path = "/"
+		}
+		sys.Disk = options.Restore.Disk
+		if options.Restore.NativeGPT {
+			sys.GPT = &system.GPT{}
+		}
+		sys.FstabUUID = options.Restore.FstabUUID
+		sys.PartitionTypes = partitionFlags(sys, options.Restore.PartType)
+		sys.PartUUIDs = partitionFlags(sys, options.Restore.PartUUID)
+		sys.DPS = options.Restore.DPS
+		sys.PasswordPolicy = &system.PasswordPolicy{
+			MinLength:  minPasswordLength,
+			MinEntropy: minEntropy,
+		}
+		sys.Root.FSType = system.FSType(options.Restore.FSType)
+		if options.Restore.EnableSwap {
+			sys.EnableSwap(options.Restore.EnableCrypt)
+			sys.Swap.Disk = options.Restore.SwapDisk
+		}
+		addSwaps(sys, options.Restore.SwapPri, options.Restore.Zram, options.Restore.SwapFile)
+		addDataDisks(sys, options.Restore.Data, options.Restore.EnableCrypt)
+		// the restored /etc has its own vconsole.conf, these are for typing the password
+		sys.Keymap = options.Restore.Keymap
+		sys.Font = options.Restore.Font
+		loadConsole(sys, options.Remote != "")
+		if options.Restore.EnableCrypt {
+			steps = append(steps, diskPassword(sys, options.Restore.DiskSecret, options.Restore.Escrow)...)
+		}
+		if options.Restore.KeyDevice != "" {
+			sys.TwoFactor = &system.TwoFactor{
+				Device: options.Restore.KeyDevice,
+				Path:   options.Restore.KeyFile,
+			}
+		}
+		planFirmware(sys, options.Remote != "")
+		steps = append(steps, prepare(sys, options.Restore.KeepGPT)...)
+		steps = append(
+			steps,
+			Step{Do: sys.Restore(backend, path)},
+			Step{Do: sys.VirtualFS.Mount, Defer: sys.VirtualFS.Umount},
+			Step{Do: sys.GenRefind},
+			Step{Do: sys.GenFstab},
+			Step{Do: sys.GenSwap},
+			Step{Do: sys.GenTwoFactorHook},
+			Step{Do: sys.PostInstall},
+			Step{Do: sys.Validate},
+			Step{Do: sys.Root.Snapshot("restored")},
+		)
 	case "backup":
+		if len(options.Backup.Exclude) > 0 {
+			sys.BackupExcludes = options.Backup.Exclude
+		}
+		sys.BackupLimits = &system.BackupLimits{Bandwidth: options.Backup.BWLimit}
+		if options.Backup.Idle {
+			sys.BackupLimits.IOClass = "idle"
+			sys.BackupLimits.Nice = 19
+		}
+		sys.BackupLive = options.Backup.Live
+		sys.BackupReport = &system.BackupReport{
+			LogDir:       options.Backup.LogDir,
+			Webhook:      options.Backup.Webhook,
+			Healthchecks: options.Backup.Healthchecks,
+			Notify:       options.Backup.Notify,
+		}
+		if options.Backup.Window != "" {
+			start, end, ok := strings.Cut(options.Backup.Window, "-")
+			if !ok {
+				fmt.Fprintln(os.Stderr, "--window must be like 22:00-06:00")
+				os.Exit(2)
+			}
+			sys.BackupLimits.Window = &system.BackupWindow{Start: start, End: end}
+		}
+		backends := backupBackends(
+			options.Backup.Rsync,
+			options.Backup.Dated,
+			options.Backup.Restic,
+			options.Backup.Borg,
+			options.Backup.PasswordFile,
+			options.Backup.Tag,
+			options.Backup.Prefix,
+			retention(
+				options.Backup.KeepLast,
+				options.Backup.KeepDaily,
+				options.Backup.KeepWeekly,
+				options.Backup.KeepMonthly,
+			),
+		)
+		backup := sys.Backup(options.Backup.Remainder)
+		if len(backends) > 0 {
+			backup = sys.BackupFanOut(backends, options.Backup.Remainder)
+		}
 		steps = exec(
 			sys,
-			Step{Do: sys.Backup(options.Backup.Remainder)},
+			Step{Do: backup},
 			Step{Do: sys.Root.Snapshot("backup")},
 		)
+	case "prune":
+		r := retention(
+			options.Prune.KeepLast,
+			options.Prune.KeepDaily,
+			options.Prune.KeepWeekly,
+			options.Prune.KeepMonthly,
+		)
+		if r == nil {
+			fmt.Fprintln(os.Stderr, "at least one of the --keep flags is required")
+			os.Exit(2)
+		}
+		backends := backupBackends(
+			options.Prune.Rsync,
+			true,
+			options.Prune.Restic,
+			options.Prune.Borg,
+			options.Prune.PasswordFile,
+			options.Prune.Tag,
+			options.Prune.Prefix,
+			r,
+		)
+		verb := "pruned"
+		if options.Prune.DryRun {
+			verb = "would prune"
+		}
+		list := func(b system.BackupBackend, backup string) {
+			fmt.Printf("%s: %s %s\n", b, verb, backup)
+		}
+		steps = []Step{Step{Do: sys.PruneBackups(backends, options.Prune.DryRun, list)}}
+	case "serve":
+		if options.Token == "" {
+			fmt.Fprintln(os.Stderr, "serve requires a --server-token")
+			os.Exit(2)
+		}
+		srv := summonserver.New(options.Token)
+		steps = []Step{Step{Do: func(kill chan bool) error {
+			if options.Serve.Cert != "" {
+				return http.ListenAndServeTLS(options.Serve.Listen, options.Serve.Cert, options.Serve.Key, srv)
+			}
+			return http.ListenAndServe(options.Serve.Listen, srv)
+		}}}
+	case "provision":
+		if options.Server == "" {
+			fmt.Fprintln(os.Stderr, "provision requires a --server")
+			os.Exit(2)
+		}
+		if err := provision(options.Server, options.Token, sys.Name); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	case "netboot":
+		sys.Packages = system.NetbootPackages
+		sys.Proxy = system.ProxyFromEnvironment()
+		sys.Network = &system.Network{
+			Interfaces: []system.Interface{{Match: "en*", DHCP: true}},
+		}
+		n := system.Netboot{
+			Dir:    options.Netboot.Dir,
+			URL:    options.Netboot.URL,
+			Binary: options.Netboot.Binary,
+			Args:   options.Netboot.Remainder,
+		}
+		steps = []Step{
+			Step{Do: sys.GenPacmanConf},
+			Step{Do: sys.InstallFileSystem},
+			Step{Do: sys.VirtualFS.Mount, Defer: sys.VirtualFS.Umount},
+			Step{Do: sys.InstallSystem},
+			Step{Do: sys.GenEtcHostname},
+			Step{Do: sys.GenNetwork},
+			Step{Do: sys.GenNetboot(n)},
+		}
 	case "nspawn":
 		args := []string{"systemd-nspawn", "--directory", sys.Root.Dir}
 		if len(options.NSpawn.Remainder) == 0 {
@@ -124,15 +924,314 @@ func main() {
 		steps = exec(sys, Step{Do: sys.Exec(args)})
 	}
 
-	if err := run(steps); err != nil {
+	if sys.Audit != nil {
+		steps = append(steps, Step{Do: sys.WriteAudit})
+	}
+	if metrics != nil && install {
+		metrics.InstallStarted()
+	}
+	start := time.Now()
+	err := run(steps)
+	if err == nil {
+		err = run(after)
+	}
+	if metrics != nil && install {
+		metrics.InstallDone(err)
+	}
+	// a partial run would make for a poor estimate next time
+	if eta != nil && err == nil && len(only) == 0 && len(skip) == 0 {
+		if serr := eta.Save(); serr != nil {
+			fmt.Fprintln(os.Stderr, serr)
+		}
+	}
+	if client != nil {
+		if rerr := client.Report(context.Background(), start, err); rerr != nil {
+			fmt.Fprintln(os.Stderr, rerr)
+		}
+	}
+	if install {
+		if nerr := sys.NotifyInstall(start, err); nerr != nil {
+			fmt.Fprintln(os.Stderr, nerr)
+		}
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(3)
 	}
 }
 
+// Estimate the time remaining from the previous run on this machine, kept in
+// the user cache directory.
+func newETA(name string, console *summonconsole.Console) *summoneta.ETA {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	eta, err := summoneta.New(filepath.Join(dir, "summon", "eta.json"), name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if total := eta.Estimate(); total > 0 {
+		console.Printf("the previous install took %s", total.Round(time.Second))
+	}
+	eta.Report = func(remaining time.Duration) {
+		console.SetNote(fmt.Sprintf("about %s remaining", remaining.Round(time.Second)))
+	}
+	return eta
+}
+
+// The config for the provision verb is the summon command line to run.
+type provisionConfig struct {
+	Args []string
+}
+
+// Fetch the command line from the server, and replace this process with it.
+func provision(server, token, name string) error {
+	c := &summonserver.Client{URL: server, Machine: name, Token: token}
+	var config provisionConfig
+	if err := c.Config(context.Background(), &config); err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args := []string{os.Args[0], "--name", name, "--server", server}
+	if token != "" {
+		args = append(args, "--server-token", token)
+	}
+	args = append(args, config.Args...)
+	return syscall.Exec(self, args, os.Environ())
+}
+
+// Serve metrics about the tasks, commands and backups run.
+func serveMetrics(sys *system.Config, addr string) *summonmetrics.Metrics {
+	m := summonmetrics.New()
+	sys.OnBackup = func(b *system.BackupManifest) {
+		for _, t := range b.Targets {
+			var err error
+			if t.Error != "" {
+				err = errors.New(t.Error)
+			}
+			m.ObserveBackup(t.Target, t.Bytes, err)
+		}
+	}
+	go func() {
+		if err := http.ListenAndServe(addr, m); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return m
+}
+
+// The retention for the --keep flags, or nil if none are set.
+func retention(last, daily, weekly, monthly int) *system.Retention {
+	if last == 0 && daily == 0 && weekly == 0 && monthly == 0 {
+		return nil
+	}
+	return &system.Retention{Last: last, Daily: daily, Weekly: weekly, Monthly: monthly}
+}
+
+// The backends for the backup destinations, sharing the repository password
+// and the retention.
+func backupBackends(rsync []string, dated bool, restic, borg []string, passwordFile string, tags []string, prefix string, r *system.Retention) []system.BackupBackend {
+	var backends []system.BackupBackend
+	for _, dest := range rsync {
+		backends = append(backends, system.Rsync{Destination: dest, Dated: dated, Retention: r})
+	}
+	for _, repo := range restic {
+		backends = append(backends, system.Restic{
+			Repository:   repo,
+			PasswordFile: passwordFile,
+			Tags:         tags,
+			Retention:    r,
+		})
+	}
+	for _, repo := range borg {
+		backends = append(backends, system.Borg{
+			Repository:     repo,
+			PassphraseFile: passwordFile,
+			Prefix:         prefix,
+			Retention:      r,
+		})
+	}
+	return backends
+}
+
+// Add the data disks, given like /home:/dev/sdb.
+func addDataDisks(sys *system.Config, specs []string, encrypt bool) {
+	for _, spec := range specs {
+		mountpoint, disk, ok := strings.Cut(spec, ":")
+		if !ok || !strings.HasPrefix(mountpoint, "/") || disk == "" {
+			fmt.Fprintf(os.Stderr, "invalid data disk %q, expected a mount point and disk like /home:/dev/sdb\n", spec)
+			os.Exit(2)
+		}
+		sys.AddDataDisk(disk, mountpoint, encrypt)
+	}
+}
+
+// Sizes like 512M or 8G.
+func parseSize(s string) (int64, error) {
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// Set the priority of the swap partition, and add the zram swap and swap
+// files.
+func addSwaps(sys *system.Config, priority, zram int, files []string) {
+	if priority != 0 {
+		if sys.Swap == nil {
+			fmt.Fprintln(os.Stderr, "--swap-priority requires --enable-swap")
+			os.Exit(2)
+		}
+		sys.Swap.Priority = priority
+	}
+	if zram > 0 {
+		sys.EnableZram(zram)
+	}
+	for _, spec := range files {
+		parts := strings.Split(spec, ":")
+		swap := system.Swap{Kind: system.SwapFile, Path: parts[0]}
+		ok := (len(parts) == 2 || len(parts) == 3) && strings.HasPrefix(swap.Path, "/")
+		var err error
+		if ok {
+			swap.Size, err = parseSize(parts[1])
+			if err == nil && len(parts) == 3 {
+				swap.Priority, err = strconv.Atoi(parts[2])
+			}
+		}
+		if !ok || err != nil {
+			fmt.Fprintf(os.Stderr, "invalid swap file %q, expected a path, size and optional priority like /swap/file:8G:10\n", spec)
+			os.Exit(2)
+		}
+		sys.Swaps = append(sys.Swaps, swap)
+	}
+}
+
+func addSubvolumes(sys *system.Config, specs []string) {
+	for _, spec := range specs {
+		name, mountpoint, ok := strings.Cut(spec, ":")
+		if !ok || name == "" || !strings.HasPrefix(mountpoint, "/") {
+			fmt.Fprintf(os.Stderr, "invalid subvolume %q, expected a name and mount point like __home:/home\n", spec)
+			os.Exit(2)
+		}
+		sys.Subvolumes = append(sys.Subvolumes, system.Subvolume{Name: name, Mountpoint: mountpoint})
+	}
+}
+
+// Detect the firmware of this machine before anything is changed, since the
+// installed system only boots with UEFI. Images and ALARM boards are for
+// other machines, and a remote machine can't be inspected from here.
+func planFirmware(sys *system.Config, remote bool) {
+	if _, ok := sys.Installer.(system.ALARM); ok || sys.Image != nil || remote {
+		return
+	}
+	sys.Firmware = system.DetectFirmware()
+	if sys.Firmware == system.FirmwareBIOS {
+		fmt.Fprintln(os.Stderr, "warning: booted with BIOS, the installed system boots only with UEFI and no boot entry will be registered")
+	}
+}
+
+// Parse flags like root=8304 into values by partition name, like
+// system-root.
+func partitionFlags(sys *system.Config, specs []string) map[string]string {
+	values := map[string]string{}
+	for _, spec := range specs {
+		part, value, ok := strings.Cut(spec, "=")
+		if !ok || part == "" || value == "" {
+			fmt.Fprintf(os.Stderr, "invalid partition setting %q, expected a partition and value like root=8304\n", spec)
+			os.Exit(2)
+		}
+		values[fmt.Sprintf("%s-%s", sys.Name, part)] = value
+	}
+	return values
+}
+
+// Steps to partition, format and mount fresh disks for the system.
+func prepare(sys *system.Config, keepGPT bool) []Step {
+	steps := []Step{
+		Step{Do: sys.CheckPasswords},
+		Step{Do: sys.CheckLabels},
+		Step{Do: sys.CombineKeyfile},
+		Step{Do: sys.SyncClock},
+		Step{Do: sys.AttachImage, Defer: sys.DetachImage},
+	}
+	if !keepGPT {
+		gpt := []Step{Step{Do: sys.GptSetup}, Step{Do: sys.SwapGptSetup}}
+		for _, d := range sys.Data {
+			gpt = append(gpt, Step{Do: d.GptSetup})
+		}
+		steps = append(steps, parallel(gpt...))
+	}
+	// the ESP and data disks are independent of the root until they are
+	// mounted within it, while the swap key is read from the opened root
+	disks := []Step{
+		serial(
+			Step{Do: sys.Root.LuksFormat},
+			Step{Do: sys.Root.LuksOpen, Defer: sys.Root.LuksClose},
+			parallel(
+				serial(
+					Step{Do: sys.Root.MakeFS},
+					Step{Do: sys.Root.Mount, Defer: sys.Root.Umount},
+				),
+				serial(
+					Step{Do: sys.Swap.LuksFormat},
+					Step{Do: sys.Swap.LuksOpen, Defer: sys.Swap.LuksClose},
+					Step{Do: sys.Swap.MakeFS},
+				),
+			),
+		),
+		Step{Do: sys.EFI.MakeFS},
+	}
+	mounts := []Step{Step{Do: sys.EFI.Mount, Defer: sys.EFI.Umount}}
+	for _, d := range sys.Data {
+		disks = append(disks, serial(
+			Step{Do: d.LuksFormat},
+			Step{Do: d.LuksOpen, Defer: d.LuksClose},
+			Step{Do: d.MakeFS},
+		))
+		mounts = append(mounts, Step{Do: d.Mount, Defer: d.Umount})
+	}
+	return append(append(steps, parallel(disks...)), mounts...)
+}
+
+// Steps to open and mount the existing disks of the system, with a fresh
+// active subvolume for the root.
+func reinstall(sys *system.Config) []Step {
+	steps := []Step{
+		Step{Do: sys.SyncClock},
+		Step{Do: sys.AttachImage, Defer: sys.DetachImage},
+		Step{Do: sys.Root.LuksOpen, Defer: sys.Root.LuksClose},
+		Step{Do: sys.Reinstall},
+		Step{Do: sys.Root.Mount, Defer: sys.Root.Umount},
+		Step{Do: sys.Swap.LuksOpen, Defer: sys.Swap.LuksClose},
+		Step{Do: sys.EFI.Mount, Defer: sys.EFI.Umount},
+	}
+	for _, d := range sys.Data {
+		steps = append(steps, Step{Do: d.LuksOpen, Defer: d.LuksClose}, Step{Do: d.Mount, Defer: d.Umount})
+	}
+	return steps
+}
+
 func exec(sys *system.Config, steps ...Step) []Step {
-	sys.Root.Password = prompt.Password("%s disk password: ", sys.Name)
+	p := system.PasswordPrompt{Prompt: sys.Name + " disk password"}
 	r := []Step{
+		Step{Do: sys.PromptDiskPassword(p)},
 		Step{Do: sys.Root.LuksOpen, Defer: sys.Root.LuksClose},
 		Step{Do: sys.Root.Mount, Defer: sys.Root.Umount},
 		Step{Do: sys.EFI.Mount, Defer: sys.EFI.Umount},
@@ -148,7 +1247,10 @@ func run(steps []Step) error {
 	go func() {
 		ec <- func() error {
 			for _, step := range steps {
-				if err := step.Do(kill); err != nil {
+				if step.skipped() {
+					continue
+				}
+				if err := step.Run(kill); err != nil {
 					return err
 				}
 				defer step.LoggedDefer(deferKill)
@@ -166,15 +1268,64 @@ func run(steps []Step) error {
 	case err := <-ec:
 		return err
 	}
-	panic("not reached")
 }
 
-func passwordConfirm(str string, args ...interface{}) string {
-	for {
-		original := prompt.Password(str, args...)
-		confirm := prompt.Password("confirm "+str, args...)
-		if original == confirm {
-			return original
+// Passwords for new disks and users are entered twice, and must not be
+// trivially guessable.
+const (
+	minEntropy        = 50
+	minPasswordLength = 12
+)
+
+// Steps to set the password for a new encrypted disk, from the secret if
+// one is given, generated and escrowed if there are escrows, or otherwise
+// prompted for.
+func diskPassword(sys *system.Config, secret string, escrowURIs []string) []Step {
+	sys.DiskPasswordSecret = secret
+	var escrows []system.Escrow
+	for _, uri := range escrowURIs {
+		e, err := system.ParseEscrow(uri)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
+		escrows = append(escrows, e)
+	}
+	steps := []Step{Step{Do: sys.ResolveSecrets}}
+	if len(escrows) > 0 {
+		steps = append(steps, Step{Do: sys.GenerateDiskPassword(escrows...)})
+	}
+	p := system.PasswordPrompt{
+		Prompt:     sys.Name + " disk password",
+		Confirm:    true,
+		MinEntropy: minEntropy,
+	}
+	return append(steps, Step{Do: sys.PromptDiskPassword(p)})
+}
+
+// Switch the console to the Keymap and Font before any password is typed, so
+// it is the password the target will ask for on boot. Remotely the layout is
+// the one of the SSH client.
+func loadConsole(sys *system.Config, remote bool) {
+	if remote {
+		return
+	}
+	if err := sys.LoadConsole(nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func passwordConfirm(str string, args ...interface{}) string {
+	p := system.PasswordPrompt{
+		Prompt:     fmt.Sprintf(str, args...),
+		Confirm:    true,
+		MinEntropy: minEntropy,
+	}
+	pass, err := p.Read()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	return pass
 }
@@ -0,0 +1,52 @@
+package summon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// How long a canceled command has to exit after SIGTERM, before it is
+// killed.
+const killGrace = 10 * time.Second
+
+// Whether the command reads from a terminal, like a shell or a password
+// prompt, which only works from the foreground process group.
+func interactive(cmd *exec.Cmd) bool {
+	f, ok := cmd.Stdin.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// How often the process group is checked for having exited during the grace
+// period.
+const killPoll = 100 * time.Millisecond
+
+// Ask the process, and its process group if it has one, to exit, and kill
+// them once the grace period is over. The group is waited for even if the
+// process is done, since what it started may still be running, until none of
+// it is left, so a reused group id isn't killed. Without a group, done is
+// closed once the process has been waited for.
+func terminate(p *os.Process, group bool, done chan struct{}) {
+	if group {
+		if syscall.Kill(-p.Pid, syscall.SIGTERM) == syscall.ESRCH {
+			return
+		}
+		for deadline := time.Now().Add(killGrace); time.Now().Before(deadline); {
+			time.Sleep(killPoll)
+			if syscall.Kill(-p.Pid, 0) == syscall.ESRCH {
+				return
+			}
+		}
+		syscall.Kill(-p.Pid, syscall.SIGKILL)
+		return
+	}
+	p.Signal(syscall.SIGTERM)
+	select {
+	case <-time.After(killGrace):
+		p.Kill()
+	case <-done:
+	}
+}
@@ -16,9 +16,20 @@ package summon
 // - encrypted home
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/daaku/errgroup"
 	"github.com/kballard/go-shellquote"
@@ -41,19 +52,269 @@ func MustCmdf(ctx context.Context, format string, a ...any) *exec.Cmd {
 	return exec.CommandContext(ctx, name, args...)
 }
 
+// VerboseRun runs the command, capturing the output. If it fails, the error
+// is a *CommandError including the output.
 func VerboseRun(cmd *exec.Cmd) error {
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error running command: %q: %v\n%s", cmd, err, out)
+	return RunStreaming(context.Background(), cmd, nil, nil)
+}
+
+// RunStreaming runs the command using the current Runner, capturing the
+// output for the *CommandError if it fails, while also copying stdout and
+// stderr to the writers as the command runs. Either may be nil. Both are
+// also copied to the writer set with SetOutput, if any, and the one the
+// Tracer put in the context with WithOutput.
+func RunStreaming(ctx context.Context, cmd *exec.Cmd, stdout, stderr io.Writer) error {
+	ctx, end := currentTracer().StartCommand(ctx, redactArgs(cmd.Args))
+	out, errOut := newCapture(true), newCapture(false)
+	outs := []io.Writer{out}
+	errs := []io.Writer{out, errOut}
+	if stdout != nil {
+		outs = append(outs, stdout)
+	}
+	if stderr != nil {
+		errs = append(errs, stderr)
+	}
+	if w := currentOutput(); w != nil {
+		outs = append(outs, w)
+		errs = append(errs, w)
+	}
+	if w, ok := ctx.Value(outputKey{}).(io.Writer); ok {
+		outs = append(outs, w)
+		errs = append(errs, w)
 	}
+	cmd.Stdout = io.MultiWriter(outs...)
+	cmd.Stderr = io.MultiWriter(errs...)
+	start := time.Now()
+	err := RunCommand(ctx, cmd)
+	d := time.Since(start)
+	end(CommandResult{
+		ExitCode:    exitCode(err),
+		OutputBytes: int(out.Len()),
+		Duration:    d,
+		Err:         RedactError(err),
+	})
+	if err != nil {
+		e := NewCommandError(cmd, err, out.Bytes(), errOut.Bytes(), d)
+		e.OutputFile = out.Close(true)
+		return e
+	}
+	out.Close(false)
 	return nil
 }
 
+var output = struct {
+	sync.Mutex
+	w io.Writer
+}{}
+
+// SetOutput copies the output of every command to w as it runs, like
+// os.Stderr to watch pacman and rsync work, and returns a function to
+// restore the previous writer. Writes are serialized, so w is safe to share.
+func SetOutput(w io.Writer) (restore func()) {
+	output.Lock()
+	defer output.Unlock()
+	prev := output.w
+	output.w = nil
+	if w != nil {
+		output.w = &lockedWriter{w: w}
+	}
+	return func() {
+		output.Lock()
+		defer output.Unlock()
+		output.w = prev
+	}
+}
+
+func currentOutput() io.Writer {
+	output.Lock()
+	defer output.Unlock()
+	return output.w
+}
+
+type outputKey struct{}
+
+// WithOutput copies the output of the commands run with the context to w,
+// like for a Tracer to show the output of just the command it was told about.
+func WithOutput(ctx context.Context, w io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, w)
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// A CommandError is a failed command. ExitCode is -1 if the command didn't
+// exit normally, like when it couldn't be started or was killed. Output is
+// the combined stdout and stderr, and Err the underlying error, so that
+// errors.Is(err, exec.ErrNotFound) reports a missing binary. Only the start
+// and end of long output is kept, and OutputFile is then the temporary file
+// with all of it, if it could be written. Unlike Output, the file isn't
+// redacted, and is only readable by the user.
+type CommandError struct {
+	Args       []string
+	ExitCode   int
+	Stderr     []byte
+	Output     []byte
+	OutputFile string
+	Duration   time.Duration
+	Err        error
+
+	cmd string
+}
+
+// NewCommandError describes the failed command, with any registered secrets
+// redacted from the arguments and output.
+func NewCommandError(cmd *exec.Cmd, err error, output, stderr []byte, d time.Duration) *CommandError {
+	return &CommandError{
+		Args:     redactArgs(cmd.Args),
+		ExitCode: exitCode(err),
+		Stderr:   []byte(Redact(string(stderr))),
+		Output:   []byte(Redact(string(output))),
+		Duration: d,
+		Err:      err,
+		cmd:      cmd.String(),
+	}
+}
+
+// The exit code for the error from running a command, or -1 if it didn't
+// exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return exit.ExitCode()
+	}
+	return -1
+}
+
+func (e *CommandError) Error() string {
+	return Redact(fmt.Sprintf("error running command: %q: %v\n%s", e.cmd, e.Err, e.Output))
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// A Runner runs commands to completion, with the Stdin, Stdout and Stderr
+// set up by the caller. Canceling the context kills the command.
+type Runner interface {
+	Run(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// The execRunner runs commands in their own process group, so canceling one
+// also stops what it started, like the gpg-agent of pacman or the ssh of
+// rsync, which would otherwise keep running, and holding the output open.
+// Commands reading from a terminal stay in the foreground group.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	group := !interactive(cmd)
+	if group {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Setpgid = true
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { go terminate(cmd.Process, group, done) })
+	}
+	// exec.CommandContext would only kill the command itself
+	if cmd.Cancel != nil {
+		cmd.Cancel = func() error {
+			stop()
+			return nil
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+var runner = struct {
+	sync.Mutex
+	r Runner
+}{r: execRunner{}}
+
+// SetRunner replaces the Runner used for all commands, like with a fake one
+// in tests, and returns a function to restore the previous one.
+func SetRunner(r Runner) (restore func()) {
+	runner.Lock()
+	defer runner.Unlock()
+	prev := runner.r
+	runner.r = r
+	return func() {
+		runner.Lock()
+		defer runner.Unlock()
+		runner.r = prev
+	}
+}
+
+// RunCommand runs the command using the current Runner.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) error {
+	runner.Lock()
+	r := runner.r
+	runner.Unlock()
+	return r.Run(ctx, cmd)
+}
+
+// Local reports whether the current Runner runs commands on this machine,
+// which only the default one does. Otherwise file system operations should
+// be done using commands too, so they happen where the commands do, and are
+// seen by a fake Runner.
+func Local() bool {
+	runner.Lock()
+	defer runner.Unlock()
+	_, ok := runner.r.(execRunner)
+	return ok
+}
+
+// Runners which run commands elsewhere, like on a remote machine, implement
+// FileWriter so generated files are written there too.
+type FileWriter interface {
+	WriteFile(ctx context.Context, name string, data []byte, perm os.FileMode) error
+}
+
+// WriteFile writes the file, creating the parent directories, using the
+// current Runner if it is a FileWriter, or the local file system otherwise.
+func WriteFile(ctx context.Context, name string, data []byte, perm os.FileMode) error {
+	runner.Lock()
+	r := runner.r
+	runner.Unlock()
+	if w, ok := r.(FileWriter); ok {
+		return w.WriteFile(ctx, name, data, perm)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, perm)
+}
+
 func Runf(ctx context.Context, format string, a ...any) error {
 	name, args, err := Shellf(format, a...)
 	if err != nil {
 		return err
 	}
-	return VerboseRun(exec.CommandContext(ctx, name, args...))
+	return RunStreaming(ctx, exec.CommandContext(ctx, name, args...), nil, nil)
 }
 
 type Task struct {
@@ -61,77 +322,173 @@ type Task struct {
 	Do, Defer func(context.Context) error
 }
 
+// A TaskError is the error of the named Task, so the failures collected in
+// an errgroup.MultiError can be told apart. A panic in the Task is one too.
+type TaskError struct {
+	Task string
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return e.Task + ": " + e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// Tag the error with the name of the Task, unless a nested Task already did.
+func tag(name string, err error) error {
+	if err == nil || name == "" {
+		return err
+	}
+	var te *TaskError
+	var multi errgroup.MultiError
+	if errors.As(err, &te) || errors.As(err, &multi) {
+		return err
+	}
+	return &TaskError{Task: name, Err: err}
+}
+
+// Like errgroup.NewMultiError, but the errors of a MultiError are included
+// rather than nesting it, so each is there with its TaskError.
+func joinErrors(errs ...error) error {
+	var flat []error
+	for _, err := range errs {
+		if multi, ok := err.(errgroup.MultiError); ok {
+			flat = append(flat, multi...)
+			continue
+		}
+		flat = append(flat, err)
+	}
+	return errgroup.NewMultiError(flat...)
+}
+
+// Call f, returning a panic as a TaskError with the stack of the panic.
+func protect(ctx context.Context, name string, f func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &TaskError{Task: name, Err: fmt.Errorf("panic: %v\n%s", r, debug.Stack())}
+		}
+	}()
+	return f(ctx)
+}
+
+// The Defer of a Task which is done, to be run later.
+type deferred struct {
+	name string
+	f    func(context.Context) error
+}
+
+// A list of deferred, filled by tasks running in parallel.
+type defers struct {
+	mu   sync.Mutex
+	list []deferred
+}
+
+func (d *defers) add(t Task) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.list = append(d.list, deferred{name: t.Name, f: t.Defer})
+}
+
+// Run the defers added so far, all of them even if some fail, in parallel or
+// in order. They are only run once.
+func (d *defers) run(ctx context.Context, parallel bool) error {
+	d.mu.Lock()
+	list := d.list
+	d.list = nil
+	d.mu.Unlock()
+	errs := make([]error, len(list))
+	var wg sync.WaitGroup
+	for i, f := range list {
+		if !parallel {
+			errs[i] = tag(f.name, protect(ctx, f.name, f.f))
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = tag(f.name, protect(ctx, f.name, f.f))
+		}()
+	}
+	wg.Wait()
+	return joinErrors(errs...)
+}
+
+// Parallel runs the tasks at the same time. If any fail, the ones which
+// succeeded are undone before returning.
 func Parallel(name string, tasks ...Task) Task {
-	defers := []func(context.Context) error{}
+	var done defers
 	return Task{
 		Name: name,
 		Do: func(ctx context.Context) error {
 			var eg errgroup.Group
 			for _, t := range tasks {
-				if t.Do != nil {
-					eg.Add(1)
-					go func() {
-						defer eg.Done()
-						eg.Error(t.Do(ctx))
-					}()
-				}
-				if t.Defer != nil {
-					defers = append(defers, t.Defer)
+				if t.Do == nil {
+					if t.Defer != nil {
+						done.add(t)
+					}
+					continue
 				}
-			}
-			return eg.Wait()
-		},
-		Defer: func(ctx context.Context) error {
-			var eg errgroup.Group
-			eg.Add(len(defers))
-			for _, f := range defers {
+				eg.Add(1)
 				go func() {
 					defer eg.Done()
-					eg.Error(f(ctx))
+					if err := t.do(ctx); err != nil {
+						eg.Error(err)
+						return
+					}
+					if t.Defer != nil {
+						done.add(t)
+					}
 				}()
 			}
-			return eg.Wait()
+			if err := eg.Wait(); err != nil {
+				return joinErrors(err, done.run(ctx, true))
+			}
+			return nil
+		},
+		Defer: func(ctx context.Context) error {
+			return done.run(ctx, true)
 		},
 	}
 }
 
+// Serial runs the tasks in order. If one fails, the ones before it are
+// undone before returning.
 func Serial(name string, tasks ...Task) Task {
-	defers := []func(context.Context) error{}
+	var done defers
 	return Task{
 		Name: name,
 		Do: func(ctx context.Context) error {
 			for _, t := range tasks {
 				if t.Do != nil {
-					if err := t.Do(ctx); err != nil {
-						return err
+					if err := t.do(ctx); err != nil {
+						return joinErrors(err, done.run(ctx, false))
 					}
 				}
 				if t.Defer != nil {
-					defers = append(defers, t.Defer)
+					done.add(t)
 				}
 			}
 			return nil
 		},
 		Defer: func(ctx context.Context) error {
-			var multiErrors []error
-			for _, f := range defers {
-				multiErrors = append(multiErrors, f(ctx))
-			}
-			return errgroup.NewMultiError(multiErrors...)
+			return done.run(ctx, false)
 		},
 	}
 }
 
+// Run the Task's Do, and if it succeeds its Defer. Panics in either are
+// returned as errors.
 func Run(ctx context.Context, t Task) error {
 	if t.Do != nil {
-		if err := t.Do(ctx); err != nil {
+		if err := t.do(ctx); err != nil {
 			return err
 		}
 	}
 	if t.Defer != nil {
-		if err := t.Defer(ctx); err != nil {
-			return err
-		}
+		return tag(t.Name, protect(ctx, t.Name, t.Defer))
 	}
 	return nil
 }
@@ -143,3 +500,108 @@ var CheckInternet = Task{
 		return nil
 	},
 }
+
+// An Event reports the progress of a long running task. Percent is -1 when
+// unknown.
+type Event struct {
+	Task    string
+	Message string
+	Percent int
+}
+
+type Reporter func(Event)
+
+type reporterKey struct{}
+
+func WithReporter(ctx context.Context, r Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey{}, r)
+}
+
+// Report the event to the Reporter in the context, if there is one.
+func Report(ctx context.Context, e Event) {
+	if r, ok := ctx.Value(reporterKey{}).(Reporter); ok && r != nil {
+		e.Message = Redact(e.Message)
+		r(e)
+	}
+}
+
+// LineWriter calls f with each line written to it. Both \n and \r end a line,
+// since progress output rewrites the current line using \r. Close flushes a
+// final unterminated line.
+func LineWriter(f func(line string)) io.WriteCloser {
+	return &lineWriter{f: f}
+}
+
+type lineWriter struct {
+	f   func(string)
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i == -1 {
+			return len(p), nil
+		}
+		if i > 0 {
+			w.f(string(w.buf[:i]))
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+func (w *lineWriter) Close() error {
+	if len(w.buf) > 0 {
+		w.f(string(w.buf))
+		w.buf = nil
+	}
+	return nil
+}
+
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+// AddSecret registers a value, like a disk password, to be masked wherever
+// it may appear in command transcripts, reported events and errors.
+func AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, s := range secrets.values {
+		if s == secret {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, secret)
+	// longer secrets first, in case one contains another
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// Redact masks the registered secrets in s.
+func Redact(s string) string {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, secret := range secrets.values {
+		s = strings.ReplaceAll(s, secret, "********")
+	}
+	return s
+}
+
+// RedactError masks the registered secrets in the message of err.
+func RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if r := Redact(msg); r != msg {
+		return errors.New(r)
+	}
+	return err
+}
@@ -2,10 +2,20 @@ package summon_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/daaku/ensure"
+	"github.com/daaku/errgroup"
 	"github.com/daaku/summon"
+	"github.com/daaku/summon/summontest"
 	"github.com/gkampitakis/go-snaps/snaps"
 )
 
@@ -45,3 +55,278 @@ func TestShellf(t *testing.T) {
 		})
 	}
 }
+
+func TestReport(t *testing.T) {
+	t.Parallel()
+	summon.Report(context.Background(), summon.Event{Task: "no reporter"})
+
+	var events []summon.Event
+	ctx := summon.WithReporter(context.Background(), func(e summon.Event) {
+		events = append(events, e)
+	})
+	e := summon.Event{Task: "backup", Message: "halfway", Percent: 50}
+	summon.Report(ctx, e)
+	ensure.DeepEqual(t, events, []summon.Event{e})
+}
+
+func TestLineWriter(t *testing.T) {
+	t.Parallel()
+	var lines []string
+	w := summon.LineWriter(func(line string) {
+		lines = append(lines, line)
+	})
+	for _, chunk := range []string{"one\ntw", "o\r\r", "three\r\nfo", "ur"} {
+		_, err := w.Write([]byte(chunk))
+		ensure.Nil(t, err)
+	}
+	ensure.DeepEqual(t, lines, []string{"one", "two", "three"})
+	ensure.Nil(t, w.Close())
+	ensure.DeepEqual(t, lines, []string{"one", "two", "three", "four"})
+}
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+	summon.AddSecret("")
+	summon.AddSecret("hunter2")
+	summon.AddSecret("hunter2hunter2")
+	ensure.DeepEqual(t, summon.Redact("echo hunter2hunter2 hunter2"), "echo ******** ********")
+	ensure.DeepEqual(t, summon.Redact("nothing to hide"), "nothing to hide")
+
+	err := summon.VerboseRun(exec.Command("sh", "-c", "echo hunter2; exit 1"))
+	ensure.NotNil(t, err)
+	ensure.StringDoesNotContain(t, err.Error(), "hunter2")
+	var cerr *summon.CommandError
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.DeepEqual(t, cerr.Args, []string{"sh", "-c", "echo ********; exit 1"})
+	ensure.Nil(t, summon.RedactError(nil))
+}
+
+func TestFakeRunner(t *testing.T) {
+	f := summontest.Install(t)
+	f.On("cryptsetup open *", summontest.Response{
+		Stderr: "No key available with this passphrase.",
+		Err:    errors.New("exit status 2"),
+	})
+	ctx := context.Background()
+	ensure.Nil(t, summon.Runf(ctx, "mkfs.ext4 -L %q %q", "boe root", "/dev/sda2"))
+
+	cmd := summon.MustCmdf(ctx, "cryptsetup open --type luks %q %q", "/dev/sda2", "boe-root")
+	cmd.Stdin = strings.NewReader("correct horse")
+	err := summon.VerboseRun(cmd)
+	ensure.Err(t, err, regexp.MustCompile("No key available"))
+	snaps.MatchSnapshot(t, f.Transcript())
+}
+
+func TestCommandError(t *testing.T) {
+	t.Parallel()
+	err := summon.VerboseRun(exec.Command("sh", "-c", "echo out; echo busy >&2; exit 32"))
+	var cerr *summon.CommandError
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.DeepEqual(t, cerr.Args, []string{"sh", "-c", "echo out; echo busy >&2; exit 32"})
+	ensure.DeepEqual(t, cerr.ExitCode, 32)
+	ensure.DeepEqual(t, string(cerr.Stderr), "busy\n")
+	ensure.StringContains(t, string(cerr.Output), "out\n")
+	ensure.StringContains(t, err.Error(), "busy\n")
+
+	err = summon.VerboseRun(exec.Command("summon-does-not-exist"))
+	ensure.True(t, errors.Is(err, exec.ErrNotFound))
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.DeepEqual(t, cerr.ExitCode, -1)
+}
+
+func TestRunStreaming(t *testing.T) {
+	t.Parallel()
+	var stdout, stderr strings.Builder
+	cmd := exec.Command("sh", "-c", "echo progress; echo failed >&2; exit 1")
+	err := summon.RunStreaming(context.Background(), cmd, &stdout, &stderr)
+	ensure.DeepEqual(t, stdout.String(), "progress\n")
+	ensure.DeepEqual(t, stderr.String(), "failed\n")
+	var cerr *summon.CommandError
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.StringContains(t, string(cerr.Output), "progress\n")
+	ensure.DeepEqual(t, string(cerr.Stderr), "failed\n")
+}
+
+// Puts a writer for the output of each command in the context.
+type outputTracer struct {
+	recordingTracer
+	out strings.Builder
+}
+
+func (o *outputTracer) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	return summon.WithOutput(ctx, &o.out), func(summon.CommandResult) {}
+}
+
+func TestWithOutput(t *testing.T) {
+	o := &outputTracer{}
+	t.Cleanup(summon.SetTracer(o))
+	cmd := exec.Command("sh", "-c", "echo warning >&2")
+	ensure.Nil(t, summon.RunStreaming(context.Background(), cmd, nil, nil))
+	ensure.DeepEqual(t, o.out.String(), "warning\n")
+}
+
+type parentKey struct{}
+
+// Records spans as lines indented by their depth.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+func (r *recordingTracer) start(ctx context.Context, name string) (context.Context, func(string)) {
+	depth, _ := ctx.Value(parentKey{}).(int)
+	return context.WithValue(ctx, parentKey{}, depth+1), func(result string) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.spans = append(r.spans, strings.Repeat("  ", depth)+name+result)
+	}
+}
+
+func (r *recordingTracer) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, end := r.start(ctx, name)
+	return ctx, func(err error) { end(fmt.Sprintf(" err=%v", err)) }
+}
+
+func (r *recordingTracer) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	ctx, end := r.start(ctx, strings.Join(args, " "))
+	return ctx, func(c summon.CommandResult) {
+		end(fmt.Sprintf(" exit=%d bytes=%d", c.ExitCode, c.OutputBytes))
+	}
+}
+
+func TestTracer(t *testing.T) {
+	f := summontest.Install(t)
+	f.On("wipefs *", summontest.Response{Stdout: "wiped\n"})
+	r := &recordingTracer{}
+	t.Cleanup(summon.SetTracer(r))
+
+	err := summon.Run(context.Background(), summon.Serial(
+		"Install",
+		summon.Task{
+			Name: "Wipe",
+			Do:   func(ctx context.Context) error { return summon.Runf(ctx, "wipefs -a /dev/sda") },
+		},
+	))
+	ensure.Nil(t, err)
+	// spans end innermost first
+	ensure.DeepEqual(t, r.spans, []string{
+		"    wipefs -a /dev/sda exit=0 bytes=6",
+		"  Wipe err=<nil>",
+		"Install err=<nil>",
+	})
+}
+
+type uploadRunner struct {
+	summon.Runner
+	files map[string]string
+}
+
+func (u *uploadRunner) WriteFile(ctx context.Context, name string, data []byte, perm os.FileMode) error {
+	u.files[name] = string(data)
+	return nil
+}
+
+func TestWriteFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "etc", "hostname")
+	ensure.Nil(t, summon.WriteFile(context.Background(), name, []byte("boe\n"), os.FileMode(0o644)))
+	contents, err := os.ReadFile(name)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(contents), "boe\n")
+
+	u := &uploadRunner{Runner: summontest.New(), files: map[string]string{}}
+	t.Cleanup(summon.SetRunner(u))
+	ensure.Nil(t, summon.WriteFile(context.Background(), "/mnt/boe/etc/hostname", []byte("boe\n"), os.FileMode(0o644)))
+	ensure.DeepEqual(t, u.files, map[string]string{"/mnt/boe/etc/hostname": "boe\n"})
+}
+
+func TestCommandErrorLongOutput(t *testing.T) {
+	t.Parallel()
+	cmd := exec.Command("sh", "-c", "echo start; head -c 1000000 /dev/zero | tr '\\0' x; echo; echo end; exit 1")
+	err := summon.VerboseRun(cmd)
+	var cerr *summon.CommandError
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.True(t, len(cerr.Output) < 400<<10)
+	ensure.True(t, strings.HasPrefix(string(cerr.Output), "start\n"))
+	ensure.True(t, strings.HasSuffix(string(cerr.Output), "end\n"))
+	ensure.StringContains(t, string(cerr.Output), "bytes left out")
+	ensure.True(t, cerr.OutputFile != "")
+	defer os.Remove(cerr.OutputFile)
+	spilled, err := os.ReadFile(cerr.OutputFile)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(spilled), len("start\n")+1000000+len("\nend\n"))
+}
+
+func TestPanic(t *testing.T) {
+	t.Parallel()
+	err := summon.Run(context.Background(), summon.Serial(
+		"Install",
+		summon.Task{
+			Name: "GenFstab",
+			Do:   func(context.Context) error { panic("no root disk") },
+		},
+	))
+	var terr *summon.TaskError
+	ensure.True(t, errors.As(err, &terr))
+	ensure.DeepEqual(t, terr.Task, "GenFstab")
+	ensure.StringContains(t, err.Error(), "GenFstab: panic: no root disk")
+
+	err = summon.Run(context.Background(), summon.Task{
+		Name:  "Umount",
+		Defer: func(context.Context) error { panic("busy") },
+	})
+	ensure.StringContains(t, err.Error(), "Umount: panic: busy")
+}
+
+func TestDefers(t *testing.T) {
+	t.Parallel()
+	var undone []string
+	undo := func(name string, err error) summon.Task {
+		return summon.Task{
+			Name: name,
+			Do:   func(context.Context) error { return nil },
+			Defer: func(context.Context) error {
+				undone = append(undone, name)
+				if name == "Swap" {
+					panic("swapoff")
+				}
+				return err
+			},
+		}
+	}
+	err := summon.Run(context.Background(), summon.Serial(
+		"Install",
+		undo("Mount", errors.New("busy")),
+		undo("Swap", nil),
+		undo("Open", nil),
+		summon.Task{
+			Name: "Pacstrap",
+			Do:   func(context.Context) error { return errors.New("no network") },
+		},
+	))
+	// every defer is run even though some fail
+	ensure.DeepEqual(t, undone, []string{"Mount", "Swap", "Open"})
+	var multi errgroup.MultiError
+	ensure.True(t, errors.As(err, &multi))
+	var tasks []string
+	for _, err := range multi {
+		var terr *summon.TaskError
+		ensure.True(t, errors.As(err, &terr))
+		tasks = append(tasks, terr.Task)
+	}
+	ensure.DeepEqual(t, tasks, []string{"Pacstrap", "Mount", "Swap"})
+}
+
+func TestCancelKillsGroup(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	pids := make(chan string, 1)
+	stdout := summon.LineWriter(func(line string) { pids <- line })
+	go func() {
+		<-pids
+		cancel()
+	}()
+	// the background sleep keeps the output open until it is killed too
+	cmd := exec.CommandContext(ctx, "sh", "-c", "sleep 60 & echo $!; wait")
+	err := summon.RunStreaming(ctx, cmd, stdout, nil)
+	ensure.NotNil(t, err)
+}
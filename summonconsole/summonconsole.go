@@ -0,0 +1,227 @@
+// Package summonconsole shows the progress of summon tasks and commands on a
+// terminal, with as much detail as the Level asks for. Tasks are shown as
+// they end, colored by how they did, and at the Verbose level each command is
+// collapsed into a single line, with its output expanded only if it fails.
+package summonconsole
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+	"github.com/kballard/go-shellquote"
+	"golang.org/x/term"
+)
+
+// How much is shown.
+type Level int
+
+const (
+	// Only failures.
+	Quiet Level = iota
+	// Tasks as they end, and progress events.
+	Normal
+	// Also each command as it ends, with its output if it failed.
+	Verbose
+	// Also the output of every command as it runs.
+	Debug
+)
+
+// The last lines of output kept for a failed command. The complete output is
+// in the *summon.CommandError.
+const keepLines = 50
+
+// ANSI colors.
+const (
+	red   = "\033[31m"
+	green = "\033[32m"
+	dim   = "\033[2m"
+	reset = "\033[0m"
+)
+
+// A Console is a summon.Tracer writing what the Level asks for. On a
+// terminal, progress is shown on a status line which is replaced as it
+// changes, and output is colored unless NO_COLOR is set.
+type Console struct {
+	Level Level
+
+	w        io.Writer
+	terminal bool
+	color    bool
+
+	mu     sync.Mutex
+	status bool // whether the cursor is at the end of a status line
+	note   string
+}
+
+// New writes to w, which is usually os.Stderr.
+func New(w io.Writer, level Level) *Console {
+	c := &Console{Level: level, w: w}
+	if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		c.terminal = true
+		c.color = os.Getenv("NO_COLOR") == ""
+	}
+	return c
+}
+
+// Write the lines, replacing the status line if there is one.
+func (c *Console) println(lines ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status {
+		io.WriteString(c.w, "\r\033[K")
+		c.status = false
+	}
+	for _, l := range lines {
+		io.WriteString(c.w, l+"\n")
+	}
+}
+
+// Replace the status line, cut to fit the terminal so it doesn't wrap. Status
+// isn't shown when not on a terminal, since it would be a line for every
+// change.
+func (c *Console) setStatus(s string) {
+	if !c.terminal {
+		return
+	}
+	c.mu.Lock()
+	if c.note != "" {
+		s = "[" + c.note + "] " + s
+	}
+	c.mu.Unlock()
+	if width, _, err := term.GetSize(int(c.w.(*os.File).Fd())); err == nil {
+		if r := []rune(s); len(r) >= width {
+			s = string(r[:max(width-1, 0)])
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "\r\033[K%s", s)
+	c.status = true
+}
+
+// SetNote keeps the note at the start of the status line, like the time
+// remaining.
+func (c *Console) SetNote(note string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.note = note
+}
+
+func (c *Console) paint(color, s string) string {
+	if !c.color {
+		return s
+	}
+	return color + s + reset
+}
+
+// Printf writes a line of information, unless Quiet.
+func (c *Console) Printf(format string, a ...any) {
+	if c.Level >= Normal {
+		c.println(fmt.Sprintf(format, a...))
+	}
+}
+
+// Report is a summon.Reporter showing the event on the status line, unless
+// Quiet.
+func (c *Console) Report(e summon.Event) {
+	if c.Level < Normal {
+		return
+	}
+	s := e.Task + ": " + e.Message
+	if e.Percent >= 0 && e.Message == "" {
+		s = fmt.Sprintf("%s: %d%%", e.Task, e.Percent)
+	}
+	c.setStatus(s)
+}
+
+func (c *Console) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	start := time.Now()
+	if c.Level >= Normal {
+		c.setStatus("… " + name)
+	}
+	return ctx, func(err error) {
+		d := time.Since(start).Round(time.Millisecond)
+		switch {
+		case err != nil:
+			c.println(fmt.Sprintf("%s %s %s", c.paint(red, "✗"), name, c.paint(dim, d.String())))
+		case c.Level >= Normal:
+			c.println(fmt.Sprintf("%s %s %s", c.paint(green, "✓"), name, c.paint(dim, d.String())))
+		}
+	}
+}
+
+func (c *Console) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	if c.Level < Verbose {
+		return ctx, func(summon.CommandResult) {}
+	}
+	command := shellquote.Join(args...)
+	if c.Level >= Debug {
+		c.println(c.paint(dim, "$ "+command))
+	}
+	out := &commandOutput{c: c, command: command}
+	lines := summon.LineWriter(out.line)
+	return summon.WithOutput(ctx, &lockedWriter{w: lines}), func(r summon.CommandResult) {
+		lines.Close()
+		d := r.Duration.Round(time.Millisecond)
+		if r.Err == nil {
+			c.println(fmt.Sprintf("  %s %s", c.paint(dim, "$ "+command), c.paint(dim, d.String())))
+			return
+		}
+		failed := []string{fmt.Sprintf("  %s %s", c.paint(red, "$ "+command), c.paint(red, fmt.Sprintf("exit %d", r.ExitCode)))}
+		// the output is already there when it was shown as it ran
+		if c.Level < Debug {
+			out.mu.Lock()
+			if out.dropped > 0 {
+				failed = append(failed, c.paint(dim, fmt.Sprintf("    [... %d lines left out ...]", out.dropped)))
+			}
+			for _, l := range out.tail {
+				failed = append(failed, "    "+l)
+			}
+			out.mu.Unlock()
+		}
+		c.println(failed...)
+	}
+}
+
+// The output of a running command, keeping the last lines in case it fails.
+type commandOutput struct {
+	c       *Console
+	command string
+
+	mu      sync.Mutex
+	tail    []string
+	dropped int
+}
+
+func (o *commandOutput) line(l string) {
+	l = summon.Redact(l)
+	if o.c.Level >= Debug {
+		o.c.println(l)
+		return
+	}
+	o.mu.Lock()
+	if len(o.tail) == keepLines {
+		o.tail = o.tail[1:]
+		o.dropped++
+	}
+	o.tail = append(o.tail, l)
+	o.mu.Unlock()
+	o.c.setStatus("$ " + o.command + ": " + l)
+}
+
+// Commands write stdout and stderr at the same time.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
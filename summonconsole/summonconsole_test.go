@@ -0,0 +1,67 @@
+package summonconsole
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/summon"
+)
+
+func install(t *testing.T, level Level) *strings.Builder {
+	var out strings.Builder
+	t.Cleanup(summon.SetTracer(New(&out, level)))
+	return &out
+}
+
+func runTask(name string, args ...string) error {
+	return summon.Run(context.Background(), summon.Task{
+		Name: name,
+		Do: func(ctx context.Context) error {
+			return summon.RunStreaming(ctx, exec.CommandContext(ctx, args[0], args[1:]...), nil, nil)
+		},
+	})
+}
+
+func TestQuiet(t *testing.T) {
+	out := install(t, Quiet)
+	ensure.Nil(t, runTask("Config.GenFstab", "true"))
+	ensure.NotNil(t, runTask("Config.GptSetup", "sh", "-c", "echo busy; exit 1"))
+	ensure.StringDoesNotContain(t, out.String(), "GenFstab")
+	ensure.StringContains(t, out.String(), "✗ Config.GptSetup")
+	ensure.StringDoesNotContain(t, out.String(), "busy")
+}
+
+func TestVerbose(t *testing.T) {
+	out := install(t, Verbose)
+	ensure.Nil(t, runTask("Config.GenFstab", "sh", "-c", "echo wrote fstab"))
+	ensure.NotNil(t, runTask("Config.GptSetup", "sh", "-c", "echo busy >&2; exit 1"))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	ensure.DeepEqual(t, len(lines), 5)
+	// the output of a successful command is collapsed
+	ensure.True(t, strings.HasPrefix(lines[0], "  $ sh -c 'echo wrote fstab' "))
+	ensure.True(t, strings.HasPrefix(lines[1], "✓ Config.GenFstab "))
+	ensure.DeepEqual(t, lines[2], "  $ sh -c 'echo busy >&2; exit 1' exit 1")
+	ensure.DeepEqual(t, lines[3], "    busy")
+	ensure.True(t, strings.HasPrefix(lines[4], "✗ Config.GptSetup "))
+}
+
+func TestDebug(t *testing.T) {
+	out := install(t, Debug)
+	ensure.Nil(t, runTask("Config.GenFstab", "sh", "-c", "echo wrote fstab"))
+	lines := strings.Split(out.String(), "\n")
+	ensure.DeepEqual(t, lines[0], "$ sh -c 'echo wrote fstab'")
+	ensure.DeepEqual(t, lines[1], "wrote fstab")
+}
+
+func TestKeepLines(t *testing.T) {
+	out := install(t, Verbose)
+	err := runTask("Config.Pacstrap", "sh", "-c", "seq 100; exit 1")
+	var cerr *summon.CommandError
+	ensure.True(t, errors.As(err, &cerr))
+	ensure.StringContains(t, out.String(), "[... 50 lines left out ...]\n    51\n")
+	ensure.StringContains(t, out.String(), "    100\n")
+}
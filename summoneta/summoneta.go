@@ -0,0 +1,120 @@
+// Package summoneta estimates the time remaining for an install from the
+// durations of the tasks of the previous successful run on the same machine.
+package summoneta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+// A Task of a run, with its Duration, and when it ended relative to the start
+// of the run.
+type Task struct {
+	Duration time.Duration
+	End      time.Duration
+}
+
+// A Run is the tasks of an install by name, with the nth repeat of a name
+// after the first keyed as name#n, and the Total duration.
+type Run struct {
+	Total time.Duration
+	Tasks map[string]Task
+}
+
+// ETA is a summon.Tracer recording the tasks of the run, and calling Report
+// with the time remaining as each task the previous run also had ends.
+type ETA struct {
+	Report func(remaining time.Duration)
+
+	path    string
+	machine string
+	history map[string]Run
+
+	mu    sync.Mutex
+	start time.Time
+	seen  map[string]int
+	run   Run
+
+	now func() time.Time
+}
+
+// Load the history of the runs, by machine, from the JSON file at path,
+// which doesn't need to exist yet.
+func New(path, machine string) (*ETA, error) {
+	e := &ETA{
+		path:    path,
+		machine: machine,
+		history: map[string]Run{},
+		seen:    map[string]int{},
+		run:     Run{Tasks: map[string]Task{}},
+		now:     time.Now,
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &e.history); err != nil {
+			return nil, fmt.Errorf("summoneta: invalid history %s: %w", path, err)
+		}
+	}
+	e.start = e.now()
+	return e, nil
+}
+
+// Estimate of the Total duration, from the previous run.
+func (e *ETA) Estimate() time.Duration {
+	return e.history[e.machine].Total
+}
+
+func (e *ETA) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	e.mu.Lock()
+	key := name
+	if n := e.seen[name]; n > 0 {
+		key = fmt.Sprintf("%s#%d", name, n)
+	}
+	e.seen[name]++
+	start := e.now()
+	e.mu.Unlock()
+
+	return ctx, func(error) {
+		e.mu.Lock()
+		end := e.now()
+		e.run.Tasks[key] = Task{Duration: end.Sub(start), End: end.Sub(e.start)}
+		prev := e.history[e.machine]
+		last, ok := prev.Tasks[key]
+		e.mu.Unlock()
+		if ok && e.Report != nil {
+			e.Report(max(prev.Total-last.End, 0))
+		}
+	}
+}
+
+func (e *ETA) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	return ctx, func(summon.CommandResult) {}
+}
+
+// Save the run as the one to estimate the next run on the machine from. It
+// should only be called for a run which succeeded, since a failed one ends
+// early.
+func (e *ETA) Save() error {
+	e.mu.Lock()
+	e.run.Total = e.now().Sub(e.start)
+	e.history[e.machine] = e.run
+	b, err := json.MarshalIndent(e.history, "", "  ")
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.path), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return os.WriteFile(e.path, append(b, '\n'), os.FileMode(0o644))
+}
@@ -0,0 +1,50 @@
+package summoneta
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+)
+
+func TestEstimate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eta.json")
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+	ctx := context.Background()
+
+	task := func(e *ETA, name string, d time.Duration) {
+		_, end := e.StartTask(ctx, name)
+		now = now.Add(d)
+		end(nil)
+	}
+
+	first, err := New(path, "boe")
+	ensure.Nil(t, err)
+	first.now = clock
+	first.start = now
+	ensure.DeepEqual(t, first.Estimate(), time.Duration(0))
+	task(first, "Config.GptSetup", time.Second)
+	task(first, "Config.Passwd", 2*time.Second)
+	task(first, "Config.Passwd", 3*time.Second)
+	ensure.Nil(t, first.Save())
+
+	second, err := New(path, "boe")
+	ensure.Nil(t, err)
+	second.now = clock
+	second.start = now
+	var remaining []time.Duration
+	second.Report = func(d time.Duration) { remaining = append(remaining, d) }
+	ensure.DeepEqual(t, second.Estimate(), 6*time.Second)
+	task(second, "Config.GptSetup", 2*time.Second)
+	task(second, "Config.New", time.Second)
+	task(second, "Config.Passwd", time.Second)
+	task(second, "Config.Passwd", time.Second)
+	ensure.DeepEqual(t, remaining, []time.Duration{5 * time.Second, 3 * time.Second, 0})
+
+	other, err := New(path, "marvin")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, other.Estimate(), time.Duration(0))
+}
@@ -0,0 +1,159 @@
+// Package summonjournal logs summon tasks and commands to the systemd journal
+// with structured fields, so provisioning history can be queried like:
+//
+//	journalctl SUMMON_MACHINE=boe SUMMON_TASK=Config.GptSetup
+package summonjournal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daaku/summon"
+	"github.com/kballard/go-shellquote"
+)
+
+const socket = "/run/systemd/journal/socket"
+
+// Priorities from syslog(3).
+const (
+	priErr    = 3
+	priNotice = 5
+	priInfo   = 6
+)
+
+// A Journal is a summon.Tracer writing an entry for each task as it starts
+// and ends, and for each command once it is done. Entries include the
+// SUMMON_MACHINE and the SUMMON_TASK they were part of.
+type Journal struct {
+	conn    *net.UnixConn
+	machine string
+}
+
+// New connects to the journal, for logging about the named machine.
+func New(machine string) (*Journal, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("summon: connecting to the journal: %v", err)
+	}
+	return &Journal{conn: conn, machine: machine}, nil
+}
+
+func (j *Journal) Close() error {
+	return j.conn.Close()
+}
+
+type taskKey struct{}
+
+func (j *Journal) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx = context.WithValue(ctx, taskKey{}, name)
+	j.send(priInfo, name+" started", map[string]string{"SUMMON_TASK": name})
+	return ctx, func(err error) {
+		fields := map[string]string{
+			"SUMMON_TASK":          name,
+			"SUMMON_DURATION_USEC": strconv.FormatInt(time.Since(start).Microseconds(), 10),
+		}
+		if err != nil {
+			fields["SUMMON_ERROR"] = err.Error()
+			j.send(priErr, fmt.Sprintf("%s failed: %v", name, err), fields)
+			return
+		}
+		j.send(priNotice, name+" done", fields)
+	}
+}
+
+func (j *Journal) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	task, _ := ctx.Value(taskKey{}).(string)
+	return ctx, func(r summon.CommandResult) {
+		command := shellquote.Join(args...)
+		fields := map[string]string{
+			"SUMMON_COMMAND":       command,
+			"SUMMON_EXIT_CODE":     strconv.Itoa(r.ExitCode),
+			"SUMMON_OUTPUT_BYTES":  strconv.Itoa(r.OutputBytes),
+			"SUMMON_DURATION_USEC": strconv.FormatInt(r.Duration.Microseconds(), 10),
+		}
+		if task != "" {
+			fields["SUMMON_TASK"] = task
+		}
+		if r.Err != nil {
+			fields["SUMMON_ERROR"] = r.Err.Error()
+			j.send(priErr, fmt.Sprintf("%s failed: %v", command, r.Err), fields)
+			return
+		}
+		j.send(priInfo, command+" succeeded", fields)
+	}
+}
+
+// Logging must not fail the install, so errors are reported on stderr.
+func (j *Journal) send(priority int, message string, fields map[string]string) {
+	if err := j.write(entry(j.machine, priority, message, fields)); err != nil {
+		fmt.Fprintf(os.Stderr, "summon: writing to the journal: %v\n", err)
+	}
+}
+
+// Encode the entry using the native journal protocol.
+func entry(machine string, priority int, message string, fields map[string]string) []byte {
+	var b bytes.Buffer
+	appendField(&b, "MESSAGE", message)
+	appendField(&b, "PRIORITY", strconv.Itoa(priority))
+	appendField(&b, "SYSLOG_IDENTIFIER", "summon")
+	appendField(&b, "SUMMON_MACHINE", machine)
+	for _, k := range sortedKeys(fields) {
+		appendField(&b, k, fields[k])
+	}
+	return b.Bytes()
+}
+
+// Values with newlines are written with their length rather than terminated.
+func appendField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Entries too large for a datagram, like those with the output of a failed
+// command, are passed in a sealed temporary file instead.
+func (j *Journal) write(data []byte) error {
+	_, err := j.conn.Write(data)
+	if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return err
+	}
+	f, err := os.CreateTemp("/dev/shm", "summon-journal-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	_, _, err = j.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), nil)
+	return err
+}
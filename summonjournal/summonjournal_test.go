@@ -0,0 +1,20 @@
+package summonjournal
+
+import (
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestEntry(t *testing.T) {
+	e := entry("boe", priErr, "mkfs.btrfs failed", map[string]string{
+		"SUMMON_TASK":  "Config.GptSetup",
+		"SUMMON_ERROR": "exit status 1\nERROR: device busy",
+	})
+	ensure.DeepEqual(t, string(e), "MESSAGE=mkfs.btrfs failed\n"+
+		"PRIORITY=3\n"+
+		"SYSLOG_IDENTIFIER=summon\n"+
+		"SUMMON_MACHINE=boe\n"+
+		"SUMMON_ERROR\n\x20\x00\x00\x00\x00\x00\x00\x00exit status 1\nERROR: device busy\n"+
+		"SUMMON_TASK=Config.GptSetup\n")
+}
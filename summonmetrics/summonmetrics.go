@@ -0,0 +1,187 @@
+// Package summonmetrics exposes metrics about installs, tasks, commands and
+// backups in the Prometheus text format, for dashboards tracking summon
+// running as a service, like on an image builder or provisioning node.
+package summonmetrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+type summary struct {
+	count int64
+	sum   float64
+}
+
+// Metrics is a summon.Tracer recording task and command durations, and an
+// http.Handler serving them along with the installs and backups it is told
+// about.
+type Metrics struct {
+	mu                sync.Mutex
+	installsStarted   int64
+	installsSucceeded int64
+	installsFailed    int64
+	tasks             map[string]*summary
+	commands          map[string]*summary
+	commandFailures   map[string]int64
+	backupBytes       map[string]int64
+	backups           map[[2]string]int64
+
+	now func() time.Time
+}
+
+func New() *Metrics {
+	return &Metrics{
+		tasks:           map[string]*summary{},
+		commands:        map[string]*summary{},
+		commandFailures: map[string]int64{},
+		backupBytes:     map[string]int64{},
+		backups:         map[[2]string]int64{},
+		now:             time.Now,
+	}
+}
+
+// InstallStarted counts an install as started. InstallDone should be called
+// once it is done.
+func (m *Metrics) InstallStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.installsStarted++
+}
+
+// InstallDone counts an install as succeeded, or failed if err is not nil.
+func (m *Metrics) InstallDone(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.installsSucceeded++
+	} else {
+		m.installsFailed++
+	}
+}
+
+// ObserveBackup counts a backup to the target, and the bytes it transferred.
+func (m *Metrics) ObserveBackup(target string, bytes int64, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backupBytes[target] += bytes
+	m.backups[[2]string{target, result}]++
+}
+
+func observe(s map[string]*summary, name string, d time.Duration) {
+	if s[name] == nil {
+		s[name] = &summary{}
+	}
+	s[name].count++
+	s[name].sum += d.Seconds()
+}
+
+func (m *Metrics) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	start := m.now()
+	return ctx, func(error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		observe(m.tasks, name, m.now().Sub(start))
+	}
+}
+
+// Commands are recorded by executable name, since the arguments would make
+// for unbounded label values.
+func (m *Metrics) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	var name string
+	if len(args) > 0 {
+		name = path.Base(args[0])
+	}
+	return ctx, func(r summon.CommandResult) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		observe(m.commands, name, r.Duration)
+		if r.Err != nil {
+			m.commandFailures[name]++
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeSummary(w io.Writer, name, label, help string, s map[string]*summary) {
+	header(w, name, "summary", help)
+	for _, k := range sortedKeys(s) {
+		l := fmt.Sprintf(`{%s="%s"}`, label, labelEscaper.Replace(k))
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, l, s[k].sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, l, s[k].count)
+	}
+}
+
+// WriteText writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"summon_installs_started_total", "Installs started.", m.installsStarted},
+		{"summon_installs_succeeded_total", "Installs which succeeded.", m.installsSucceeded},
+		{"summon_installs_failed_total", "Installs which failed.", m.installsFailed},
+	} {
+		header(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+	writeSummary(w, "summon_task_duration_seconds", "task", "Time spent running tasks.", m.tasks)
+	writeSummary(w, "summon_command_duration_seconds", "command", "Time spent running commands.", m.commands)
+
+	header(w, "summon_command_failures_total", "counter", "Commands which failed.")
+	for _, k := range sortedKeys(m.commandFailures) {
+		fmt.Fprintf(w, "summon_command_failures_total{command=\"%s\"} %d\n", labelEscaper.Replace(k), m.commandFailures[k])
+	}
+	header(w, "summon_backup_bytes_total", "counter", "Bytes transferred by backups.")
+	for _, k := range sortedKeys(m.backupBytes) {
+		fmt.Fprintf(w, "summon_backup_bytes_total{target=\"%s\"} %d\n", labelEscaper.Replace(k), m.backupBytes[k])
+	}
+	header(w, "summon_backups_total", "counter", "Backups by target and result.")
+	backups := make([][2]string, 0, len(m.backups))
+	for k := range m.backups {
+		backups = append(backups, k)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i][0] != backups[j][0] {
+			return backups[i][0] < backups[j][0]
+		}
+		return backups[i][1] < backups[j][1]
+	})
+	for _, k := range backups {
+		fmt.Fprintf(w, "summon_backups_total{target=\"%s\",result=\"%s\"} %d\n", labelEscaper.Replace(k[0]), k[1], m.backups[k])
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
@@ -0,0 +1,35 @@
+package summonmetrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/summon"
+	"github.com/gkampitakis/go-snaps/snaps"
+)
+
+func TestWriteText(t *testing.T) {
+	m := New()
+	now := time.Unix(0, 0)
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	m.InstallStarted()
+	_, end := m.StartTask(ctx, "Config.GptSetup")
+	now = now.Add(1500 * time.Millisecond)
+	end(nil)
+	_, endCmd := m.StartCommand(ctx, []string{"/usr/bin/pacman", "-S", "base"})
+	endCmd(summon.CommandResult{ExitCode: 1, Duration: 2 * time.Second, Err: errors.New("exit status 1")})
+	m.InstallDone(errors.New("exit status 1"))
+	m.ObserveBackup(`/backups/"boe"`, 1024, nil)
+	m.ObserveBackup(`/backups/"boe"`, 0, errors.New("no space left on device"))
+
+	var b strings.Builder
+	m.WriteText(&b)
+	ensure.StringContains(t, b.String(), `summon_backups_total{target="/backups/\"boe\"",result="failure"} 1`)
+	snaps.MatchSnapshot(t, b.String())
+}
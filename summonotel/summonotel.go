@@ -0,0 +1,80 @@
+// Package summonotel records summon tasks and commands as OpenTelemetry
+// spans, so installs orchestrated from CI or a provisioning server show up
+// in existing tracing backends.
+package summonotel
+
+import (
+	"context"
+	"path"
+
+	"github.com/daaku/summon"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/daaku/summon"
+
+// Attributes of command spans, beyond the process semantic conventions.
+const (
+	OutputBytesKey = attribute.Key("summon.command.output_bytes")
+	DurationMsKey  = attribute.Key("summon.command.duration_ms")
+)
+
+type tracer struct {
+	t trace.Tracer
+}
+
+// New returns a summon.Tracer creating spans using the provider, or the
+// global one if it is nil.
+func New(tp trace.TracerProvider) summon.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tracer{t: tp.Tracer(instrumentation)}
+}
+
+// Install a Tracer using the global provider, returning a function to restore
+// the previous one.
+func Install() (restore func()) {
+	return summon.SetTracer(New(nil))
+}
+
+func (t tracer) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	ctx, span := t.t.Start(ctx, name)
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (t tracer) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	var name string
+	if len(args) > 0 {
+		name = path.Base(args[0])
+	}
+	ctx, span := t.t.Start(
+		ctx,
+		name,
+		trace.WithAttributes(
+			attribute.String("process.executable.name", name),
+			attribute.StringSlice("process.command_args", args),
+		),
+	)
+	return ctx, func(r summon.CommandResult) {
+		span.SetAttributes(
+			attribute.Int("process.exit.code", r.ExitCode),
+			OutputBytesKey.Int(r.OutputBytes),
+			DurationMsKey.Int64(r.Duration.Milliseconds()),
+		)
+		if r.Err != nil {
+			span.RecordError(r.Err)
+			span.SetStatus(codes.Error, r.Err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,232 @@
+package summonserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+// A Client is what an installer uses to fetch its config from a Server and
+// report back on its progress. URL is the base of the Server like
+// https://provision:8443, and Token the one the Server requires.
+type Client struct {
+	URL     string
+	Machine string
+	Token   string
+	HTTP    *http.Client
+
+	mu      sync.Mutex
+	queue   chan summon.Event
+	drained chan struct{}
+	done    bool
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP != nil {
+		return c.HTTP
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// The HTTP client for following events, which has no overall timeout since
+// the response lasts as long as the install, and is only ended by the ctx.
+func (c *Client) streamHTTP() *http.Client {
+	if c.HTTP != nil {
+		h := *c.HTTP
+		h.Timeout = 0
+		return &h
+	}
+	return &http.Client{}
+}
+
+func (c *Client) url(resource string) string {
+	return fmt.Sprintf("%s/machines/%s/%s", c.URL, url.PathEscape(c.Machine), resource)
+}
+
+func (c *Client) do(ctx context.Context, method, resource string, body any) (*http.Response, error) {
+	return c.doWith(ctx, c.http(), method, resource, body)
+}
+
+func (c *Client) doWith(ctx context.Context, h *http.Client, method, resource string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(j)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(resource), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("summon: %s %s: %s", method, req.URL, res.Status)
+	}
+	return res, nil
+}
+
+// Config fetches the machine config into v.
+func (c *Client) Config(ctx context.Context, v any) error {
+	res, err := c.do(ctx, http.MethodGet, "config", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// SetConfig submits the machine config, starting a new install.
+func (c *Client) SetConfig(ctx context.Context, v any) error {
+	res, err := c.do(ctx, http.MethodPut, "config", v)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Event posts the event.
+func (c *Client) Event(ctx context.Context, e summon.Event) error {
+	res, err := c.do(ctx, http.MethodPost, "events", e)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Reporter posts the events it is given, and the previous Reporter is still
+// called if there is one. Events are posted in the background so progress
+// isn't slowed down by the Server, and are dropped if it can't keep up.
+// Failures to post are logged, since they must not fail the install.
+func (c *Client) Reporter(next summon.Reporter) summon.Reporter {
+	c.start()
+	return func(e summon.Event) {
+		if next != nil {
+			next(e)
+		}
+		c.enqueue(e)
+	}
+}
+
+// StartTask posts an event as each task starts and ends, so the Server shows
+// the tasks along with the progress of the Reporter.
+func (c *Client) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	c.start()
+	c.enqueue(summon.Event{Task: name, Message: "started"})
+	return ctx, func(err error) {
+		e := summon.Event{Task: name, Message: "done", Percent: 100}
+		if err != nil {
+			e = summon.Event{Task: name, Message: "failed: " + err.Error()}
+		}
+		c.enqueue(e)
+	}
+}
+
+// StartCommand does nothing, commands are too many to post.
+func (c *Client) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	return ctx, func(summon.CommandResult) {}
+}
+
+// Start posting queued events in the background, unless it already is or the
+// report has been posted.
+func (c *Client) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queue == nil && !c.done {
+		c.queue = make(chan summon.Event, 256)
+		c.drained = make(chan struct{})
+		go c.post(c.queue, c.drained)
+	}
+}
+
+// Queue the event to be posted, dropping it if the queue is full or has been
+// drained.
+func (c *Client) enqueue(e summon.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.queue == nil {
+		return
+	}
+	select {
+	case c.queue <- e:
+	default:
+	}
+}
+
+func (c *Client) post(queue chan summon.Event, drained chan struct{}) {
+	defer close(drained)
+	for e := range queue {
+		if err := c.Event(context.Background(), e); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// Wait for the queued events to be posted.
+func (c *Client) drain() {
+	c.mu.Lock()
+	queue, drained := c.queue, c.drained
+	c.queue = nil
+	c.done = true
+	c.mu.Unlock()
+	if queue != nil {
+		close(queue)
+		<-drained
+	}
+}
+
+// Report posts the final report for an install which started at start and
+// failed with err, if it isn't nil, once the events reported so far have
+// been posted.
+func (c *Client) Report(ctx context.Context, start time.Time, err error) error {
+	c.drain()
+	r := Report{Start: start, Duration: time.Since(start).Round(time.Second).String()}
+	if err != nil {
+		r.Error = summon.Redact(err.Error())
+	}
+	res, err := c.do(ctx, http.MethodPut, "report", r)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Follow calls f with each event of the install as it happens, until the
+// report is posted.
+func (c *Client) Follow(ctx context.Context, f func(summon.Event)) error {
+	res, err := c.doWith(ctx, c.streamHTTP(), http.MethodGet, "events?follow", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	dec := json.NewDecoder(res.Body)
+	for {
+		var e summon.Event
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f(e)
+	}
+}
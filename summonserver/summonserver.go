@@ -0,0 +1,265 @@
+// Package summonserver tracks installs across a fleet. Machine configs are
+// submitted to the Server, installers fetch theirs by machine name, like from
+// a PXE booted image, and post their progress and final report to it while
+// anyone can follow along.
+//
+// The API, with machines identified by name:
+//
+//	PUT  /machines/{name}/config  submit the config, any JSON document
+//	GET  /machines/{name}/config  fetch the config
+//	POST /machines/{name}/events  post a summon.Event
+//	GET  /machines/{name}/events  stream events as newline delimited JSON,
+//	                              until the report arrives if ?follow is set
+//	PUT  /machines/{name}/report  post the final Report
+//	GET  /machines/{name}/report  fetch the final Report
+//	GET  /machines                the Status of every machine
+//
+// Configs may hold secrets, and a submitted config is run by the installer,
+// so the config endpoints and the ones posting progress require the shared
+// token as a bearer token, like "Authorization: Bearer <token>". The token
+// and configs are sent in the clear unless the Server is served over TLS,
+// like with http.ListenAndServeTLS or behind a TLS terminating proxy, which
+// should be done on anything but a trusted provisioning network.
+package summonserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+// Configs are small, this is only to bound memory.
+const maxBody = 1 << 20
+
+// The final Report of an install. Error is empty if it succeeded.
+type Report struct {
+	Start    time.Time
+	Duration string
+	Error    string `json:",omitempty"`
+}
+
+// The Status of a machine. State is one of pending, running, succeeded or
+// failed.
+type Status struct {
+	Name   string
+	State  string
+	Events int
+	Last   *summon.Event `json:",omitempty"`
+}
+
+type machine struct {
+	config  json.RawMessage
+	events  []summon.Event
+	report  *Report
+	changed chan struct{}
+}
+
+// Wake up followers.
+func (m *machine) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *machine) status(name string) Status {
+	s := Status{Name: name, State: "pending", Events: len(m.events)}
+	if len(m.events) > 0 {
+		s.Last = &m.events[len(m.events)-1]
+		s.State = "running"
+	}
+	if m.report != nil {
+		s.State = "succeeded"
+		if m.report.Error != "" {
+			s.State = "failed"
+		}
+	}
+	return s
+}
+
+// A Server keeps machine configs and install progress in memory.
+type Server struct {
+	mu       sync.Mutex
+	machines map[string]*machine
+	mux      *http.ServeMux
+	token    string
+}
+
+// New returns a Server requiring the token for the protected endpoints. With
+// an empty token they are always refused.
+func New(token string) *Server {
+	s := &Server{machines: map[string]*machine{}, mux: http.NewServeMux(), token: token}
+	s.mux.HandleFunc("PUT /machines/{name}/config", s.authorized(s.putConfig))
+	s.mux.HandleFunc("GET /machines/{name}/config", s.authorized(s.getConfig))
+	s.mux.HandleFunc("POST /machines/{name}/events", s.authorized(s.postEvent))
+	s.mux.HandleFunc("GET /machines/{name}/events", s.getEvents)
+	s.mux.HandleFunc("PUT /machines/{name}/report", s.authorized(s.putReport))
+	s.mux.HandleFunc("GET /machines/{name}/report", s.getReport)
+	s.mux.HandleFunc("GET /machines", s.getMachines)
+	return s
+}
+
+// Wrap the handler to require the bearer token.
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// The machine, created if it doesn't exist. The lock must be held.
+func (s *Server) machine(name string) *machine {
+	m := s.machines[name]
+	if m == nil {
+		m = &machine{changed: make(chan struct{})}
+		s.machines[name] = m
+	}
+	return m
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody)).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// A new config starts a new install, so the previous progress is dropped.
+func (s *Server) putConfig(w http.ResponseWriter, r *http.Request) {
+	var config json.RawMessage
+	if !readJSON(w, r, &config) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.machine(r.PathValue("name"))
+	m.config = config
+	m.events = nil
+	m.report = nil
+	m.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	var config json.RawMessage
+	s.mu.Lock()
+	if m := s.machines[r.PathValue("name")]; m != nil {
+		config = m.config
+	}
+	s.mu.Unlock()
+	if config == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(config)
+}
+
+func (s *Server) postEvent(w http.ResponseWriter, r *http.Request) {
+	var e summon.Event
+	if !readJSON(w, r, &e) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.machine(r.PathValue("name"))
+	m.events = append(m.events, e)
+	m.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getEvents(w http.ResponseWriter, r *http.Request) {
+	follow := r.URL.Query().Has("follow")
+	enc := json.NewEncoder(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	sent := 0
+	for {
+		s.mu.Lock()
+		m := s.machines[r.PathValue("name")]
+		if m == nil {
+			s.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		events := m.events[min(sent, len(m.events)):]
+		done := m.report != nil
+		changed := m.changed
+		s.mu.Unlock()
+
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		sent += len(events)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !follow || done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) putReport(w http.ResponseWriter, r *http.Request) {
+	var report Report
+	if !readJSON(w, r, &report) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.machine(r.PathValue("name"))
+	m.report = &report
+	m.notify()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getReport(w http.ResponseWriter, r *http.Request) {
+	var report *Report
+	s.mu.Lock()
+	if m := s.machines[r.PathValue("name")]; m != nil {
+		report = m.report
+	}
+	s.mu.Unlock()
+	if report == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, report)
+}
+
+func (s *Server) getMachines(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	statuses := make([]Status, 0, len(s.machines))
+	for name, m := range s.machines {
+		statuses = append(statuses, m.status(name))
+	}
+	s.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	writeJSON(w, statuses)
+}
@@ -0,0 +1,77 @@
+package summonserver_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/summon"
+	"github.com/daaku/summon/summonserver"
+)
+
+func TestInstall(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(summonserver.New("sekrit"))
+	defer srv.Close()
+	ctx := context.Background()
+	c := &summonserver.Client{URL: srv.URL, Machine: "boe", Token: "sekrit"}
+
+	type config struct{ Args []string }
+	ensure.Nil(t, c.SetConfig(ctx, config{Args: []string{"create", "--fs", "btrfs"}}))
+	var got config
+	ensure.Nil(t, c.Config(ctx, &got))
+	ensure.DeepEqual(t, got.Args, []string{"create", "--fs", "btrfs"})
+
+	type result struct {
+		events []summon.Event
+		err    error
+	}
+	followed := make(chan result)
+	go func() {
+		var r result
+		r.err = c.Follow(ctx, func(e summon.Event) { r.events = append(r.events, e) })
+		followed <- r
+	}()
+
+	r := c.Reporter(nil)
+	_, end := c.StartTask(ctx, "pacstrap")
+	r(summon.Event{Task: "pacstrap", Message: "base", Percent: 50})
+	r(summon.Event{Task: "pacstrap", Message: "base", Percent: 100})
+	end(nil)
+	ensure.Nil(t, c.Report(ctx, time.Now(), errors.New("mkinitcpio failed")))
+
+	select {
+	case r := <-followed:
+		ensure.Nil(t, r.err)
+		ensure.DeepEqual(t, len(r.events), 4)
+		ensure.DeepEqual(t, r.events[0].Message, "started")
+		ensure.DeepEqual(t, r.events[2].Percent, 100)
+		ensure.DeepEqual(t, r.events[3].Message, "done")
+	case <-time.After(5 * time.Second):
+		t.Fatal("following didn't end with the report")
+	}
+}
+
+func TestToken(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(summonserver.New("sekrit"))
+	defer srv.Close()
+	ctx := context.Background()
+
+	for _, token := range []string{"", "wrong"} {
+		c := &summonserver.Client{URL: srv.URL, Machine: "boe", Token: token}
+		ensure.Err(t, c.SetConfig(ctx, struct{}{}), regexp.MustCompile("401 Unauthorized"))
+		ensure.Err(t, c.Config(ctx, &struct{}{}), regexp.MustCompile("401 Unauthorized"))
+		ensure.Err(t, c.Event(ctx, summon.Event{}), regexp.MustCompile("401 Unauthorized"))
+	}
+
+	// without a token nothing is allowed
+	open := httptest.NewServer(summonserver.New(""))
+	defer open.Close()
+	c := &summonserver.Client{URL: open.URL, Machine: "boe"}
+	ensure.Err(t, c.SetConfig(ctx, struct{}{}), regexp.MustCompile("401 Unauthorized"))
+}
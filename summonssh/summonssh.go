@@ -0,0 +1,127 @@
+// Package summonssh runs summon commands on a remote machine over SSH, like
+// one booted into a rescue or live environment, using the ssh client and its
+// configuration. Connections are multiplexed over a control master, so each
+// command doesn't pay for a new handshake.
+package summonssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// A Runner runs commands on the Host, which may be anything ssh accepts,
+// like root@192.168.1.20 or an alias from ssh_config. Options are additional
+// ssh arguments, like -i for the identity or -p for the port.
+//
+// Killing a command only closes the connection, which may leave the remote
+// command running if it ignores the hangup.
+type Runner struct {
+	Host    string
+	Options []string
+
+	controlPath string
+}
+
+func New(host string, options ...string) *Runner {
+	return &Runner{
+		Host:    host,
+		Options: options,
+		controlPath: filepath.Join(
+			os.TempDir(),
+			fmt.Sprintf("summon-ssh-%d-%%C", os.Getpid()),
+		),
+	}
+}
+
+func (r *Runner) ssh(ctx context.Context, script string) *exec.Cmd {
+	args := []string{"-T"}
+	if r.controlPath != "" {
+		args = append(
+			args,
+			"-o", "ControlMaster=auto",
+			"-o", "ControlPath="+r.controlPath,
+			"-o", "ControlPersist=60",
+		)
+	}
+	args = append(args, r.Options...)
+	args = append(args, r.Host, "--", script)
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// The environment variables the command adds to the local environment, which
+// unlike the rest of it make sense on the remote machine.
+func addedEnv(env []string) []string {
+	local := map[string]bool{}
+	for _, e := range os.Environ() {
+		local[e] = true
+	}
+	var added []string
+	for _, e := range env {
+		if !local[e] {
+			added = append(added, e)
+		}
+	}
+	return added
+}
+
+// The shell command for the remote machine.
+func remoteScript(cmd *exec.Cmd) string {
+	script := shellquote.Join(cmd.Args...)
+	if env := addedEnv(cmd.Env); len(env) > 0 {
+		script = "env " + shellquote.Join(env...) + " " + script
+	}
+	if cmd.Dir != "" {
+		script = "cd " + shellquote.Join(cmd.Dir) + " && " + script
+	}
+	return script
+}
+
+func (r *Runner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	ssh := r.ssh(ctx, remoteScript(cmd))
+	ssh.Stdin = cmd.Stdin
+	ssh.Stdout = cmd.Stdout
+	ssh.Stderr = cmd.Stderr
+	return ssh.Run()
+}
+
+// WriteFile uploads the file, creating the parent directories. The mode is
+// set before the contents are written, so secrets are never readable by
+// others.
+func (r *Runner) WriteFile(ctx context.Context, name string, data []byte, perm os.FileMode) error {
+	q := shellquote.Join(name)
+	script := fmt.Sprintf(
+		"mkdir -p %s && : > %s && chmod %o %s && cat > %s",
+		shellquote.Join(filepath.Dir(name)), q, perm.Perm(), q, q,
+	)
+	var stderr bytes.Buffer
+	ssh := r.ssh(ctx, script)
+	ssh.Stdin = bytes.NewReader(data)
+	ssh.Stderr = &stderr
+	if err := ssh.Run(); err != nil {
+		return fmt.Errorf("summon: uploading %s to %s: %v: %s", name, r.Host, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Close the control master connection.
+func (r *Runner) Close() error {
+	if r.controlPath == "" {
+		return nil
+	}
+	args := append([]string{"-o", "ControlPath=" + r.controlPath, "-O", "exit"}, r.Options...)
+	err := exec.Command("ssh", append(args, r.Host)...).Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		// there was no master
+		return nil
+	}
+	return err
+}
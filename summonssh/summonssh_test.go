@@ -0,0 +1,16 @@
+package summonssh
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+func TestRemoteScript(t *testing.T) {
+	cmd := exec.Command("borg", "create", "::boe root")
+	cmd.Dir = "/mnt/boe"
+	cmd.Env = append(os.Environ(), "BORG_REPO=/backups/boe")
+	ensure.DeepEqual(t, remoteScript(cmd), "cd /mnt/boe && env BORG_REPO=/backups/boe borg create '::boe root'")
+}
@@ -0,0 +1,133 @@
+// Package summontest provides a fake Runner, to test complete install plans
+// without root or real disks.
+package summontest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/daaku/summon"
+	"github.com/kballard/go-shellquote"
+)
+
+// What a fake command writes, and the error it fails with, if any.
+type Response struct {
+	Stdout string
+	Stderr string
+	Err    error
+}
+
+// A Command run by the FakeRunner. Stdin is what the command was given to
+// read.
+type Command struct {
+	Args  []string
+	Dir   string
+	Stdin string
+}
+
+// The shell quoted command line.
+func (c Command) String() string {
+	return shellquote.Join(c.Args...)
+}
+
+type response struct {
+	pattern *regexp.Regexp
+	r       Response
+}
+
+// FakeRunner records the commands it is asked to run instead of running
+// them, and responds with the canned Response for the first matching
+// pattern. Commands without a match succeed without output.
+type FakeRunner struct {
+	mu        sync.Mutex
+	responses []response
+	commands  []Command
+}
+
+func New() *FakeRunner {
+	return &FakeRunner{}
+}
+
+// Install a new FakeRunner for the duration of the test. The Runner is
+// shared by the whole process, so the test must not be parallel.
+func Install(t testing.TB) *FakeRunner {
+	f := New()
+	t.Cleanup(summon.SetRunner(f))
+	return f
+}
+
+// On responds to commands matching the pattern, which is matched against the
+// complete shell quoted command line, with * matching anything.
+func (f *FakeRunner) On(pattern string, r Response) *FakeRunner {
+	re := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, response{pattern: regexp.MustCompile(re), r: r})
+	return f
+}
+
+func (f *FakeRunner) Run(ctx context.Context, cmd *exec.Cmd) error {
+	c := Command{Args: cmd.Args, Dir: cmd.Dir}
+	if cmd.Stdin != nil {
+		stdin, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		c.Stdin = string(stdin)
+	}
+
+	f.mu.Lock()
+	f.commands = append(f.commands, c)
+	var r Response
+	for _, resp := range f.responses {
+		if resp.pattern.MatchString(c.String()) {
+			r = resp.r
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, r.Stdout)
+	}
+	if cmd.Stderr != nil {
+		io.WriteString(cmd.Stderr, r.Stderr)
+	}
+	return r.Err
+}
+
+// The commands run so far, in order.
+func (f *FakeRunner) Commands() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.commands...)
+}
+
+// A transcript of the commands run so far, for comparing against a golden
+// snapshot. Stdin is included indented below its command, and registered
+// secrets are redacted.
+func (f *FakeRunner) Transcript() string {
+	var b strings.Builder
+	for _, c := range f.Commands() {
+		fmt.Fprintf(&b, "$ %s", c)
+		if c.Dir != "" {
+			fmt.Fprintf(&b, "  # in %s", c.Dir)
+		}
+		b.WriteString("\n")
+		if c.Stdin != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(c.Stdin, "\n"), "\n") {
+				fmt.Fprintf(&b, "\t%s\n", line)
+			}
+		}
+	}
+	return summon.Redact(b.String())
+}
@@ -0,0 +1,224 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	alarmArch   = "aarch64"
+	alarmMirror = "http://mirror.archlinuxarm.org/$arch/$repo"
+)
+
+// The ways an ARM board boots.
+const (
+	// The Raspberry Pi firmware loads the kernel, DTBs and config.txt from the
+	// first FAT partition.
+	BoardRPi = "rpi"
+	// U-Boot, already present on the board, boots using extlinux.conf.
+	BoardUBoot = "uboot"
+	// UEFI firmware, like edk2 on the Raspberry Pi or on Rockchip boards, boots
+	// using rEFInd as on x86.
+	BoardEFI = "efi"
+)
+
+// Copy everything the firmware or U-Boot needs from /boot onto the ESP. The
+// cmdline.txt shipped by linux-rpi is replaced by a generated one.
+func alarmCopyBoot(esp string) string {
+	return fmt.Sprintf(`find /boot -mindepth 1 -maxdepth 1 ! -name efi ! -name cmdline.txt -exec cp -rt %s {} +`, esp)
+}
+
+// A pacman hook to keep the ESP in sync with /boot on kernel updates.
+func alarmBootHook(esp string) string {
+	return `[Trigger]
+Type = Path
+Operation = Install
+Operation = Upgrade
+Target = boot/*
+
+[Action]
+Description = Copying /boot to the ESP...
+When = PostTransaction
+Exec = /bin/sh -c '` + alarmCopyBoot(esp) + `'
+`
+}
+
+// ALARM installs Arch Linux ARM for aarch64 boards, usually onto a loop image
+// from an x86 host. Unless a Config.Pacman is configured, a pacman.conf for
+// the Arch Linux ARM repositories is generated. The host keyring must include
+// the Arch Linux ARM keys. Running the install scripts and PostInstall from an
+// x86 host requires qemu-user emulation, see SetupEmulation.
+type ALARM struct {
+	Board  string
+	Mirror string
+}
+
+func (ALARM) EFIVendor() string {
+	return "archlinuxarm"
+}
+
+func (ALARM) Architecture() string {
+	return alarmArch
+}
+
+func (ALARM) KernelParams(c *Config) []string {
+	return Arch{}.KernelParams(c)
+}
+
+func (a ALARM) pacman() *PacmanConf {
+	mirror := a.Mirror
+	if mirror == "" {
+		mirror = alarmMirror
+	}
+	var repos []PacmanRepo
+	for _, name := range []string{"core", "extra", "alarm"} {
+		repos = append(repos, PacmanRepo{Name: name, Servers: []string{mirror}})
+	}
+	return &PacmanConf{Architecture: alarmArch, Repos: repos}
+}
+
+func (a ALARM) packages() []string {
+	pkgs := []string{"base", "archlinuxarm-keyring"}
+	switch a.Board {
+	case BoardRPi:
+		pkgs = append(pkgs, "linux-rpi", "raspberrypi-bootloader", "firmware-raspberrypi")
+	case BoardUBoot:
+		pkgs = append(pkgs, "linux-aarch64", "uboot-tools")
+	default:
+		pkgs = append(pkgs, "linux-aarch64")
+	}
+	return pkgs
+}
+
+// Generate the pacman.conf for aarch64, and install the filesystem package.
+func (a ALARM) InstallFileSystem(c *Config, kill chan bool) error {
+	if c.Pacman == nil {
+		c.Pacman = a.pacman()
+	}
+	if c.Pacman.Architecture == "" {
+		c.Pacman.Architecture = alarmArch
+	}
+	if len(c.Pacman.Repos) == 0 {
+		c.Pacman.Repos = a.pacman().Repos
+	}
+	if err := c.GenPacmanConf(kill); err != nil {
+		return err
+	}
+	return Arch{}.InstallFileSystem(c, kill)
+}
+
+// Install base, the kernel and boot files for the Board, and the configured
+// Packages and Groups.
+func (a ALARM) InstallSystem(c *Config, kill chan bool) error {
+	args := []string{
+		"--root", c.Root.Dir,
+		"--noconfirm",
+		"--quiet",
+		"--needed",
+		"--sync",
+	}
+	args = append(args, c.pacmanConfArgs()...)
+	if len(c.IgnorePkg) > 0 {
+		args = append(args, "--ignore", strings.Join(c.IgnorePkg, ","))
+	}
+	args = append(args, a.packages()...)
+	args = append(args, c.Packages...)
+	args = append(args, c.Groups...)
+	return run(exec.Command("pacman", args...), kill)
+}
+
+// Initialize the keyring, generate locales and the initramfs, and set up the
+// ESP for the Board.
+func (a ALARM) PostInstall(c *Config, kill chan bool) error {
+	cmds := [][]string{
+		{"/usr/bin/pacman-key", "--init"},
+		{"/usr/bin/pacman-key", "--populate", "archlinuxarm"},
+		{"/usr/bin/locale-gen"},
+		{"/usr/bin/mkinitcpio", "--allpresets"},
+	}
+	switch a.Board {
+	case BoardRPi, BoardUBoot:
+		cmds = append(cmds, []string{"/bin/sh", "-c", alarmCopyBoot(c.espPath())})
+	default:
+		vendor := c.vendorDir()
+		cmds = append(
+			cmds,
+			[]string{"/usr/bin/mkdir", "-p", vendor},
+			[]string{"/usr/bin/cp", "/boot/Image", path.Join(vendor, "vmlinuz.efi")},
+			[]string{"/usr/bin/cp", "/boot/initramfs-linux.img", path.Join(vendor, "initrd.img")},
+		)
+	}
+	for _, cmd := range cmds {
+		if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+			return err
+		}
+	}
+
+	switch a.Board {
+	case BoardRPi:
+		if err := a.genRPiCmdline(c); err != nil {
+			return err
+		}
+	case BoardUBoot:
+		if err := a.genExtlinux(c); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return a.genBootHook(c)
+}
+
+// Generate cmdline.txt on the ESP for the Raspberry Pi firmware.
+func (ALARM) genRPiCmdline(c *Config) error {
+	return writeFile(
+		filepath.Join(c.EFI.Dir, "cmdline.txt"),
+		[]byte(c.kernelOptions()+"\n"),
+		os.FileMode(0o644),
+	)
+}
+
+// Generate extlinux/extlinux.conf on the ESP for U-Boot. The DTB for the
+// board is picked by U-Boot from the copied dtbs directory.
+func (ALARM) genExtlinux(c *Config) error {
+	dir := filepath.Join(c.EFI.Dir, "extlinux")
+	if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	conf := fmt.Sprintf(`DEFAULT summon
+TIMEOUT 10
+
+LABEL summon
+	LINUX /Image
+	INITRD /initramfs-linux.img
+	FDTDIR /dtbs
+	APPEND %s
+`, c.kernelOptions())
+	return writeFile(filepath.Join(dir, "extlinux.conf"), []byte(conf), os.FileMode(0o644))
+}
+
+func (ALARM) genBootHook(c *Config) error {
+	dir := filepath.Join(c.Root.Dir, "etc", "pacman.d", "hooks")
+	return writeFile(
+		filepath.Join(dir, "90-summon-boot.hook"),
+		[]byte(alarmBootHook(c.espPath())),
+		os.FileMode(0o644),
+	)
+}
+
+// The boards booting from a copy of /boot have the kernel and configuration
+// at the top of the ESP.
+func (a ALARM) BootFiles(c *Config) []string {
+	vendor := path.Join("EFI", c.efiVendor())
+	switch a.Board {
+	case BoardRPi:
+		return []string{"cmdline.txt", "config.txt", "initramfs-linux.img"}
+	case BoardUBoot:
+		return []string{"extlinux/extlinux.conf", "Image", "initramfs-linux.img"}
+	}
+	return []string{path.Join(vendor, "vmlinuz.efi"), path.Join(vendor, "initrd.img")}
+}
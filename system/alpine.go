@@ -0,0 +1,221 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const defaultAlpineMirror = "https://dl-cdn.alpinelinux.org/alpine"
+
+// The signing keys trusted by apk, from the alpine-keys package.
+const defaultAlpineKeysDir = "/etc/apk/keys"
+
+var errNoKernelModules = errors.New("summon: no kernel found in /lib/modules")
+
+// The OpenRC services enabled by setup-alpine, by runlevel.
+var alpineServices = [][2]string{
+	{"devfs", "sysinit"},
+	{"dmesg", "sysinit"},
+	{"mdev", "sysinit"},
+	{"hwdrivers", "sysinit"},
+	{"hwclock", "boot"},
+	{"modules", "boot"},
+	{"sysctl", "boot"},
+	{"hostname", "boot"},
+	{"bootmisc", "boot"},
+	{"syslog", "boot"},
+	{"mount-ro", "shutdown"},
+	{"killprocs", "shutdown"},
+	{"savecache", "shutdown"},
+}
+
+// Alpine installs Alpine Linux using apk. The Branch is required, for example
+// "v3.20" or "edge", and the Config.Packages are installed along with the
+// kernel. The packages are verified using the keys in KeysDir on the host,
+// which defaults to those of the alpine-keys package in /etc/apk/keys, and
+// must include the keys the Branch is signed with.
+type Alpine struct {
+	Branch  string
+	Mirror  string
+	Kernel  string
+	KeysDir string
+}
+
+func (Alpine) EFIVendor() string {
+	return "alpine"
+}
+
+// Add the OpenRC service to the default runlevel. A systemd style .service
+// suffix is ignored.
+func (Alpine) EnableService(c *Config, name string, kill chan bool) error {
+	name = strings.TrimSuffix(name, ".service")
+	return run(c.targetCmd(nil, "/sbin/rc-update", "add", name, "default"), kill)
+}
+
+// The mkinitfs init unlocks the encrypted root based on these.
+func (Alpine) KernelParams(c *Config) []string {
+	params := []string{"rootfstype=" + string(c.Root.FSType)}
+	if c.Root.Password != "" {
+		params = append(
+			params,
+			"cryptroot="+filepath.Join("/dev/disk/by-partlabel", c.Root.Name),
+			"cryptdm="+c.Root.Name,
+		)
+	}
+	return params
+}
+
+func (a Alpine) kernel() string {
+	if a.Kernel == "" {
+		return "lts"
+	}
+	return a.Kernel
+}
+
+func (a Alpine) repositories() []string {
+	mirror := a.Mirror
+	if mirror == "" {
+		mirror = defaultAlpineMirror
+	}
+	return []string{
+		fmt.Sprintf("%s/%s/main", mirror, a.Branch),
+		fmt.Sprintf("%s/%s/community", mirror, a.Branch),
+	}
+}
+
+// Copy the trusted keys into the target, where apk looks for them. They are
+// replaced by those of the alpine-keys package once it is installed.
+func (a Alpine) installKeys(c *Config, kill chan bool) error {
+	src := a.KeysDir
+	if src == "" {
+		src = defaultAlpineKeysDir
+	}
+	names, err := readDirNames(src)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(c.Root.Dir, "etc", "apk", "keys")
+	if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	var keys int
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".pub") {
+			continue
+		}
+		dst := filepath.Join(dir, name)
+		if err := copyHostFile(filepath.Join(src, name), dst, os.FileMode(0o644), kill); err != nil {
+			return err
+		}
+		keys++
+	}
+	if keys == 0 {
+		return fmt.Errorf("summon: no alpine keys found in %s", src)
+	}
+	return nil
+}
+
+// Install alpine-base and configure the repositories.
+func (a Alpine) InstallFileSystem(c *Config, kill chan bool) error {
+	if err := a.installKeys(c, kill); err != nil {
+		return err
+	}
+	args := []string{
+		"--root", c.Root.Dir,
+		"--initdb",
+		"--update-cache",
+	}
+	for _, r := range a.repositories() {
+		args = append(args, "--repository", r)
+	}
+	args = append(args, "add", "alpine-base")
+	if err := run(exec.Command("apk", args...), kill); err != nil {
+		return err
+	}
+
+	return writeFile(
+		filepath.Join(c.Root.Dir, "etc", "apk", "repositories"),
+		[]byte(strings.Join(a.repositories(), "\n")+"\n"),
+		os.FileMode(0o644),
+	)
+}
+
+// Configure mkinitfs, and install the kernel and configured packages.
+func (a Alpine) InstallSystem(c *Config, kill chan bool) error {
+	if err := a.genMkinitfsConf(c); err != nil {
+		return err
+	}
+
+	pkgs := []string{"linux-" + a.kernel(), "mkinitfs"}
+	if c.Root.Password != "" {
+		pkgs = append(pkgs, "cryptsetup")
+	}
+	if c.Root.FSType == Btrfs {
+		pkgs = append(pkgs, "btrfs-progs")
+	}
+	pkgs = append(pkgs, c.Packages...)
+
+	args := append([]string{"/sbin/apk", "add"}, pkgs...)
+	if err := run(c.targetCmd(nil, args...), kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Generate /etc/mkinitfs/mkinitfs.conf with the features needed to boot.
+func (Alpine) genMkinitfsConf(c *Config) error {
+	features := []string{"base", "keymap", "kms", "mmc", "nvme", "scsi", "usb", "virtio"}
+	features = append(features, string(c.Root.FSType))
+	if c.Root.Password != "" {
+		features = append(features, "cryptsetup")
+	}
+	if c.Swap != nil {
+		features = append(features, "resume")
+	}
+
+	dir := filepath.Join(c.Root.Dir, "etc", "mkinitfs")
+	return writeFile(
+		filepath.Join(dir, "mkinitfs.conf"),
+		[]byte(fmt.Sprintf("features=%q\n", strings.Join(features, " "))),
+		os.FileMode(0o644),
+	)
+}
+
+// Enable the standard OpenRC services, regenerate the initramfs, and copy the
+// kernel and initramfs into the ESP.
+func (a Alpine) PostInstall(c *Config, kill chan bool) error {
+	r := c.Root.Dir
+	var cmds [][]string
+	for _, s := range alpineServices {
+		cmds = append(cmds, []string{"/sbin/rc-update", "add", s[0], s[1]})
+	}
+
+	modules, err := readDirNames(filepath.Join(r, "lib", "modules"))
+	if err != nil {
+		return err
+	}
+	if len(modules) == 0 {
+		return errNoKernelModules
+	}
+	vendor := c.vendorDir()
+	if err := mkdirAll(filepath.Join(r, vendor), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	cmds = append(
+		cmds,
+		[]string{"/sbin/mkinitfs", modules[len(modules)-1]},
+		[]string{"/bin/cp", "/boot/vmlinuz-" + a.kernel(), filepath.Join(vendor, "vmlinuz.efi")},
+		[]string{"/bin/cp", "/boot/initramfs-" + a.kernel(), filepath.Join(vendor, "initrd.img")},
+	)
+
+	for _, cmd := range cmds {
+		if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/daaku/summon"
+	"github.com/kballard/go-shellquote"
+)
+
+// Where the audit trail is kept in the target.
+const auditDir = "var/log/summon"
+
+// A task in the audit trail.
+type AuditTask struct {
+	Name     string
+	Start    time.Time
+	Duration string
+	Error    string `json:",omitempty"`
+}
+
+// A command in the audit trail, with secrets redacted from the Args.
+type AuditCommand struct {
+	Task     string `json:",omitempty"`
+	Args     []string
+	Start    time.Time
+	Duration string
+	ExitCode int
+	Error    string `json:",omitempty"`
+}
+
+// An AuditTrail is a summon.Tracer recording the tasks and commands of an
+// install, for WriteAudit to keep in the target so a machine can always
+// answer how it was built.
+type AuditTrail struct {
+	Start time.Time
+
+	mu       sync.Mutex
+	tasks    []AuditTask
+	commands []AuditCommand
+}
+
+func NewAuditTrail() *AuditTrail {
+	return &AuditTrail{Start: time.Now()}
+}
+
+type auditTaskKey struct{}
+
+func (a *AuditTrail) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	start := time.Now()
+	return context.WithValue(ctx, auditTaskKey{}, name), func(err error) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.tasks = append(a.tasks, AuditTask{
+			Name:     name,
+			Start:    start,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+			Error:    errorString(err),
+		})
+	}
+}
+
+func (a *AuditTrail) StartCommand(ctx context.Context, args []string) (context.Context, func(summon.CommandResult)) {
+	task, _ := ctx.Value(auditTaskKey{}).(string)
+	start := time.Now()
+	return ctx, func(r summon.CommandResult) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.commands = append(a.commands, AuditCommand{
+			Task:     task,
+			Args:     args,
+			Start:    start,
+			Duration: r.Duration.Round(time.Millisecond).String(),
+			ExitCode: r.ExitCode,
+			Error:    errorString(r.Err),
+		})
+	}
+}
+
+// Fields left out of the audit trail, since the value would be a secret.
+var auditSecretFields = map[string]bool{"Password": true, "PasswordHash": true}
+
+// The exported fields of the value which can be encoded, leaving out
+// callbacks like the Reporter and passwords.
+func auditValue(v reflect.Value) any {
+	if v.Kind() == reflect.Struct && v.CanInterface() {
+		if m, ok := v.Interface().(json.Marshaler); ok {
+			return m
+		}
+	}
+	switch v.Kind() {
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return auditValue(v.Elem())
+	case reflect.Struct:
+		fields := map[string]any{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || auditSecretFields[f.Name] {
+				continue
+			}
+			if fv := auditValue(v.Field(i)); fv != nil {
+				fields[f.Name] = fv
+			}
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = auditValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		entries := map[string]any{}
+		for _, k := range v.MapKeys() {
+			entries[fmt.Sprint(k.Interface())] = auditValue(v.MapIndex(k))
+		}
+		return entries
+	}
+	return v.Interface()
+}
+
+// The configuration, without the passwords.
+func (c *Config) auditConfig() ([]byte, error) {
+	j, err := json.MarshalIndent(auditValue(reflect.ValueOf(c)), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(summon.Redact(string(j))), nil
+}
+
+// A shell like transcript of the commands, for reading the trail without
+// tools.
+func (a *AuditTrail) transcript() []byte {
+	var b bytes.Buffer
+	for _, cmd := range a.commands {
+		fmt.Fprintf(&b, "$ %s\n", shellquote.Join(cmd.Args...))
+		fmt.Fprintf(&b, "# %s exit %d in %s", cmd.Start.Format(time.RFC3339), cmd.ExitCode, cmd.Duration)
+		if cmd.Task != "" {
+			fmt.Fprintf(&b, " during %s", cmd.Task)
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// Write the audit trail into a directory for this install under
+// /var/log/summon in the target: the configuration, tasks and commands, the
+// Inventory of the installed system, and for Arch Linux the installed package
+// versions. It should be the last step of the install, while the target is
+// still mounted.
+func (c *Config) WriteAudit(kill chan bool) error {
+	if c.Audit == nil {
+		return nil
+	}
+	a := c.Audit
+	dir := filepath.Join(c.Root.Dir, auditDir, a.Start.UTC().Format("20060102T150405Z"))
+
+	config, err := c.auditConfig()
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	report, err := json.MarshalIndent(struct {
+		Start     time.Time
+		Duration  string
+		Tasks     []AuditTask
+		Commands  []AuditCommand
+		Benchmark []BenchmarkResult `json:",omitempty"`
+	}{
+		Start:     a.Start,
+		Duration:  time.Since(a.Start).Round(time.Second).String(),
+		Tasks:     a.tasks,
+		Commands:  a.commands,
+		Benchmark: c.benchmark,
+	}, "", "  ")
+	transcript := a.transcript()
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	inv, err := c.inventory()
+	if err != nil {
+		return err
+	}
+	inventory, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	files := map[string][]byte{
+		"config.json":    append(config, '\n'),
+		"report.json":    append([]byte(summon.Redact(string(report))), '\n'),
+		"commands.log":   []byte(summon.Redact(string(transcript))),
+		"inventory.json": append(inventory, '\n'),
+	}
+	if _, ok := c.installer().(Arch); ok {
+		lock, err := QueryLockfile(c.Root.Dir)
+		if err != nil {
+			return err
+		}
+		var b bytes.Buffer
+		for _, n := range lock.Names() {
+			fmt.Fprintf(&b, "%s %s\n", n, lock[n])
+		}
+		files["packages.txt"] = b.Bytes()
+	}
+	for name, contents := range files {
+		if err := writeFile(filepath.Join(dir, name), contents, os.FileMode(0o600)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
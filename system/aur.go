@@ -0,0 +1,220 @@
+package system
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/daaku/errgroup"
+	"github.com/daaku/summon"
+)
+
+const aurCloneURL = "https://aur.archlinux.org/%s.git"
+
+var errAURAsRoot = errors.New("summon: AUR packages must be built as an unprivileged user")
+
+// PkgRepo is a local package repository. It is bind mounted into the target
+// at the same path, so it can be used by pacman both from the host and from
+// within the target.
+type PkgRepo struct {
+	Name string
+	Dir  string
+	Root string
+}
+
+// The path to the repository database.
+func (r PkgRepo) DB() string {
+	return path.Join(r.Dir, r.Name+".db.tar.zst")
+}
+
+// As a repository for pacman.conf.
+func (r PkgRepo) PacmanRepo() PacmanRepo {
+	return PacmanRepo{
+		Name:     r.Name,
+		SigLevel: "Optional TrustAll",
+		Servers:  []string{"file://" + r.Dir},
+	}
+}
+
+// Task bind mounts the repository into the target.
+func (r PkgRepo) Task() (summon.Task, error) {
+	target := path.Join(r.Root, r.Dir)
+	return summon.Task{
+		Name: fmt.Sprintf("Package Repo: %s", r.Name),
+		Do: func(ctx context.Context) error {
+			if err := mkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			return bindMount(r.Dir, target, false)
+		},
+		Defer: func(ctx context.Context) error {
+			return errgroup.NewMultiError(
+				umount(target),
+				remove(target),
+			)
+		},
+	}, nil
+}
+
+// PkgRepoInstall installs packages from a local repository into the target.
+// The pacman.conf used is rendered from Pacman, like the Config.Pacman of the
+// target, with the repository added, so the install uses the same
+// repositories and architecture as the rest of the target.
+type PkgRepoInstall struct {
+	Repo      PkgRepo
+	Packages  []string
+	Pacman    *PacmanConf
+	IgnorePkg []string
+}
+
+func (p PkgRepoInstall) Task() (summon.Task, error) {
+	return summon.Task{
+		Name: fmt.Sprintf("Install from %s: %s", p.Repo.Name, strings.Join(p.Packages, ", ")),
+		Do: func(ctx context.Context) error {
+			conf, err := pacmanConfWith(p.Pacman, p.IgnorePkg, p.Repo.PacmanRepo())
+			if err != nil {
+				return err
+			}
+			defer removeAll(filepath.Dir(conf))
+
+			args := []string{
+				"--root", p.Repo.Root,
+				"--config", conf,
+				"--noconfirm",
+				"--quiet",
+				"--needed",
+				"--sync",
+				"--refresh",
+			}
+			args = append(args, p.Packages...)
+			return summon.VerboseRun(exec.CommandContext(ctx, "pacman", args...))
+		},
+	}, nil
+}
+
+// AURBuild builds packages from the AUR as an unprivileged user and adds them
+// to a local repository. If Chroot is set, packages are built in a clean
+// chroot using makechrootpkg, otherwise they are built with makepkg directly
+// on the host and their dependencies must already be installed.
+type AURBuild struct {
+	Packages []string
+	User     string
+	BuildDir string
+	Chroot   string
+	Repo     PkgRepo
+}
+
+func (a AURBuild) Task() (summon.Task, error) {
+	if a.User == "" || a.User == "root" {
+		return summon.Task{}, errAURAsRoot
+	}
+	return summon.Task{
+		Name: fmt.Sprintf("AUR Build: %s", strings.Join(a.Packages, ", ")),
+		Do: func(ctx context.Context) error {
+			if err := mkdirAll(a.Repo.Dir, 0o755); err != nil {
+				return err
+			}
+			if err := a.makeChroot(ctx); err != nil {
+				return err
+			}
+
+			var pkgs []string
+			for _, name := range a.Packages {
+				built, err := a.build(ctx, name)
+				if err != nil {
+					return err
+				}
+				pkgs = append(pkgs, built...)
+			}
+
+			args := append([]string{"--remove", a.Repo.DB()}, pkgs...)
+			return summon.VerboseRun(exec.CommandContext(ctx, "repo-add", args...))
+		},
+	}, nil
+}
+
+// Create the clean chroot if necessary.
+func (a AURBuild) makeChroot(ctx context.Context) error {
+	if a.Chroot == "" {
+		return nil
+	}
+	root := path.Join(a.Chroot, "root")
+	if ok, _ := exists(root); ok {
+		return summon.Runf(ctx, "arch-nspawn %q pacman --noconfirm --sync --refresh --sysupgrade", root)
+	}
+	if err := mkdirAll(a.Chroot, 0o755); err != nil {
+		return err
+	}
+	return summon.Runf(ctx, "mkarchroot %q base-devel", root)
+}
+
+// Build a single package and copy the results into the repository. Returns
+// the paths of the packages in the repository.
+func (a AURBuild) build(ctx context.Context, name string) ([]string, error) {
+	dir := path.Join(a.BuildDir, name)
+	if err := removeAll(dir); err != nil {
+		return nil, err
+	}
+	if err := summon.Runf(ctx, "runuser -u %q -- git clone --depth 1 %q %q",
+		a.User, fmt.Sprintf(aurCloneURL, name), dir); err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	if a.Chroot != "" {
+		cmd = summon.MustCmdf(ctx, "makechrootpkg -c -r %q -U %q", a.Chroot, a.User)
+	} else {
+		cmd = summon.MustCmdf(ctx, "runuser -u %q -- makepkg --noconfirm --clean", a.User)
+	}
+	cmd.Dir = dir
+	if err := summon.VerboseRun(cmd); err != nil {
+		return nil, err
+	}
+
+	built, err := glob(path.Join(dir, "*.pkg.tar.*"))
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []string
+	for _, src := range built {
+		if strings.HasSuffix(src, ".sig") {
+			continue
+		}
+		dst := path.Join(a.Repo.Dir, path.Base(src))
+		if err := copyHostFile(src, dst, os.FileMode(0o644), nil); err != nil {
+			return nil, err
+		}
+		pkgs = append(pkgs, dst)
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("no packages built for %s", name)
+	}
+	return pkgs, nil
+}
+
+// Write a temporary pacman.conf rendered from conf with the given repositories
+// appended, on the machine being installed. The caller is responsible for
+// removing the directory it is in.
+func pacmanConfWith(conf *PacmanConf, ignore []string, repos ...PacmanRepo) (string, error) {
+	if conf == nil {
+		conf = &PacmanConf{}
+	}
+	with := *conf
+	with.Repos = append(slices.Clone(conf.repos()), repos...)
+	dir, err := mkdirTemp("pacman")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, "pacman.conf")
+	if err := writeFile(name, []byte(with.render(ignore)), os.FileMode(0o644)); err != nil {
+		removeAll(dir)
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,160 @@
+package system
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The per-directory ignore file. Each line is an rsync exclude pattern,
+// relative to the directory containing the file.
+const ignoreFile = ".summon-ignore"
+
+// Caches and build artifacts which are never worth backing up. These are used
+// unless Config.BackupExcludes is set.
+var DefaultBackupExcludes = []string{
+	".cache/",
+	".ccache/",
+	"__pycache__/",
+	"node_modules/",
+	".thumbnails/",
+	"*.o",
+}
+
+// The excludes, which always include snapshots left over from interrupted
+// backups.
+func (c *Config) backupExcludes() []string {
+	excludes := DefaultBackupExcludes
+	if c.BackupExcludes != nil {
+		excludes = c.BackupExcludes
+	}
+	return append(append([]string{}, excludes...), snapshotPrefix+"*/")
+}
+
+// Write the contents to a temporary file. The returned function removes it.
+func writeTemp(pattern, contents string) (string, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(f.Name()) }
+	_, err = f.WriteString(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	return f.Name(), remove, nil
+}
+
+// rsync arguments for the excludes and the .summon-ignore files, which rsync
+// merges in as it descends into each directory.
+func (c *Config) rsyncExcludeArgs() ([]string, func(), error) {
+	name, remove, err := writeTemp("summon-exclude-", strings.Join(c.backupExcludes(), "\n")+"\n")
+	if err != nil {
+		return nil, nil, err
+	}
+	args := []string{
+		"--exclude-from", name,
+		"--filter", "dir-merge,- " + ignoreFile,
+	}
+	return args, remove, nil
+}
+
+// A BackupBackend stores backups of a set of source directories. Restore
+// extracts the backed up path from the latest backup into the target. Prune
+// removes the backups its Retention doesn't keep, if it has one, and returns
+// them. The String describes where backups are stored.
+type BackupBackend interface {
+	Backup(c *Config, sources []string, kill chan bool) (BackupStats, error)
+	Restore(c *Config, path string, kill chan bool) error
+	Prune(c *Config, dryRun bool, kill chan bool) ([]string, error)
+	String() string
+}
+
+// What a backend reports about a backup. Bytes is what was transferred or
+// added to the repository.
+type BackupStats struct {
+	Files int64
+	Bytes int64
+}
+
+// Backup the sources using the backend, once the backup window opens.
+func (c *Config) BackupWith(b BackupBackend, sources []string) func(kill chan bool) error {
+	return c.BackupFanOut([]BackupBackend{b}, sources)
+}
+
+// Restore the system from the backup of path onto freshly prepared disks. The
+// fstab and crypttab from the backup describe the old disks, so they are
+// replaced. GenFstab, GenRefind and PostInstall should follow to set up
+// booting from the new disks.
+func (c *Config) Restore(b BackupBackend, path string) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if err := b.Restore(c, path, kill); err != nil {
+			return err
+		}
+		for _, name := range []string{"etc/fstab", "etc/crypttab"} {
+			if err := remove(filepath.Join(c.Root.Dir, name)); err != nil {
+				return err
+			}
+		}
+		return c.genCrypttab()
+	}
+}
+
+// Patterns from the .summon-ignore files within the sources, made absolute,
+// for backends which can't merge them as they go like rsync does.
+func collectIgnores(sources []string) ([]string, error) {
+	var patterns []string
+	for _, s := range sources {
+		err := filepath.WalkDir(s, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || d.Name() != ignoreFile {
+				return nil
+			}
+			contents, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			dir := filepath.Dir(p)
+			for _, l := range strings.Split(string(contents), "\n") {
+				l = strings.TrimSpace(l)
+				if l == "" || strings.HasPrefix(l, "#") {
+					continue
+				}
+				// like rsync, patterns with a leading slash are anchored to the
+				// directory, others match at any depth below it
+				if strings.HasPrefix(l, "/") {
+					patterns = append(patterns, dir+l)
+				} else {
+					patterns = append(patterns, filepath.Join(dir, "**", l))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
+
+// The excludes, including those from .summon-ignore files in the sources.
+// The rsync style trailing slash marking directories is removed, since other
+// backends don't use it.
+func (c *Config) allExcludes(sources []string) ([]string, error) {
+	ignores, err := collectIgnores(sources)
+	if err != nil {
+		return nil, err
+	}
+	var excludes []string
+	for _, e := range append(append([]string{}, c.backupExcludes()...), ignores...) {
+		excludes = append(excludes, strings.TrimSuffix(e, "/"))
+	}
+	return excludes, nil
+}
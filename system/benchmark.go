@@ -0,0 +1,120 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// How much the benchmark writes, and how long each profile runs.
+const (
+	benchmarkSize    = "1G"
+	benchmarkRuntime = 15
+)
+
+// A fio profile, run one after the other against a file in the target.
+type benchmarkProfile struct {
+	Name    string
+	RW      string
+	BS      string
+	IODepth int
+}
+
+var benchmarkProfiles = []benchmarkProfile{
+	{Name: "seq-read", RW: "read", BS: "1M", IODepth: 16},
+	{Name: "seq-write", RW: "write", BS: "1M", IODepth: 16},
+	{Name: "rand-read", RW: "randread", BS: "4k", IODepth: 32},
+	{Name: "rand-write", RW: "randwrite", BS: "4k", IODepth: 32},
+}
+
+// The throughput and IOPS of a profile, with the side it doesn't exercise
+// left at zero.
+type BenchmarkResult struct {
+	Profile    string
+	ReadMiBps  float64 `json:",omitempty"`
+	WriteMiBps float64 `json:",omitempty"`
+	ReadIOPS   float64 `json:",omitempty"`
+	WriteIOPS  float64 `json:",omitempty"`
+}
+
+func benchmarkArgs(file string) []string {
+	args := []string{
+		"--output-format=json",
+		"--filename=" + file,
+		"--size=" + benchmarkSize,
+		"--runtime=" + strconv.Itoa(benchmarkRuntime),
+		"--time_based",
+		"--ioengine=libaio",
+		"--direct=1",
+	}
+	for _, p := range benchmarkProfiles {
+		args = append(
+			args,
+			"--name="+p.Name,
+			"--rw="+p.RW,
+			"--bs="+p.BS,
+			"--iodepth="+strconv.Itoa(p.IODepth),
+			"--stonewall",
+		)
+	}
+	return args
+}
+
+// Parse the fio JSON output, which has the bandwidth in KiB/s.
+func parseBenchmark(out []byte) ([]BenchmarkResult, error) {
+	type side struct {
+		BW   float64 `json:"bw"`
+		IOPS float64 `json:"iops"`
+	}
+	var report struct {
+		Jobs []struct {
+			Name  string `json:"jobname"`
+			Read  side   `json:"read"`
+			Write side   `json:"write"`
+		} `json:"jobs"`
+	}
+	// fio may print warnings before the JSON
+	if i := bytes.IndexByte(out, '{'); i > 0 {
+		out = out[i:]
+	}
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, fmt.Errorf("summon: invalid fio output: %w", err)
+	}
+	var results []BenchmarkResult
+	for _, j := range report.Jobs {
+		results = append(results, BenchmarkResult{
+			Profile:    j.Name,
+			ReadMiBps:  j.Read.BW / 1024,
+			WriteMiBps: j.Write.BW / 1024,
+			ReadIOPS:   j.Read.IOPS,
+			WriteIOPS:  j.Write.IOPS,
+		})
+	}
+	return results, nil
+}
+
+// Benchmark the mounted root using fio on the host, with the results kept
+// for the audit trail and the install notification. This checks encryption
+// and queue settings didn't ruin the performance of new hardware, and needs
+// enough free space for the test file.
+func (c *Config) Benchmark(kill chan bool) error {
+	file := filepath.Join(c.Root.Dir, "var", "tmp", "summon-benchmark")
+	if err := os.MkdirAll(filepath.Dir(file), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	defer os.Remove(file)
+	var out bytes.Buffer
+	if err := runTee(exec.Command("fio", benchmarkArgs(file)...), kill, &out); err != nil {
+		return err
+	}
+	results, err := parseBenchmark(out.Bytes())
+	if err != nil {
+		return err
+	}
+	c.benchmark = results
+	return nil
+}
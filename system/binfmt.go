@@ -0,0 +1,131 @@
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// An Installer for a different architecture than the host. Commands inside
+// the target are run using qemu-user emulation.
+type CrossInstaller interface {
+	Architecture() string
+}
+
+// The ELF magic and mask for each architecture, from qemu-binfmt-conf.sh.
+var binfmtMagic = map[string][2]string{
+	"aarch64": {
+		`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"armv7h": {
+		`\x7fELF\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+	"riscv64": {
+		`\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`,
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`,
+	},
+}
+
+// The qemu name for each architecture, where it differs.
+var qemuArch = map[string]string{
+	"armv7h": "arm",
+}
+
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7h"
+	}
+	return runtime.GOARCH
+}
+
+// The architecture of the target.
+func (c *Config) targetArch() string {
+	if i, ok := c.installer().(CrossInstaller); ok {
+		return i.Architecture()
+	}
+	return hostArch()
+}
+
+func (c *Config) crossArch() bool {
+	return c.targetArch() != hostArch()
+}
+
+// Register qemu-user-static with binfmt_misc for the target architecture,
+// unless it already is. The fix binary flag makes the kernel open the
+// interpreter from the host, so it works inside chroot and systemd-nspawn
+// without being copied into the target.
+func (c *Config) SetupEmulation(kill chan bool) error {
+	if !c.crossArch() {
+		return nil
+	}
+	arch := c.targetArch()
+	magic, ok := binfmtMagic[arch]
+	if !ok {
+		return fmt.Errorf("summon: no binfmt configuration for %s", arch)
+	}
+	qemu := arch
+	if q, ok := qemuArch[arch]; ok {
+		qemu = q
+	}
+	interpreter := "/usr/bin/qemu-" + qemu + "-static"
+	if _, err := os.Stat(interpreter); err != nil {
+		return fmt.Errorf("summon: %s emulation requires qemu-user-static: %v", arch, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(binfmtDir, "register")); os.IsNotExist(err) {
+		if err := mount("binfmt_misc", binfmtDir, "binfmt_misc", ""); err != nil {
+			return err
+		}
+	}
+
+	name := "qemu-" + qemu
+	status, err := readFile(filepath.Join(binfmtDir, name))
+	if err == nil {
+		if bytes.HasPrefix(status, []byte("enabled")) {
+			return nil
+		}
+		return fmt.Errorf("summon: binfmt %s is registered but disabled", name)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	rule := fmt.Sprintf(":%s:M::%s:%s:%s:FPC", name, magic[0], magic[1], interpreter)
+	// the register file can't be created or chmod-ed like writeFile would
+	cmd := exec.Command("tee", filepath.Join(binfmtDir, "register"))
+	cmd.Stdin = strings.NewReader(rule)
+	return run(cmd, kill)
+}
+
+// Verify commands run inside the target under emulation, before the post
+// install steps which depend on it.
+func (c *Config) VerifyEmulation(kill chan bool) error {
+	if !c.crossArch() {
+		return nil
+	}
+	out, err := output(c.targetCmd(nil, "/usr/bin/uname", "-m"), kill)
+	if err != nil {
+		return fmt.Errorf("summon: running commands under %s emulation failed: %v", c.targetArch(), err)
+	}
+	got := strings.TrimSpace(string(out))
+	want := c.targetArch()
+	if want == "armv7h" {
+		want = "armv7l"
+	}
+	if got != want {
+		return fmt.Errorf("summon: expected %s emulation but target runs %s", want, got)
+	}
+	return nil
+}
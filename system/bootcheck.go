@@ -0,0 +1,183 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+var (
+	errBootCheckEncrypted = errors.New("summon: boot checks can't unlock an encrypted disk")
+	errBootCheckTimeout   = errors.New("summon: timed out waiting for the system to boot")
+	errBootCheckFirmware  = errors.New("summon: no UEFI firmware found for QEMU")
+)
+
+const (
+	bootCheckUnit   = "summon-boot-check.service"
+	bootCheckMarker = "summon-boot-check-ok"
+)
+
+// Only in virtual machines, so the marker isn't written on real hardware.
+var bootCheckService = `[Unit]
+Description=summon boot check marker
+ConditionVirtualization=vm
+After=multi-user.target
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh -c 'echo ` + bootCheckMarker + ` > /dev/ttyS0'
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// Where distributions install the QEMU UEFI firmware, by architecture.
+var qemuFirmware = map[string][]string{
+	"x86_64": {
+		"/usr/share/edk2/x64/OVMF.fd",
+		"/usr/share/ovmf/x64/OVMF.fd",
+		"/usr/share/ovmf/OVMF.fd",
+		"/usr/share/qemu/OVMF.fd",
+	},
+	"aarch64": {
+		"/usr/share/edk2/aarch64/QEMU_EFI.fd",
+		"/usr/share/AAVMF/AAVMF_CODE.fd",
+		"/usr/share/qemu-efi-aarch64/QEMU_EFI.fd",
+	},
+}
+
+// A BootCheck boots the installed disk in QEMU, headless and without writing
+// to it, and waits until the Expect string appears on the serial console.
+// That defaults to the marker written by the unit GenBootCheck installs,
+// since a login prompt only appears on the serial console if the kernel is
+// told to use it. The Firmware defaults to the first UEFI firmware found.
+type BootCheck struct {
+	Timeout  time.Duration
+	Memory   string
+	Firmware string
+	Expect   string
+}
+
+// Install the boot check marker unit.
+func (c *Config) GenBootCheck(kill chan bool) error {
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return nil
+	}
+	name := filepath.Join("etc", "systemd", "system", bootCheckUnit)
+	if err := c.writeTargetFile(name, bootCheckService, os.FileMode(0o644)); err != nil {
+		return err
+	}
+	return c.enableService(bootCheckUnit, kill)
+}
+
+func (b BootCheck) firmware(arch string) (string, error) {
+	if b.Firmware != "" {
+		return b.Firmware, nil
+	}
+	for _, f := range qemuFirmware[arch] {
+		if _, err := os.Stat(f); err == nil {
+			return f, nil
+		}
+	}
+	return "", errBootCheckFirmware
+}
+
+func (b BootCheck) args(c *Config, arch, disk, firmware string) []string {
+	memory := b.Memory
+	if memory == "" {
+		memory = "1G"
+	}
+	args := []string{
+		"-nographic",
+		"-no-reboot",
+		"-snapshot",
+		"-m", memory,
+		"-bios", firmware,
+		"-drive", "file=" + disk + ",format=raw,if=virtio",
+		"-serial", "stdio",
+		"-monitor", "none",
+	}
+	if arch == "aarch64" {
+		args = append(args, "-machine", "virt", "-cpu", "max")
+	}
+	if _, err := os.Stat("/dev/kvm"); err == nil && !c.crossArch() {
+		args = append(args, "-enable-kvm", "-cpu", "host")
+	}
+	return args
+}
+
+// Boot the disk, or the Config.Image, once it is no longer mounted, and wait
+// for it to come up.
+func (c *Config) VerifyBoot(b BootCheck) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if c.Root.Password != "" {
+			return errBootCheckEncrypted
+		}
+		disk := c.Disk
+		if c.Image != nil {
+			disk = c.Image.File
+		}
+		arch := c.targetArch()
+		firmware, err := b.firmware(arch)
+		if err != nil {
+			return err
+		}
+		expect := b.Expect
+		if expect == "" {
+			expect = bootCheckMarker
+		}
+		timeout := b.Timeout
+		if timeout == 0 {
+			timeout = 5 * time.Minute
+		}
+
+		var console bytes.Buffer
+		found := make(chan struct{})
+		w := summon.LineWriter(func(line string) {
+			console.WriteString(line + "\n")
+			if strings.Contains(line, expect) {
+				select {
+				case <-found:
+				default:
+					close(found)
+				}
+			}
+		})
+		cmd := exec.Command("qemu-system-"+arch, b.args(c, arch, disk, firmware)...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-found:
+			cmd.Process.Kill()
+			<-exited
+			return nil
+		case err := <-exited:
+			w.Close()
+			return fmt.Errorf("summon: QEMU exited before the system booted: %v\n%s", err, console.Bytes())
+		case <-timer.C:
+			cmd.Process.Kill()
+			<-exited
+			w.Close()
+			return fmt.Errorf("%w\n%s", errBootCheckTimeout, console.Bytes())
+		case <-kill:
+			cmd.Process.Kill()
+			<-exited
+			return errKilled
+		}
+	}
+}
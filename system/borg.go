@@ -0,0 +1,187 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// Borg backs up to a BorgBackup repository, which is initialized if
+// necessary. The Encryption defaults to repokey-blake2. With a keyfile
+// encryption mode, the key is kept in the KeyFile instead of the default
+// location in the home directory. The passphrase is read from the
+// PassphraseFile or the output of the PassCommand. Archives are named with
+// the Prefix followed by the time, and if a Retention is configured, Prune
+// removes old archives with the same Prefix.
+type Borg struct {
+	Repository     string
+	Encryption     string
+	KeyFile        string
+	PassphraseFile string
+	PassCommand    string
+	Compression    string
+	Prefix         string
+	Env            []string
+	Retention      *Retention
+}
+
+func (b Borg) cmd(args ...string) *exec.Cmd {
+	cmd := exec.Command("borg", args...)
+	cmd.Env = append(os.Environ(), "BORG_REPO="+b.Repository)
+	if b.KeyFile != "" {
+		cmd.Env = append(cmd.Env, "BORG_KEY_FILE="+b.KeyFile)
+	}
+	switch {
+	case b.PassphraseFile != "":
+		cmd.Env = append(cmd.Env, "BORG_PASSCOMMAND=cat "+b.PassphraseFile)
+	case b.PassCommand != "":
+		cmd.Env = append(cmd.Env, "BORG_PASSCOMMAND="+b.PassCommand)
+	}
+	cmd.Env = append(cmd.Env, b.Env...)
+	return cmd
+}
+
+func (b Borg) prefix() string {
+	if b.Prefix == "" {
+		return "summon"
+	}
+	return b.Prefix
+}
+
+// Initialize the repository unless it already exists.
+func (b Borg) init(kill chan bool) error {
+	if err := summon.RunCommand(context.Background(), b.cmd("info")); err == nil {
+		return nil
+	}
+	encryption := b.Encryption
+	if encryption == "" {
+		encryption = "repokey-blake2"
+	}
+	if b.KeyFile != "" {
+		if err := mkdirAll(filepath.Dir(b.KeyFile), os.FileMode(0o700)); err != nil {
+			return err
+		}
+	}
+	return run(b.cmd("init", "--encryption", encryption), kill)
+}
+
+func (b Borg) String() string {
+	return "borg " + b.Repository
+}
+
+func (b Borg) Backup(c *Config, sources []string, kill chan bool) (BackupStats, error) {
+	var stats BackupStats
+	if err := b.init(kill); err != nil {
+		return stats, err
+	}
+
+	patterns, err := c.allExcludes(sources)
+	if err != nil {
+		return stats, err
+	}
+	// borg matches against the full path, so relative patterns match at any
+	// depth
+	for i, p := range patterns {
+		if !strings.HasPrefix(p, "/") {
+			p = "**/" + p
+		}
+		patterns[i] = "sh:" + p
+	}
+	excludes, remove, err := writeTemp("summon-exclude-", strings.Join(patterns, "\n")+"\n")
+	if err != nil {
+		return stats, err
+	}
+	defer remove()
+
+	compression := b.Compression
+	if compression == "" {
+		compression = "zstd,3"
+	}
+	args := []string{
+		"create",
+		"--json",
+		"--one-file-system",
+		"--exclude-caches",
+		"--exclude-from", excludes,
+		"--compression", compression,
+	}
+	args = append(args, c.bwlimitArgs("--upload-ratelimit")...)
+	args = append(args, "::"+b.prefix()+"-{now:%Y-%m-%dT%H:%M:%S}")
+	args = append(args, sources...)
+	var out bytes.Buffer
+	if err := runTee(c.backupCmd(b.cmd(args...)), kill, &out); err != nil {
+		return stats, err
+	}
+	var created struct {
+		Archive struct {
+			Stats struct {
+				Files int64 `json:"nfiles"`
+				Bytes int64 `json:"deduplicated_size"`
+			} `json:"stats"`
+		} `json:"archive"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &created); err == nil {
+		stats = BackupStats{Files: created.Archive.Stats.Files, Bytes: created.Archive.Stats.Bytes}
+	}
+
+	return stats, nil
+}
+
+// Prune the archives with the Prefix which the Retention doesn't keep, and
+// compact the repository to free the space.
+func (b Borg) Prune(c *Config, dryRun bool, kill chan bool) ([]string, error) {
+	if b.Retention == nil {
+		return nil, nil
+	}
+	args := []string{"prune", "--list", "--glob-archives", b.prefix() + "-*"}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	args = append(args, b.Retention.keepArgs()...)
+	// the list is logged, with lines like "Would prune: <archive> <time>"
+	var pruned []string
+	w := summon.LineWriter(func(line string) {
+		if strings.HasPrefix(line, "Would prune") || strings.HasPrefix(line, "Pruning archive") {
+			_, archive, _ := strings.Cut(line, ":")
+			if fields := strings.Fields(archive); len(fields) > 0 {
+				pruned = append(pruned, fields[0])
+			}
+		}
+	})
+	err := runStreams(b.cmd(args...), kill, nil, w)
+	w.Close()
+	if err != nil || dryRun || len(pruned) == 0 {
+		return pruned, err
+	}
+	return pruned, run(b.cmd("compact"), kill)
+}
+
+// Extract the path from the latest archive with the Prefix. borg stores paths
+// without the leading slash, and extracts into the working directory.
+func (b Borg) Restore(c *Config, path string, kill chan bool) error {
+	out, err := output(b.cmd("list", "--short", "--last", "1", "--glob-archives", b.prefix()+"-*"), kill)
+	if err != nil {
+		return err
+	}
+	archive := strings.TrimSpace(string(out))
+	if archive == "" {
+		return fmt.Errorf("summon: no archives with prefix %s in %s", b.prefix(), b.Repository)
+	}
+
+	path = strings.Trim(filepath.Clean(path), "/")
+	args := []string{"extract", "--numeric-ids", "::" + archive}
+	if path != "" {
+		args = append(args, "--strip-components", strconv.Itoa(strings.Count(path, "/")+1), path)
+	}
+	cmd := b.cmd(args...)
+	cmd.Dir = c.Root.Dir
+	return run(cmd, kill)
+}
@@ -0,0 +1,103 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errBtrfsMaintenanceWithoutSystemd = errors.New("summon: btrfs maintenance timers require systemd")
+
+// Where the top level of the btrfs root is mounted in the target, with all
+// the subvolumes below it.
+const btrfsTopLevel = "/mnt/root"
+
+// BtrfsMaintenance schedules a scrub, which verifies the checksums of all
+// data and metadata, and a balance, which compacts the chunks using less
+// than the usage percentages so free space isn't stuck in them, like
+// btrfsmaintenance does. Schedules are systemd calendar events, defaulting to
+// monthly for the scrub and weekly for the balance.
+type BtrfsMaintenance struct {
+	ScrubSchedule   string
+	BalanceSchedule string
+	DataUsage       int
+	MetadataUsage   int
+}
+
+// The units by name, both running with idle IO priority on the top level
+// so every subvolume is covered.
+func (m *BtrfsMaintenance) units() map[string]string {
+	scrub, balance := m.ScrubSchedule, m.BalanceSchedule
+	if scrub == "" {
+		scrub = "monthly"
+	}
+	if balance == "" {
+		balance = "weekly"
+	}
+	dusage, musage := m.DataUsage, m.MetadataUsage
+	if dusage == 0 {
+		dusage = 10
+	}
+	if musage == 0 {
+		musage = 5
+	}
+
+	service := func(what, cmd string) string {
+		var b strings.Builder
+		b.WriteString("[Unit]\n")
+		fmt.Fprintf(&b, "Description=btrfs %s of %s\n", what, btrfsTopLevel)
+		fmt.Fprintf(&b, "RequiresMountsFor=%s\n", btrfsTopLevel)
+		b.WriteString("\n[Service]\n")
+		b.WriteString("Type=oneshot\n")
+		fmt.Fprintf(&b, "ExecStart=%s\n", cmd)
+		b.WriteString("Nice=19\n")
+		b.WriteString("IOSchedulingClass=idle\n")
+		return b.String()
+	}
+	timer := func(what, schedule string) string {
+		var b strings.Builder
+		b.WriteString("[Unit]\n")
+		fmt.Fprintf(&b, "Description=btrfs %s schedule\n", what)
+		b.WriteString("\n[Timer]\n")
+		fmt.Fprintf(&b, "OnCalendar=%s\n", schedule)
+		b.WriteString("Persistent=true\n")
+		b.WriteString("RandomizedDelaySec=1h\n")
+		b.WriteString("\n[Install]\n")
+		b.WriteString("WantedBy=timers.target\n")
+		return b.String()
+	}
+	return map[string]string{
+		"summon-btrfs-scrub.service": service("scrub", "/usr/bin/btrfs scrub start -B "+btrfsTopLevel),
+		"summon-btrfs-scrub.timer":   timer("scrub", scrub),
+		"summon-btrfs-balance.service": service(
+			"balance",
+			fmt.Sprintf("/usr/bin/btrfs balance start -dusage=%d -musage=%d %s", dusage, musage, btrfsTopLevel),
+		),
+		"summon-btrfs-balance.timer": timer("balance", balance),
+	}
+}
+
+// Install the Config.BtrfsMaintenance timers into the target, if the root is
+// btrfs.
+func (c *Config) GenBtrfsMaintenance(kill chan bool) error {
+	if c.BtrfsMaintenance == nil || c.Root.FSType != Btrfs {
+		return nil
+	}
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return errBtrfsMaintenanceWithoutSystemd
+	}
+	dir := filepath.Join(c.Root.Dir, "etc", "systemd", "system")
+	for name, contents := range c.BtrfsMaintenance.units() {
+		if err := writeFile(filepath.Join(dir, name), []byte(contents), os.FileMode(0o644)); err != nil {
+			return err
+		}
+	}
+	for _, timer := range []string{"summon-btrfs-scrub.timer", "summon-btrfs-balance.timer"} {
+		if err := c.enableService(timer, kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// A BuildCache speeds up repeated builds. Downloaded packages are shared
+// between all builds, and the installed base system is kept as a tarball
+// keyed by a hash of the configuration it depends on. A build with the same
+// configuration extracts the tarball instead of installing the system.
+type BuildCache struct {
+	Dir string
+}
+
+func (b *BuildCache) pkgDir() string {
+	return filepath.Join(b.Dir, "pkg")
+}
+
+func (b *BuildCache) tarball(hash string) string {
+	return filepath.Join(b.Dir, "base", hash+".tar.zst")
+}
+
+// A hash of everything that affects the result of InstallFileSystem and
+// InstallSystem.
+func (c *Config) configHash() (string, error) {
+	key := struct {
+		InstallerType string
+		Installer     Installer
+		Name          string
+		Package       string
+		Packages      []string
+		Groups        []string
+		IgnorePkg     []string
+		Pacman        *PacmanConf
+		Lockfile      []byte
+		FSType        string
+		Encrypted     bool
+		Swap          bool
+	}{
+		InstallerType: fmt.Sprintf("%T", c.installer()),
+		Installer:     c.installer(),
+		Name:          c.Name,
+		Package:       c.Package,
+		Packages:      c.Packages,
+		Groups:        c.Groups,
+		IgnorePkg:     c.IgnorePkg,
+		Pacman:        c.Pacman,
+		FSType:        string(c.Root.FSType),
+		Encrypted:     c.Root.Password != "",
+		Swap:          c.Swap != nil,
+	}
+	if c.Offline != nil {
+		lock, err := os.ReadFile(c.Offline.Lockfile)
+		if err != nil {
+			return "", err
+		}
+		key.Lockfile = lock
+	}
+	j, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Arguments to make pacman use the shared package cache.
+func (c *Config) pacmanCacheArgs() []string {
+	if c.Cache == nil {
+		return nil
+	}
+	return []string{"--cachedir", c.Cache.pkgDir()}
+}
+
+// Extract the cached base system, returning false if there is none.
+func (c *Config) restoreBase(kill chan bool) (bool, error) {
+	if c.Cache == nil {
+		return false, nil
+	}
+	// installers may adjust the configuration, so the hash is kept from
+	// before they run
+	hash, err := c.configHash()
+	if err != nil {
+		return false, err
+	}
+	c.baseHash = hash
+	tarball := c.Cache.tarball(hash)
+	if _, err := os.Stat(tarball); os.IsNotExist(err) {
+		return false, nil
+	}
+	cmd := exec.Command(
+		"tar", "--extract", "--zstd", "--xattrs", "--acls", "--numeric-owner",
+		"--directory", c.Root.Dir,
+		"--file", tarball,
+	)
+	if err := run(cmd, kill); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Save the installed base system to the cache. The virtual file systems and
+// the ESP are separate file systems, and are not included.
+func (c *Config) saveBase(kill chan bool) error {
+	if c.Cache == nil {
+		return nil
+	}
+	tarball := c.Cache.tarball(c.baseHash)
+	if err := os.MkdirAll(filepath.Dir(tarball), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	tmp := tarball + ".tmp"
+	cmd := exec.Command(
+		"tar", "--create", "--zstd", "--xattrs", "--acls", "--numeric-owner",
+		"--one-file-system",
+		"--directory", c.Root.Dir,
+		"--file", tmp,
+		".",
+	)
+	if err := run(cmd, kill); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, tarball)
+}
+
+// The package cache of the host, which is also where it is in the target.
+const hostPkgCache = "/var/cache/pacman/pkg"
+
+// Bind mount the package cache of the host over the one in the target if
+// Config.HostCache is set, so repeated installs don't download the same
+// packages again. Packages downloaded by the install are left in the host
+// cache.
+func (c *Config) BindHostCache(kill chan bool) error {
+	if !c.HostCache {
+		return nil
+	}
+	dir := filepath.Join(c.Root.Dir, hostPkgCache)
+	if err := os.MkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return bindMount(hostPkgCache, dir, false)
+}
+
+// Unmount the package cache bound by BindHostCache.
+func (c *Config) UnbindHostCache(kill chan bool) error {
+	if !c.HostCache {
+		return nil
+	}
+	return umount(filepath.Join(c.Root.Dir, hostPkgCache))
+}
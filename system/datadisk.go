@@ -0,0 +1,136 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// A DataDisk is another physical disk for the system, like for /home, with
+// one partition using all of it. It is encrypted with the passphrase of the
+// root, so it is unlocked along with it at boot.
+type DataDisk struct {
+	Name       string
+	Disk       string
+	Device     string
+	Mapper     string
+	Mountpoint string
+	FSType     string
+	Encrypt    bool
+
+	config *Config
+}
+
+// Add a data disk mounted at the mountpoint in the target, like /home, using
+// the file system type of the root.
+func (c *Config) AddDataDisk(disk, mountpoint string, encrypt bool) *DataDisk {
+	name := c.label(path.Base(mountpoint))
+	d := &DataDisk{
+		Name:       name,
+		Disk:       disk,
+		Device:     path.Join("/dev/disk/by-partlabel", name),
+		Mapper:     path.Join("/dev/mapper", name),
+		Mountpoint: mountpoint,
+		FSType:     string(c.Root.FSType),
+		Encrypt:    encrypt,
+		config:     c,
+	}
+	c.Data = append(c.Data, d)
+	return d
+}
+
+// Get the device path where the file system resides.
+func (d *DataDisk) fsDev() string {
+	if d.Encrypt {
+		return d.Mapper
+	}
+	return d.Device
+}
+
+// Where it is mounted on the host.
+func (d *DataDisk) dir() string {
+	return filepath.Join(d.config.Root.Dir, d.Mountpoint)
+}
+
+// Create the GPT of the disk.
+func (d *DataDisk) GptSetup(kill chan bool) error {
+	parts := []gptPartition{{Typecode: "8300", Name: d.Name}}
+	if d.config.DPS && d.Mountpoint == "/home" {
+		parts[0].Typecode = dpsHomeType
+	}
+	if err := d.config.partition(d.Disk, parts, kill); err != nil {
+		return err
+	}
+	return waitForDevice(d.Device)
+}
+
+// Initializes the LUKS device.
+func (d *DataDisk) LuksFormat(kill chan bool) error {
+	if !d.Encrypt {
+		return nil
+	}
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksFormat(ctx, d.Device, d.config.Root.Password)
+}
+
+// Opens the LUKS device.
+func (d *DataDisk) LuksOpen(kill chan bool) error {
+	if !d.Encrypt {
+		return nil
+	}
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksOpen(ctx, d.Device, d.Name, d.config.Root.Password)
+}
+
+// Closes the LUKS mapping.
+func (d *DataDisk) LuksClose(kill chan bool) error {
+	if !d.Encrypt {
+		return nil
+	}
+	return luksClose(context.Background(), d.Name)
+}
+
+// Create the file system.
+func (d *DataDisk) MakeFS(kill chan bool) error {
+	label, err := fsLabel(d.FSType, d.Name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("mkfs."+d.FSType, "-L", label, d.fsDev())
+	return run(cmd, kill)
+}
+
+// Mount the disk within the mounted root.
+func (d *DataDisk) Mount(kill chan bool) error {
+	if err := mkdirAll(d.dir(), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return mount(d.fsDev(), d.dir(), d.FSType, MountNoatime)
+}
+
+// Umount the disk. Does not remove the target directory.
+func (d *DataDisk) Umount(kill chan bool) error {
+	return umount(d.dir())
+}
+
+// The fstab line, checked after the root.
+func (d *DataDisk) fstabLine() ([]string, error) {
+	source, err := d.config.fstabSource(d.fsDev())
+	if err != nil {
+		return nil, err
+	}
+	return []string{source, d.Mountpoint, d.FSType, MountNoatime, "0 2"}, nil
+}
+
+// The crypttab line, if it is encrypted.
+func (d *DataDisk) crypttabLine() string {
+	if !d.Encrypt {
+		return ""
+	}
+	return fmt.Sprintf("%s %s none luks,discard\n", d.Name, d.Device)
+}
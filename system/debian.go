@@ -0,0 +1,121 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var errDebianEncryptedSwap = errors.New("summon: encrypted swap is not supported with debootstrap")
+
+// Debootstrap installs Debian-family distributions like Debian and Ubuntu.
+// The Suite is required, and the Config.Packages are installed along with the
+// kernel. Unlike Arch, the encrypted root is unlocked based on the generated
+// crypttab.
+type Debootstrap struct {
+	Suite   string
+	Mirror  string
+	Include []string
+	Kernel  string
+	Vendor  string
+}
+
+func (d Debootstrap) EFIVendor() string {
+	if d.Vendor == "" {
+		return "debian"
+	}
+	return d.Vendor
+}
+
+func (Debootstrap) KernelParams(c *Config) []string {
+	return nil
+}
+
+func (d Debootstrap) kernel() string {
+	if d.Kernel == "" {
+		return "linux-image-amd64"
+	}
+	return d.Kernel
+}
+
+// Bootstrap the base system.
+func (d Debootstrap) InstallFileSystem(c *Config, kill chan bool) error {
+	args := []string{"--variant=minbase"}
+	if len(d.Include) > 0 {
+		args = append(args, "--include="+strings.Join(d.Include, ","))
+	}
+	args = append(args, d.Suite, c.Root.Dir)
+	if d.Mirror != "" {
+		args = append(args, d.Mirror)
+	}
+	if err := run(exec.Command("debootstrap", args...), kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Install the kernel, initramfs-tools and configured packages.
+func (d Debootstrap) InstallSystem(c *Config, kill chan bool) error {
+	if c.Swap != nil && c.Swap.Encrypt {
+		return errDebianEncryptedSwap
+	}
+
+	pkgs := []string{d.kernel(), "initramfs-tools", "systemd-sysv"}
+	if c.Root.Password != "" {
+		pkgs = append(pkgs, "cryptsetup-initramfs")
+	}
+	if c.Root.FSType == Btrfs {
+		pkgs = append(pkgs, "btrfs-progs")
+	}
+	pkgs = append(pkgs, c.Packages...)
+
+	args := []string{"/usr/bin/apt-get", "install", "--yes", "--no-install-recommends"}
+	cmd := c.targetCmd([]string{"DEBIAN_FRONTEND=noninteractive"}, append(args, pkgs...)...)
+	if err := run(cmd, kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Generate the crypttab and initramfs-tools configuration, regenerate the
+// initramfs, and copy the kernel and initramfs into the ESP.
+func (d Debootstrap) PostInstall(c *Config, kill chan bool) error {
+	if err := c.genCrypttab(); err != nil {
+		return err
+	}
+	if err := d.genInitramfsConf(c); err != nil {
+		return err
+	}
+
+	vendor := c.vendorDir()
+	if err := mkdirAll(filepath.Join(c.Root.Dir, vendor), os.FileMode(0o755)); err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		{"/usr/sbin/update-initramfs", "-u", "-k", "all"},
+		{"/usr/bin/cp", "/vmlinuz", filepath.Join(vendor, "vmlinuz.efi")},
+		{"/usr/bin/cp", "/initrd.img", filepath.Join(vendor, "initrd.img")},
+	}
+	for _, cmd := range cmds {
+		if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generate the initramfs-tools configuration for resuming from swap.
+func (Debootstrap) genInitramfsConf(c *Config) error {
+	if c.Swap == nil {
+		return nil
+	}
+	dir := filepath.Join(c.Root.Dir, "etc", "initramfs-tools", "conf.d")
+	return writeFile(
+		filepath.Join(dir, "resume"),
+		[]byte("RESUME="+c.Swap.fsDev()+"\n"),
+		os.FileMode(0o644),
+	)
+}
@@ -0,0 +1,89 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The kind of storage a disk is, which decides the mount options.
+type DiskKind string
+
+const (
+	DiskHDD  DiskKind = "hdd"
+	DiskSSD  DiskKind = "ssd"
+	DiskNVMe DiskKind = "nvme"
+)
+
+// Detect the kind of the disk, like /dev/sda or a link to it, from what the
+// kernel reports in sysfs.
+func DetectDiskKind(disk string) (DiskKind, error) {
+	dev, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(dev)
+	if strings.HasPrefix(name, "nvme") {
+		return DiskNVMe, nil
+	}
+	// partitions don't have a queue, their parent does
+	queue := filepath.Join("/sys/class/block", name, "queue")
+	if _, err := os.Stat(queue); os.IsNotExist(err) {
+		queue = filepath.Join("/sys/class/block", name, "..", "queue")
+	}
+	b, err := os.ReadFile(filepath.Join(queue, "rotational"))
+	if err != nil {
+		return "", fmt.Errorf("summon: detecting the kind of %s: %w", disk, err)
+	}
+	if strings.TrimSpace(string(b)) == "1" {
+		return DiskHDD, nil
+	}
+	return DiskSSD, nil
+}
+
+// The configured Config.DiskKind, or the detected one.
+func (c *Config) diskKind() (DiskKind, error) {
+	switch c.DiskKind {
+	case DiskHDD, DiskSSD, DiskNVMe:
+		return c.DiskKind, nil
+	case "":
+	default:
+		return "", fmt.Errorf("summon: unknown disk kind %q", c.DiskKind)
+	}
+	if c.Disk == "" {
+		return "", nil
+	}
+	kind, err := DetectDiskKind(c.Disk)
+	if err != nil {
+		return "", err
+	}
+	c.DiskKind = kind
+	return kind, nil
+}
+
+// The mount options of the root file system, without the subvolume. Solid
+// state disks are trimmed in the background by btrfs, while spinning disks
+// get none of the SSD flags. A Config.Commit sets the interval in seconds
+// between writing out data and metadata.
+func (c *Config) rootMountOptions() (string, error) {
+	opts := []string{MountNoatime}
+	if c.Root.FSType == Btrfs {
+		opts = append(opts, MountCompressLZO)
+		kind, err := c.diskKind()
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case DiskSSD, DiskNVMe:
+			opts = append(opts, "ssd", "discard=async")
+		case DiskHDD:
+			opts = append(opts, "nossd")
+		}
+	}
+	if c.Commit > 0 {
+		opts = append(opts, "commit="+strconv.Itoa(c.Commit))
+	}
+	return strings.Join(opts, ","), nil
+}
@@ -0,0 +1,92 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Dotfiles for a user, from a git repository or a local directory. A
+// directory is copied into the home. A repository is checked out into the
+// home, with the git directory in .git, or in GitDir for a bare repository
+// setup where the home isn't a normal working tree.
+type Dotfiles struct {
+	Repo   string
+	Ref    string
+	Bare   bool
+	GitDir string
+}
+
+const defaultDotfilesGitDir = ".dotfiles"
+
+// Deploy the Dotfiles of the Users into their homes in the target, owned by
+// them. Files from the home skeleton are replaced by the ones in the
+// dotfiles. Repositories are cloned on the host, so git isn't needed in the
+// target.
+func (c *Config) InstallDotfiles(kill chan bool) error {
+	users, err := c.targetUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range c.Users {
+		if u.Dotfiles == nil {
+			continue
+		}
+		entry, ok := users[u.Name]
+		if !ok {
+			return fmt.Errorf("user %s does not exist in %s", u.Name, c.Root.Dir)
+		}
+		home := filepath.Join(c.Root.Dir, entry.Home)
+		if err := u.Dotfiles.install(home, kill); err != nil {
+			return err
+		}
+		owner := fmt.Sprintf("%d:%d", entry.UID, entry.GID)
+		if err := run(exec.Command("chown", "-R", "-h", owner, "--", home), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dotfiles) install(home string, kill chan bool) error {
+	if info, err := os.Stat(d.Repo); err == nil && info.IsDir() {
+		if _, err := os.Stat(filepath.Join(d.Repo, ".git")); os.IsNotExist(err) {
+			return run(exec.Command("cp", "-a", "--", d.Repo+"/.", home), kill)
+		}
+	}
+
+	gitDir := filepath.Join(home, ".git")
+	if d.Bare {
+		gitDir = filepath.Join(home, defaultDotfilesGitDir)
+		if d.GitDir != "" {
+			gitDir = filepath.Join(home, d.GitDir)
+		}
+	}
+	clone := []string{"clone", "--bare"}
+	if d.Ref != "" {
+		clone = append(clone, "--branch", d.Ref)
+	}
+	if err := run(exec.Command("git", append(clone, "--", d.Repo, gitDir)...), kill); err != nil {
+		return err
+	}
+
+	git := func(args ...string) error {
+		return run(exec.Command("git", append([]string{"--git-dir", gitDir, "--work-tree", home}, args...)...), kill)
+	}
+	cmds := [][]string{
+		{"config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"},
+		{"checkout", "--force"},
+	}
+	if d.Bare {
+		cmds = append(cmds, []string{"config", "status.showUntrackedFiles", "no"})
+	} else {
+		cmds = append(cmds, []string{"config", "--bool", "core.bare", "false"})
+	}
+	for _, args := range cmds {
+		if err := git(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package system
+
+import "fmt"
+
+// The root partition type GUIDs of the Discoverable Partitions Specification,
+// by target architecture. The ESP and swap types are already the ones the
+// specification uses.
+var dpsRootTypes = map[string]string{
+	"x86_64":  "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+	"aarch64": "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+	"armv7h":  "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+	"riscv64": "72EC70A6-CF74-40E6-BD49-4BDA08E8F224",
+}
+
+// The home partition type of the specification.
+const dpsHomeType = "8302"
+
+// The root partition type for the target architecture.
+func (c *Config) dpsRootType() (string, error) {
+	arch := c.targetArch()
+	t, ok := dpsRootTypes[arch]
+	if !ok {
+		return "", fmt.Errorf("summon: no discoverable root partition type for %s", arch)
+	}
+	return t, nil
+}
+
+// With Config.DPS, the ESP is only mounted by systemd-gpt-auto-generator at
+// /efi or /boot.
+func (c *Config) dpsESP() bool {
+	esp := c.espPath()
+	return c.DPS && (esp == "/efi" || esp == "/boot")
+}
+
+// Swap on the root disk is found by systemd-gpt-auto-generator, unless it is
+// encrypted with a key from the root, or has a priority the generator can't
+// set.
+func (c *Config) dpsSwap() bool {
+	return c.DPS && c.Swap != nil && c.Swap.Disk == "" && !c.Swap.Encrypt && c.Swap.Priority == 0
+}
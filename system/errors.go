@@ -0,0 +1,67 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// Conditions orchestration code may want to handle, like by prompting for
+// the passphrase again. Failed commands are matched using errors.Is, while
+// errors.As still finds the *summon.CommandError.
+var (
+	ErrDeviceNotFound = errors.New("summon: device not found")
+	ErrUnknownFS      = errors.New("summon: unknown file system")
+	ErrAlreadyMounted = errors.New("summon: already mounted")
+	ErrBusy           = errors.New("summon: device or mount point is busy")
+	ErrBadPassphrase  = errors.New("summon: no LUKS key slot matches the passphrase")
+)
+
+// The condition for a failed command, based on its exit code and messages.
+func commandCondition(e *summon.CommandError) error {
+	if len(e.Args) == 0 {
+		return nil
+	}
+	stderr := string(e.Stderr)
+	switch path.Base(e.Args[0]) {
+	case "cryptsetup":
+		switch e.ExitCode {
+		case 2:
+			return ErrBadPassphrase
+		case 4:
+			return ErrDeviceNotFound
+		case 5:
+			return ErrBusy
+		}
+	case "mount", "umount":
+		switch {
+		case strings.Contains(stderr, "already mounted"):
+			return ErrAlreadyMounted
+		case strings.Contains(stderr, "unknown filesystem type"):
+			return ErrUnknownFS
+		case strings.Contains(stderr, "target is busy"):
+			return ErrBusy
+		case strings.Contains(stderr, "does not exist"):
+			return ErrDeviceNotFound
+		}
+	}
+	if strings.Contains(stderr, "No such device") || strings.Contains(stderr, "not a block device") {
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// Wrap a command error with the condition, if it's a known one.
+func withCondition(err error) error {
+	var e *summon.CommandError
+	if !errors.As(err, &e) {
+		return err
+	}
+	if cond := commandCondition(e); cond != nil {
+		return fmt.Errorf("%w: %w", cond, err)
+	}
+	return err
+}
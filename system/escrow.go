@@ -0,0 +1,148 @@
+package system
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+var errNoEscrow = errors.New("summon: generated passwords require an escrow")
+
+// Generated passphrases use groups of characters which can't be confused when
+// read back, giving 200 bits of entropy.
+const (
+	passphraseAlphabet = "23456789abcdefghijkmnpqrstuvwxyz"
+	passphraseGroups   = 8
+	passphraseGroupLen = 5
+)
+
+// An Escrow keeps a copy of a generated passphrase, so it can be recovered
+// by whoever has access to the escrow.
+type Escrow interface {
+	Store(name, passphrase string) error
+}
+
+// FileEscrow writes each passphrase to a new file named after it in the Dir,
+// like a directory on removable media. Existing files are never replaced.
+type FileEscrow struct {
+	Dir string
+}
+
+func (e FileEscrow) Store(name, passphrase string) error {
+	f, err := os.OpenFile(
+		filepath.Join(e.Dir, name+".txt"),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		os.FileMode(0o400),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(passphrase + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	// the media may be removed right after
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PassEscrow inserts each passphrase into pass, or a compatible password
+// store like gopass, as the entry Prefix/name.
+type PassEscrow struct {
+	Command string
+	Prefix  string
+}
+
+func (e PassEscrow) Store(name, passphrase string) error {
+	command := e.Command
+	if command == "" {
+		command = "pass"
+	}
+	cmd := exec.Command(command, "insert", "--multiline", filepath.Join(e.Prefix, name))
+	cmd.Stdin = strings.NewReader(passphrase + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("summon: %s insert %s: %v\n%s", command, name, err, out)
+	}
+	return nil
+}
+
+// PrintEscrow prints each passphrase to the terminal, once, for it to be
+// written down.
+type PrintEscrow struct{}
+
+func (PrintEscrow) Store(name, passphrase string) error {
+	_, err := fmt.Fprintf(os.Stderr, "%s passphrase, write it down now: %s\n", name, passphrase)
+	return err
+}
+
+// Parse an escrow reference like file:/media/usb, pass:machines, gopass:
+// or print:, in the same form as secret references.
+func ParseEscrow(uri string) (Escrow, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, errSecretURI
+	}
+	switch scheme {
+	case "file":
+		return FileEscrow{Dir: rest}, nil
+	case "pass", "gopass":
+		return PassEscrow{Command: scheme, Prefix: rest}, nil
+	case "print":
+		return PrintEscrow{}, nil
+	}
+	return nil, fmt.Errorf("summon: unknown escrow %q", scheme)
+}
+
+// Generate a random passphrase, like 7hq2m-x9kcd-....
+func GeneratePassphrase() (string, error) {
+	max := big.NewInt(int64(len(passphraseAlphabet)))
+	groups := make([]string, passphraseGroups)
+	for i := range groups {
+		group := make([]byte, passphraseGroupLen)
+		for j := range group {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			group[j] = passphraseAlphabet[n.Int64()]
+		}
+		groups[i] = string(group)
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// Generate a random root disk password when the step runs, unless one is
+// already set. It is stored in each of the escrows before being used, so
+// the disk is never formatted with a passphrase nobody has.
+func (c *Config) GenerateDiskPassword(escrows ...Escrow) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if c.Root.Password != "" {
+			return nil
+		}
+		if len(escrows) == 0 {
+			return errNoEscrow
+		}
+		pass, err := GeneratePassphrase()
+		if err != nil {
+			return err
+		}
+		for _, e := range escrows {
+			if err := e.Store(c.Root.Name, pass); err != nil {
+				return err
+			}
+		}
+		summon.AddSecret(pass)
+		c.Root.Password = pass
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How /etc in the target is kept in version control.
+type EtcGit string
+
+const (
+	// A plain git repository, which requires git in the target.
+	EtcGitPlain EtcGit = "git"
+	// Using etckeeper, which also records the metadata git doesn't, and
+	// requires etckeeper in the target.
+	EtcGitEtckeeper EtcGit = "etckeeper"
+)
+
+const etcCommitMessage = "summon: configuration as installed"
+
+// Initialize the repository for /etc in the target, if it isn't already, and
+// commit the configuration as generated, so later changes on the machine can
+// be tracked. It should run after everything in /etc has been generated.
+func (c *Config) CommitEtc(kill chan bool) error {
+	switch c.EtcGit {
+	case "":
+		return nil
+	case EtcGitEtckeeper:
+		// etckeeper only commits when there are changes
+		for _, args := range [][]string{
+			{"/usr/bin/etckeeper", "init"},
+			{"/usr/bin/etckeeper", "commit", etcCommitMessage},
+		} {
+			if err := run(c.targetCmd(nil, args...), kill); err != nil {
+				return err
+			}
+		}
+		return nil
+	case EtcGitPlain:
+	default:
+		return fmt.Errorf("summon: unknown /etc version control %q", c.EtcGit)
+	}
+
+	git := func(args ...string) []string {
+		return append([]string{"/usr/bin/git", "-C", "/etc"}, args...)
+	}
+	if err := run(c.targetCmd(nil, git("init", "--quiet")...), kill); err != nil {
+		return err
+	}
+	// the shadow files are in the history too
+	if err := chmod(filepath.Join(c.Root.Dir, "etc", ".git"), os.FileMode(0o700)); err != nil {
+		return err
+	}
+	if err := run(c.targetCmd(nil, git("add", "--all")...), kill); err != nil {
+		return err
+	}
+	status, err := output(c.targetCmd(nil, git("status", "--porcelain")...), kill)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(status)) == "" {
+		return nil
+	}
+	commit := git(
+		"-c", "user.name=summon",
+		"-c", "user.email=root@"+c.Name,
+		"commit", "--quiet", "--message", etcCommitMessage,
+	)
+	return run(c.targetCmd(nil, commit...), kill)
+}
@@ -0,0 +1,179 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+var errFedoraRelease = errors.New("summon: the Fedora installer requires a release")
+
+// Fedora installs Fedora using dnf --installroot. The Release is required, and
+// is used as the releasever. The Config.Packages are installed along with the
+// core group and kernel. Boot entries are generated by kernel-install
+// following the Boot Loader Specification, and booted by systemd-boot.
+//
+// The host usually isn't Fedora, so packages come from the Fedora mirrors
+// instead of the repositories of the host, or from the .repo files in the
+// Repos directory on the host, like for a local mirror.
+type Fedora struct {
+	Release string
+	Repos   string
+}
+
+func (Fedora) EFIVendor() string {
+	return "fedora"
+}
+
+// dracut unlocks the encrypted root based on the generated crypttab.
+func (Fedora) KernelParams(c *Config) []string {
+	return nil
+}
+
+// The repositories used during the install, until the target has its own
+// from fedora-repos. The keys are fetched along with the metadata, since the
+// host doesn't have them.
+const fedoraRepos = `[fedora]
+name=Fedora $releasever - $basearch
+metalink=https://mirrors.fedoraproject.org/metalink?repo=fedora-$releasever&arch=$basearch
+gpgcheck=1
+gpgkey=https://fedoraproject.org/fedora.gpg
+
+[updates]
+name=Fedora $releasever - $basearch - Updates
+metalink=https://mirrors.fedoraproject.org/metalink?repo=updates-released-f$releasever&arch=$basearch
+gpgcheck=1
+gpgkey=https://fedoraproject.org/fedora.gpg
+`
+
+// Where the repositories for the install are written, in the target so they
+// are next to it with --remote.
+func (Fedora) bootstrapRepos(c *Config) string {
+	return filepath.Join(c.Root.Dir, "var", "tmp", "summon-repos")
+}
+
+// The reposdir for the install.
+func (f Fedora) reposDir(c *Config) string {
+	if f.Repos != "" {
+		return f.Repos
+	}
+	return f.bootstrapRepos(c)
+}
+
+func (f Fedora) dnf(c *Config, args ...string) *exec.Cmd {
+	base := []string{
+		"--installroot", c.Root.Dir,
+		"--releasever", f.Release,
+		"--setopt=reposdir=" + f.reposDir(c),
+		"--assumeyes",
+		"--setopt=install_weak_deps=False",
+	}
+	return exec.Command("dnf", append(base, args...)...)
+}
+
+// Install the filesystem and setup packages, along with the release package
+// and the repositories the target uses once installed.
+func (f Fedora) InstallFileSystem(c *Config, kill chan bool) error {
+	if f.Release == "" {
+		return errFedoraRelease
+	}
+	if f.Repos == "" {
+		name := filepath.Join(f.bootstrapRepos(c), "fedora.repo")
+		if err := writeFile(name, []byte(fedoraRepos), os.FileMode(0o644)); err != nil {
+			return err
+		}
+	}
+	if err := run(f.dnf(c, "install", "filesystem", "setup", "fedora-release", "fedora-repos"), kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Install the core group, kernel, systemd-boot and configured packages. The
+// kernel-install configuration is generated first, so the kernel package
+// creates the boot entries on the ESP.
+func (f Fedora) InstallSystem(c *Config, kill chan bool) error {
+	if err := f.genKernelInstallConf(c); err != nil {
+		return err
+	}
+	if err := c.genCrypttab(); err != nil {
+		return err
+	}
+
+	if err := run(f.dnf(c, "group", "install", "core"), kill); err != nil {
+		return err
+	}
+	pkgs := []string{"kernel", "systemd-boot-unsigned"}
+	if c.Root.Password != "" {
+		pkgs = append(pkgs, "cryptsetup")
+	}
+	if c.Root.FSType == Btrfs {
+		pkgs = append(pkgs, "btrfs-progs")
+	}
+	pkgs = append(pkgs, c.Packages...)
+	if err := run(f.dnf(c, append([]string{"install"}, pkgs...)...), kill); err != nil {
+		return err
+	}
+	if f.Repos != "" {
+		return nil
+	}
+	return run(exec.Command("rm", "-rf", f.bootstrapRepos(c)), kill)
+}
+
+// Generate /etc/kernel/install.conf and /etc/kernel/cmdline.
+func (Fedora) genKernelInstallConf(c *Config) error {
+	dir := filepath.Join(c.Root.Dir, "etc", "kernel")
+	err := writeFile(
+		filepath.Join(dir, "install.conf"),
+		[]byte("layout=bls\n"),
+		os.FileMode(0o644),
+	)
+	if err != nil {
+		return err
+	}
+	return writeFile(
+		filepath.Join(dir, "cmdline"),
+		[]byte(c.kernelOptions()+"\n"),
+		os.FileMode(0o644),
+	)
+}
+
+// Install systemd-boot, regenerate the initramfs and boot entries for all
+// installed kernels, and schedule a SELinux relabel on first boot. The boot
+// entry is only added to the EFI variables when booted with UEFI.
+func (Fedora) PostInstall(c *Config, kill chan bool) error {
+	r := c.Root.Dir
+	bootctl := []string{"/usr/bin/bootctl", "install", "--esp-path=" + c.espPath()}
+	if !c.efiVariables() {
+		bootctl = append(bootctl, "--no-variables")
+	}
+	cmds := [][]string{
+		{"/usr/bin/systemd-machine-id-setup"},
+		bootctl,
+		{"/usr/bin/dracut", "--regenerate-all", "--force"},
+	}
+
+	kernels, err := readDirNames(filepath.Join(r, "lib", "modules"))
+	if err != nil {
+		return err
+	}
+	for _, k := range kernels {
+		vmlinuz := filepath.Join("/lib/modules", k, "vmlinuz")
+		cmds = append(cmds, []string{"/usr/bin/kernel-install", "add", k, vmlinuz})
+	}
+
+	for _, cmd := range cmds {
+		cmd := c.targetCmd([]string{"BOOT_ROOT=" + c.espPath()}, cmd...)
+		if err := run(cmd, kill); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filepath.Join(r, ".autorelabel"), nil, os.FileMode(0o644))
+}
+
+// systemd-boot and the boot entries of kernel-install.
+func (Fedora) BootFiles(c *Config) []string {
+	return []string{"EFI/systemd/systemd-boot*.efi", "loader/entries/*.conf"}
+}
@@ -0,0 +1,270 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// A TargetFile is a file rendered into the target from the Contents, a
+// text/template executed with the Config, and the Vars as .Vars. The Mode
+// defaults to 0644, and the Owner, as user or user:group, to root.
+type TargetFile struct {
+	Path     string
+	Contents string
+	Mode     os.FileMode
+	Owner    string
+	Vars     map[string]any
+}
+
+// A TargetDir is a directory in the target, with the Mode defaulting to 0755
+// and the Owner to root.
+type TargetDir struct {
+	Path  string
+	Mode  os.FileMode
+	Owner string
+}
+
+// A TargetLink is a symlink in the target at Path pointing to Target, like
+// /etc/resolv.conf to /run/systemd/resolve/stub-resolv.conf.
+type TargetLink struct {
+	Path   string
+	Target string
+}
+
+// A Manifest of what to create in the target, applied with the directories
+// first and the files last. Files changed in the target since they were last
+// written are left alone, unless Overwrite is set.
+type Manifest struct {
+	Dirs      []TargetDir
+	Links     []TargetLink
+	Files     []TargetFile
+	Overwrite bool
+}
+
+// Read a JSON Manifest, where the Modes are decimal values.
+func ReadManifest(name string) (*Manifest, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("summon: invalid manifest %s: %v", name, err)
+	}
+	return &m, nil
+}
+
+// Where the hashes of the files last written from the Manifest are kept in
+// the target, to detect files changed since.
+const manifestState = "/var/lib/summon/manifest.json"
+
+// The data the file templates are executed with.
+type fileData struct {
+	*Config
+	Vars map[string]any
+}
+
+func (f TargetFile) render(c *Config) ([]byte, error) {
+	t, err := template.New(f.Path).Option("missingkey=error").Parse(f.Contents)
+	if err != nil {
+		return nil, fmt.Errorf("summon: template for %s: %w", f.Path, err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, fileData{Config: c, Vars: f.Vars}); err != nil {
+		return nil, fmt.Errorf("summon: template for %s: %w", f.Path, err)
+	}
+	return []byte(b.String()), nil
+}
+
+func hashContents(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// The groups which exist in the target, by name.
+func (c *Config) targetGroups() (map[string]int, error) {
+	group, err := readFile(filepath.Join(c.Root.Dir, "etc", "group"))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := map[string]int{}
+	s := bufio.NewScanner(bytes.NewReader(group))
+	for s.Scan() {
+		// name:password:gid:members
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) != 4 {
+			continue
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		groups[fields[0]] = gid
+	}
+	return groups, s.Err()
+}
+
+// The uid and gid for an owner like user or user:group in the target, with
+// the primary group of the user if there is no group.
+func (c *Config) targetOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return 0, 0, nil
+	}
+	users, err := c.targetUsers()
+	if err != nil {
+		return 0, 0, err
+	}
+	name, group, hasGroup := strings.Cut(owner, ":")
+	u, ok := users[name]
+	if !ok {
+		return 0, 0, fmt.Errorf("summon: user %s does not exist in %s", name, c.Root.Dir)
+	}
+	if !hasGroup {
+		return u.UID, u.GID, nil
+	}
+	groups, err := c.targetGroups()
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, ok := groups[group]
+	if !ok {
+		return 0, 0, fmt.Errorf("summon: group %s does not exist in %s", group, c.Root.Dir)
+	}
+	return u.UID, gid, nil
+}
+
+func (c *Config) readManifestState() (map[string]string, error) {
+	state := map[string]string{}
+	b, err := readFile(filepath.Join(c.Root.Dir, manifestState))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("summon: reading %s: %w", manifestState, err)
+	}
+	return state, nil
+}
+
+// Make the symlink at name in the target, replacing whatever is there unless
+// it already points to target.
+func (c *Config) targetSymlink(target, name string) error {
+	link := filepath.Join(c.Root.Dir, name)
+	if current, err := readlink(link); err == nil && current == target {
+		return nil
+	}
+	if err := remove(link); err != nil {
+		return err
+	}
+	if err := mkdirAll(filepath.Dir(link), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return symlink(target, link)
+}
+
+func (c *Config) installDirs() error {
+	for _, d := range c.Manifest.Dirs {
+		mode := d.Mode
+		if mode == 0 {
+			mode = os.FileMode(0o755)
+		}
+		uid, gid, err := c.targetOwner(d.Owner)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(c.Root.Dir, d.Path)
+		if err := mkdirAll(dir, mode); err != nil {
+			return err
+		}
+		if err := chmod(dir, mode); err != nil {
+			return err
+		}
+		if err := lchown(dir, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the Manifest to the target. Directories and links are made to match
+// on every run. On later runs, files changed in the target since they were
+// written are reported as an error once the others are written, and are only
+// replaced with Overwrite.
+func (c *Config) InstallManifest(kill chan bool) error {
+	if c.Manifest == nil {
+		return nil
+	}
+	if err := c.installDirs(); err != nil {
+		return err
+	}
+	for _, l := range c.Manifest.Links {
+		if err := c.targetSymlink(l.Target, l.Path); err != nil {
+			return err
+		}
+	}
+	state, err := c.readManifestState()
+	if err != nil {
+		return err
+	}
+	var drifted []string
+	for _, f := range c.Manifest.Files {
+		contents, err := f.render(c)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(c.Root.Dir, f.Path)
+		if last, ok := state[f.Path]; ok && !c.Manifest.Overwrite {
+			current, err := readFile(name)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil && hashContents(current) != last && hashContents(current) != hashContents(contents) {
+				drifted = append(drifted, f.Path)
+				continue
+			}
+		}
+		mode := f.Mode
+		if mode == 0 {
+			mode = os.FileMode(0o644)
+		}
+		uid, gid, err := c.targetOwner(f.Owner)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(name, contents, mode); err != nil {
+			return err
+		}
+		// the mode of an existing file isn't changed by writing it
+		if err := chmod(name, mode); err != nil {
+			return err
+		}
+		if err := lchown(name, uid, gid); err != nil {
+			return err
+		}
+		state[f.Path] = hashContents(contents)
+	}
+
+	j, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := c.writeTargetFile(manifestState, string(j)+"\n", os.FileMode(0o600)); err != nil {
+		return err
+	}
+	if len(drifted) > 0 {
+		return fmt.Errorf("summon: changed in the target since they were written, and not replaced without Overwrite: %s", strings.Join(drifted, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package system
+
+import "os"
+
+// How the machine running summon was booted.
+type Firmware string
+
+const (
+	FirmwareUEFI Firmware = "uefi"
+	FirmwareBIOS Firmware = "bios"
+)
+
+// Detect the firmware the live environment was booted with, which the kernel
+// only exposes in sysfs for UEFI.
+func DetectFirmware() Firmware {
+	if _, err := os.Stat("/sys/firmware/efi"); err == nil {
+		return FirmwareUEFI
+	}
+	return FirmwareBIOS
+}
+
+// Whether boot entries can be registered in the EFI variables, which is only
+// when installing to a disk of this machine booted with UEFI. An unset
+// Config.Firmware is treated as unknown.
+func (c *Config) efiVariables() bool {
+	return c.Firmware == FirmwareUEFI && c.Image == nil
+}
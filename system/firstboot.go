@@ -0,0 +1,71 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errFirstBootWithoutSystemd = errors.New("summon: first boot scripts require systemd")
+
+const (
+	firstBootUnit = "summon-first-boot.service"
+	firstBootDir  = "/var/lib/summon/first-boot"
+)
+
+func firstBootService(scripts []string) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=summon first boot setup\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	fmt.Fprintf(&b, "ConditionPathIsDirectory=%s\n", firstBootDir)
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=oneshot\n")
+	for _, s := range scripts {
+		fmt.Fprintf(&b, "ExecStart=%s\n", s)
+	}
+	fmt.Fprintf(&b, "ExecStartPost=/usr/bin/systemctl disable %s\n", firstBootUnit)
+	fmt.Fprintf(&b, "ExecStartPost=/usr/bin/rm -rf %s\n", firstBootDir)
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// Install the FirstBoot scripts, along with a oneshot service which runs them
+// in order on the first boot and then disables itself. This is for steps which
+// can't be done inside the target during the install, like enrolling the TPM
+// of the actual hardware. If a script fails, it will be retried on the next
+// boot.
+func (c *Config) GenFirstBoot(kill chan bool) error {
+	if len(c.FirstBoot) == 0 {
+		return nil
+	}
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return errFirstBootWithoutSystemd
+	}
+
+	dir := filepath.Join(c.Root.Dir, firstBootDir)
+	if err := mkdirAll(dir, os.FileMode(0o700)); err != nil {
+		return err
+	}
+	var scripts []string
+	for i, s := range c.FirstBoot {
+		name := path.Join(firstBootDir, fmt.Sprintf("%02d.sh", 10+i))
+		err := writeFile(filepath.Join(c.Root.Dir, name), []byte(s), os.FileMode(0o700))
+		if err != nil {
+			return err
+		}
+		scripts = append(scripts, name)
+	}
+
+	unit := filepath.Join(c.Root.Dir, "etc", "systemd", "system", firstBootUnit)
+	err := writeFile(unit, []byte(firstBootService(scripts)), os.FileMode(0o644))
+	if err != nil {
+		return err
+	}
+	return c.enableService(firstBootUnit, kill)
+}
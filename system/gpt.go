@@ -0,0 +1,382 @@
+package system
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/daaku/summon"
+	"golang.org/x/sys/unix"
+)
+
+// The partition type GUIDs for the sgdisk typecodes, including the roots and
+// home of the Discoverable Partitions Specification found by
+// systemd-gpt-auto-generator.
+var gptTypes = map[string]string{
+	"ef00": "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"af00": "48465300-0000-11AA-AA11-00306543ECAC",
+	"ab00": "426F6F74-0000-11AA-AA11-00306543ECAC",
+	"8200": "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+	"8300": "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+	"8302": "933AC7E1-2EB4-4F13-B844-0E14E2AEF915",
+	"8304": "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+	"8305": "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+}
+
+// The type GUID for a typecode, which may also be a GUID itself.
+func partitionType(code string) (string, error) {
+	if t, ok := gptTypes[strings.ToLower(code)]; ok {
+		return t, nil
+	}
+	if _, err := encodeGUID(code); err != nil {
+		return "", fmt.Errorf("summon: unknown partition type %q", code)
+	}
+	return strings.ToUpper(code), nil
+}
+
+// The MBR types for partitions in a hybrid MBR.
+var mbrTypes = map[string]byte{
+	"af00": 0xaf,
+	"ab00": 0xab,
+	"8300": 0x83,
+}
+
+const (
+	gptEntries   = 128
+	gptEntrySize = 128
+	gptAlign     = 1 << 20
+)
+
+var errNativeGPTRemote = errors.New("summon: the GPT can only be written directly for local installs, use sgdisk instead")
+
+// GPT configures writing the partition table directly, instead of using
+// sgdisk, for environments without gptfdisk like a minimal initramfs. It
+// isn't supported for remote installs.
+type GPT struct {
+	// Partition alignment in bytes, 1MiB by default.
+	Align int64
+	// The disk GUID, random if not set.
+	DiskGUID string
+}
+
+// A partition in the layout, with a Size of zero using the rest of the disk.
+// The Typecode may also be a type GUID, and the GUID is random if not set.
+// Hybrid partitions are also in the MBR.
+type gptPartition struct {
+	Size     int64
+	Typecode string
+	Name     string
+	GUID     string
+	Hybrid   bool
+}
+
+// The numbers of the hybrid partitions, for sgdisk --hybrid.
+func hybridPartitions(parts []gptPartition) []string {
+	var nums []string
+	for i, p := range parts {
+		if p.Hybrid {
+			nums = append(nums, fmt.Sprint(i+1))
+		}
+	}
+	return nums
+}
+
+// The sgdisk arguments for the layout, starting with the partition number n.
+func (p gptPartition) sgdiskArgs(n int) []string {
+	size := "0"
+	if p.Size > 0 {
+		size = fmt.Sprintf("+%dM", p.Size>>20)
+	}
+	args := []string{
+		"--new", fmt.Sprintf("%d:0:%s", n, size),
+		"--typecode", fmt.Sprintf("%d:%s", n, p.Typecode),
+		"--change-name", fmt.Sprintf("%d:%s", n, p.Name),
+	}
+	if p.GUID != "" {
+		args = append(args, "--partition-guid", fmt.Sprintf("%d:%s", n, p.GUID))
+	}
+	return args
+}
+
+// Encode the GUID in the mixed endian form used on disk.
+func encodeGUID(s string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return nil, fmt.Errorf("summon: invalid GUID %q", s)
+	}
+	b := make([]byte, 16)
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(b[8:], raw[8:])
+	return b, nil
+}
+
+// A GUID from the configured string, or a random one.
+func gptGUID(s string) ([]byte, error) {
+	if s != "" {
+		return encodeGUID(s)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[7] = b[7]&0x0f | 0x40 // version 4, in the little endian field
+	b[8] = b[8]&0x3f | 0x80
+	return b, nil
+}
+
+// The logical sector size and total size of the disk, which may also be an
+// image file.
+func diskGeometry(f *os.File) (int64, int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	sector, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET)
+	if err != nil {
+		sector = 512
+	}
+	return int64(sector), size, nil
+}
+
+// Build the protective MBR, the partition entries and the primary and backup
+// headers, returning the writes by byte offset.
+func (g *GPT) layout(parts []gptPartition, sector, size int64) (map[int64][]byte, error) {
+	align := g.Align
+	if align <= 0 {
+		align = gptAlign
+	}
+	if align%sector != 0 {
+		return nil, fmt.Errorf("summon: GPT alignment %d is not a multiple of the %d byte sectors", align, sector)
+	}
+	lastLBA := size/sector - 1
+	entrySectors := int64(gptEntries*gptEntrySize) / sector
+	firstUsable := 2 + entrySectors
+	lastUsable := lastLBA - 1 - entrySectors
+	alignLBA := align / sector
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	mbr := make([]byte, sector)
+	var hybrids [][3]int64 // type, start and end
+	next := firstUsable
+	for i, p := range parts {
+		typ, err := partitionType(p.Typecode)
+		if err != nil {
+			return nil, err
+		}
+		start := (next + alignLBA - 1) / alignLBA * alignLBA
+		end := lastUsable
+		if p.Size > 0 {
+			end = start + p.Size/sector - 1
+		}
+		if end > lastUsable || end < start {
+			return nil, fmt.Errorf("summon: partition %s does not fit on the disk", p.Name)
+		}
+		next = end + 1
+		if p.Hybrid {
+			t, ok := mbrTypes[strings.ToLower(p.Typecode)]
+			if !ok || end > 0xffffffff || len(hybrids) == 3 {
+				return nil, fmt.Errorf("summon: partition %s can not be in the hybrid MBR", p.Name)
+			}
+			hybrids = append(hybrids, [3]int64{int64(t), start, end})
+		}
+
+		e := entries[i*gptEntrySize:]
+		t, err := encodeGUID(typ)
+		if err != nil {
+			return nil, err
+		}
+		id, err := gptGUID(p.GUID)
+		if err != nil {
+			return nil, err
+		}
+		copy(e[0:], t)
+		copy(e[16:], id)
+		binary.LittleEndian.PutUint64(e[32:], uint64(start))
+		binary.LittleEndian.PutUint64(e[40:], uint64(end))
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return nil, fmt.Errorf("summon: partition name %q is too long", p.Name)
+		}
+		for j, r := range name {
+			binary.LittleEndian.PutUint16(e[56+j*2:], r)
+		}
+	}
+
+	diskGUID, err := gptGUID(g.DiskGUID)
+	if err != nil {
+		return nil, err
+	}
+	header := func(my, alternate, entriesLBA int64) []byte {
+		h := make([]byte, sector)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(my))
+		binary.LittleEndian.PutUint64(h[32:], uint64(alternate))
+		binary.LittleEndian.PutUint64(h[40:], uint64(firstUsable))
+		binary.LittleEndian.PutUint64(h[48:], uint64(lastUsable))
+		copy(h[56:], diskGUID)
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+
+	// a hybrid MBR protects only up to the first hybrid partition, like gdisk
+	pe := mbr[446:]
+	copy(pe[1:], []byte{0x00, 0x02, 0x00, 0xee, 0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(pe[8:], 1)
+	if len(hybrids) > 0 {
+		binary.LittleEndian.PutUint32(pe[12:], uint32(hybrids[0][1]-1))
+	} else {
+		binary.LittleEndian.PutUint32(pe[12:], uint32(min(lastLBA, 0xffffffff)))
+	}
+	for i, h := range hybrids {
+		pe := mbr[446+16*(i+1):]
+		// the CHS addresses are past what they can hold, so LBA is used
+		copy(pe[1:], []byte{0xfe, 0xff, 0xff, byte(h[0]), 0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(pe[8:], uint32(h[1]))
+		binary.LittleEndian.PutUint32(pe[12:], uint32(h[2]-h[1]+1))
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	backupEntries := lastLBA - entrySectors
+	return map[int64][]byte{
+		0:                      mbr,
+		sector:                 header(1, lastLBA, 2),
+		2 * sector:             entries,
+		backupEntries * sector: entries,
+		lastLBA * sector:       header(lastLBA, 1, backupEntries),
+	}, nil
+}
+
+// Write the partitions to the disk, and have the kernel read the new table.
+func (g *GPT) write(disk string, parts []gptPartition) error {
+	if !summon.Local() {
+		return errNativeGPTRemote
+	}
+	f, err := os.OpenFile(disk, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sector, size, err := diskGeometry(f)
+	if err != nil {
+		return err
+	}
+	writes, err := g.layout(parts, sector, size)
+	if err != nil {
+		return err
+	}
+	for off, b := range writes {
+		if _, err := f.WriteAt(b, off); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	// image files don't have a partition table to reread
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.BLKRRPART, 0); err != nil && err != unix.ENOTTY {
+		return fmt.Errorf("summon: rereading the partition table of %s: %w", disk, err)
+	}
+	return nil
+}
+
+// A partition read back from the GPT, with the GUIDs in upper case.
+type gptEntry struct {
+	Type string
+	GUID string
+	Name string
+}
+
+func decodeGUID(b []byte) string {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint32(raw[0:], binary.LittleEndian.Uint32(b[0:]))
+	binary.BigEndian.PutUint16(raw[4:], binary.LittleEndian.Uint16(b[4:]))
+	binary.BigEndian.PutUint16(raw[6:], binary.LittleEndian.Uint16(b[6:]))
+	copy(raw[8:], b[8:16])
+	return strings.ToUpper(formatUUID(raw))
+}
+
+// Read the partitions from the primary GPT of the disk.
+func readGPT(disk string) ([]gptEntry, error) {
+	sector := sectorSize(disk)
+	h, err := readAt(disk, sector, 92)
+	if err != nil {
+		return nil, err
+	}
+	if len(h) != 92 || string(h[:8]) != "EFI PART" {
+		return nil, fmt.Errorf("summon: no GPT on %s", disk)
+	}
+	lba := int64(binary.LittleEndian.Uint64(h[72:]))
+	n := binary.LittleEndian.Uint32(h[80:])
+	size := binary.LittleEndian.Uint32(h[84:])
+	if size < gptEntrySize || int64(size) > sector {
+		return nil, fmt.Errorf("summon: invalid GPT entry size %d on %s", size, disk)
+	}
+	if n > gptEntries {
+		return nil, fmt.Errorf("summon: invalid GPT entry count %d on %s", n, disk)
+	}
+	total := int64(n) * int64(size)
+	entries, err := readAt(disk, lba*sector, total)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(entries)) != total {
+		return nil, fmt.Errorf("summon: truncated GPT on %s", disk)
+	}
+	var parts []gptEntry
+	for i := uint32(0); i < n; i++ {
+		e := entries[i*size:]
+		if binary.LittleEndian.Uint64(e[32:]) == 0 {
+			continue
+		}
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(e[56+j*2:])
+		}
+		parts = append(parts, gptEntry{
+			Type: decodeGUID(e[:16]),
+			GUID: decodeGUID(e[16:32]),
+			Name: strings.TrimRight(string(utf16.Decode(name)), "\x00"),
+		})
+	}
+	return parts, nil
+}
+
+// Check the partitions on the disk have the names and types of the layout.
+func verifyGPT(disk string, parts []gptPartition) error {
+	entries, err := readGPT(disk)
+	if err != nil {
+		return err
+	}
+	if len(entries) != len(parts) {
+		return fmt.Errorf("summon: found %d partitions on %s instead of %d", len(entries), disk, len(parts))
+	}
+	for i, p := range parts {
+		typ, err := partitionType(p.Typecode)
+		if err != nil {
+			return err
+		}
+		if entries[i].Name != p.Name || entries[i].Type != typ {
+			return fmt.Errorf("summon: partition %d on %s is %s of type %s instead of %s of type %s",
+				i+1, disk, entries[i].Name, entries[i].Type, p.Name, typ)
+		}
+		if p.GUID != "" && entries[i].GUID != strings.ToUpper(p.GUID) {
+			return fmt.Errorf("summon: partition %s on %s has the PARTUUID %s instead of %s", p.Name, disk, entries[i].GUID, p.GUID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var errDriversNotArch = errors.New("summon: drivers can only be installed with the Arch installer")
+
+// PCI vendor IDs.
+const (
+	VendorIntel  = "8086"
+	VendorAMD    = "1002"
+	VendorNVIDIA = "10de"
+)
+
+// The hardware found on the machine being installed, which is assumed to be
+// the host.
+type Hardware struct {
+	CPUVendor  string
+	GPUVendors []string
+}
+
+// Detect the CPU vendor from /proc/cpuinfo, and the GPU vendors using lspci.
+func DetectHardware() (*Hardware, error) {
+	var hw Hardware
+
+	cpuinfo, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(cpuinfo))
+	for s.Scan() {
+		k, v, ok := strings.Cut(s.Text(), ":")
+		if !ok || strings.TrimSpace(k) != "vendor_id" {
+			continue
+		}
+		switch strings.TrimSpace(v) {
+		case "GenuineIntel":
+			hw.CPUVendor = VendorIntel
+		case "AuthenticAMD":
+			hw.CPUVendor = VendorAMD
+		}
+		break
+	}
+
+	out, err := output(exec.Command("lspci", "-mm", "-n"), nil)
+	if err != nil {
+		return nil, err
+	}
+	hw.GPUVendors = parseLspciGPUs(out)
+	return &hw, nil
+}
+
+// Parse the vendors of display controllers from lspci -mm -n output, which
+// looks like:
+//
+//	00:02.0 "0300" "8086" "3e92" -r02 "1028" "0869"
+func parseLspciGPUs(out []byte) []string {
+	var vendors []string
+	seen := map[string]bool{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		class := strings.Trim(fields[1], `"`)
+		vendor := strings.Trim(fields[2], `"`)
+		// class 03xx is a display controller
+		if !strings.HasPrefix(class, "03") || seen[vendor] {
+			continue
+		}
+		seen[vendor] = true
+		vendors = append(vendors, vendor)
+	}
+	return vendors
+}
+
+// The Arch packages for the detected hardware. linux-firmware is always
+// included.
+func (hw *Hardware) archPackages() []string {
+	pkgs := []string{"linux-firmware"}
+	switch hw.CPUVendor {
+	case VendorIntel:
+		pkgs = append(pkgs, "intel-ucode")
+	case VendorAMD:
+		pkgs = append(pkgs, "amd-ucode")
+	}
+	mesa := false
+	for _, v := range hw.GPUVendors {
+		switch v {
+		case VendorIntel:
+			mesa = true
+			pkgs = append(pkgs, "vulkan-intel", "intel-media-driver")
+		case VendorAMD:
+			mesa = true
+			pkgs = append(pkgs, "vulkan-radeon", "libva-mesa-driver")
+		case VendorNVIDIA:
+			pkgs = append(pkgs, "nvidia", "nvidia-utils")
+		}
+	}
+	if mesa {
+		pkgs = append(pkgs, "mesa")
+	}
+	return pkgs
+}
+
+// Install GPU drivers, firmware and microcode. If Config.Drivers is set those
+// packages are installed, otherwise they are picked based on the detected
+// hardware. This runs before PostInstall so the initramfs includes the
+// microcode. Offline installs are fully described by their lockfile, so
+// nothing is installed separately.
+func (c *Config) InstallDrivers(kill chan bool) error {
+	if !c.DetectDrivers && len(c.Drivers) == 0 {
+		return nil
+	}
+	if _, ok := c.installer().(Arch); !ok {
+		return errDriversNotArch
+	}
+	if c.Offline != nil {
+		return nil
+	}
+
+	pkgs := c.Drivers
+	if len(pkgs) == 0 {
+		hw, err := DetectHardware()
+		if err != nil {
+			return err
+		}
+		pkgs = hw.archPackages()
+	}
+
+	args := []string{
+		"--root", c.Root.Dir,
+		"--noconfirm",
+		"--quiet",
+		"--needed",
+		"--sync",
+	}
+	args = append(args, c.pacmanConfArgs()...)
+	args = append(args, pkgs...)
+	return run(exec.Command("pacman", args...), kill)
+}
@@ -0,0 +1,112 @@
+//go:build integration
+
+// The integration tests provision into sparse image files attached as loop
+// devices. They need root, udev for the partition label links, and the usual
+// disk tools, like in a privileged container:
+//
+//	go test -tags integration ./system
+package system
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daaku/ensure"
+)
+
+type step struct {
+	do, undo func(kill chan bool) error
+}
+
+// Run the steps, undoing those which ran once the test is done.
+func runSteps(t *testing.T, steps ...step) {
+	for _, s := range steps {
+		ensure.Nil(t, s.do(nil))
+		if s.undo != nil {
+			undo := s.undo
+			t.Cleanup(func() {
+				if err := undo(nil); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func loopConfig(t *testing.T) *Config {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	for _, tool := range []string{"losetup", "sgdisk", "mkfs.btrfs", "mkfs.vfat"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("requires %s", tool)
+		}
+	}
+	dir := t.TempDir()
+	// partition labels must not collide with other tests or the host
+	c := New(fmt.Sprintf("summon-it-%d", os.Getpid()))
+	c.Root.Dir = filepath.Join(dir, "root")
+	c.Root.FSType = Btrfs
+	c.EFI.Dir = filepath.Join(c.Root.Dir, "boot", "efi")
+	c.VirtualFS.Dir = c.Root.Dir
+	c.Image = &LoopImage{File: filepath.Join(dir, "disk.img"), Size: "2G"}
+	return c
+}
+
+func TestLoopFstab(t *testing.T) {
+	c := loopConfig(t)
+	runSteps(
+		t,
+		step{do: c.AttachImage, undo: c.DetachImage},
+		step{do: c.GptSetup},
+		step{do: c.Root.MakeFS},
+		step{do: c.Root.Mount, undo: c.Root.Umount},
+		step{do: c.EFI.MakeFS},
+		step{do: c.EFI.Mount, undo: c.EFI.Umount},
+		step{do: func(kill chan bool) error {
+			return os.MkdirAll(filepath.Join(c.Root.Dir, "etc"), os.FileMode(0o755))
+		}},
+		step{do: c.GenFstab},
+	)
+
+	btrfs, err := isBtrfs(c.Root.Dir)
+	ensure.Nil(t, err)
+	ensure.True(t, btrfs)
+	out, err := exec.Command("findmnt", "--noheadings", "--output", "FSTYPE", c.EFI.Dir).Output()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, strings.TrimSpace(string(out)), "vfat")
+	info, err := Probe(c.EFI.Device)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, info.Type, "vfat")
+	ensure.DeepEqual(t, info.Label, c.EFI.Name)
+
+	fstab, err := os.ReadFile(filepath.Join(c.Root.Dir, "etc", "fstab"))
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(fstab), "subvol="+btrfsActive)
+	ensure.StringContains(t, string(fstab), "/boot/efi")
+	ensure.StringContains(t, string(fstab), "umask=0077")
+}
+
+func TestLoopNativeGPT(t *testing.T) {
+	c := loopConfig(t)
+	c.GPT = &GPT{}
+	c.PartitionTypes = map[string]string{c.Root.Name: "8304"}
+	c.PartUUIDs = map[string]string{c.Root.Name: "6D8A5E33-8C4E-4B8B-9A62-3C5D1F8E2A10"}
+	runSteps(
+		t,
+		step{do: c.AttachImage, undo: c.DetachImage},
+		step{do: c.GptSetup},
+	)
+
+	out, err := exec.Command("sgdisk", "--verify", c.Disk).CombinedOutput()
+	ensure.Nil(t, err)
+	ensure.StringContains(t, string(out), "No problems found")
+	_, err = os.Stat(c.EFI.Device)
+	ensure.Nil(t, err)
+	_, err = os.Stat("/dev/disk/by-partuuid/6d8a5e33-8c4e-4b8b-9a62-3c5d1f8e2a10")
+	ensure.Nil(t, err)
+}
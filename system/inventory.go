@@ -0,0 +1,226 @@
+package system
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// An Inventory of the installed system, kept with the audit trail for
+// compliance and for comparing the machine against later.
+type Inventory struct {
+	Packages   map[string]string `json:",omitempty"`
+	Units      []string
+	Fstab      string
+	Crypttab   string `json:",omitempty"`
+	Partitions []PartitionInventory
+	// The sha256 of the files in /etc and the ones from the Manifest.
+	Files map[string]string
+}
+
+// A partition of the system, with the UUID of what it holds.
+type PartitionInventory struct {
+	Name     string
+	Device   string
+	PartUUID string `json:",omitempty"`
+	Type     string `json:",omitempty"`
+	UUID     string `json:",omitempty"`
+}
+
+// Query the installed packages and versions, for the package managers which
+// can list them in a single command.
+func (c *Config) inventoryPackages() (map[string]string, error) {
+	var args []string
+	switch c.installer().(type) {
+	case Arch, ALARM:
+		lock, err := QueryLockfile(c.Root.Dir)
+		return map[string]string(lock), err
+	case Debootstrap:
+		args = []string{"/usr/bin/dpkg-query", "--show", "--showformat", "${Package} ${Version}\n"}
+	case Fedora:
+		args = []string{"/usr/bin/rpm", "--query", "--all", "--queryformat", "%{NAME} %{VERSION}-%{RELEASE}\n"}
+	default:
+		return nil, nil
+	}
+	out, err := output(c.targetCmd(nil, args...), nil)
+	if err != nil {
+		return nil, err
+	}
+	packages := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, version, ok := strings.Cut(line, " "); ok {
+			packages[name] = version
+		}
+	}
+	return packages, nil
+}
+
+// The units enabled in the target, from the symlinks systemctl makes.
+func (c *Config) inventoryUnits() ([]string, error) {
+	wants, err := glob(filepath.Join(c.Root.Dir, "etc", "systemd", "system", "*.wants", "*"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var units []string
+	for _, w := range wants {
+		if name := filepath.Base(w); !seen[name] {
+			seen[name] = true
+			units = append(units, name)
+		}
+	}
+	sort.Strings(units)
+	return units, nil
+}
+
+// The PARTUUID of the partition device, from the links udev makes.
+func partUUID(device string) string {
+	dev, err := realpath(device)
+	if err != nil {
+		return ""
+	}
+	links, _ := glob("/dev/disk/by-partuuid/*")
+	for _, l := range links {
+		if target, err := realpath(l); err == nil && target == dev {
+			return filepath.Base(l)
+		}
+	}
+	return ""
+}
+
+func (c *Config) inventoryPartitions() []PartitionInventory {
+	devices := [][2]string{{c.Root.Name, c.Root.Device}, {c.EFI.Name, c.EFI.Device}}
+	if c.Swap != nil {
+		devices = append(devices, [2]string{c.Swap.Name, c.Swap.Device})
+	}
+	for _, d := range c.Data {
+		devices = append(devices, [2]string{d.Name, d.Device})
+	}
+	var parts []PartitionInventory
+	for _, d := range devices {
+		p := PartitionInventory{Name: d[0], Device: d[1], PartUUID: partUUID(d[1])}
+		if info, err := Probe(d[1]); err == nil {
+			p.Type, p.UUID = info.Type, info.UUID
+		}
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hashes the files in etc of the root given first, without the .git, and the
+// other files given relative to it, for a remote inventory.
+const inventoryFilesScript = `cd "$1" && shift &&
+{ find etc -name .git -prune -o -type f -print0; printf '%s\0' "$@"; } |
+xargs -0 -r sha256sum --`
+
+func (c *Config) inventoryFilesRemote() (map[string]string, error) {
+	args := []string{"-c", inventoryFilesScript, "sh", c.Root.Dir}
+	if c.Manifest != nil {
+		for _, f := range c.Manifest.Files {
+			args = append(args, strings.TrimPrefix(f.Path, "/"))
+		}
+	}
+	out, err := output(exec.Command("sh", args...), nil)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// sha256sum separates the sum and the name with two spaces
+		if sum, name, ok := strings.Cut(line, "  "); ok {
+			files["/"+name] = sum
+		}
+	}
+	return files, nil
+}
+
+func (c *Config) inventoryFiles() (map[string]string, error) {
+	if !summon.Local() {
+		return c.inventoryFilesRemote()
+	}
+	files := map[string]string{}
+	add := func(name string) error {
+		sum, err := hashFile(filepath.Join(c.Root.Dir, name))
+		if err != nil {
+			return err
+		}
+		files[name] = sum
+		return nil
+	}
+	etc := filepath.Join(c.Root.Dir, "etc")
+	err := filepath.WalkDir(etc, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.Root.Dir, p)
+		if err != nil {
+			return err
+		}
+		return add("/" + rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Manifest != nil {
+		for _, f := range c.Manifest.Files {
+			if err := add(f.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// Take the Inventory of the target.
+func (c *Config) inventory() (*Inventory, error) {
+	var inv Inventory
+	var err error
+	if inv.Packages, err = c.inventoryPackages(); err != nil {
+		return nil, err
+	}
+	if inv.Units, err = c.inventoryUnits(); err != nil {
+		return nil, err
+	}
+	fstab, err := readFile(filepath.Join(c.Root.Dir, "etc", "fstab"))
+	if err != nil {
+		return nil, err
+	}
+	inv.Fstab = string(fstab)
+	crypttab, err := readFile(filepath.Join(c.Root.Dir, "etc", "crypttab"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	inv.Crypttab = string(crypttab)
+	inv.Partitions = c.inventoryPartitions()
+	if inv.Files, err = c.inventoryFiles(); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
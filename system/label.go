@@ -0,0 +1,77 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// The longest label, in bytes, each file system allows.
+var fsLabelLimits = map[string]int{
+	"vfat":  11,
+	"swap":  16,
+	"ext2":  16,
+	"ext3":  16,
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+}
+
+// The longest GPT partition name, in UTF-16 code units.
+const gptNameLimit = 36
+
+// Characters FAT doesn't allow in a volume label.
+const vfatInvalid = `"*+,./:;<=>?[\]|`
+
+// The label for a new file system of the type, or an error naming the limit
+// it exceeds. FAT labels are upper cased with invalid characters replaced, and
+// FAT and swap labels are cut to fit, since nothing refers to the ESP or swap
+// by their label.
+func fsLabel(fstype, label string) (string, error) {
+	limit, ok := fsLabelLimits[fstype]
+	switch fstype {
+	case "vfat":
+		label = strings.Map(func(r rune) rune {
+			if r < 0x20 || r > 0x7e || strings.ContainsRune(vfatInvalid, r) {
+				return '_'
+			}
+			return r
+		}, strings.ToUpper(label))
+		return label[:min(len(label), limit)], nil
+	case "swap":
+		return label[:min(len(label), limit)], nil
+	}
+	if ok && len(label) > limit {
+		return "", fmt.Errorf("summon: label %q is %d bytes, but %s allows at most %d, so a shorter name is needed", label, len(label), fstype, limit)
+	}
+	return label, nil
+}
+
+// Check the labels and partition names generated from the name of the system
+// fit, before anything is written to the disks.
+func (c *Config) CheckLabels(kill chan bool) error {
+	names := []string{c.Root.Name, c.EFI.Name}
+	labels := [][2]string{{string(c.Root.FSType), c.Root.Name}}
+	if c.Swap != nil {
+		names = append(names, c.Swap.Name)
+		labels = append(labels, [2]string{"swap", c.Swap.label()})
+	}
+	for _, d := range c.Data {
+		names = append(names, d.Name)
+		labels = append(labels, [2]string{d.FSType, d.Name})
+	}
+	if c.EnableOSX {
+		names = append(names, c.label("osx"), c.label("recovery"))
+	}
+	for _, n := range names {
+		if len(utf16.Encode([]rune(n))) > gptNameLimit {
+			return fmt.Errorf("summon: partition name %q is longer than the %d characters GPT allows, so a shorter name is needed", n, gptNameLimit)
+		}
+	}
+	for _, l := range labels {
+		if _, err := fsLabel(l[0], l[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The supported power management daemons.
+const (
+	PowerTLP            = "tlp"
+	PowerProfilesDaemon = "power-profiles-daemon"
+)
+
+// A Laptop profile adds power management on top of the base install. The
+// LidSwitch actions are logind actions like "suspend", "hibernate" or
+// "ignore".
+type Laptop struct {
+	PowerDaemon            string
+	LidSwitch              string
+	LidSwitchExternalPower string
+	KernelParams           []string
+}
+
+// A reasonable profile for most laptops. Deep sleep is preferred over s2idle
+// where the firmware supports it.
+var DefaultLaptop = Laptop{
+	PowerDaemon:            PowerProfilesDaemon,
+	LidSwitch:              "suspend",
+	LidSwitchExternalPower: "suspend",
+	KernelParams:           []string{"mem_sleep_default=deep", "nmi_watchdog=0"},
+}
+
+// Enable the laptop profile. The power daemon is added to the Packages and
+// EnableUnits, so it is installed and enabled along with the rest of the
+// system. This must be called after the Packages are configured.
+func (c *Config) EnableLaptop(l Laptop) {
+	// keep installing the meta-package, which explicit packages would replace
+	if c.Package == "" {
+		c.Package = c.metaPackage()
+	}
+	c.Laptop = &l
+	if l.PowerDaemon == "" {
+		return
+	}
+	c.Packages = append(c.Packages, l.PowerDaemon)
+	c.EnableUnits = append(c.EnableUnits, l.PowerDaemon+".service")
+	if l.PowerDaemon == PowerTLP {
+		// tlp manages radio devices itself
+		c.MaskUnits = append(c.MaskUnits, "systemd-rfkill.service", "systemd-rfkill.socket")
+	}
+}
+
+func (l *Laptop) logindConf() string {
+	var b strings.Builder
+	b.WriteString("[Login]\n")
+	if l.LidSwitch != "" {
+		fmt.Fprintf(&b, "HandleLidSwitch=%s\n", l.LidSwitch)
+	}
+	if l.LidSwitchExternalPower != "" {
+		fmt.Fprintf(&b, "HandleLidSwitchExternalPower=%s\n", l.LidSwitchExternalPower)
+	}
+	b.WriteString("HandleLidSwitchDocked=ignore\n")
+	return b.String()
+}
+
+// Generate the logind drop-in with the lid switch configuration.
+func (c *Config) GenLogind(kill chan bool) error {
+	if c.Laptop == nil {
+		return nil
+	}
+	dir := filepath.Join(c.Root.Dir, "etc", "systemd", "logind.conf.d")
+	return writeFile(
+		filepath.Join(dir, "10-summon.conf"),
+		[]byte(c.Laptop.logindConf()),
+		os.FileMode(0o644),
+	)
+}
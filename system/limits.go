@@ -0,0 +1,114 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+var errKilled = errors.New("summon: killed")
+
+// Limits for backups, so they don't starve the interactive system. The
+// Bandwidth is in KiB/s. The IOClass is an ionice class like "idle" or
+// "best-effort", and Nice is the niceness to run at. If a Window is set,
+// backups wait for it to open before starting.
+type BackupLimits struct {
+	Bandwidth int
+	IOClass   string
+	Nice      int
+	Window    *BackupWindow
+}
+
+// A daily time window, with times like "22:00". The window may span
+// midnight, like 22:00 to 06:00. Backups which are running when the window
+// closes are not interrupted.
+type BackupWindow struct {
+	Start string
+	End   string
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("summon: invalid backup window time %q: %v", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// How long until the window opens, which is zero if it's open.
+func (w *BackupWindow) until(now time.Time) (time.Duration, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return 0, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return 0, err
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	since := now.Sub(midnight)
+	open := since >= start && since < end
+	if start > end {
+		open = since >= start || since < end
+	}
+	if open {
+		return 0, nil
+	}
+	if since < start {
+		return start - since, nil
+	}
+	return 24*time.Hour - since + start, nil
+}
+
+// Wait for the backup window to open, if there is one.
+func (c *Config) waitBackupWindow(kill chan bool) error {
+	if c.BackupLimits == nil || c.BackupLimits.Window == nil {
+		return nil
+	}
+	d, err := c.BackupLimits.Window.until(time.Now())
+	if err != nil || d == 0 {
+		return err
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-kill:
+		return errKilled
+	}
+}
+
+// Wrap a backup command to run against the snapshots, with ionice and nice
+// as configured.
+func (c *Config) backupCmd(cmd *exec.Cmd) *exec.Cmd {
+	cmd = c.backupSnapshots.wrap(cmd)
+	l := c.BackupLimits
+	if l == nil || (l.IOClass == "" && l.Nice == 0) {
+		return cmd
+	}
+	var args []string
+	if l.IOClass != "" {
+		args = append(args, "ionice", "--class", l.IOClass)
+	}
+	if l.Nice != 0 {
+		args = append(args, "nice", "--adjustment", strconv.Itoa(l.Nice))
+	}
+	args = append(args, cmd.Args...)
+	wrapped := exec.Command(args[0], args[1:]...)
+	wrapped.Env = cmd.Env
+	wrapped.Dir = cmd.Dir
+	return wrapped
+}
+
+// The bandwidth limit argument, in the form flag=KiB/s.
+func (c *Config) bwlimitArgs(flags ...string) []string {
+	if c.BackupLimits == nil || c.BackupLimits.Bandwidth == 0 {
+		return nil
+	}
+	var args []string
+	for _, f := range flags {
+		args = append(args, fmt.Sprintf("%s=%d", f, c.BackupLimits.Bandwidth))
+	}
+	return args
+}
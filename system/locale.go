@@ -0,0 +1,109 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The locale.gen entry for a locale like en_US.UTF-8.
+func localeGenEntry(locale string) string {
+	_, charset, found := strings.Cut(locale, ".")
+	if !found {
+		charset = "ISO-8859-1"
+	}
+	return locale + " " + charset
+}
+
+// Generate /etc/locale.gen and /etc/locale.conf from the configured Locales.
+// The Lang defaults to the first of the Locales.
+func (c *Config) GenLocale(kill chan bool) error {
+	if len(c.Locales) == 0 {
+		return nil
+	}
+
+	var gen strings.Builder
+	for _, l := range c.Locales {
+		gen.WriteString(localeGenEntry(l) + "\n")
+	}
+	err := writeFile(
+		filepath.Join(c.Root.Dir, "etc", "locale.gen"),
+		[]byte(gen.String()),
+		os.FileMode(0o644),
+	)
+	if err != nil {
+		return err
+	}
+
+	lang := c.Lang
+	if lang == "" {
+		lang = c.Locales[0]
+	}
+	return writeFile(
+		filepath.Join(c.Root.Dir, "etc", "locale.conf"),
+		[]byte("LANG="+lang+"\n"),
+		os.FileMode(0o644),
+	)
+}
+
+// Generate the /etc/localtime symlink for the configured Timezone.
+func (c *Config) GenLocaltime(kill chan bool) error {
+	if c.Timezone == "" {
+		return nil
+	}
+
+	zone := filepath.Join("/usr/share/zoneinfo", c.Timezone)
+	if ok, err := exists(filepath.Join(c.Root.Dir, zone)); !ok {
+		if err == nil {
+			err = os.ErrNotExist
+		}
+		return fmt.Errorf("invalid timezone %q: %v", c.Timezone, err)
+	}
+	return c.targetSymlink(zone, "/etc/localtime")
+}
+
+// The terminals of the Linux console, where loadkeys and setfont apply.
+var virtualConsole = regexp.MustCompile(`^/dev/(tty[0-9]+|console)$`)
+
+// Use the Keymap and Font on the console summon runs on, like the one of the
+// live environment, so passwords for the disk are typed with the layout the
+// boot prompt will use. Nothing is changed elsewhere, like over SSH, where the
+// layout is the one of the client.
+func (c *Config) LoadConsole(kill chan bool) error {
+	tty, err := os.Readlink("/proc/self/fd/0")
+	if err != nil || !virtualConsole.MatchString(tty) {
+		return nil
+	}
+	if c.Keymap != "" {
+		if err := run(exec.Command("loadkeys", c.Keymap), kill); err != nil {
+			return err
+		}
+	}
+	if c.Font != "" {
+		return run(exec.Command("setfont", c.Font), kill)
+	}
+	return nil
+}
+
+// Generate /etc/vconsole.conf from the configured Keymap and Font.
+func (c *Config) GenVConsole(kill chan bool) error {
+	if c.Keymap == "" && c.Font == "" {
+		return nil
+	}
+
+	var b strings.Builder
+	if c.Keymap != "" {
+		fmt.Fprintf(&b, "KEYMAP=%s\n", c.Keymap)
+	}
+	if c.Font != "" {
+		fmt.Fprintf(&b, "FONT=%s\n", c.Font)
+	}
+	return writeFile(
+		filepath.Join(c.Root.Dir, "etc", "vconsole.conf"),
+		[]byte(b.String()),
+		os.FileMode(0o644),
+	)
+}
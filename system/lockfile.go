@@ -0,0 +1,188 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Lockfile records exact package versions, keyed by package name. It is
+// stored in the same format as the output of `pacman -Q`.
+type Lockfile map[string]string
+
+// Read a Lockfile.
+func ReadLockfile(name string) (Lockfile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseLockfile(f, name)
+}
+
+func parseLockfile(r io.Reader, name string) (Lockfile, error) {
+	l := Lockfile{}
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected package name and version", name, line)
+		}
+		l[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// The package names in sorted order.
+func (l Lockfile) Names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Find the package files for the locked versions in the given directory.
+func (l Lockfile) Files(dir string) ([]string, error) {
+	var files, missing []string
+	for _, name := range l.Names() {
+		file, err := l.file(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if file == "" {
+			missing = append(missing, name+"-"+l[name])
+			continue
+		}
+		files = append(files, file)
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("packages missing from %s: %s", dir, strings.Join(missing, ", "))
+	}
+	return files, nil
+}
+
+// Find the package file for a single locked package, returning an empty string
+// if it isn't found.
+func (l Lockfile) file(dir, name string) (string, error) {
+	prefix := name + "-" + l[name] + "-"
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+"*.pkg.tar.*"))
+	if err != nil {
+		return "", err
+	}
+	for _, m := range matches {
+		arch, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(m), prefix), ".")
+		if strings.HasSuffix(m, ".sig") || strings.Contains(arch, "-") {
+			continue
+		}
+		return m, nil
+	}
+	return "", nil
+}
+
+// Query the packages installed in root.
+func QueryLockfile(root string) (Lockfile, error) {
+	out, err := output(exec.Command("pacman", "--root", root, "--query"), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error querying packages in %s: %w", root, err)
+	}
+	return parseLockfile(bytes.NewReader(out), root)
+}
+
+// Write the Lockfile.
+func (l Lockfile) Write(name string) error {
+	var b bytes.Buffer
+	for _, n := range l.Names() {
+		fmt.Fprintf(&b, "%s %s\n", n, l[n])
+	}
+	return os.WriteFile(name, b.Bytes(), os.FileMode(0o644))
+}
+
+// Verify the packages installed in root exactly match the Lockfile.
+func (l Lockfile) Verify(root string) error {
+	installed, err := QueryLockfile(root)
+	if err != nil {
+		return err
+	}
+
+	var mismatch []string
+	for _, name := range l.Names() {
+		if installed[name] != l[name] {
+			mismatch = append(mismatch, fmt.Sprintf("%s (want %s, have %q)", name, l[name], installed[name]))
+		}
+	}
+	for _, name := range installed.Names() {
+		if _, ok := l[name]; !ok {
+			mismatch = append(mismatch, fmt.Sprintf("%s (not locked)", name))
+		}
+	}
+	if len(mismatch) > 0 {
+		return fmt.Errorf("installed packages do not match lockfile: %s", strings.Join(mismatch, ", "))
+	}
+	return nil
+}
+
+// Download the locked packages for arch missing from dir from the Arch Linux
+// Archive.
+func (l Lockfile) fetch(archive, dir, arch string, kill chan bool) error {
+	if err := os.MkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	for _, name := range l.Names() {
+		file, err := l.file(dir, name)
+		if err != nil {
+			return err
+		}
+		if file != "" {
+			continue
+		}
+		if err := l.fetchOne(archive, dir, arch, name, kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The package architecture and compression are not recorded in the Lockfile,
+// so each possibility is tried in turn, being either arch or any.
+func (l Lockfile) fetchOne(archive, dir, arch, name string, kill chan bool) error {
+	var errs []error
+	for _, a := range []string{arch, "any"} {
+		for _, ext := range []string{"zst", "xz"} {
+			base := fmt.Sprintf("%s-%s-%s.pkg.tar.%s", name, l[name], a, ext)
+			url := fmt.Sprintf("%s/packages/%c/%s/%s", archive, name[0], name, base)
+			partial := filepath.Join(dir, base+".part")
+			cmd := exec.Command(
+				"curl",
+				"--fail",
+				"--silent",
+				"--show-error",
+				"--location",
+				"--output", partial,
+				url,
+			)
+			if err := run(cmd, kill); err != nil {
+				os.Remove(partial)
+				errs = append(errs, err)
+				continue
+			}
+			return os.Rename(partial, filepath.Join(dir, base))
+		}
+	}
+	return fmt.Errorf("unable to fetch %s-%s from %s: %v", name, l[name], archive, errs)
+}
@@ -0,0 +1,43 @@
+package system
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A disk image attached as a loop device, to install onto instead of a
+// physical disk. The partitions are scanned, so the usual partition labels
+// are available once the GPT is created.
+type LoopImage struct {
+	File   string
+	Size   string
+	Device string
+}
+
+// Create the image if it doesn't exist, and attach it as the Config.Disk.
+func (c *Config) AttachImage(kill chan bool) error {
+	if c.Image == nil {
+		return nil
+	}
+	if _, err := os.Stat(c.Image.File); os.IsNotExist(err) {
+		if err := run(exec.Command("truncate", "--size", c.Image.Size, c.Image.File), kill); err != nil {
+			return err
+		}
+	}
+	out, err := output(exec.Command("losetup", "--find", "--show", "--partscan", c.Image.File), kill)
+	if err != nil {
+		return err
+	}
+	c.Image.Device = strings.TrimSpace(string(out))
+	c.Disk = c.Image.Device
+	return nil
+}
+
+// Detach the loop device.
+func (c *Config) DetachImage(kill chan bool) error {
+	if c.Image == nil || c.Image.Device == "" {
+		return nil
+	}
+	return run(exec.Command("losetup", "--detach", c.Image.Device), kill)
+}
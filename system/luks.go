@@ -0,0 +1,78 @@
+package system
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// The LUKS settings for new containers. By default cryptsetup is run to
+// manage them, while building with the libcryptsetup tag uses the library
+// for local installs instead, which needs cgo and the libcryptsetup headers:
+//
+//	go build -tags libcryptsetup ./cmd/summon
+const (
+	luksCipher   = "aes"
+	luksMode     = "xts-plain64"
+	luksKeyBits  = 512
+	luksHash     = "sha512"
+	luksIterTime = 5000
+)
+
+// A context cancelled once kill fires, for steps calling the context based
+// helpers.
+func killContext(kill chan bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-kill:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// A context like killContext, which also has the Reporter of the Config for
+// the progress of the LUKS helpers.
+func (c *Config) luksContext(kill chan bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := killContext(kill)
+	if c != nil && c.Reporter != nil {
+		ctx = summon.WithReporter(ctx, c.Reporter)
+	}
+	return ctx, cancel
+}
+
+// Create a LUKS container on the device, unlocked by the key, by running
+// cryptsetup.
+func cryptsetupFormat(ctx context.Context, device, key string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"cryptsetup", "luksFormat",
+		"--cipher", luksCipher+"-"+luksMode,
+		"--key-size", strconv.Itoa(luksKeyBits),
+		"--hash", luksHash,
+		"--iter-time", strconv.Itoa(luksIterTime),
+		"--use-random",
+		device,
+	)
+	cmd.Stdin = strings.NewReader(key)
+	return withCondition(summon.RunStreaming(ctx, cmd, nil, nil))
+}
+
+// Unlock the LUKS container on the device as /dev/mapper/name by running
+// cryptsetup.
+func cryptsetupOpen(ctx context.Context, device, name, key string) error {
+	cmd := exec.CommandContext(ctx, "cryptsetup", "open", "--type", "luks", device, name)
+	cmd.Stdin = strings.NewReader(key)
+	return withCondition(summon.RunStreaming(ctx, cmd, nil, nil))
+}
+
+// Lock the LUKS container unlocked as /dev/mapper/name by running cryptsetup.
+func cryptsetupClose(ctx context.Context, name string) error {
+	cmd := exec.CommandContext(ctx, "cryptsetup", "close", name)
+	return withCondition(summon.RunStreaming(ctx, cmd, nil, nil))
+}
@@ -0,0 +1,20 @@
+//go:build !libcryptsetup || !cgo
+
+package system
+
+import "context"
+
+// Create a LUKS container on the device, unlocked by the key.
+func luksFormat(ctx context.Context, device, key string) error {
+	return cryptsetupFormat(ctx, device, key)
+}
+
+// Unlock the LUKS container on the device as /dev/mapper/name.
+func luksOpen(ctx context.Context, device, name, key string) error {
+	return cryptsetupOpen(ctx, device, name, key)
+}
+
+// Lock the LUKS container unlocked as /dev/mapper/name.
+func luksClose(ctx context.Context, name string) error {
+	return cryptsetupClose(ctx, name)
+}
@@ -0,0 +1,144 @@
+//go:build libcryptsetup && cgo
+
+package system
+
+/*
+#cgo pkg-config: libcryptsetup
+#include <stdlib.h>
+#include <libcryptsetup.h>
+
+static int summon_luks_format(struct crypt_device *cd, const char *cipher,
+		const char *mode, size_t key_size, const char *hash, uint32_t time_ms) {
+	struct crypt_pbkdf_type pbkdf = {
+		.type = CRYPT_KDF_ARGON2ID,
+		.hash = hash,
+		.time_ms = time_ms,
+	};
+	int r = crypt_set_pbkdf_type(cd, &pbkdf);
+	if (r < 0) {
+		return r;
+	}
+	crypt_set_rng_type(cd, CRYPT_RNG_RANDOM);
+	return crypt_format(cd, CRYPT_LUKS2, cipher, mode, NULL, NULL, key_size, NULL);
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/daaku/summon"
+)
+
+// The condition for a failed libcryptsetup call, which returns negative
+// errno values.
+func luksError(op, what string, r C.int) error {
+	errno := syscall.Errno(-r)
+	err := fmt.Errorf("summon: cryptsetup %s %s: %w", op, what, errno)
+	var cond error
+	switch {
+	case errors.Is(errno, syscall.EPERM):
+		cond = ErrBadPassphrase
+	case errors.Is(errno, syscall.EBUSY):
+		cond = ErrBusy
+	case errors.Is(errno, syscall.ENOENT), errors.Is(errno, syscall.ENODEV), errors.Is(errno, syscall.ENXIO):
+		cond = ErrDeviceNotFound
+	}
+	if cond != nil {
+		return fmt.Errorf("%w: %w", cond, err)
+	}
+	return err
+}
+
+func luksInit(device string) (*C.struct_crypt_device, error) {
+	cdevice := C.CString(device)
+	defer C.free(unsafe.Pointer(cdevice))
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init(&cd, cdevice); r < 0 {
+		return nil, luksError("init", device, r)
+	}
+	return cd, nil
+}
+
+// Create a LUKS container on the device, unlocked by the key. Progress is
+// reported for the header and the key slot, whose key derivation takes most
+// of the time. The library only reaches local devices, so cryptsetup is run
+// for remote installs.
+func luksFormat(ctx context.Context, device, key string) error {
+	if !summon.Local() {
+		return cryptsetupFormat(ctx, device, key)
+	}
+	task := "Luks Format: " + device
+	cd, err := luksInit(device)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+
+	summon.Report(ctx, summon.Event{Task: task, Message: "writing the header"})
+	cipher, mode, hash := C.CString(luksCipher), C.CString(luksMode), C.CString(luksHash)
+	defer C.free(unsafe.Pointer(cipher))
+	defer C.free(unsafe.Pointer(mode))
+	defer C.free(unsafe.Pointer(hash))
+	r := C.summon_luks_format(cd, cipher, mode, luksKeyBits/8, hash, luksIterTime)
+	if r < 0 {
+		return luksError("luksFormat", device, r)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	summon.Report(ctx, summon.Event{Task: task, Message: "adding the key slot", Percent: 10})
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	r = C.crypt_keyslot_add_by_volume_key(cd, C.CRYPT_ANY_SLOT, nil, 0, ckey, C.size_t(len(key)))
+	if r < 0 {
+		return luksError("luksAddKey", device, r)
+	}
+	summon.Report(ctx, summon.Event{Task: task, Message: "done", Percent: 100})
+	return nil
+}
+
+// Unlock the LUKS container on the device as /dev/mapper/name.
+func luksOpen(ctx context.Context, device, name, key string) error {
+	if !summon.Local() {
+		return cryptsetupOpen(ctx, device, name, key)
+	}
+	cd, err := luksInit(device)
+	if err != nil {
+		return err
+	}
+	defer C.crypt_free(cd)
+	if r := C.crypt_load(cd, nil, nil); r < 0 {
+		return luksError("open", device, r)
+	}
+	cname, ckey := C.CString(name), C.CString(key)
+	defer C.free(unsafe.Pointer(cname))
+	defer C.free(unsafe.Pointer(ckey))
+	if r := C.crypt_activate_by_passphrase(cd, cname, C.CRYPT_ANY_SLOT, ckey, C.size_t(len(key)), 0); r < 0 {
+		return luksError("open", device, r)
+	}
+	return nil
+}
+
+// Lock the LUKS container unlocked as /dev/mapper/name.
+func luksClose(ctx context.Context, name string) error {
+	if !summon.Local() {
+		return cryptsetupClose(ctx, name)
+	}
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var cd *C.struct_crypt_device
+	if r := C.crypt_init_by_name(&cd, cname); r < 0 {
+		return luksError("close", name, r)
+	}
+	defer C.crypt_free(cd)
+	if r := C.crypt_deactivate(cd, cname); r < 0 {
+		return luksError("close", name, r)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Metadata about the machine for systemd-hostnamed, as in machine-info(5),
+// like the PrettyHostname "Work Laptop" for boe, and the Deployment, like
+// production, and Location of a machine in a fleet. IconName defaults to
+// computer-<chassis> as hostnamectl does.
+type MachineInfo struct {
+	PrettyHostname string
+	IconName       string
+	Chassis        string
+	Deployment     string
+	Location       string
+}
+
+// The chassis types hostnamectl accepts.
+var chassisTypes = []string{"desktop", "laptop", "convertible", "server", "tablet", "handset", "watch", "embedded", "vm", "container"}
+
+// Quote the value for machine-info, which is read like a shell assignment.
+func quoteMachineInfo(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(v) + `"`
+}
+
+func (m *MachineInfo) render() (string, error) {
+	if m.Chassis != "" && !slices.Contains(chassisTypes, m.Chassis) {
+		return "", fmt.Errorf("summon: unknown chassis %q, must be one of %s", m.Chassis, strings.Join(chassisTypes, ", "))
+	}
+	icon := m.IconName
+	if icon == "" && m.Chassis != "" {
+		icon = "computer-" + m.Chassis
+	}
+	var b strings.Builder
+	for _, v := range [][2]string{
+		{"PRETTY_HOSTNAME", m.PrettyHostname},
+		{"ICON_NAME", icon},
+		{"CHASSIS", m.Chassis},
+		{"DEPLOYMENT", m.Deployment},
+		{"LOCATION", m.Location},
+	} {
+		if v[1] != "" {
+			fmt.Fprintf(&b, "%s=%s\n", v[0], quoteMachineInfo(v[1]))
+		}
+	}
+	return b.String(), nil
+}
+
+// Generate /etc/machine-info, next to the /etc/hostname from GenEtcHostname.
+func (c *Config) GenMachineInfo(kill chan bool) error {
+	if c.MachineInfo == nil {
+		return nil
+	}
+	contents, err := c.MachineInfo.render()
+	if err != nil {
+		return err
+	}
+	return c.writeTargetFile("/etc/machine-info", contents, os.FileMode(0o644))
+}
@@ -0,0 +1,121 @@
+package system
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/daaku/errgroup"
+)
+
+// Where to report backup runs. A manifest of each run is written to the
+// LogDir. The manifest is also POSTed to the Webhook, and to the Healthchecks
+// ping URL, with /fail appended if the backup failed. Notify targets are as
+// accepted by ParseNotifier.
+type BackupReport struct {
+	LogDir       string   `json:",omitempty"`
+	Webhook      string   `json:",omitempty"`
+	Healthchecks string   `json:",omitempty"`
+	Notify       []string `json:",omitempty"`
+}
+
+// The result of a backup run.
+type BackupManifest struct {
+	Start    time.Time
+	Duration string
+	Sources  []string
+	Targets  []BackupTargetResult
+	Error    string `json:",omitempty"`
+}
+
+// The result of backing up to one target.
+type BackupTargetResult struct {
+	Target   string
+	Files    int64
+	Bytes    int64
+	Duration string
+	Pruned   []string `json:",omitempty"`
+	Error    string   `json:",omitempty"`
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Complete the manifest with the error and report it, and pass it to
+// Config.OnBackup if set. The backup error is returned along with any errors
+// reporting it.
+func (c *Config) finishBackup(m *BackupManifest, err error) error {
+	m.Duration = time.Since(m.Start).Round(time.Second).String()
+	m.Error = errorString(err)
+	if c.OnBackup != nil {
+		c.OnBackup(m)
+	}
+	if c.BackupReport == nil {
+		return err
+	}
+	return errgroup.NewMultiError(err, c.BackupReport.report(m))
+}
+
+func (r *BackupReport) report(m *BackupManifest) error {
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if r.LogDir != "" {
+		errs = append(errs, r.write(m, j))
+	}
+	if r.Webhook != "" {
+		errs = append(errs, post(r.Webhook, j))
+	}
+	if r.Healthchecks != "" {
+		url := strings.TrimSuffix(r.Healthchecks, "/")
+		if m.Error != "" {
+			url += "/fail"
+		}
+		errs = append(errs, post(url, j))
+	}
+	if len(r.Notify) > 0 {
+		n := Notification{Subject: "backup succeeded", Report: j}
+		if m.Error != "" {
+			n.Subject = "backup failed"
+			n.Failed = true
+		}
+		if host, err := os.Hostname(); err == nil {
+			n.Subject = host + ": " + n.Subject
+		}
+		errs = append(errs, notify(r.Notify, n))
+	}
+	return errgroup.NewMultiError(errs...)
+}
+
+func (r *BackupReport) write(m *BackupManifest, j []byte) error {
+	if err := os.MkdirAll(r.LogDir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	name := filepath.Join(r.LogDir, m.Start.UTC().Format("20060102T150405Z")+".json")
+	return os.WriteFile(name, append(j, '\n'), os.FileMode(0o644))
+}
+
+var reportClient = &http.Client{Timeout: 30 * time.Second}
+
+func post(url string, body []byte) error {
+	res, err := reportClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("summon: reporting backup to %s: %s", url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// How often pacman is retried after a network error.
+const pacmanRetries = 3
+
+// The output of pacman, including the libcurl errors, when a download failed.
+var networkErrors = regexp.MustCompile(`failed retrieving file|failed to retrieve some files|failed to synchronize all databases|Could not resolve host|Failed to connect|Connection timed out|Connection reset|Operation too slow`)
+
+func isNetworkError(err error) bool {
+	var cerr *summon.CommandError
+	return errors.As(err, &cerr) && networkErrors.Match(cerr.Output)
+}
+
+// The Server lines of the mirrorlist which aren't commented out.
+func mirrorServers(mirrorlist []byte) []string {
+	var servers []string
+	for _, line := range strings.Split(string(mirrorlist), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if ok && strings.TrimSpace(key) == "Server" {
+			servers = append(servers, strings.TrimSpace(value))
+		}
+	}
+	return servers
+}
+
+// Run pacman with the args for the install. A single flaky mirror shouldn't
+// fail the install, so after a network error it is retried with the servers
+// of the mirrorlist rotated, to start with the next one. Packages which were
+// downloaded stay in the cache, and partial downloads are resumed.
+func (c *Config) pacmanSync(args []string, kill chan bool) error {
+	err := run(exec.Command("pacman", args...), kill)
+	if !isNetworkError(err) {
+		return err
+	}
+	dir, derr := os.MkdirTemp("", "summon-pacman-")
+	if derr != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for attempt := 1; attempt <= pacmanRetries && isNetworkError(err); attempt++ {
+		retry, server, rerr := rotateMirrors(dir, args, attempt)
+		if rerr != nil {
+			return fmt.Errorf("%w\nsummon: failing over to another mirror: %v", err, rerr)
+		}
+		if c.Reporter != nil {
+			c.Reporter(summon.Event{
+				Task:    "pacman",
+				Message: fmt.Sprintf("download failed, retrying with %s", server),
+				Percent: -1,
+			})
+		}
+		err = run(exec.Command("pacman", retry...), kill)
+	}
+	return err
+}
+
+// The pacman.conf used by the args, and the args without it.
+func pacmanConfig(args []string) (string, []string) {
+	for i, a := range args {
+		if a == "--config" && i+1 < len(args) {
+			return args[i+1], append(append([]string{}, args[:i]...), args[i+2:]...)
+		}
+	}
+	return "/etc/pacman.conf", args
+}
+
+var mirrorlistLine = regexp.MustCompile(`(?m)^([ \t]*Include[ \t]*=[ \t]*)` + regexp.QuoteMeta(mirrorlistInclude) + `[ \t]*$`)
+
+// Write a mirrorlist with the servers rotated for the attempt into dir, along
+// with a pacman.conf including it instead of the usual one, and return the
+// args using them and the server now first.
+func rotateMirrors(dir string, args []string, attempt int) ([]string, string, error) {
+	conf, args := pacmanConfig(args)
+	contents, err := os.ReadFile(conf)
+	if err != nil {
+		return nil, "", err
+	}
+	mirrorlist, err := os.ReadFile(mirrorlistInclude)
+	if err != nil {
+		return nil, "", err
+	}
+	servers := mirrorServers(mirrorlist)
+	if len(servers) == 0 {
+		return nil, "", fmt.Errorf("no servers in %s", mirrorlistInclude)
+	}
+	n := attempt % len(servers)
+	servers = slices.Concat(servers[n:], servers[:n])
+
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "Server = %s\n", s)
+	}
+	rotated := filepath.Join(dir, "mirrorlist")
+	if err := os.WriteFile(rotated, []byte(b.String()), os.FileMode(0o644)); err != nil {
+		return nil, "", err
+	}
+	retryConf := filepath.Join(dir, "pacman.conf")
+	contents = mirrorlistLine.ReplaceAll(contents, []byte("${1}"+rotated))
+	if err := os.WriteFile(retryConf, contents, os.FileMode(0o644)); err != nil {
+		return nil, "", err
+	}
+	return append([]string{"--config", retryConf}, args...), servers[0], nil
+}
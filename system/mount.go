@@ -0,0 +1,155 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/daaku/summon"
+	"golang.org/x/sys/unix"
+)
+
+// Mount options which are flags for mount(2), instead of data for the file
+// system. The ones starting with no clear the flag.
+var mountFlags = map[string]uintptr{
+	"ro":          unix.MS_RDONLY,
+	"nosuid":      unix.MS_NOSUID,
+	"nodev":       unix.MS_NODEV,
+	"noexec":      unix.MS_NOEXEC,
+	"sync":        unix.MS_SYNCHRONOUS,
+	"dirsync":     unix.MS_DIRSYNC,
+	"remount":     unix.MS_REMOUNT,
+	"bind":        unix.MS_BIND,
+	"rbind":       unix.MS_BIND | unix.MS_REC,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+}
+
+// Options which only reset a flag to its default.
+var mountDefaults = map[string]bool{"rw": true, "defaults": true, "suid": true, "dev": true, "exec": true, "async": true, "atime": true}
+
+// Split the comma separated options, like noatime,compress=lzo,subvol=a, into
+// the flags and the data passed to the file system.
+func parseMountOptions(options string) (uintptr, string) {
+	var flags uintptr
+	var data []string
+	for _, o := range strings.Split(options, ",") {
+		if o == "" || mountDefaults[o] {
+			continue
+		}
+		if f, ok := mountFlags[o]; ok {
+			flags |= f
+			continue
+		}
+		data = append(data, o)
+	}
+	return flags, strings.Join(data, ",")
+}
+
+// The condition for a failed mount(2) or umount(2).
+func mountCondition(err error, mounting bool) error {
+	switch {
+	case errors.Is(err, unix.EBUSY):
+		if mounting {
+			return ErrAlreadyMounted
+		}
+		return ErrBusy
+	case errors.Is(err, unix.ENODEV):
+		return ErrUnknownFS
+	case errors.Is(err, unix.ENOENT), errors.Is(err, unix.ENOTBLK), errors.Is(err, unix.ENXIO):
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+func mountError(op, what string, err error, mounting bool) error {
+	err = fmt.Errorf("summon: %s %s: %w", op, what, err)
+	if cond := mountCondition(err, mounting); cond != nil {
+		return fmt.Errorf("%w: %w", cond, err)
+	}
+	return err
+}
+
+// The block device file systems the kernel supports, to try in turn when the
+// type isn't known, like mount(8) does.
+func kernelFSTypes() ([]string, error) {
+	b, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return nil, err
+	}
+	var types []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" || strings.HasPrefix(line, "nodev") {
+			continue
+		}
+		types = append(types, strings.TrimSpace(line))
+	}
+	return types, nil
+}
+
+// Mount the device on dir with the comma separated options. If the fstype is
+// empty, the file systems the kernel supports are tried. Remote mounts use
+// mount(8) on the machine being installed.
+func mount(device, dir, fstype, options string) error {
+	if !summon.Local() {
+		var args []string
+		if fstype != "" {
+			args = append(args, "-t", fstype)
+		}
+		if options != "" {
+			args = append(args, "-o", options)
+		}
+		return run(exec.Command("mount", append(args, "--", device, dir)...), nil)
+	}
+	flags, data := parseMountOptions(options)
+	what := device + " on " + dir
+	if fstype != "" || flags&(unix.MS_BIND|unix.MS_REMOUNT) != 0 {
+		if err := unix.Mount(device, dir, fstype, flags, data); err != nil {
+			return mountError("mount", what, err, true)
+		}
+		return nil
+	}
+	types, err := kernelFSTypes()
+	if err != nil {
+		return err
+	}
+	err = unix.ENODEV
+	for _, t := range types {
+		if err = unix.Mount(device, dir, t, flags, data); err == nil {
+			return nil
+		}
+		// anything but the wrong type is final
+		if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENODEV) {
+			break
+		}
+	}
+	return mountError("mount", what, err, true)
+}
+
+// Bind mount src on dst, including the mounts below src if recursive.
+func bindMount(src, dst string, recursive bool) error {
+	options := "bind"
+	if recursive {
+		options = "rbind"
+	}
+	return mount(src, dst, "", options)
+}
+
+// Unmount the file system mounted on dir.
+func umount(dir string) error {
+	if !summon.Local() {
+		return run(exec.Command("umount", "--", dir), nil)
+	}
+	if err := unix.Unmount(dir, 0); err != nil {
+		return mountError("umount", dir, err, false)
+	}
+	return nil
+}
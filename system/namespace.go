@@ -0,0 +1,59 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set in the environment of summon once it runs in its own mount namespace.
+const namespaceEnv = "SUMMON_MOUNT_NAMESPACE"
+
+// Isolate runs summon in a private mount namespace, so the mounts of the
+// install, like the target, btrfs root and virtual file systems, never show
+// up in the mount table of the host, and are torn down with the process if it
+// dies. The namespace is per process, so summon is run again within it, with
+// the same arguments, and Isolate only returns within the namespace. The
+// original process forwards interrupts and exits with the same status.
+func Isolate() error {
+	if os.Getenv(namespaceEnv) != "" {
+		// mounts would otherwise still propagate to the host
+		return unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	}
+
+	cmd := exec.Command("/proc/self/exe", os.Args[1:]...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Env = append(os.Environ(), namespaceEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNS,
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// the terminal already interrupts both, this takes care of kill
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for range sig {
+			cmd.Process.Signal(syscall.SIGINT)
+		}
+	}()
+
+	err := cmd.Wait()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		return err
+	}
+	os.Exit(0)
+	panic("not reached")
+}
@@ -0,0 +1,149 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+var errNetbootArch = errors.New("summon: netboot images are only built for Arch Linux")
+
+const netbootUnit = "summon-netboot.service"
+
+// Packages for the netboot installer, which needs the tools summon drives
+// but not a bootloader or firmware beyond what the network cards need.
+var NetbootPackages = []string{
+	"base",
+	"linux",
+	"linux-firmware",
+	"arch-install-scripts",
+	"btrfs-progs",
+	"cryptsetup",
+	"dosfstools",
+	"gptfdisk",
+	"openssh",
+	"rsync",
+}
+
+// A Netboot installer is the target system, unpacked from the initramfs into
+// memory, which runs summon with the Args once the network is up. With a
+// provisioning server, the Args can be like:
+//
+//	--server http://provision:8080 --name boe provision
+//
+// The Dir receives the vmlinuz, initramfs.img and a summon.ipxe script. The
+// script fetches them relative to itself, or from the URL if set. The Binary
+// defaults to the running summon. Machines need enough memory to hold the
+// unpacked system, which is around 2G.
+type Netboot struct {
+	Dir    string
+	URL    string
+	Binary string
+	Args   []string
+}
+
+func (n Netboot) service() string {
+	args := append([]string{"/usr/local/bin/summon"}, n.Args...)
+	return fmt.Sprintf(`[Unit]
+Description=summon netboot installer
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+StandardOutput=journal+console
+StandardError=journal+console
+
+[Install]
+WantedBy=multi-user.target
+`, shellquote.Join(args...))
+}
+
+func (n Netboot) ipxe() string {
+	base := strings.TrimSuffix(n.URL, "/")
+	if base != "" {
+		base += "/"
+	}
+	return fmt.Sprintf(`#!ipxe
+kernel %[1]svmlinuz rdinit=/usr/lib/systemd/systemd console=tty0 console=ttyS0,115200
+initrd %[1]sinitramfs.img
+boot
+`, base)
+}
+
+// Turn the installed target into the netboot installer in the Dir. This must
+// run after InstallSystem and GenNetwork, with the virtual file systems still
+// mounted.
+func (c *Config) GenNetboot(n Netboot) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if _, ok := c.installer().(Arch); !ok {
+			return errNetbootArch
+		}
+		bin := n.Binary
+		if bin == "" {
+			self, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			bin = self
+		}
+		dst := filepath.Join(c.Root.Dir, "usr", "local", "bin", "summon")
+		if err := os.MkdirAll(filepath.Dir(dst), os.FileMode(0o755)); err != nil {
+			return err
+		}
+		if err := copyFile(bin, dst, os.FileMode(0o755)); err != nil {
+			return err
+		}
+
+		name := filepath.Join("etc", "systemd", "system", netbootUnit)
+		if err := c.writeTargetFile(name, n.service(), os.FileMode(0o644)); err != nil {
+			return err
+		}
+		if err := c.enableService(netbootUnit, kill); err != nil {
+			return err
+		}
+		// summon installs using the keyring of the installer
+		for _, cmd := range [][]string{
+			{"/usr/bin/pacman-key", "--init"},
+			{"/usr/bin/pacman-key", "--populate", "archlinux"},
+		} {
+			if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+				return err
+			}
+		}
+		return c.packNetboot(n, kill)
+	}
+}
+
+// Copy out the kernel, and pack everything else into the initramfs.
+func (c *Config) packNetboot(n Netboot, kill chan bool) error {
+	if err := os.MkdirAll(n.Dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	kernel := filepath.Join(c.Root.Dir, "boot", "vmlinuz-linux")
+	if err := copyFile(kernel, filepath.Join(n.Dir, "vmlinuz"), os.FileMode(0o644)); err != nil {
+		return err
+	}
+	initramfs, err := filepath.Abs(filepath.Join(n.Dir, "initramfs.img"))
+	if err != nil {
+		return err
+	}
+	// the virtual file systems are left out by -xdev, and the kernel, package
+	// cache and initramfs images only take up memory
+	script := fmt.Sprintf(
+		"find . -xdev ! -path './boot/*' ! -path './var/cache/pacman/pkg/*' | cpio --quiet --create --format=newc | zstd --quiet --force -T0 -19 -o %s",
+		shellquote.Join(initramfs),
+	)
+	cmd := exec.Command("sh", "-o", "pipefail", "-c", script)
+	cmd.Dir = c.Root.Dir
+	if err := run(cmd, kill); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(n.Dir, "summon.ipxe"), []byte(n.ipxe()), os.FileMode(0o644))
+}
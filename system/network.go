@@ -0,0 +1,127 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Network configuration for systemd-networkd and systemd-resolved.
+type Network struct {
+	Interfaces []Interface
+	Netdevs    []Netdev
+}
+
+// An Interface generates a .network file. Match is a glob matching interface
+// names, like "en*" or "br0". Addresses are in CIDR notation. An interface may
+// carry VLANs, or be enslaved to a Bridge or Bond, which are Netdevs.
+type Interface struct {
+	Match     string
+	DHCP      bool
+	Addresses []string
+	Gateway   string
+	DNS       []string
+	VLANs     []string
+	Bridge    string
+	Bond      string
+}
+
+// The kinds of Netdev.
+const (
+	NetdevBridge = "bridge"
+	NetdevBond   = "bond"
+	NetdevVLAN   = "vlan"
+)
+
+// A Netdev generates a .netdev file for a virtual network device. VLANID is
+// only used for VLANs, and BondMode only for bonds.
+type Netdev struct {
+	Name     string
+	Kind     string
+	VLANID   int
+	BondMode string
+}
+
+func (i Interface) network() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Match]\nName=%s\n\n[Network]\n", i.Match)
+	if i.DHCP {
+		b.WriteString("DHCP=yes\n")
+	}
+	for _, a := range i.Addresses {
+		fmt.Fprintf(&b, "Address=%s\n", a)
+	}
+	if i.Gateway != "" {
+		fmt.Fprintf(&b, "Gateway=%s\n", i.Gateway)
+	}
+	for _, d := range i.DNS {
+		fmt.Fprintf(&b, "DNS=%s\n", d)
+	}
+	for _, v := range i.VLANs {
+		fmt.Fprintf(&b, "VLAN=%s\n", v)
+	}
+	if i.Bridge != "" {
+		fmt.Fprintf(&b, "Bridge=%s\n", i.Bridge)
+	}
+	if i.Bond != "" {
+		fmt.Fprintf(&b, "Bond=%s\n", i.Bond)
+	}
+	return b.String()
+}
+
+func (n Netdev) netdev() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[NetDev]\nName=%s\nKind=%s\n", n.Name, n.Kind)
+	switch n.Kind {
+	case NetdevVLAN:
+		fmt.Fprintf(&b, "\n[VLAN]\nId=%d\n", n.VLANID)
+	case NetdevBond:
+		if n.BondMode != "" {
+			fmt.Fprintf(&b, "\n[Bond]\nMode=%s\n", n.BondMode)
+		}
+	}
+	return b.String()
+}
+
+// Name for a generated file, keeping the configured order.
+func networkFileName(i int, name, ext string) string {
+	name = strings.NewReplacer("*", "", "?", "", "/", "-").Replace(name)
+	return fmt.Sprintf("%02d-%s.%s", 10+i, name, ext)
+}
+
+// Generate the systemd-networkd configuration, and enable networkd and
+// resolved with the stub resolver.
+func (c *Config) GenNetwork(kill chan bool) error {
+	if c.Network == nil {
+		return nil
+	}
+
+	dir := filepath.Join(c.Root.Dir, "etc", "systemd", "network")
+	if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	for i, n := range c.Network.Netdevs {
+		name := filepath.Join(dir, networkFileName(i, n.Name, "netdev"))
+		if err := writeFile(name, []byte(n.netdev()), os.FileMode(0o644)); err != nil {
+			return err
+		}
+	}
+	for i, iface := range c.Network.Interfaces {
+		name := filepath.Join(dir, networkFileName(i, iface.Match, "network"))
+		if err := writeFile(name, []byte(iface.network()), os.FileMode(0o644)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.targetSymlink("/run/systemd/resolve/stub-resolv.conf", "/etc/resolv.conf"); err != nil {
+		return err
+	}
+
+	for _, s := range []string{"systemd-networkd.service", "systemd-resolved.service"} {
+		if err := c.enableService(s, kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
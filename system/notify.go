@@ -0,0 +1,245 @@
+package system
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/daaku/errgroup"
+	"github.com/daaku/summon"
+)
+
+// A Notification is sent once an install or backup completes. The Report is
+// the JSON manifest of the run.
+type Notification struct {
+	Subject string
+	Failed  bool
+	Report  []byte
+}
+
+// The message text, with the report following the subject.
+func (n Notification) text() string {
+	return n.Subject + "\n\n" + string(n.Report)
+}
+
+// A Notifier delivers notifications, like to a phone or chat room.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// Webhook POSTs the report to the URL.
+type Webhook struct {
+	URL string
+}
+
+func (w Webhook) Notify(n Notification) error {
+	return post(w.URL, n.Report)
+}
+
+// Ntfy publishes to the ntfy topic URL, like https://ntfy.sh/my-machines,
+// with failures sent at high priority.
+type Ntfy struct {
+	URL string
+}
+
+func (t Ntfy) Notify(n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, t.URL, strings.NewReader(n.text()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Subject)
+	if n.Failed {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	} else {
+		req.Header.Set("Tags", "white_check_mark")
+	}
+	return send(req)
+}
+
+// Matrix sends a message to the Room on the Homeserver, like
+// https://matrix.org, using the access Token of the sending account.
+type Matrix struct {
+	Homeserver string
+	Room       string
+	Token      string
+}
+
+func (m Matrix) Notify(n Notification) error {
+	txn := make([]byte, 8)
+	if _, err := rand.Read(txn); err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": n.text()})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf(
+		"%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimSuffix(m.Homeserver, "/"),
+		url.PathEscape(m.Room),
+		hex.EncodeToString(txn),
+	)
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.Token)
+	return send(req)
+}
+
+// Email sends the notification To the address using the local sendmail,
+// with the report attached.
+type Email struct {
+	To   string
+	From string
+}
+
+func (e Email) message(n Notification) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(text, n.Subject)
+	report, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {"application/json"},
+		"Content-Disposition": {`attachment; filename="report.json"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Write(n.Report)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var m bytes.Buffer
+	fmt.Fprintf(&m, "To: %s\r\n", e.To)
+	if e.From != "" {
+		fmt.Fprintf(&m, "From: %s\r\n", e.From)
+	}
+	fmt.Fprintf(&m, "Subject: %s\r\n", n.Subject)
+	m.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&m, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	m.Write(body.Bytes())
+	return m.Bytes(), nil
+}
+
+func (e Email) Notify(n Notification) error {
+	m, err := e.message(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sendmail", "-t", "-i")
+	cmd.Stdin = bytes.NewReader(m)
+	return run(cmd, nil)
+}
+
+func send(req *http.Request) error {
+	res, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("summon: notifying %s: %s", req.URL.Host, res.Status)
+	}
+	return nil
+}
+
+// ParseNotifier parses a notification target like one of:
+//
+//	https://example.com/hook
+//	ntfy:https://ntfy.sh/my-machines
+//	matrix:https://matrix.org/!room:matrix.org?token=pass:matrix/bot
+//	mailto:ops@example.com
+//
+// The Matrix token is a secret reference, resolved using LookupSecret.
+func ParseNotifier(uri string) (Notifier, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, fmt.Errorf("summon: invalid notification target %q", uri)
+	}
+	switch scheme {
+	case "http", "https":
+		return Webhook{URL: uri}, nil
+	case "ntfy":
+		return Ntfy{URL: rest}, nil
+	case "mailto":
+		return Email{To: rest}, nil
+	case "matrix":
+		u, err := url.Parse(rest)
+		if err != nil {
+			return nil, err
+		}
+		token, err := LookupSecret(u.Query().Get("token"))
+		if err != nil {
+			return nil, err
+		}
+		room := strings.TrimPrefix(u.Path, "/")
+		u.Path, u.RawQuery = "", ""
+		return Matrix{Homeserver: u.String(), Room: room, Token: token}, nil
+	}
+	return nil, fmt.Errorf("summon: unknown notification target %q", scheme)
+}
+
+// Send the notification to each target, with registered secrets redacted.
+func notify(targets []string, n Notification) error {
+	n.Subject = summon.Redact(n.Subject)
+	n.Report = []byte(summon.Redact(string(n.Report)))
+	var errs []error
+	for _, t := range targets {
+		notifier, err := ParseNotifier(t)
+		if err == nil {
+			err = notifier.Notify(n)
+		}
+		errs = append(errs, err)
+	}
+	return errgroup.NewMultiError(errs...)
+}
+
+// The result of an install.
+type InstallReport struct {
+	Name      string
+	Start     time.Time
+	Duration  string
+	Error     string            `json:",omitempty"`
+	Benchmark []BenchmarkResult `json:",omitempty"`
+}
+
+// Notify the Config.Notify targets about the install which started at start,
+// and failed with err if it isn't nil.
+func (c *Config) NotifyInstall(start time.Time, err error) error {
+	if len(c.Notify) == 0 {
+		return nil
+	}
+	r := InstallReport{
+		Name:      c.Name,
+		Start:     start,
+		Duration:  time.Since(start).Round(time.Second).String(),
+		Error:     errorString(err),
+		Benchmark: c.benchmark,
+	}
+	j, jerr := json.MarshalIndent(r, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+	n := Notification{Subject: c.Name + ": install succeeded", Report: j}
+	if err != nil {
+		n.Subject = c.Name + ": install failed"
+		n.Failed = true
+	}
+	return notify(c.Notify, n)
+}
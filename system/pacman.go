@@ -0,0 +1,411 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const mirrorlistInclude = "/etc/pacman.d/mirrorlist"
+
+// Arch installs Arch Linux using pacman, and is the default Installer. It is
+// configured using the pacman related fields of Config.
+type Arch struct{}
+
+// Packages for a minimal bootable system, for use as Config.Packages when no
+// meta-package is available.
+var DefaultPackages = []string{"base", "linux", "linux-firmware"}
+
+func (Arch) EFIVendor() string {
+	return "archlinux"
+}
+
+// The encrypt hook needs the encrypted root device.
+func (Arch) KernelParams(c *Config) []string {
+	params := []string{"init=/usr/lib/systemd/systemd"}
+	if c.Root.Password != "" {
+		params = append(params, "cryptdevice=/dev/disk/by-partlabel/"+c.Root.Name+":"+c.Root.Name)
+	}
+	return params
+}
+
+// Install the filesystem package.
+func (Arch) InstallFileSystem(c *Config, kill chan bool) error {
+	dirs := []string{"var/lib/pacman", "var/cache/pacman/pkg"}
+	for _, d := range dirs {
+		full := path.Join(c.Root.Dir, d)
+		if err := mkdirAll(full, os.FileMode(0o755)); err != nil {
+			return err
+		}
+	}
+
+	if c.Offline != nil {
+		return c.installOffline("filesystem", kill)
+	}
+
+	args := []string{
+		"--refresh",
+		"--root", c.Root.Dir,
+		"--asdeps",
+		"--noconfirm",
+		"--quiet",
+		"--needed",
+		"--sync",
+	}
+	args = append(args, c.pacmanConfArgs()...)
+	args = append(args, "filesystem")
+	return c.pacmanSync(args, kill)
+}
+
+// Install system. The meta-package is installed along with any explicit
+// Packages and Groups. If only explicit Packages or Groups are configured,
+// they are installed instead of the meta-package, similar to pacstrap.
+func (Arch) InstallSystem(c *Config, kill chan bool) error {
+	if c.Offline != nil {
+		if err := c.installOffline("", kill); err != nil {
+			return err
+		}
+		if err := c.configureIgnorePkg(); err != nil {
+			return err
+		}
+		lock, err := ReadLockfile(c.Offline.Lockfile)
+		if err != nil {
+			return err
+		}
+		return lock.Verify(c.Root.Dir)
+	}
+
+	args := []string{
+		"--root", c.Root.Dir,
+		"--noconfirm",
+		"--quiet",
+		"--needed",
+		"--sync",
+	}
+	args = append(args, c.pacmanConfArgs()...)
+	if len(c.IgnorePkg) > 0 {
+		args = append(args, "--ignore", strings.Join(c.IgnorePkg, ","))
+	}
+	meta := c.metaPackage()
+	if meta != "" {
+		args = append(args, meta)
+	}
+	args = append(args, c.Packages...)
+	args = append(args, c.Groups...)
+	if err := c.pacmanSync(args, kill); err != nil {
+		return err
+	}
+
+	if err := c.configureIgnorePkg(); err != nil {
+		return err
+	}
+
+	// without a meta-package to provide one, copy the host mirrorlist into the
+	// target as pacstrap does.
+	if meta == "" {
+		const mirrorlist = "etc/pacman.d/mirrorlist"
+		return copyHostFile(
+			path.Join("/", mirrorlist),
+			path.Join(c.Root.Dir, mirrorlist),
+			os.FileMode(0o644),
+			kill,
+		)
+	}
+	return nil
+}
+
+// The meta-package to install, or an empty string if only explicit packages
+// should be installed.
+func (c *Config) metaPackage() string {
+	if c.Package != "" {
+		return c.Package
+	}
+	if len(c.Packages) > 0 || len(c.Groups) > 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s-system", c.Name)
+}
+
+// Add the IgnorePkg entries to the [options] section of the target's
+// pacman.conf, so they continue to be ignored on upgrades. A generated
+// pacman.conf already includes them.
+func (c *Config) configureIgnorePkg() error {
+	if len(c.IgnorePkg) == 0 || c.Pacman != nil {
+		return nil
+	}
+
+	conf := c.pacmanConf()
+	contents, err := readFile(conf)
+	if err != nil {
+		return err
+	}
+	contents, err = setIgnorePkg(contents, c.IgnorePkg)
+	if err != nil {
+		return fmt.Errorf("%w in %s", err, conf)
+	}
+	return writeFile(conf, contents, os.FileMode(0o644))
+}
+
+// Replace the IgnorePkg entries in the [options] section of the pacman.conf
+// contents with one for the packages, so running it again doesn't add
+// another one.
+func setIgnorePkg(contents []byte, pkgs []string) ([]byte, error) {
+	lines := strings.SplitAfter(string(contents), "\n")
+	section, found := "", false
+	var b strings.Builder
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			section = trimmed
+		}
+		if key, _, ok := strings.Cut(trimmed, "="); ok && section == "[options]" && strings.TrimSpace(key) == "IgnorePkg" {
+			continue
+		}
+		b.WriteString(line)
+		if trimmed == "[options]" && !found {
+			if !strings.HasSuffix(line, "\n") {
+				b.WriteString("\n")
+			}
+			found = true
+			fmt.Fprintf(&b, "IgnorePkg = %s\n", strings.Join(pkgs, " "))
+		}
+	}
+	if !found {
+		return nil, errors.New("no [options] section")
+	}
+	return []byte(b.String()), nil
+}
+
+// Initialize the keyring, generate locales and the initramfs, and copy the
+// kernel and initramfs into the ESP.
+func (a Arch) PostInstall(c *Config, kill chan bool) error {
+	r := c.Root.Dir
+	cmds := [][]string{
+		{"/usr/bin/pacman-key", "--init"},
+		{"/usr/bin/pacman-key", "--populate", "archlinux"},
+		{"/usr/bin/locale-gen"},
+		{"/usr/bin/mkinitcpio", "-p", "linux"},
+		{"/usr/bin/cp", "/boot/vmlinuz-linux", path.Join(c.vendorDir(), "vmlinuz.efi")},
+		{"/usr/bin/cp", "/boot/initramfs-linux.img", path.Join(c.vendorDir(), "initrd.img")},
+	}
+
+	mandb := "/usr/bin/mandb"
+	if ok, _ := exists(filepath.Join(r, mandb)); ok {
+		cmds = append(cmds, []string{mandb, "--quiet"})
+	}
+
+	for _, cmd := range cmds {
+		if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A repository section in pacman.conf.
+type PacmanRepo struct {
+	Name     string
+	SigLevel string
+	Servers  []string
+	Include  string
+}
+
+// The official repositories.
+var (
+	CoreRepo     = PacmanRepo{Name: "core", Include: mirrorlistInclude}
+	ExtraRepo    = PacmanRepo{Name: "extra", Include: mirrorlistInclude}
+	MultilibRepo = PacmanRepo{Name: "multilib", Include: mirrorlistInclude}
+)
+
+// Configuration for the generated pacman.conf of the target. If no Repos are
+// specified, the core and extra repos are used. The Architecture defaults to
+// auto, matching the host. The download settings also apply to the install,
+// which uses the generated pacman.conf. DownloadUser is the user downloads
+// run as, like alpm, instead of root. XferCommand replaces the downloader of
+// pacman, like for a proxy libcurl can't use.
+type PacmanConf struct {
+	Architecture           string
+	SigLevel               string
+	LocalFileSigLevel      string
+	ParallelDownloads      int
+	DisableDownloadTimeout bool
+	DownloadUser           string
+	XferCommand            string
+	Repos                  []PacmanRepo
+}
+
+func (p *PacmanConf) render(ignore []string) string {
+	var b strings.Builder
+	b.WriteString("[options]\n")
+	b.WriteString("HoldPkg = pacman glibc\n")
+	arch := p.Architecture
+	if arch == "" {
+		arch = "auto"
+	}
+	fmt.Fprintf(&b, "Architecture = %s\n", arch)
+	b.WriteString("CheckSpace\n")
+	if p.ParallelDownloads > 0 {
+		fmt.Fprintf(&b, "ParallelDownloads = %d\n", p.ParallelDownloads)
+	}
+	if p.DisableDownloadTimeout {
+		b.WriteString("DisableDownloadTimeout\n")
+	}
+	if p.DownloadUser != "" {
+		fmt.Fprintf(&b, "DownloadUser = %s\n", p.DownloadUser)
+	}
+	if p.XferCommand != "" {
+		fmt.Fprintf(&b, "XferCommand = %s\n", p.XferCommand)
+	}
+	sigLevel := p.SigLevel
+	if sigLevel == "" {
+		sigLevel = "Required DatabaseOptional"
+	}
+	fmt.Fprintf(&b, "SigLevel = %s\n", sigLevel)
+	localFileSigLevel := p.LocalFileSigLevel
+	if localFileSigLevel == "" {
+		localFileSigLevel = "Optional"
+	}
+	fmt.Fprintf(&b, "LocalFileSigLevel = %s\n", localFileSigLevel)
+	if len(ignore) > 0 {
+		fmt.Fprintf(&b, "IgnorePkg = %s\n", strings.Join(ignore, " "))
+	}
+
+	for _, r := range p.repos() {
+		b.WriteString("\n")
+		b.WriteString(r.section())
+	}
+	return b.String()
+}
+
+// The configured Repos, or the default ones.
+func (p *PacmanConf) repos() []PacmanRepo {
+	if len(p.Repos) == 0 {
+		return []PacmanRepo{CoreRepo, ExtraRepo}
+	}
+	return p.Repos
+}
+
+func (r PacmanRepo) section() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]\n", r.Name)
+	if r.SigLevel != "" {
+		fmt.Fprintf(&b, "SigLevel = %s\n", r.SigLevel)
+	}
+	for _, s := range r.Servers {
+		fmt.Fprintf(&b, "Server = %s\n", s)
+	}
+	if r.Include != "" {
+		fmt.Fprintf(&b, "Include = %s\n", r.Include)
+	}
+	return b.String()
+}
+
+// The Arch Linux Archive, which retains every package version.
+const DefaultArchive = "https://archive.archlinux.org"
+
+// Offline installs exclusively from a local package cache, using the exact
+// package versions in the Lockfile. Package databases are never refreshed,
+// and the configured meta-package, Packages and Groups are ignored. If an
+// Archive is specified, locked packages missing from the cache are first
+// downloaded from it, allowing for reinstalling precisely those versions.
+type Offline struct {
+	CacheDir string
+	Lockfile string
+	Archive  string
+}
+
+// Install the locked packages from the offline cache. If only is specified,
+// just that package is installed without its dependencies.
+func (c *Config) installOffline(only string, kill chan bool) error {
+	lock, err := ReadLockfile(c.Offline.Lockfile)
+	if err != nil {
+		return err
+	}
+	if only != "" {
+		if _, ok := lock[only]; !ok {
+			return fmt.Errorf("%s is not in lockfile %s", only, c.Offline.Lockfile)
+		}
+		lock = Lockfile{only: lock[only]}
+	}
+	if c.Offline.Archive != "" {
+		if err := lock.fetch(c.Offline.Archive, c.Offline.CacheDir, c.pacmanArch(), kill); err != nil {
+			return err
+		}
+	}
+	files, err := lock.Files(c.Offline.CacheDir)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"--root", c.Root.Dir,
+		"--cachedir", c.Offline.CacheDir,
+		"--noconfirm",
+		"--quiet",
+		"--needed",
+		"--upgrade",
+	}
+	if only != "" {
+		args = append(args, "--asdeps", "--nodeps")
+	}
+	args = append(args, c.pacmanConfArgs()...)
+	args = append(args, files...)
+	return run(exec.Command("pacman", args...), kill)
+}
+
+// Record the packages installed in the target into a Lockfile.
+func (c *Config) RecordLockfile(name string) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		lock, err := QueryLockfile(c.Root.Dir)
+		if err != nil {
+			return err
+		}
+		return lock.Write(name)
+	}
+}
+
+// The package architecture of the target, as configured in the Pacman
+// configuration or otherwise that of the installer.
+func (c *Config) pacmanArch() string {
+	if c.Pacman != nil && c.Pacman.Architecture != "" && c.Pacman.Architecture != "auto" {
+		return c.Pacman.Architecture
+	}
+	return c.targetArch()
+}
+
+// The pacman.conf of the target.
+func (c *Config) pacmanConf() string {
+	return filepath.Join(c.Root.Dir, "etc", "pacman.conf")
+}
+
+// Arguments to make pacman use the BuildCache and the generated pacman.conf of
+// the target, if configured. The file is also part of the pacman package,
+// which will be installed as a .pacnew instead of conflicting with the
+// generated one.
+func (c *Config) pacmanConfArgs() []string {
+	args := c.pacmanCacheArgs()
+	if c.Pacman == nil {
+		return args
+	}
+	return append(args, "--config", c.pacmanConf(), "--overwrite", "/etc/pacman.conf")
+}
+
+// Generate the pacman.conf of the target. This must run before
+// InstallFileSystem so the declared repositories are used for the install.
+func (c *Config) GenPacmanConf(kill chan bool) error {
+	if c.Pacman == nil {
+		return nil
+	}
+	if err := mkdirAll(filepath.Dir(c.pacmanConf()), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	return writeFile(
+		c.pacmanConf(),
+		[]byte(c.Pacman.render(c.IgnorePkg)),
+		os.FileMode(0o644),
+	)
+}
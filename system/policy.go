@@ -0,0 +1,165 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var errPasswordDenied = errors.New("summon: password contains a denied word")
+
+// Passwords so common they're among the first guesses.
+var commonPasswords = []string{
+	"password", "passw0rd", "letmein", "welcome", "iloveyou", "monkey",
+	"dragon", "master", "admin", "changeme", "secret", "qwerty", "abc123",
+	"123456", "111111", "trustno1", "sunshine", "princess", "football",
+}
+
+// The keyboard rows, for spotting runs of adjacent keys.
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// A PasswordPolicy rejects weak passwords before they protect a disk or an
+// account. Passwords containing a word from the Denylist, or any of the
+// commonly used passwords, are rejected regardless of their entropy.
+type PasswordPolicy struct {
+	MinLength  int
+	MinEntropy float64
+	Denylist   []string
+}
+
+// Check the password against the policy. The extra words, like the machine
+// or user name, are denied along with the Denylist.
+func (p *PasswordPolicy) Check(pass string, extra ...string) error {
+	if n := utf8.RuneCountInString(pass); n < p.MinLength {
+		return fmt.Errorf("summon: password has %d characters but %d are required", n, p.MinLength)
+	}
+	lower := strings.ToLower(pass)
+	for _, lists := range [][]string{commonPasswords, p.Denylist, extra} {
+		for _, w := range lists {
+			if w != "" && strings.Contains(lower, strings.ToLower(w)) {
+				return errPasswordDenied
+			}
+		}
+	}
+	if e := passwordEntropy(pass); e < p.MinEntropy {
+		return fmt.Errorf("summon: password has an estimated %.0f bits of entropy but %.0f are required", e, p.MinEntropy)
+	}
+	return nil
+}
+
+// Check the root disk password, the user passwords and those given to
+// Passwd against the Config.PasswordPolicy, if there is one. This should run
+// before the disks are formatted, to fail before anything is provisioned.
+// Admin users without a password are refused here too, unless NoPasswd.
+func (c *Config) CheckPasswords(kill chan bool) error {
+	if err := c.checkAdminPasswords(); err != nil {
+		return err
+	}
+	if c.PasswordPolicy == nil {
+		return nil
+	}
+	if c.Root.Password != "" {
+		if err := c.PasswordPolicy.Check(c.Root.Password, c.Name); err != nil {
+			return fmt.Errorf("%v: disk %s", err, c.Root.Name)
+		}
+	}
+	for _, u := range c.Users {
+		if u.Password == "" {
+			continue
+		}
+		if err := c.PasswordPolicy.Check(u.Password, c.Name, u.Name); err != nil {
+			return fmt.Errorf("%v: user %s", err, u.Name)
+		}
+	}
+	for user, pass := range c.passwds {
+		if err := c.PasswordPolicy.Check(pass, c.Name, user); err != nil {
+			return fmt.Errorf("%v: user %s", err, user)
+		}
+	}
+	return nil
+}
+
+// An estimate of the entropy in bits, in the spirit of zxcvbn. Characters are
+// assumed to be picked at random from the classes of characters used, except
+// that repeats, sequences like abcd or 4321 and runs of adjacent keys like
+// qwerty only count for as much as their first character and length.
+func passwordEntropy(pass string) float64 {
+	runes := []rune(pass)
+	pool := poolSize(runes)
+	if pool == 0 {
+		return 0
+	}
+	bits := math.Log2(pool)
+	var e float64
+	for i := 0; i < len(runes); {
+		n := patternRun(runes, i)
+		if n < 3 {
+			e += bits
+			i++
+			continue
+		}
+		e += bits + math.Log2(float64(n))
+		i += n
+	}
+	return e
+}
+
+// The number of possible characters from the classes of characters used.
+func poolSize(runes []rune) float64 {
+	var lower, upper, digit, other bool
+	for _, r := range runes {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	var pool float64
+	for _, c := range []struct {
+		used bool
+		size float64
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+	return pool
+}
+
+// The length of the longest repeat, sequence or keyboard run starting at i.
+func patternRun(runes []rune, i int) int {
+	steps := []func(a, b rune) bool{
+		func(a, b rune) bool { return a == b },
+		func(a, b rune) bool { return b == a+1 },
+		func(a, b rune) bool { return b == a-1 },
+		func(a, b rune) bool { return adjacentKeys(a, b) },
+		func(a, b rune) bool { return adjacentKeys(b, a) },
+	}
+	longest := 1
+	for _, step := range steps {
+		n := 1
+		for i+n < len(runes) && step(unicode.ToLower(runes[i+n-1]), unicode.ToLower(runes[i+n])) {
+			n++
+		}
+		longest = max(longest, n)
+	}
+	return longest
+}
+
+// Whether b is the key to the right of a.
+func adjacentKeys(a, b rune) bool {
+	for _, row := range keyboardRows {
+		if i := strings.IndexRune(row, a); i != -1 && i+1 < len(row) && rune(row[i+1]) == b {
+			return true
+		}
+	}
+	return false
+}
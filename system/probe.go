@@ -0,0 +1,123 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// What Probe found on a block device. The Type uses the blkid names, like
+// ext4, btrfs, vfat, swap, xfs or crypto_LUKS, and is empty if no known
+// signature was found.
+type BlockInfo struct {
+	Type  string
+	UUID  string
+	Label string
+}
+
+// Enough of the device to find the superblocks, the last being the btrfs one
+// at 64KiB.
+const probeSize = 0x10000 + 0x1000
+
+// Probe reads the superblock of the device, like blkid, to identify the file
+// system, LUKS container or swap it holds. The device is read on the machine
+// being installed.
+func Probe(device string) (BlockInfo, error) {
+	return probeContext(context.Background(), device)
+}
+
+func probeContext(ctx context.Context, device string) (BlockInfo, error) {
+	b, err := readAtContext(ctx, device, 0, probeSize)
+	if err != nil {
+		return BlockInfo{}, fmt.Errorf("summon: probing %s: %w", device, err)
+	}
+	return probe(b), nil
+}
+
+// Identify the superblock at the start of the device in b.
+func probe(b []byte) BlockInfo {
+	at := func(off, n int) []byte {
+		if off+n > len(b) {
+			return nil
+		}
+		return b[off : off+n]
+	}
+
+	if m := at(0, 6); bytes.Equal(m, []byte("LUKS\xba\xbe")) {
+		info := BlockInfo{Type: "crypto_LUKS", UUID: cstring(at(168, 40))}
+		if binary.BigEndian.Uint16(at(6, 2)) == 2 {
+			info.Label = cstring(at(24, 48))
+		}
+		return info
+	}
+
+	if m := at(0x10040, 8); bytes.Equal(m, []byte("_BHRfS_M")) {
+		return BlockInfo{Type: "btrfs", UUID: formatUUID(at(0x10020, 16)), Label: cstring(at(0x1012b, 256))}
+	}
+
+	if m := at(1024+56, 2); m != nil && binary.LittleEndian.Uint16(m) == 0xef53 {
+		sb := b[1024:]
+		compat := binary.LittleEndian.Uint32(sb[92:])
+		incompat := binary.LittleEndian.Uint32(sb[96:])
+		info := BlockInfo{Type: "ext2", UUID: formatUUID(sb[104:120]), Label: cstring(sb[120:136])}
+		switch {
+		case incompat&(0x40|0x80|0x200) != 0: // extents, 64bit or flex_bg
+			info.Type = "ext4"
+		case compat&0x4 != 0: // has_journal
+			info.Type = "ext3"
+		}
+		return info
+	}
+
+	if m := at(0, 4); bytes.Equal(m, []byte("XFSB")) {
+		return BlockInfo{Type: "xfs", UUID: formatUUID(at(32, 16)), Label: cstring(at(108, 12))}
+	}
+
+	// the swap signature ends the first page, whatever the page size was
+	for _, page := range []int{4096, 8192, 16384, 65536} {
+		if m := at(page-10, 10); bytes.Equal(m, []byte("SWAPSPACE2")) {
+			return BlockInfo{Type: "swap", UUID: formatUUID(at(1036, 16)), Label: cstring(at(1052, 16))}
+		}
+	}
+
+	if m := at(510, 2); bytes.Equal(m, []byte{0x55, 0xaa}) {
+		// FAT32 and FAT12/16 keep the volume id and label at different offsets
+		for _, fat := range []struct{ magic, id, label int }{{0x52, 0x43, 0x47}, {0x36, 0x27, 0x2b}} {
+			if bytes.HasPrefix(at(fat.magic, 8), []byte("FAT")) {
+				id := binary.LittleEndian.Uint32(at(fat.id, 4))
+				label := string(bytes.TrimRight(at(fat.label, 11), " "))
+				if label == "NO NAME" {
+					label = ""
+				}
+				return BlockInfo{Type: "vfat", UUID: fmt.Sprintf("%04X-%04X", id>>16, id&0xffff), Label: label}
+			}
+		}
+	}
+	return BlockInfo{}
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func formatUUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// IdentifyFSType identifies the filesystem on the specified device.
+func IdentifyFSType(ctx context.Context, device string) (string, error) {
+	info, err := probeContext(ctx, device)
+	if err != nil {
+		return "", err
+	}
+	return info.Type, nil
+}
@@ -0,0 +1,79 @@
+package system
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// Parse a line of rsync --info=progress2 output, which looks like:
+//
+//	1,234,567  45%   12.34MB/s    0:01:23 (xfr#12, to-chk=100/200)
+//
+// The message has the transferred bytes, rate and estimated time remaining.
+func parseRsyncProgress(line string) (summon.Event, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasSuffix(fields[1], "%") {
+		return summon.Event{}, false
+	}
+	percent, err := strconv.Atoi(strings.TrimSuffix(fields[1], "%"))
+	if err != nil {
+		return summon.Event{}, false
+	}
+	return summon.Event{
+		Message: strings.Join(fields[:4], " "),
+		Percent: percent,
+	}, true
+}
+
+// Parse a line of the rsync --stats summary into the stats.
+func parseRsyncStats(line string, stats *BackupStats) {
+	number := func(s string) int64 {
+		s, _, _ = strings.Cut(strings.TrimSpace(s), " ")
+		n, _ := strconv.ParseInt(strings.ReplaceAll(s, ",", ""), 10, 64)
+		return n
+	}
+	if k, v, ok := strings.Cut(line, ": "); ok {
+		switch k {
+		case "Number of files":
+			stats.Files = number(v)
+		case "Total transferred file size":
+			stats.Bytes = number(v)
+		}
+	}
+}
+
+// Run rsync with progress reported to the Config.Reporter, if there is one.
+// If limit is set, it is run as a backup command.
+func (c *Config) runRsync(task string, args []string, limit bool, kill chan bool) (BackupStats, error) {
+	if limit {
+		args = append(c.bwlimitArgs("--bwlimit"), args...)
+	}
+	rsync := func(args []string) *exec.Cmd {
+		cmd := exec.Command("rsync", args...)
+		if limit {
+			return c.backupCmd(cmd)
+		}
+		return cmd
+	}
+	args = append([]string{"--stats"}, args...)
+	if c.Reporter != nil {
+		args = append([]string{"--info=progress2", "--no-inc-recursive"}, args...)
+	}
+	var stats BackupStats
+	w := summon.LineWriter(func(line string) {
+		parseRsyncStats(line, &stats)
+		if c.Reporter == nil {
+			return
+		}
+		if e, ok := parseRsyncProgress(line); ok {
+			e.Task = task
+			c.Reporter(e)
+		}
+	})
+	err := runTee(rsync(args), kill, w)
+	w.Close()
+	return stats, err
+}
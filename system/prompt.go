@@ -0,0 +1,126 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/daaku/summon"
+	"golang.org/x/term"
+)
+
+var (
+	errNoTerminal       = errors.New("summon: a terminal is required to prompt for passwords")
+	errPasswordMismatch = errors.New("summon: passwords did not match")
+	errPasswordAttempts = errors.New("summon: too many failed password attempts")
+)
+
+// How many times a PasswordPrompt asks before giving up.
+const promptAttempts = 3
+
+// A PasswordPrompt reads a password from the terminal without echoing it, or
+// with systemd-ask-password when running as a systemd service or without a
+// terminal. With Confirm the password must be entered twice. Passwords with
+// an estimated entropy below MinEntropy bits are rejected, and asked for
+// again.
+type PasswordPrompt struct {
+	Prompt     string
+	Confirm    bool
+	MinEntropy float64
+}
+
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if underSystemd() || !term.IsTerminal(fd) {
+		if _, err := exec.LookPath("systemd-ask-password"); err == nil {
+			return askPassword(prompt)
+		}
+	}
+	if !term.IsTerminal(fd) {
+		return "", errNoTerminal
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	pass, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return string(pass), err
+}
+
+// Running as a systemd service, like a provisioning service, where stdin is
+// not the console.
+func underSystemd() bool {
+	return os.Getenv("INVOCATION_ID") != ""
+}
+
+// Ask using systemd-ask-password, which is answered by whichever password
+// agents are running, like the console, plymouth or a remote agent.
+func askPassword(prompt string) (string, error) {
+	cmd := exec.Command(
+		"systemd-ask-password",
+		"--timeout=0",
+		"--id=summon:"+prompt,
+		prompt+":",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("summon: systemd-ask-password: %v\n%s", err, stderr.Bytes())
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (p PasswordPrompt) Read() (string, error) {
+	for i := 0; i < promptAttempts; i++ {
+		pass, err := readPassword(p.Prompt)
+		if err != nil {
+			return "", err
+		}
+		if e := passwordEntropy(pass); e < p.MinEntropy {
+			fmt.Fprintf(os.Stderr, "password too weak, %.0f bits of entropy but %.0f are required\n", e, p.MinEntropy)
+			continue
+		}
+		if p.Confirm {
+			confirm, err := readPassword("confirm " + p.Prompt)
+			if err != nil {
+				return "", err
+			}
+			if confirm != pass {
+				fmt.Fprintln(os.Stderr, errPasswordMismatch)
+				continue
+			}
+		}
+		return pass, nil
+	}
+	return "", errPasswordAttempts
+}
+
+// Prompt for the root disk password when the step runs, unless one is
+// already set.
+func (c *Config) PromptDiskPassword(p PasswordPrompt) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if c.Root.Password != "" {
+			return nil
+		}
+		pass, err := p.Read()
+		if err != nil {
+			return err
+		}
+		summon.AddSecret(pass)
+		c.Root.Password = pass
+		return nil
+	}
+}
+
+// Like Passwd, with the password prompted for when the step runs.
+func (c *Config) PromptPasswd(user string, p PasswordPrompt) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		pass, err := p.Read()
+		if err != nil {
+			return err
+		}
+		return c.Passwd(user, pass)(kill)
+	}
+}
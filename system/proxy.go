@@ -0,0 +1,79 @@
+package system
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// A Proxy for the downloads of the install, like behind a corporate proxy.
+// HTTPS defaults to HTTP. NoProxy are the hosts and domains reached directly.
+type Proxy struct {
+	HTTP    string
+	HTTPS   string
+	NoProxy []string
+}
+
+// The proxy configured in the environment of summon, if any, to also use in
+// the target.
+func ProxyFromEnvironment() *Proxy {
+	get := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return os.Getenv(strings.ToUpper(name))
+	}
+	p := &Proxy{HTTP: get("http_proxy"), HTTPS: get("https_proxy")}
+	if p.HTTP == "" && p.HTTPS == "" {
+		return nil
+	}
+	if no := get("no_proxy"); no != "" {
+		p.NoProxy = strings.Split(no, ",")
+	}
+	return p
+}
+
+// The environment for the proxy, with the variables in both cases since tools
+// disagree on which they read.
+func (p *Proxy) env() []string {
+	if p == nil {
+		return nil
+	}
+	https := p.HTTPS
+	if https == "" {
+		https = p.HTTP
+	}
+	var env []string
+	for _, v := range [][2]string{
+		{"http_proxy", p.HTTP},
+		{"https_proxy", https},
+		{"no_proxy", strings.Join(p.NoProxy, ",")},
+	} {
+		if v[1] == "" {
+			continue
+		}
+		env = append(env, v[0]+"="+v[1], strings.ToUpper(v[0])+"="+v[1])
+	}
+	return env
+}
+
+// Use the Proxy for the commands run on the host, like pacman, pacstrap or
+// debootstrap, which inherit the environment of summon. Commands in the
+// target get it from targetCmd. Passwords in the proxy URLs are kept out of
+// the output.
+func (c *Config) SetupProxy(kill chan bool) error {
+	for _, e := range c.Proxy.env() {
+		name, value, _ := strings.Cut(e, "=")
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				summon.AddSecret(password)
+			}
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
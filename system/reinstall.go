@@ -0,0 +1,158 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/daaku/summon"
+)
+
+var errReinstallBtrfs = errors.New("summon: reinstalling and subvolumes require a btrfs root")
+
+// A Subvolume is a top level btrfs subvolume of the root, like __home at
+// /home, which is mounted in the target and kept when reinstalling.
+type Subvolume struct {
+	Name       string
+	Mountpoint string
+}
+
+// The subvolumes below dir, which is a subvolume itself, with the deepest
+// ones last.
+func nestedSubvolumes(dir string) ([]string, error) {
+	if !summon.Local() {
+		out, err := output(exec.Command("find", dir, "-mindepth", "1", "-type", "d", "-inum", strconv.Itoa(btrfsSubvolInode)), nil)
+		if err != nil {
+			return nil, err
+		}
+		nested := strings.Fields(string(out))
+		slices.Sort(nested)
+		return nested, nil
+	}
+	var nested []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || p == dir {
+			return err
+		}
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			return err
+		}
+		if st.Ino == btrfsSubvolInode {
+			nested = append(nested, p)
+		}
+		return nil
+	})
+	return nested, err
+}
+
+// Reinstall replaces the active subvolume with an empty one, after taking a
+// snapshot of it, so the system can be installed again without touching the
+// partitions or the other subvolumes. Subvolumes within it at the mountpoint
+// of one of the Subvolumes, from before they were configured, are moved to
+// the top level. Other nested subvolumes, like the ones systemd creates for
+// /var/lib/machines, are not in the snapshot and are deleted.
+func (c *Config) Reinstall(kill chan bool) error {
+	if c.Root.FSType != Btrfs {
+		return errReinstallBtrfs
+	}
+	if err := c.Root.Snapshot("before-reinstall")(kill); err != nil {
+		return err
+	}
+
+	dir, err := mountBtrfsRoot(c.Root.fsDev(), kill)
+	if err != nil {
+		return err
+	}
+	defer umountBtrfsRoot(dir, kill)
+
+	active := path.Join(dir, btrfsActive)
+	nested, err := nestedSubvolumes(active)
+	if err != nil {
+		return err
+	}
+	for _, s := range c.Subvolumes {
+		old := filepath.Join(active, s.Mountpoint)
+		i := slices.Index(nested, old)
+		if i < 0 {
+			continue
+		}
+		if ok, _ := exists(path.Join(dir, s.Name)); ok {
+			return fmt.Errorf("summon: both %s and the subvolume %s exist", old, s.Name)
+		}
+		if err := rename(old, path.Join(dir, s.Name)); err != nil {
+			return err
+		}
+		nested = slices.Delete(nested, i, i+1)
+	}
+	slices.Reverse(nested)
+	for _, n := range append(nested, active) {
+		if err := run(exec.Command("btrfs", "subvolume", "delete", n), kill); err != nil {
+			return err
+		}
+	}
+	return run(exec.Command("btrfs", "subvolume", "create", active), kill)
+}
+
+// Mount the Subvolumes in the target, creating the ones which don't exist.
+func (c *Config) MountSubvolumes(kill chan bool) error {
+	if len(c.Subvolumes) == 0 {
+		return nil
+	}
+	if c.Root.FSType != Btrfs {
+		return errReinstallBtrfs
+	}
+	if err := c.createSubvolumes(kill); err != nil {
+		return err
+	}
+	options, err := c.rootMountOptions()
+	if err != nil {
+		return err
+	}
+	for _, s := range c.Subvolumes {
+		dir := filepath.Join(c.Root.Dir, s.Mountpoint)
+		if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+			return err
+		}
+		if err := mount(c.Root.fsDev(), dir, string(Btrfs), options+",subvol="+s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) createSubvolumes(kill chan bool) error {
+	dir, err := mountBtrfsRoot(c.Root.fsDev(), kill)
+	if err != nil {
+		return err
+	}
+	defer umountBtrfsRoot(dir, kill)
+	for _, s := range c.Subvolumes {
+		sub := path.Join(dir, s.Name)
+		if ok, _ := exists(sub); ok {
+			continue
+		}
+		if err := run(exec.Command("btrfs", "subvolume", "create", sub), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmount the Subvolumes, in the reverse order they were mounted.
+func (c *Config) UmountSubvolumes(kill chan bool) error {
+	for i := len(c.Subvolumes) - 1; i >= 0; i-- {
+		if err := umount(filepath.Join(c.Root.Dir, c.Subvolumes[i].Mountpoint)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
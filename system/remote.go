@@ -0,0 +1,296 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/daaku/summon"
+	"golang.org/x/sys/unix"
+)
+
+// Like run, returning what the command wrote to stdout, for probes like
+// lspci or losetup, which must run on the machine being installed.
+func output(cmd *exec.Cmd, kill chan bool) ([]byte, error) {
+	var b bytes.Buffer
+	if err := runTee(cmd, kill, &b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The exit code of the script readFile uses when the file doesn't exist.
+const exitNotExist = 66
+
+// Read a file on the machine being installed.
+func readFile(name string) ([]byte, error) {
+	if summon.Local() {
+		return os.ReadFile(name)
+	}
+	var b bytes.Buffer
+	cmd := exec.Command("sh", "-c", fmt.Sprintf(`[ -e "$1" ] || exit %d; exec cat -- "$1"`, exitNotExist), "sh", name)
+	cmd.Stdout = &b
+	err := summon.RunCommand(context.Background(), cmd)
+	var exit interface{ ExitCode() int }
+	if errors.As(err, &exit) && exit.ExitCode() == exitNotExist {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("summon: reading %s: %w", name, err)
+	}
+	return b.Bytes(), nil
+}
+
+// Create the directory and its parents.
+func mkdirAll(dir string, mode os.FileMode) error {
+	if summon.Local() {
+		return os.MkdirAll(dir, mode)
+	}
+	return run(exec.Command("mkdir", "-p", "-m", fmt.Sprintf("%o", mode.Perm()), "--", dir), nil)
+}
+
+// Make the symlink at link pointing to target.
+func symlink(target, link string) error {
+	if summon.Local() {
+		return os.Symlink(target, link)
+	}
+	return run(exec.Command("ln", "-s", "--", target, link), nil)
+}
+
+// Remove the file or empty directory, if it exists.
+func remove(name string) error {
+	if summon.Local() {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return run(exec.Command("rm", "-f", "-d", "--", name), nil)
+}
+
+// Remove the file or directory with everything in it.
+func removeAll(name string) error {
+	if summon.Local() {
+		return os.RemoveAll(name)
+	}
+	return run(exec.Command("rm", "-r", "-f", "--", name), nil)
+}
+
+// Rename old to new, replacing new if it is a file.
+func rename(old, new string) error {
+	if summon.Local() {
+		return os.Rename(old, new)
+	}
+	return run(exec.Command("mv", "-T", "--", old, new), nil)
+}
+
+func chmod(name string, mode os.FileMode) error {
+	if summon.Local() {
+		return os.Chmod(name, mode)
+	}
+	return run(exec.Command("chmod", fmt.Sprintf("%o", mode.Perm()), "--", name), nil)
+}
+
+// Change the owner of the file, or of the link itself for a symlink.
+func lchown(name string, uid, gid int) error {
+	if summon.Local() {
+		return os.Lchown(name, uid, gid)
+	}
+	return run(exec.Command("chown", "-h", fmt.Sprintf("%d:%d", uid, gid), "--", name), nil)
+}
+
+// Copy the local file src to dst on the machine being installed, like the
+// summon binary or saved host keys.
+func uploadFile(src, dst string, mode os.FileMode) error {
+	b, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return writeFile(dst, b, mode)
+}
+
+// Copy a file of the host to dst, both on the machine being installed.
+func copyHostFile(src, dst string, mode os.FileMode, kill chan bool) error {
+	if summon.Local() {
+		return copyFile(src, dst, mode)
+	}
+	return run(exec.Command("install", "-D", "-m", fmt.Sprintf("%o", mode.Perm()), "--", src, dst), kill)
+}
+
+// Create a new temporary directory, like for mounting the btrfs top level.
+func mkdirTemp(pattern string) (string, error) {
+	if summon.Local() {
+		return os.MkdirTemp("", pattern)
+	}
+	out, err := output(exec.Command("mktemp", "-d", "-t", pattern+"XXXXXXXX"), nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// The files matching the pattern, on the machine being installed.
+func glob(pattern string) ([]string, error) {
+	if summon.Local() {
+		return filepath.Glob(pattern)
+	}
+	script := `for f in $1; do [ -e "$f" ] && printf '%s\0' "$f"; done; true`
+	out, err := output(exec.Command("sh", "-c", script, "sh", pattern), nil)
+	if err != nil {
+		return nil, err
+	}
+	return splitNUL(out), nil
+}
+
+// The names in NUL separated output, which unlike whitespace can't be part of
+// one.
+func splitNUL(out []byte) []string {
+	var names []string
+	for _, n := range strings.Split(string(out), "\x00") {
+		if n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// The target of the symlink.
+func readlink(name string) (string, error) {
+	if summon.Local() {
+		return os.Readlink(name)
+	}
+	var b bytes.Buffer
+	cmd := exec.Command("readlink", "--", name)
+	cmd.Stdout = &b
+	if err := summon.RunCommand(context.Background(), cmd); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// Read up to n bytes at off of the file, like a disk, on the machine being
+// installed. Less is returned if the file ends first.
+func readAt(name string, off, n int64) ([]byte, error) {
+	return readAtContext(context.Background(), name, off, n)
+}
+
+// Like readAt, stopping when the ctx is done.
+func readAtContext(ctx context.Context, name string, off, n int64) ([]byte, error) {
+	if summon.Local() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		b := make([]byte, n)
+		read, err := f.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return b[:read], nil
+	}
+	var b bytes.Buffer
+	cmd := exec.Command(
+		"dd",
+		"if="+name,
+		"bs=64K",
+		"iflag=skip_bytes,count_bytes",
+		fmt.Sprintf("skip=%d", off),
+		fmt.Sprintf("count=%d", n),
+		"status=none",
+	)
+	cmd.Stdout = &b
+	if err := summon.RunCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The logical sector size of the disk, or 512 for an image file.
+func sectorSize(disk string) int64 {
+	if summon.Local() {
+		f, err := os.Open(disk)
+		if err != nil {
+			return 512
+		}
+		defer f.Close()
+		if sector, err := unix.IoctlGetInt(int(f.Fd()), unix.BLKSSZGET); err == nil {
+			return int64(sector)
+		}
+		return 512
+	}
+	out, err := output(exec.Command("blockdev", "--getss", disk), nil)
+	if err != nil {
+		return 512
+	}
+	sector, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 512
+	}
+	return sector
+}
+
+// The path with symlinks resolved, like for device links.
+func realpath(name string) (string, error) {
+	if summon.Local() {
+		return filepath.EvalSymlinks(name)
+	}
+	out, err := output(exec.Command("realpath", "-e", "--", name), nil)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// Reports whether the file exists, following symlinks.
+func exists(name string) (bool, error) {
+	if summon.Local() {
+		_, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	script := fmt.Sprintf(`[ -e "$1" ] || exit %d`, exitNotExist)
+	err := summon.RunCommand(context.Background(), exec.Command("sh", "-c", script, "sh", name))
+	var exit interface{ ExitCode() int }
+	if errors.As(err, &exit) && exit.ExitCode() == exitNotExist {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// The names of the entries in the directory, sorted.
+func readDirNames(dir string) ([]string, error) {
+	if summon.Local() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name()
+		}
+		return names, nil
+	}
+	cmd := exec.Command("find", dir, "-mindepth", "1", "-maxdepth", "1", "-printf", `%f\0`)
+	out, err := output(cmd, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := splitNUL(out)
+	sort.Strings(names)
+	return names, nil
+}
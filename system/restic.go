@@ -0,0 +1,155 @@
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/daaku/summon"
+)
+
+// Restic backs up to a restic repository, which is initialized if necessary.
+// The password is read from the PasswordFile or the output of the
+// PasswordCommand. Env is added to the environment of restic, for example
+// for cloud storage credentials. Backups are tagged with the Tags, and if a
+// Retention is configured, Prune removes old backups with the same tags.
+type Restic struct {
+	Repository      string
+	PasswordFile    string
+	PasswordCommand string
+	Env             []string
+	Tags            []string
+	Retention       *Retention
+}
+
+func (r Restic) cmd(args ...string) *exec.Cmd {
+	cmd := exec.Command("restic", args...)
+	cmd.Env = append(os.Environ(), "RESTIC_REPOSITORY="+r.Repository)
+	if r.PasswordFile != "" {
+		cmd.Env = append(cmd.Env, "RESTIC_PASSWORD_FILE="+r.PasswordFile)
+	}
+	if r.PasswordCommand != "" {
+		cmd.Env = append(cmd.Env, "RESTIC_PASSWORD_COMMAND="+r.PasswordCommand)
+	}
+	cmd.Env = append(cmd.Env, r.Env...)
+	return cmd
+}
+
+// Initialize the repository unless it already exists.
+func (r Restic) init(kill chan bool) error {
+	if err := summon.RunCommand(context.Background(), r.cmd("cat", "config")); err == nil {
+		return nil
+	}
+	return run(r.cmd("init"), kill)
+}
+
+func (r Restic) tagArgs() []string {
+	var args []string
+	for _, t := range r.Tags {
+		args = append(args, "--tag", t)
+	}
+	return args
+}
+
+func (r Restic) String() string {
+	return "restic " + r.Repository
+}
+
+func (r Restic) Backup(c *Config, sources []string, kill chan bool) (BackupStats, error) {
+	var stats BackupStats
+	if err := r.init(kill); err != nil {
+		return stats, err
+	}
+
+	patterns, err := c.allExcludes(sources)
+	if err != nil {
+		return stats, err
+	}
+	excludes, remove, err := writeTemp("summon-exclude-", strings.Join(patterns, "\n")+"\n")
+	if err != nil {
+		return stats, err
+	}
+	defer remove()
+	args := []string{
+		"backup",
+		"--json",
+		"--one-file-system",
+		"--exclude-caches",
+		"--exclude-file", excludes,
+	}
+	args = append(args, r.tagArgs()...)
+	args = append(args, c.bwlimitArgs("--limit-upload")...)
+	args = append(args, sources...)
+	// the summary is the last of the JSON messages
+	w := summon.LineWriter(func(line string) {
+		var m struct {
+			MessageType string `json:"message_type"`
+			Files       int64  `json:"total_files_processed"`
+			Bytes       int64  `json:"data_added"`
+		}
+		if json.Unmarshal([]byte(line), &m) == nil && m.MessageType == "summary" {
+			stats = BackupStats{Files: m.Files, Bytes: m.Bytes}
+		}
+	})
+	err = runTee(c.backupCmd(r.cmd(args...)), kill, w)
+	w.Close()
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// Forget the snapshots with all the Tags which the Retention doesn't keep,
+// and prune the data only they referenced.
+func (r Restic) Prune(c *Config, dryRun bool, kill chan bool) ([]string, error) {
+	if r.Retention == nil {
+		return nil, nil
+	}
+	args := []string{"forget", "--json"}
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	if len(r.Tags) > 0 {
+		args = append(args, "--tag", strings.Join(r.Tags, ","))
+	}
+	args = append(args, r.Retention.keepArgs()...)
+	var out bytes.Buffer
+	if err := runStreams(r.cmd(args...), kill, &out, io.Discard); err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Remove []struct {
+			Time    time.Time `json:"time"`
+			ShortID string    `json:"short_id"`
+		} `json:"remove"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &groups); err != nil {
+		return nil, fmt.Errorf("summon: parsing restic forget output: %v", err)
+	}
+	var removed []string
+	for _, g := range groups {
+		for _, s := range g.Remove {
+			removed = append(removed, s.ShortID+" "+s.Time.Format(time.RFC3339))
+		}
+	}
+	if dryRun || len(removed) == 0 {
+		return removed, nil
+	}
+	return removed, run(r.cmd("prune"), kill)
+}
+
+// Restore the path from the latest backup with the Tags.
+func (r Restic) Restore(c *Config, path string, kill chan bool) error {
+	args := []string{"restore", "latest:" + path, "--target", c.Root.Dir}
+	if len(r.Tags) > 0 {
+		args = append(args, "--tag", strings.Join(r.Tags, ","))
+	}
+	return run(r.cmd(args...), kill)
+}
@@ -0,0 +1,91 @@
+package system
+
+import (
+	"strconv"
+	"time"
+)
+
+// How many backups to keep. Zero values keep none for that interval, but the
+// most recent backup is always kept.
+type Retention struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// The --keep flags understood by both restic and borg.
+func (r *Retention) keepArgs() []string {
+	keep := []struct {
+		flag string
+		n    int
+	}{
+		{"--keep-last", r.Last},
+		{"--keep-daily", r.Daily},
+		{"--keep-weekly", r.Weekly},
+		{"--keep-monthly", r.Monthly},
+	}
+	var args []string
+	for _, k := range keep {
+		if k.n > 0 {
+			args = append(args, k.flag, strconv.Itoa(k.n))
+		}
+	}
+	return args
+}
+
+// Which of the backup times, sorted newest first, to keep. Like restic and
+// borg, the newest backup in each of the last N days, weeks or months is
+// kept, and a backup kept for one rule also counts towards the others.
+func (r *Retention) keep(times []time.Time) []bool {
+	keep := make([]bool, len(times))
+	if len(times) == 0 {
+		return keep
+	}
+	keep[0] = true
+	for i := 0; i < r.Last && i < len(times); i++ {
+		keep[i] = true
+	}
+	buckets := []struct {
+		n   int
+		key func(time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return strconv.Itoa(year) + "-" + strconv.Itoa(week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		seen := map[string]bool{}
+		for i, t := range times {
+			if len(seen) == b.n {
+				break
+			}
+			if k := b.key(t); !seen[k] {
+				seen[k] = true
+				keep[i] = true
+			}
+		}
+	}
+	return keep
+}
+
+// Prune old backups from each of the backends, according to their Retention.
+// With dryRun nothing is removed, and list is called with each backup which
+// would be. Otherwise list is called with each removed backup.
+func (c *Config) PruneBackups(backends []BackupBackend, dryRun bool, list func(b BackupBackend, backup string)) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		for _, b := range backends {
+			pruned, err := b.Prune(c, dryRun, kill)
+			for _, p := range pruned {
+				list(b, p)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,170 @@
+package system
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The names of dated backup directories within an rsync Destination, and of
+// the symlink to the latest complete one.
+const (
+	rsyncDateFormat = "2006-01-02T150405"
+	rsyncLatest     = "latest"
+)
+
+var errRsyncRemotePrune = errors.New("summon: pruning is only supported for local rsync destinations")
+
+// Rsync backs up to the Destination directory, which may be remote in the
+// usual rsync host:path form. The Args are added to those rsync is run with.
+//
+// With Dated set, each backup goes into a new directory in the Destination
+// named by the time, with files unchanged since the latest backup hard linked
+// to it using --link-dest, so every directory is a complete copy while only
+// changed files take up space. The latest symlink is moved to the new
+// directory once the backup completes, so a failed backup leaves it pointing
+// at the previous one. If a Retention is configured, Prune removes old dated
+// directories from a local Destination.
+type Rsync struct {
+	Destination string
+	Args        []string
+	Dated       bool
+	Retention   *Retention
+}
+
+func (r Rsync) args() []string {
+	args := []string{
+		"--archive",
+		"--one-file-system",
+		"--sparse",
+		"--delete-delay",
+		"--partial",
+		"--xattrs",
+		"--acls",
+		"--hard-links",
+	}
+	return append(args, r.Args...)
+}
+
+func (r Rsync) String() string {
+	return "rsync " + r.Destination
+}
+
+func (r Rsync) Backup(c *Config, sources []string, kill chan bool) (BackupStats, error) {
+	excludes, remove, err := c.rsyncExcludeArgs()
+	if err != nil {
+		return BackupStats{}, err
+	}
+	defer remove()
+	args := append(r.args(), excludes...)
+	if !r.Dated {
+		args = append(args, sources...)
+		args = append(args, r.Destination)
+		return c.runRsync("Backup to "+r.Destination, args, true, kill)
+	}
+
+	// a missing link-dest, as for the first backup, only warns
+	name := time.Now().Format(rsyncDateFormat)
+	args = append(args, "--link-dest", "../"+rsyncLatest)
+	args = append(args, sources...)
+	args = append(args, r.Destination+"/"+name+"/")
+	stats, err := c.runRsync("Backup to "+r.Destination, args, true, kill)
+	if err != nil {
+		return stats, err
+	}
+	return stats, r.setLatest(name, kill)
+}
+
+// Point the latest symlink at the named backup. The symlink is transferred
+// with rsync itself so that remote destinations work too.
+func (r Rsync) setLatest(name string, kill chan bool) error {
+	dir, err := os.MkdirTemp("", "summon-rsync-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	link := filepath.Join(dir, rsyncLatest)
+	if err := os.Symlink(name, link); err != nil {
+		return err
+	}
+	return run(exec.Command("rsync", "--links", link, r.Destination+"/"), kill)
+}
+
+// The path is relative to the Destination, as rsync copies the last
+// component of a source without a trailing slash. Dated backups are restored
+// from the latest one.
+func (r Rsync) Restore(c *Config, path string, kill chan bool) error {
+	src := r.Destination
+	if r.Dated {
+		src = src + "/" + rsyncLatest
+	}
+	args := append(r.args(), "--numeric-ids")
+	args = append(args, filepath.Join(src, path)+"/", c.Root.Dir+"/")
+	_, err := c.runRsync("Restore from "+r.Destination, args, false, kill)
+	return err
+}
+
+// A host:path destination, where the host part has no slash before the colon.
+func (r Rsync) remote() bool {
+	i := strings.Index(r.Destination, ":")
+	return i > 0 && !strings.Contains(r.Destination[:i], "/")
+}
+
+// The dated backup directories in the Destination, newest first.
+func (r Rsync) dated() ([]string, []time.Time, error) {
+	entries, err := os.ReadDir(r.Destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := time.ParseInLocation(rsyncDateFormat, e.Name(), time.Local); err == nil && e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	// the format sorts lexically by time
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	times := make([]time.Time, len(names))
+	for i, n := range names {
+		times[i], _ = time.ParseInLocation(rsyncDateFormat, n, time.Local)
+	}
+	return names, times, nil
+}
+
+// Remove the dated directories which the Retention doesn't keep.
+func (r Rsync) Prune(c *Config, dryRun bool, kill chan bool) ([]string, error) {
+	if r.Retention == nil {
+		return nil, nil
+	}
+	if r.remote() {
+		return nil, errRsyncRemotePrune
+	}
+	names, times, err := r.dated()
+	if err != nil {
+		return nil, err
+	}
+	// a failed backup may be newer than the latest complete one
+	latest, _ := os.Readlink(filepath.Join(r.Destination, rsyncLatest))
+	var pruned []string
+	for i, keep := range r.Retention.keep(times) {
+		if keep || names[i] == latest {
+			continue
+		}
+		if !dryRun {
+			select {
+			case <-kill:
+				return pruned, errKilled
+			default:
+			}
+			if err := os.RemoveAll(filepath.Join(r.Destination, names[i])); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, names[i])
+	}
+	return pruned, nil
+}
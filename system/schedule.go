@@ -0,0 +1,180 @@
+package system
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errTimerWithoutSystemd = errors.New("summon: backup timers require systemd")
+	errTimerCrossArch      = errors.New("summon: backup timers require the target to match the host architecture")
+	errNoBackupTarget      = errors.New("summon: backup target has no backend configured")
+)
+
+const (
+	backupUnit    = "summon-backup"
+	backupJobFile = "/etc/summon/backup.json"
+	backupBinary  = "/usr/local/bin/summon"
+)
+
+// Where to back up to. Exactly one of the backends should be set.
+type BackupTarget struct {
+	Rsync  *Rsync  `json:",omitempty"`
+	Restic *Restic `json:",omitempty"`
+	Borg   *Borg   `json:",omitempty"`
+}
+
+func (t BackupTarget) Backend() (BackupBackend, error) {
+	switch {
+	case t.Rsync != nil:
+		return *t.Rsync, nil
+	case t.Restic != nil:
+		return *t.Restic, nil
+	case t.Borg != nil:
+		return *t.Borg, nil
+	}
+	return nil, errNoBackupTarget
+}
+
+// A BackupJob is a backup declared at install time, which is run on the
+// Schedule by a systemd timer in the target. The Sources are backed up to
+// all the Targets from the same snapshot. The Schedule is a systemd calendar
+// event, and defaults to daily.
+type BackupJob struct {
+	Sources  []string
+	Targets  []BackupTarget
+	Excludes []string      `json:",omitempty"`
+	Limits   *BackupLimits `json:",omitempty"`
+	Report   *BackupReport `json:",omitempty"`
+	Live     bool          `json:",omitempty"`
+	Schedule string        `json:",omitempty"`
+}
+
+func ReadBackupJob(name string) (*BackupJob, error) {
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var j BackupJob
+	if err := json.Unmarshal(contents, &j); err != nil {
+		return nil, fmt.Errorf("summon: invalid backup job %s: %v", name, err)
+	}
+	return &j, nil
+}
+
+// Run the job with the configuration it was declared with.
+func (c *Config) RunBackupJob(j *BackupJob) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		backends, err := j.backends()
+		if err != nil {
+			return err
+		}
+		c.BackupExcludes = j.Excludes
+		c.BackupLimits = j.Limits
+		c.BackupReport = j.Report
+		c.BackupLive = j.Live
+		return c.BackupFanOut(backends, j.Sources)(kill)
+	}
+}
+
+func (j *BackupJob) backends() ([]BackupBackend, error) {
+	if len(j.Targets) == 0 {
+		return nil, errNoBackupTarget
+	}
+	var backends []BackupBackend
+	for _, t := range j.Targets {
+		b, err := t.Backend()
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+func (c *Config) backupUnits() (service, timer string) {
+	schedule := c.BackupJob.Schedule
+	if schedule == "" {
+		schedule = "daily"
+	}
+
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=summon backup\n")
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=oneshot\n")
+	fmt.Fprintf(&b, "ExecStart=%s --name %s run-backup --job %s\n", backupBinary, c.Name, backupJobFile)
+	service = b.String()
+
+	b.Reset()
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=summon backup schedule\n")
+	b.WriteString("\n[Timer]\n")
+	fmt.Fprintf(&b, "OnCalendar=%s\n", schedule)
+	b.WriteString("Persistent=true\n")
+	b.WriteString("RandomizedDelaySec=15min\n")
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=timers.target\n")
+	timer = b.String()
+	return service, timer
+}
+
+// Install the BackupJob into the target, along with this summon binary, and
+// a service and timer which run it on the schedule.
+func (c *Config) GenBackupTimer(kill chan bool) error {
+	if c.BackupJob == nil {
+		return nil
+	}
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return errTimerWithoutSystemd
+	}
+	if c.crossArch() {
+		return errTimerCrossArch
+	}
+	if _, err := c.BackupJob.backends(); err != nil {
+		return err
+	}
+
+	job, err := json.MarshalIndent(c.BackupJob, "", "  ")
+	if err != nil {
+		return err
+	}
+	jobFile := filepath.Join(c.Root.Dir, backupJobFile)
+	if err := writeFile(jobFile, append(job, '\n'), os.FileMode(0o600)); err != nil {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	binary := filepath.Join(c.Root.Dir, backupBinary)
+	if err := mkdirAll(filepath.Dir(binary), os.FileMode(0o755)); err != nil {
+		return err
+	}
+	if err := uploadFile(self, binary, os.FileMode(0o755)); err != nil {
+		return err
+	}
+
+	service, timer := c.backupUnits()
+	dir := filepath.Join(c.Root.Dir, "etc", "systemd", "system")
+	if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	units := map[string]string{
+		backupUnit + ".service": service,
+		backupUnit + ".timer":   timer,
+	}
+	for name, contents := range units {
+		if err := writeFile(filepath.Join(dir, name), []byte(contents), os.FileMode(0o644)); err != nil {
+			return err
+		}
+	}
+	return c.enableService(backupUnit+".timer", kill)
+}
@@ -0,0 +1,144 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+var errSecretURI = errors.New("summon: secret references must be like scheme:name")
+
+// A SecretProvider looks up a secret by name, so that the secret itself
+// never needs to be in the configuration. What the name means depends on the
+// provider.
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// PassProvider reads the first line of an entry from pass, or a compatible
+// password store like gopass.
+type PassProvider struct {
+	Command string
+}
+
+func (p PassProvider) Secret(name string) (string, error) {
+	command := p.Command
+	if command == "" {
+		command = "pass"
+	}
+	out, err := exec.Command(command, "show", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("summon: %s show %s: %v", command, name, err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return line, nil
+}
+
+// AgeProvider decrypts the named age encrypted file with the Identity file,
+// which defaults to ~/.config/age/keys.txt. Trailing newlines are removed.
+type AgeProvider struct {
+	Identity string
+}
+
+func (p AgeProvider) Secret(name string) (string, error) {
+	identity := p.Identity
+	if identity == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		identity = filepath.Join(home, ".config", "age", "keys.txt")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", "--decrypt", "--identity", identity, name)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("summon: decrypting %s: %v\n%s", name, err, stderr.Bytes())
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// EnvProvider reads the named environment variable, which must be set.
+type EnvProvider struct{}
+
+func (EnvProvider) Secret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("summon: environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+// PromptProvider asks for the secret on the terminal, using the name as the
+// prompt.
+type PromptProvider struct {
+	Confirm    bool
+	MinEntropy float64
+}
+
+func (p PromptProvider) Secret(name string) (string, error) {
+	return PasswordPrompt{Prompt: name, Confirm: p.Confirm, MinEntropy: p.MinEntropy}.Read()
+}
+
+// The providers by URI scheme. More may be added with
+// RegisterSecretProvider.
+var secretProviders = map[string]SecretProvider{
+	"pass":   PassProvider{},
+	"gopass": PassProvider{Command: "gopass"},
+	"age":    AgeProvider{},
+	"env":    EnvProvider{},
+	"prompt": PromptProvider{Confirm: true},
+}
+
+// Use the provider for secrets referenced with the scheme, replacing any
+// existing one.
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	secretProviders[scheme] = p
+}
+
+// Look up a secret by a reference like pass:machines/boe/root,
+// age:/media/usb/boe.age, env:BOE_PASSWORD or prompt:boe disk password.
+func LookupSecret(uri string) (string, error) {
+	scheme, name, ok := strings.Cut(uri, ":")
+	if !ok || name == "" {
+		return "", errSecretURI
+	}
+	p, ok := secretProviders[scheme]
+	if !ok {
+		return "", fmt.Errorf("summon: unknown secret provider %q", scheme)
+	}
+	return p.Secret(name)
+}
+
+// Fill in the root disk password from Config.DiskPasswordSecret, and user
+// passwords from their PasswordSecret, when the step runs. Passwords which
+// are already set are left alone.
+func (c *Config) ResolveSecrets(kill chan bool) error {
+	if c.DiskPasswordSecret != "" && c.Root.Password == "" {
+		pass, err := LookupSecret(c.DiskPasswordSecret)
+		if err != nil {
+			return err
+		}
+		summon.AddSecret(pass)
+		c.Root.Password = pass
+	}
+	for i, u := range c.Users {
+		if u.PasswordSecret == "" || u.Password != "" || u.PasswordHash != "" {
+			continue
+		}
+		pass, err := LookupSecret(u.PasswordSecret)
+		if err != nil {
+			return err
+		}
+		summon.AddSecret(pass)
+		c.Users[i].Password = pass
+	}
+	return nil
+}
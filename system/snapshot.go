@@ -0,0 +1,209 @@
+package system
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/daaku/errgroup"
+)
+
+const (
+	btrfsSuperMagic = 0x9123683e
+	// the inode number of the root directory of every btrfs subvolume
+	btrfsSubvolInode = 256
+	snapshotPrefix   = ".summon-snapshot-"
+)
+
+func isBtrfs(dir string) (bool, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return false, err
+	}
+	return fs.Type == btrfsSuperMagic, nil
+}
+
+// The root of the btrfs subvolume containing dir.
+func subvolumeRoot(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			return "", err
+		}
+		if st.Ino == btrfsSubvolInode || dir == "/" {
+			return dir, nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Read-only snapshots of the backup sources, so every backup target sees the
+// same point in time.
+type sourceSnapshots struct {
+	// the snapshot subvolumes, by the subvolume they are of
+	snapshots map[string]string
+	// the snapshot of each source, to bind mount over it
+	binds [][2]string
+	// the sources to back up
+	sources []string
+}
+
+// Snapshot the subvolumes containing the btrfs sources, each at most once,
+// removing snapshots left behind by interrupted backups. Other sources are
+// used as they are.
+//
+// Backups run in a private mount namespace with the snapshot of each source
+// bind mounted over it, so the backed up paths are unchanged. This is not
+// possible for the root directory, which is instead backed up from the
+// snapshot path. As rsync copies the contents of a source with a trailing
+// slash, the result is the same with rsync, but restic and borg record the
+// snapshot path.
+func snapshotSources(sources []string, kill chan bool) (*sourceSnapshots, error) {
+	s := &sourceSnapshots{snapshots: map[string]string{}}
+	id := fmt.Sprint(time.Now().UnixNano())
+	fail := func(err error) (*sourceSnapshots, error) {
+		return nil, errgroup.NewMultiError(err, s.remove(kill))
+	}
+	for _, src := range sources {
+		btrfs, err := isBtrfs(src)
+		if err != nil {
+			return fail(err)
+		}
+		if !btrfs {
+			s.sources = append(s.sources, src)
+			continue
+		}
+		root, err := subvolumeRoot(src)
+		if err != nil {
+			return fail(err)
+		}
+		snap, ok := s.snapshots[root]
+		if !ok {
+			if err := removeStaleSnapshots(root, kill); err != nil {
+				return fail(err)
+			}
+			snap = filepath.Join(root, snapshotPrefix+id)
+			cmd := exec.Command("btrfs", "subvolume", "snapshot", "-r", root, snap)
+			if err := run(cmd, kill); err != nil {
+				return fail(err)
+			}
+			s.snapshots[root] = snap
+		}
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return fail(err)
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil {
+			return fail(err)
+		}
+		if abs == "/" {
+			s.sources = append(s.sources, snap+"/")
+			continue
+		}
+		s.binds = append(s.binds, [2]string{filepath.Join(snap, rel), abs})
+		s.sources = append(s.sources, src)
+	}
+	return s, nil
+}
+
+func removeStaleSnapshots(root string, kill chan bool) error {
+	stale, err := filepath.Glob(filepath.Join(root, snapshotPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, snap := range stale {
+		if err := run(exec.Command("btrfs", "subvolume", "delete", snap), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wrap the command to run in a private mount namespace with the snapshots
+// bind mounted over the sources.
+func (s *sourceSnapshots) wrap(cmd *exec.Cmd) *exec.Cmd {
+	if s == nil || len(s.binds) == 0 {
+		return cmd
+	}
+	var script strings.Builder
+	var args []string
+	for _, b := range s.binds {
+		n := len(args)
+		fmt.Fprintf(&script, `mount --bind "$%d" "$%d" && `, n+1, n+2)
+		args = append(args, b[0], b[1])
+	}
+	fmt.Fprintf(&script, `shift %d && exec "$@"`, len(args))
+	wrapped := exec.Command(
+		"unshare",
+		append(
+			append([]string{"--mount", "--propagation", "private", "/bin/sh", "-c", script.String(), "sh"}, args...),
+			cmd.Args...,
+		)...,
+	)
+	wrapped.Env = cmd.Env
+	wrapped.Dir = cmd.Dir
+	return wrapped
+}
+
+// Delete the snapshots.
+func (s *sourceSnapshots) remove(kill chan bool) error {
+	var errs []error
+	for _, snap := range s.snapshots {
+		cmd := exec.Command("btrfs", "subvolume", "delete", snap)
+		errs = append(errs, run(cmd, kill))
+	}
+	return errgroup.NewMultiError(errs...)
+}
+
+// Backup the sources to each of the backends. Unless Config.BackupLive is
+// set, the sources are snapshotted once up front. Every backend is run even
+// if an earlier one fails, and prunes its old backups after a successful one.
+func (c *Config) BackupFanOut(backends []BackupBackend, sources []string) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		if err := c.waitBackupWindow(kill); err != nil {
+			return err
+		}
+		m := &BackupManifest{Start: time.Now(), Sources: sources}
+		if !c.BackupLive {
+			snaps, err := snapshotSources(sources, kill)
+			if err != nil {
+				return c.finishBackup(m, err)
+			}
+			c.backupSnapshots = snaps
+			sources = snaps.sources
+			defer func() { c.backupSnapshots = nil }()
+		}
+		var errs []error
+		for _, b := range backends {
+			start := time.Now()
+			stats, err := b.Backup(c, sources, kill)
+			// only prune once a new backup has succeeded
+			var pruned []string
+			if err == nil {
+				pruned, err = b.Prune(c, false, kill)
+			}
+			m.Targets = append(m.Targets, BackupTargetResult{
+				Target:   b.String(),
+				Files:    stats.Files,
+				Bytes:    stats.Bytes,
+				Duration: time.Since(start).Round(time.Second).String(),
+				Pruned:   pruned,
+				Error:    errorString(err),
+			})
+			errs = append(errs, err)
+		}
+		if c.backupSnapshots != nil {
+			// removal must happen even when killed
+			errs = append(errs, c.backupSnapshots.remove(nil))
+		}
+		return c.finishBackup(m, errgroup.NewMultiError(errs...))
+	}
+}
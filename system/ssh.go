@@ -0,0 +1,161 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Install the SSHKeys of the configured Users into their authorized_keys.
+func (c *Config) InstallAuthorizedKeys(kill chan bool) error {
+	users, err := c.targetUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range c.Users {
+		if len(u.SSHKeys) == 0 {
+			continue
+		}
+		entry, ok := users[u.Name]
+		if !ok {
+			return fmt.Errorf("user %s does not exist in %s", u.Name, c.Root.Dir)
+		}
+
+		dir := filepath.Join(c.Root.Dir, entry.Home, ".ssh")
+		if err := mkdirAll(dir, os.FileMode(0o700)); err != nil {
+			return err
+		}
+		keys := filepath.Join(dir, "authorized_keys")
+		contents := strings.Join(u.SSHKeys, "\n") + "\n"
+		if err := writeFile(keys, []byte(contents), os.FileMode(0o600)); err != nil {
+			return err
+		}
+		for _, p := range []string{dir, keys} {
+			if err := lchown(p, entry.UID, entry.GID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Users allowed to login over SSH, which are those with SSHKeys.
+func (c *Config) sshUsers() []string {
+	var users []string
+	for _, u := range c.Users {
+		if len(u.SSHKeys) > 0 {
+			users = append(users, u.Name)
+		}
+	}
+	return users
+}
+
+func (c *Config) sshdConfig() string {
+	var b strings.Builder
+	b.WriteString("PasswordAuthentication no\n")
+	b.WriteString("KbdInteractiveAuthentication no\n")
+	b.WriteString("PermitRootLogin no\n")
+	if users := c.sshUsers(); len(users) > 0 {
+		fmt.Fprintf(&b, "AllowUsers %s\n", strings.Join(users, " "))
+	}
+	return b.String()
+}
+
+// Generate a hardened sshd_config drop-in which only allows key based logins
+// for the Users with SSHKeys, and enable sshd. This is only done if
+// Config.SSHD is set, and openssh must be installed using the Packages.
+func (c *Config) GenSSHD(kill chan bool) error {
+	if !c.SSHD {
+		return nil
+	}
+
+	dir := filepath.Join(c.Root.Dir, "etc", "ssh", "sshd_config.d")
+	if err := mkdirAll(dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	conf := filepath.Join(dir, "10-summon.conf")
+	if err := writeFile(conf, []byte(c.sshdConfig()), os.FileMode(0o644)); err != nil {
+		return err
+	}
+	if err := run(c.targetCmd(nil, "/usr/sbin/sshd", "-t"), kill); err != nil {
+		return err
+	}
+
+	service := "sshd"
+	if _, ok := c.installer().(Debootstrap); ok {
+		service = "ssh"
+	}
+	return c.enableService(service, kill)
+}
+
+// Files identifying the machine, which are preserved across reinstalls.
+func (c *Config) identityFiles() ([]string, error) {
+	keys, err := glob(filepath.Join(c.Root.Dir, "etc", "ssh", "ssh_host_*"))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{filepath.Join(c.Root.Dir, "etc", "machine-id")}, keys...), nil
+}
+
+// The mode of an identity file, where only the private keys are secret.
+func identityMode(name string) os.FileMode {
+	if name == "machine-id" || strings.HasSuffix(name, ".pub") {
+		return os.FileMode(0o644)
+	}
+	return os.FileMode(0o600)
+}
+
+// Save the SSH host keys and machine-id of the existing install into the
+// local dir, so they can be restored into a new install with RestoreIdentity.
+func (c *Config) SaveIdentity(dir string) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		files, err := c.identityFiles()
+		if err != nil {
+			return err
+		}
+		// dir is local, unlike the files read from the machine being installed
+		if err := os.MkdirAll(dir, os.FileMode(0o700)); err != nil {
+			return err
+		}
+		for _, f := range files {
+			contents, err := readFile(f)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			name := filepath.Base(f)
+			if err := os.WriteFile(filepath.Join(dir, name), contents, identityMode(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Restore the SSH host keys and machine-id saved by SaveIdentity, so clients
+// don't see a changed host key after a reinstall.
+func (c *Config) RestoreIdentity(dir string) func(kill chan bool) error {
+	return func(kill chan bool) error {
+		saved, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		sshDir := filepath.Join(c.Root.Dir, "etc", "ssh")
+		if err := mkdirAll(sshDir, os.FileMode(0o755)); err != nil {
+			return err
+		}
+		for _, s := range saved {
+			dst := filepath.Join(sshDir, s.Name())
+			if s.Name() == "machine-id" {
+				dst = filepath.Join(c.Root.Dir, "etc", "machine-id")
+			}
+			if err := uploadFile(filepath.Join(dir, s.Name()), dst, identityMode(s.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
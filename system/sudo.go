@@ -0,0 +1,109 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The admin users and groups, in sudoers syntax.
+func (c *Config) admins() []string {
+	var admins []string
+	for _, g := range c.AdminGroups {
+		admins = append(admins, "%"+g)
+	}
+	for _, u := range c.Users {
+		if u.Admin {
+			admins = append(admins, u.Name)
+		}
+	}
+	return admins
+}
+
+// Admin users with NoPasswd aren't asked for a password.
+func (c *Config) adminNoPass(admin string) bool {
+	for _, u := range c.Users {
+		if u.Name == admin {
+			return u.NoPasswd
+		}
+	}
+	return false
+}
+
+// Admins without a password couldn't use sudo or doas unless they are
+// explicitly allowed to without one.
+func (c *Config) checkAdminPasswords() error {
+	for _, u := range c.Users {
+		if u.Admin && !u.NoPasswd && u.Password == "" && u.PasswordHash == "" && u.PasswordSecret == "" {
+			return fmt.Errorf("summon: admin %s has no password, and NoPasswd is not set", u.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) sudoers() string {
+	var b strings.Builder
+	for _, a := range c.admins() {
+		if c.adminNoPass(a) {
+			fmt.Fprintf(&b, "%s ALL=(ALL:ALL) NOPASSWD: ALL\n", a)
+		} else {
+			fmt.Fprintf(&b, "%s ALL=(ALL:ALL) ALL\n", a)
+		}
+	}
+	return b.String()
+}
+
+func (c *Config) doasConf() string {
+	var b strings.Builder
+	for _, a := range c.admins() {
+		// doas uses a colon prefix for groups
+		id := strings.Replace(a, "%", ":", 1)
+		if c.adminNoPass(a) {
+			fmt.Fprintf(&b, "permit nopass %s\n", id)
+		} else {
+			fmt.Fprintf(&b, "permit persist %s\n", id)
+		}
+	}
+	return b.String()
+}
+
+// Generate a sudoers drop-in, or doas.conf if Config.Doas is set, for the
+// admin users and AdminGroups. The file is validated inside the target, and
+// removed if invalid so it can't break sudo or doas entirely.
+func (c *Config) GenSudoers(kill chan bool) error {
+	if len(c.admins()) == 0 {
+		return nil
+	}
+	if err := c.checkAdminPasswords(); err != nil {
+		return err
+	}
+
+	var name, contents string
+	var mode os.FileMode
+	var check []string
+	if c.Doas {
+		name = "/etc/doas.conf"
+		contents = c.doasConf()
+		mode = os.FileMode(0o400)
+		check = []string{"/usr/bin/doas", "-C", name}
+	} else {
+		name = "/etc/sudoers.d/summon"
+		contents = c.sudoers()
+		mode = os.FileMode(0o440)
+		check = []string{"/usr/bin/visudo", "--check", "--file", name}
+	}
+
+	full := filepath.Join(c.Root.Dir, name)
+	if err := mkdirAll(filepath.Dir(full), os.FileMode(0o750)); err != nil {
+		return err
+	}
+	if err := writeFile(full, []byte(contents), mode); err != nil {
+		return err
+	}
+	if err := run(c.targetCmd(nil, check...), kill); err != nil {
+		remove(full)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A kind of swap besides the SwapDisk.
+type SwapKind string
+
+const (
+	// Compressed swap in memory, set up on boot by zram-generator.
+	SwapZram SwapKind = "zram"
+	// A swap file in the target, created during the install.
+	SwapFile SwapKind = "file"
+)
+
+// Swap besides the SwapDisk. The kernel uses the swap with the highest
+// Priority first, like zram before falling back to disk. The Size is in
+// bytes, and for zram may be left out for half of the memory. The Path is for
+// a SwapFile, which on btrfs should be in a subvolume of its own, since a
+// subvolume with an active swap file can't be snapshotted.
+type Swap struct {
+	Kind     SwapKind
+	Path     string
+	Size     int64
+	Priority int
+}
+
+// The highest priority swapon(8) accepts.
+const maxSwapPriority = 32767
+
+var errSwapPriority = fmt.Errorf("summon: swap priority must be between 0 and %d", maxSwapPriority)
+
+func checkSwapPriority(p int) error {
+	if p < 0 || p > maxSwapPriority {
+		return errSwapPriority
+	}
+	return nil
+}
+
+// The fstab options for swap with the priority.
+func swapOptions(priority int) string {
+	if priority == 0 {
+		return "defaults"
+	}
+	return "pri=" + strconv.Itoa(priority)
+}
+
+// Add zram swap with the priority, along with zram-generator to set it up.
+func (c *Config) EnableZram(priority int) {
+	// keep installing the meta-package, which explicit packages would replace
+	if c.Package == "" {
+		c.Package = c.metaPackage()
+	}
+	pkg := "zram-generator"
+	if _, ok := c.installer().(Debootstrap); ok {
+		pkg = "systemd-zram-generator"
+	}
+	c.Packages = append(c.Packages, pkg)
+	c.Swaps = append(c.Swaps, Swap{Kind: SwapZram, Priority: priority})
+}
+
+// Generate the zram-generator.conf for the zram swaps, and create the swap
+// files.
+func (c *Config) GenSwap(kill chan bool) error {
+	if c.Swap != nil {
+		if err := checkSwapPriority(c.Swap.Priority); err != nil {
+			return err
+		}
+	}
+	var zram strings.Builder
+	var n int
+	for _, s := range c.Swaps {
+		if err := checkSwapPriority(s.Priority); err != nil {
+			return err
+		}
+		switch s.Kind {
+		case SwapZram:
+			fmt.Fprintf(&zram, "[zram%d]\n", n)
+			if s.Size > 0 {
+				fmt.Fprintf(&zram, "zram-size = %d\n", s.Size>>20)
+			}
+			fmt.Fprintf(&zram, "swap-priority = %d\n", s.Priority)
+			n++
+		case SwapFile:
+			if err := c.makeSwapFile(s, kill); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("summon: unknown swap kind %q", s.Kind)
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return c.writeTargetFile("/etc/systemd/zram-generator.conf", zram.String(), os.FileMode(0o644))
+}
+
+// Create the swap file. On btrfs it must not be copy on write or compressed,
+// which btrfs sets up itself.
+func (c *Config) makeSwapFile(s Swap, kill chan bool) error {
+	if !filepath.IsAbs(s.Path) || s.Size <= 0 {
+		return errors.New("summon: a swap file needs an absolute path and a size")
+	}
+	name := filepath.Join(c.Root.Dir, s.Path)
+	size := strconv.FormatInt(s.Size>>20, 10) + "m"
+	if c.Root.FSType == Btrfs {
+		return run(exec.Command("btrfs", "filesystem", "mkswapfile", "--size", size, name), kill)
+	}
+	if err := run(exec.Command("fallocate", "--length", size, name), kill); err != nil {
+		return err
+	}
+	if err := chmod(name, os.FileMode(0o600)); err != nil {
+		return err
+	}
+	return run(exec.Command("mkswap", name), kill)
+}
+
+// The fstab lines for the swap files. Zram swap is set up by its generator.
+func (c *Config) swapFileLines() [][]string {
+	var lines [][]string
+	for _, s := range c.Swaps {
+		if s.Kind == SwapFile {
+			lines = append(lines, []string{s.Path, "none", "swap", swapOptions(s.Priority), "0 0"})
+		}
+	}
+	return lines
+}
@@ -0,0 +1,61 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write a generated configuration file in the target, creating the containing
+// directory as necessary.
+func (c *Config) writeTargetFile(name, contents string, mode os.FileMode) error {
+	return writeFile(filepath.Join(c.Root.Dir, name), []byte(contents), mode)
+}
+
+// Write a generated file, creating the parent directories. It is uploaded
+// when commands run on a remote machine.
+func writeFile(name string, data []byte, mode os.FileMode) error {
+	return summon.WriteFile(context.Background(), name, data, mode)
+}
+
+// Generate /etc/sysctl.d/90-summon.conf from the configured Sysctl settings.
+func (c *Config) GenSysctl(kill chan bool) error {
+	if len(c.Sysctl) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, k := range sortedKeys(c.Sysctl) {
+		fmt.Fprintf(&b, "%s = %s\n", k, c.Sysctl[k])
+	}
+	return c.writeTargetFile("/etc/sysctl.d/90-summon.conf", b.String(), os.FileMode(0o644))
+}
+
+// Generate /etc/modprobe.d/summon.conf from the configured ModuleOptions and
+// BlacklistModules.
+func (c *Config) GenModprobe(kill chan bool) error {
+	if len(c.ModuleOptions) == 0 && len(c.BlacklistModules) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, m := range sortedKeys(c.ModuleOptions) {
+		fmt.Fprintf(&b, "options %s %s\n", m, c.ModuleOptions[m])
+	}
+	for _, m := range c.BlacklistModules {
+		fmt.Fprintf(&b, "blacklist %s\n", m)
+	}
+	return c.writeTargetFile("/etc/modprobe.d/summon.conf", b.String(), os.FileMode(0o644))
+}
@@ -5,10 +5,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,20 +24,11 @@ type LuksFormat struct {
 }
 
 func (l LuksFormat) Task() (summon.Task, error) {
+	summon.AddSecret(l.Password)
 	return summon.Task{
 		Name: fmt.Sprintf("Luks Format: %s", l.Device),
 		Do: func(ctx context.Context) error {
-			cmd := summon.MustCmdf(ctx, `
-				cryptsetup luksFormat
-					--cipher aes-xts-plain64
-					--key-size 512
-					--hash sha512
-					--iter-time 5000
-					--use-random
-					%q
-				`, l.Device)
-			cmd.Stdin = strings.NewReader(l.Password)
-			return summon.VerboseRun(cmd)
+			return luksFormat(ctx, l.Device, l.Password)
 		},
 	}, nil
 }
@@ -47,15 +40,14 @@ type LuksOpenClose struct {
 }
 
 func (l LuksOpenClose) Task() (summon.Task, error) {
+	summon.AddSecret(l.Password)
 	return summon.Task{
 		Name: fmt.Sprintf("Luks Setup: %s", l.Device),
 		Do: func(ctx context.Context) error {
-			cmd := summon.MustCmdf(ctx, "cryptsetup open --type luks %q %q", l.Device, l.Name)
-			cmd.Stdin = strings.NewReader(l.Password)
-			return summon.VerboseRun(cmd)
+			return luksOpen(ctx, l.Device, l.Name, l.Password)
 		},
 		Defer: func(ctx context.Context) error {
-			return summon.Runf(ctx, "cryptsetup close %q", l.Name)
+			return luksClose(ctx, l.Name)
 		},
 	}, nil
 }
@@ -71,15 +63,15 @@ func (m Mount) Task() (summon.Task, error) {
 	return summon.Task{
 		Name: fmt.Sprintf("Mount %q", m.MountPath),
 		Do: func(ctx context.Context) error {
-			if err := os.MkdirAll(m.MountPath, 0o700); err == nil {
+			if err := mkdirAll(m.MountPath, 0o700); err == nil {
 				rmmdir = true
 			}
-			return summon.Runf(ctx, "mount -o %q %q %q", m.Options, m.Device, m.MountPath)
+			return mount(m.Device, m.MountPath, "", m.Options)
 		},
 		Defer: func(ctx context.Context) error {
-			me := []error{summon.Runf(ctx, "umount %q", m.MountPath)}
+			me := []error{umount(m.MountPath)}
 			if rmmdir {
-				me = append(me, os.Remove(m.MountPath))
+				me = append(me, remove(m.MountPath))
 			}
 			return errgroup.NewMultiError(me...)
 		},
@@ -90,15 +82,58 @@ type MakeFS struct {
 	Device string
 	Type   string
 	Label  string
+
+	// Leave initializing the ext4 inode tables and journal to the kernel after
+	// the first mount, instead of writing them out up front.
+	LazyInit bool
+	// Checksum the ext4 metadata.
+	MetadataCsum bool
+	// The device was already discarded, like by blkdiscard or a secure erase,
+	// so the discard pass of mkfs, which takes ages on multi-TB drives, is
+	// skipped.
+	Discarded bool
+}
+
+// The mkfs arguments for the tunables of the Type.
+func (m MakeFS) args() []string {
+	args := []string{"-L", m.Label}
+	switch m.Type {
+	case "ext4":
+		var ext []string
+		if m.LazyInit {
+			ext = append(ext, "lazy_itable_init=1", "lazy_journal_init=1")
+		}
+		if m.Discarded {
+			ext = append(ext, "nodiscard")
+		}
+		if len(ext) > 0 {
+			args = append(args, "-E", strings.Join(ext, ","))
+		}
+		if m.MetadataCsum {
+			args = append(args, "-O", "metadata_csum")
+		}
+	case "btrfs":
+		if m.Discarded {
+			args = append(args, "--nodiscard")
+		}
+	case "xfs":
+		if m.Discarded {
+			args = append(args, "-K")
+		}
+	}
+	return append(args, m.Device)
 }
 
 // MkFS makes file systems.
 func (m MakeFS) Task() (summon.Task, error) {
+	if _, err := fsLabel(m.Type, m.Label); err != nil {
+		return summon.Task{}, err
+	}
 	bin := "mkfs." + m.Type
 	return summon.Task{
 		Name: fmt.Sprintf("File System: %s of type %s on %s", m.Label, m.Type, m.Device),
 		Do: func(ctx context.Context) error {
-			return summon.Runf(ctx, "%q -L %q %q", bin, m.Label, m.Device)
+			return summon.RunStreaming(ctx, exec.CommandContext(ctx, bin, m.args()...), nil, nil)
 		},
 	}, nil
 }
@@ -113,16 +148,24 @@ func (m MakeBtrfsSubvolume) Task() (summon.Task, error) {
 	if err != nil {
 		return summon.Task{}, err
 	}
-	return summon.Parallel(
+	mt, err := Mount{
+		Device:    m.Device,
+		MountPath: tmpdir,
+	}.Task()
+	if err != nil {
+		return summon.Task{}, err
+	}
+	// the file system must be mounted before the subvolume is created in it
+	return summon.Serial(
 		fmt.Sprintf("On btrfs %s make subvolume %s", m.Device, m.Name),
-		Mount{
-			Device:    m.Device,
-			MountPath: tmpdir,
-		}.Task(),
-		summon.DoTask(func(ctx context.Context) error {
-			return summon.Runf(ctx, "btrfs subvolume create %q", path.Join(tmpdir, m.Name))
-		}),
-	)
+		mt,
+		summon.Task{
+			Name: fmt.Sprintf("Create subvolume %s", m.Name),
+			Do: func(ctx context.Context) error {
+				return summon.Runf(ctx, "btrfs subvolume create %q", path.Join(tmpdir, m.Name))
+			},
+		},
+	), nil
 }
 
 const (
@@ -130,14 +173,115 @@ const (
 	MountCompressLZO = "compress=lzo"
 )
 
-// IdentifyFSType identifies the filesystem on the specified device.
-func IdentifyFSType(ctx context.Context, device string) (string, error) {
-	cmd := summon.MustCmdf(ctx, "lsblk --noheadings --output fstype %q", device)
-	out, err := cmd.CombinedOutput()
+// The file systems for the root.
+type FSType string
+
+const (
+	Btrfs FSType = "btrfs"
+	Ext4  FSType = "ext4"
+	Vfat  FSType = "vfat"
+)
+
+// The subvolume of a btrfs root with the system, which is what is mounted at
+// / and snapshotted. Data kept across reinstalls lives in other subvolumes
+// next to it.
+const btrfsActive = "__active"
+
+// The start of snapshot names, so they sort by the time they were taken.
+const tsFormat = "2006-01-02-15-04-05"
+
+var errNoDiskSpecified = errors.New("summon: no disk specified")
+
+// Root disk config. With a Password the Device is encrypted, and the file
+// system is on the Mapper once opened.
+type RootDisk struct {
+	Name     string
+	Device   string
+	Mapper   string
+	Dir      string
+	FSType   FSType
+	Password string
+
+	config *Config
+}
+
+// Get the device path where the file system resides.
+func (d *RootDisk) fsDev() string {
+	if d.Password != "" {
+		return d.Mapper
+	}
+	return d.Device
+}
+
+// Initializes the LUKS device.
+func (d *RootDisk) LuksFormat(kill chan bool) error {
+	if d.Password == "" {
+		return nil
+	}
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksFormat(ctx, d.Device, d.Password)
+}
+
+// Opens the LUKS device.
+func (d *RootDisk) LuksOpen(kill chan bool) error {
+	if d.Password == "" {
+		return nil
+	}
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksOpen(ctx, d.Device, d.Name, d.Password)
+}
+
+// Closes the existing LUKS mapping.
+func (d *RootDisk) LuksClose(kill chan bool) error {
+	if d.Password == "" {
+		return nil
+	}
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksClose(ctx, d.Name)
+}
+
+// Create the root file system. On btrfs the active subvolume is created in
+// it too.
+func (d *RootDisk) MakeFS(kill chan bool) error {
+	label, err := fsLabel(string(d.FSType), d.Name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("mkfs."+string(d.FSType), "-L", label, d.fsDev())
+	if err := run(cmd, kill); err != nil {
+		return err
+	}
+	if d.FSType != Btrfs {
+		return nil
+	}
+
+	dir, err := mountBtrfsRoot(d.fsDev(), kill)
 	if err != nil {
-		return "", fmt.Errorf("error running command: %q: %v\n%s", cmd, err, out)
+		return err
 	}
-	return string(bytes.TrimSpace(out)), nil
+	defer umountBtrfsRoot(dir, kill)
+	return run(exec.Command("btrfs", "subvolume", "create", path.Join(dir, btrfsActive)), kill)
+}
+
+// Mount the root disk, the active subvolume of it on btrfs. Create the target
+// directory if necessary.
+func (d *RootDisk) Mount(kill chan bool) error {
+	if err := mkdirAll(d.Dir, os.FileMode(0o755)); err != nil {
+		return err
+	}
+	options := MountNoatime
+	if d.FSType == Btrfs {
+		options += "," + MountCompressLZO + ",subvol=" + btrfsActive
+	}
+	return mount(d.fsDev(), d.Dir, string(d.FSType), options)
+}
+
+// Umount the root disk. Does not remove the target directory.
+func (d *RootDisk) Umount(kill chan bool) error {
+	return umount(d.Dir)
 }
 
 // Create a snapshot, if the target File System supports this.
@@ -154,7 +298,7 @@ func (d *RootDisk) Snapshot(name string) func(kill chan bool) error {
 		defer umountBtrfsRoot(dir, kill)
 
 		snapdir := path.Join(dir, "__snapshot")
-		if err := os.MkdirAll(snapdir, os.FileMode(755)); err != nil {
+		if err := mkdirAll(snapdir, os.FileMode(0o755)); err != nil {
 			return err
 		}
 
@@ -173,16 +317,83 @@ func (d *RootDisk) Snapshot(name string) func(kill chan bool) error {
 	}
 }
 
-// EFI disk config.
+// EFI disk config. The Dir is where it is mounted on the host, and the
+// Mountpoint where in the target, /boot/efi by default. The Vendor is the
+// directory under EFI with the kernel and initramfs, defaulting to the
+// EFIVendor of the Installer. The FMask and DMask for the fstab default to
+// 0077, so only root can read the boot files, and with Automount it is only
+// mounted once accessed.
 type EFIDisk struct {
-	Name   string
-	Device string
-	Dir    string
+	Name       string
+	Device     string
+	Dir        string
+	Mountpoint string
+	Vendor     string
+	FMask      string
+	DMask      string
+	Automount  bool
+}
+
+const espMask = "0077"
+
+// The mount options of the ESP in the fstab.
+func (c *Config) espOptions() string {
+	var opts []string
+	if c.EFI.FMask == "" && c.EFI.DMask == "" {
+		opts = append(opts, "umask="+espMask)
+	} else {
+		fmask, dmask := c.EFI.FMask, c.EFI.DMask
+		if fmask == "" {
+			fmask = espMask
+		}
+		if dmask == "" {
+			dmask = espMask
+		}
+		opts = append(opts, "fmask="+fmask, "dmask="+dmask)
+	}
+	// without systemd nothing would mount it
+	if _, ok := c.installer().(ServiceEnabler); c.EFI.Automount && !ok {
+		opts = append(opts, "noauto", "x-systemd.automount")
+	}
+	return strings.Join(opts, ",")
+}
+
+const defaultESP = "/boot/efi"
+
+// Mount the ESP at the mountpoint in the target, like /efi.
+func (c *Config) SetESP(mountpoint string) {
+	c.EFI.Mountpoint = mountpoint
+	c.EFI.Dir = filepath.Join(c.Root.Dir, mountpoint)
+}
+
+// Where the ESP is mounted in the target.
+func (c *Config) espPath() string {
+	if c.EFI.Mountpoint == "" {
+		return defaultESP
+	}
+	return c.EFI.Mountpoint
+}
+
+// The directory under EFI in the ESP with the kernel and initramfs.
+func (c *Config) efiVendor() string {
+	if c.EFI.Vendor == "" {
+		return c.installer().EFIVendor()
+	}
+	return c.EFI.Vendor
+}
+
+// The vendor directory in the target.
+func (c *Config) vendorDir() string {
+	return path.Join(c.espPath(), "EFI", c.efiVendor())
 }
 
 // Create the EFI file system.
 func (d *EFIDisk) MakeFS(kill chan bool) error {
-	cmd := exec.Command("mkfs.vfat", "-F32", "-s1", "-n", d.Name, d.Device)
+	label, err := fsLabel("vfat", d.Name)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("mkfs.vfat", "-F32", "-s1", "-n", label, d.Device)
 	if err := run(cmd, kill); err != nil {
 		return err
 	}
@@ -191,34 +402,32 @@ func (d *EFIDisk) MakeFS(kill chan bool) error {
 
 // Mount the EFI disk. Create the target directory if necessary.
 func (d *EFIDisk) Mount(kill chan bool) error {
-	err := os.MkdirAll(d.Dir, os.FileMode(755))
+	err := mkdirAll(d.Dir, os.FileMode(0o755))
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command("mount", "-t", string(Vfat), d.Device, d.Dir)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	return nil
+	return mount(d.Device, d.Dir, string(Vfat), "")
 }
 
 // Umount the EFI disk. Does not remove the target directory.
 func (d *EFIDisk) Umount(kill chan bool) error {
-	cmd := exec.Command("umount", d.Dir)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	return nil
+	return umount(d.Dir)
 }
 
-// Swap disk config.
+// Swap disk config. If the Disk is set, swap gets that disk to itself, and
+// is otherwise a partition on the Config.Disk. The Priority orders it among
+// the Config.Swaps.
 type SwapDisk struct {
 	Name     string
+	Disk     string
 	Device   string
 	Mapper   string
 	RootName string
 	Encrypt  bool
+	Priority int
+
+	config *Config
 }
 
 // Get the device path where the swap resides.
@@ -244,20 +453,9 @@ func (d *SwapDisk) LuksFormat(kill chan bool) error {
 		return err
 	}
 
-	cmd := exec.Command(
-		"cryptsetup", "luksFormat",
-		"--cipher", "aes-xts-plain64",
-		"--key-size", "512",
-		"--hash", "sha512",
-		"--iter-time", "5000",
-		"--use-random",
-		d.Device,
-	)
-	cmd.Stdin = strings.NewReader(key)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	return nil
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksFormat(ctx, d.Device, key)
 }
 
 // Opens the LUKS device.
@@ -275,29 +473,23 @@ func (d *SwapDisk) LuksOpen(kill chan bool) error {
 		return err
 	}
 
-	cmd := exec.Command(
-		"cryptsetup", "open",
-		"--type", "luks",
-		d.Device,
-		d.Name,
-	)
-	cmd.Stdin = strings.NewReader(key)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	return nil
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksOpen(ctx, d.Device, d.Name, key)
 }
 
 // Read the key of the root partition.
 func (d *SwapDisk) key() (string, error) {
+	// not run, which would log the key
+	var out bytes.Buffer
 	cmd := exec.Command("dmsetup", "--showkeys", "table", d.RootName)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+	cmd.Stdout = &out
+	if err := summon.RunCommand(context.Background(), cmd); err != nil {
 		return "", err
 	}
-	parts := bytes.Split(out, []byte(" "))
+	parts := bytes.Split(out.Bytes(), []byte(" "))
 	if len(parts) < 5 {
-		return "", fmt.Errorf("did not find key using dmsetup: %s", out)
+		return "", errors.New("summon: did not find key using dmsetup")
 	}
 	return string(parts[4]), nil
 }
@@ -312,11 +504,14 @@ func (d *SwapDisk) LuksClose(kill chan bool) error {
 		return nil
 	}
 
-	cmd := exec.Command("cryptsetup", "close", d.Name)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	return nil
+	ctx, cancel := d.config.luksContext(kill)
+	defer cancel()
+	return luksClose(ctx, d.Name)
+}
+
+// The label of the swap file system.
+func (d *SwapDisk) label() string {
+	return fmt.Sprintf("%s-swap", d.Name)
 }
 
 // Create the Swap file system.
@@ -324,7 +519,10 @@ func (d *SwapDisk) MakeFS(kill chan bool) error {
 	if d == nil {
 		return nil
 	}
-	label := fmt.Sprintf("%s-swap", d.Name)
+	label, err := fsLabel("swap", d.label())
+	if err != nil {
+		return err
+	}
 	cmd := exec.Command("mkswap", "--label", label, d.fsDev())
 	if err := run(cmd, kill); err != nil {
 		return err
@@ -337,7 +535,10 @@ func (d *SwapDisk) Mount(kill chan bool) error {
 	if d == nil {
 		return nil
 	}
-	cmd := exec.Command("swapon", d.fsDev())
+	cmd := exec.Command("swapon", "--priority", strconv.Itoa(d.Priority), d.fsDev())
+	if d.Priority == 0 {
+		cmd = exec.Command("swapon", d.fsDev())
+	}
 	if err := run(cmd, kill); err != nil {
 		return err
 	}
@@ -366,12 +567,7 @@ type VirtualFS struct {
 // Mount virtual file systems.
 func (f *VirtualFS) Mount(kill chan bool) error {
 	for _, p := range virtualFSs {
-		cmd := exec.Command(
-			"mount", "--rbind",
-			path.Join("/", p),
-			path.Join(f.Dir, p),
-		)
-		if err := run(cmd, kill); err != nil {
+		if err := bindMount(path.Join("/", p), path.Join(f.Dir, p), true); err != nil {
 			return err
 		}
 	}
@@ -382,8 +578,7 @@ func (f *VirtualFS) Mount(kill chan bool) error {
 func (f *VirtualFS) Umount(kill chan bool) error {
 	for i := len(virtualFSs) - 1; i >= 0; i = i - 1 {
 		p := virtualFSs[i]
-		cmd := exec.Command("umount", path.Join(f.Dir, p))
-		if err := run(cmd, kill); err != nil {
+		if err := umount(path.Join(f.Dir, p)); err != nil {
 			return err
 		}
 	}
@@ -392,14 +587,123 @@ func (f *VirtualFS) Umount(kill chan bool) error {
 
 // Defines a system.
 type Config struct {
-	Name      string
-	Disk      string
-	Package   string
-	Root      *RootDisk
-	EFI       *EFIDisk
-	Swap      *SwapDisk
-	VirtualFS *VirtualFS
-	EnableOSX bool
+	Name               string
+	Disk               string
+	GPT                *GPT
+	FstabUUID          bool
+	PartitionTypes     map[string]string
+	PartUUIDs          map[string]string
+	DPS                bool
+	Firmware           Firmware
+	DiskKind           DiskKind
+	Commit             int
+	Package            string
+	Packages           []string
+	Groups             []string
+	IgnorePkg          []string
+	Pacman             *PacmanConf
+	Offline            *Offline
+	Installer          Installer
+	Chroot             bool
+	TargetEnv          []string
+	Proxy              *Proxy
+	Users              []User
+	AdminGroups        []string
+	Doas               bool
+	SSHD               bool
+	Locales            []string
+	Lang               string
+	Timezone           string
+	Keymap             string
+	Font               string
+	Hosts              []Host
+	MachineInfo        *MachineInfo
+	MachineID          MachineIDPolicy
+	EnableUnits        []string
+	MaskUnits          []string
+	Network            *Network
+	NTPServers         []string
+	Chrony             bool
+	FirstBoot          []string
+	Sysctl             map[string]string
+	ModuleOptions      map[string]string
+	BlacklistModules   []string
+	DetectDrivers      bool
+	Drivers            []string
+	Laptop             *Laptop
+	Image              *LoopImage
+	Cache              *BuildCache
+	HostCache          bool
+	BtrfsMaintenance   *BtrfsMaintenance
+	Manifest           *Manifest
+	EtcGit             EtcGit
+	BackupExcludes     []string
+	BackupLimits       *BackupLimits
+	BackupJob          *BackupJob
+	BackupReport       *BackupReport
+	BackupLive         bool
+	OnBackup           func(*BackupManifest)
+	Notify             []string
+	Audit              *AuditTrail
+	Reporter           summon.Reporter
+	DiskPasswordSecret string
+	PasswordPolicy     *PasswordPolicy
+	TwoFactor          *TwoFactor
+	Root               *RootDisk
+	EFI                *EFIDisk
+	Swap               *SwapDisk
+	Swaps              []Swap
+	Data               []*DataDisk
+	Subvolumes         []Subvolume
+	Tmp                *TmpPolicy
+	VirtualFS          *VirtualFS
+	EnableOSX          bool
+	HybridMBR          bool
+
+	cachedBase bool
+	baseHash   string
+	passwds    map[string]string
+
+	backupSnapshots *sourceSnapshots
+	benchmark       []BenchmarkResult
+}
+
+// An entry in /etc/hosts.
+type Host struct {
+	Address string
+	Names   []string
+}
+
+// How the machine-id of the target is handled.
+type MachineIDPolicy string
+
+const (
+	// Keep the machine-id created by the install, if any.
+	MachineIDKeep MachineIDPolicy = ""
+	// Leave the machine-id blank, so it is generated on first boot.
+	MachineIDBlank MachineIDPolicy = "blank"
+	// Require the machine-id to be restored using RestoreIdentity.
+	MachineIDRestored MachineIDPolicy = "restored"
+)
+
+// An Installer installs a distribution into the target.
+type Installer interface {
+	// Install the minimal file system, before virtual file systems are mounted.
+	InstallFileSystem(c *Config, kill chan bool) error
+	// Install the system, with virtual file systems mounted.
+	InstallSystem(c *Config, kill chan bool) error
+	// Post install steps, including generating the initramfs and copying the
+	// kernel and initramfs into the ESP.
+	PostInstall(c *Config, kill chan bool) error
+	// The directory under EFI in the ESP with the kernel and initramfs.
+	EFIVendor() string
+	// Additional kernel parameters for the bootloader.
+	KernelParams(c *Config) []string
+}
+
+// Installers for distributions without systemd implement ServiceEnabler.
+type ServiceEnabler interface {
+	EnableService(c *Config, name string, kill chan bool) error
 }
 
 // Create a new config based on standard naming rules.
@@ -407,7 +711,7 @@ func New(name string) *Config {
 	rootName := fmt.Sprintf("%s-root", name)
 	efiName := fmt.Sprintf("%s-efi", name)
 	dir := path.Join("/mnt", name)
-	return &Config{
+	c := &Config{
 		Name: name,
 		Root: &RootDisk{
 			Name:   rootName,
@@ -418,12 +722,14 @@ func New(name string) *Config {
 		EFI: &EFIDisk{
 			Name:   efiName,
 			Device: path.Join("/dev/disk/by-partlabel", efiName),
-			Dir:    path.Join("/mnt", name, "boot/efi"),
+			Dir:    path.Join(dir, defaultESP),
 		},
 		VirtualFS: &VirtualFS{
 			Dir: dir,
 		},
 	}
+	c.Root.config = c
+	return c
 }
 
 // Enable a swap disk.
@@ -435,149 +741,186 @@ func (c *Config) EnableSwap(encrypt bool) {
 		Device:   path.Join("/dev/disk/by-partlabel", name),
 		Mapper:   path.Join("/dev/mapper", name),
 		Encrypt:  encrypt,
+		config:   c,
 	}
 }
 
-// Create GPT for system.
+// The partitions of the system, in order.
+func (c *Config) gptLayout() ([]gptPartition, error) {
+	efisize := int64(100 << 20)
+	if _, ok := c.installer().(ALARM); ok || c.EnableOSX {
+		efisize = 256 << 20
+	}
+	parts := []gptPartition{{Size: efisize, Typecode: "ef00", Name: c.EFI.Name}}
+	if c.EnableOSX {
+		parts = append(
+			parts,
+			// with HybridMBR, Boot Camp and older OS X tools find them in the MBR
+			gptPartition{Size: 30 << 30, Typecode: "af00", Name: c.label("osx"), Hybrid: c.HybridMBR},
+			gptPartition{Size: 620 << 20, Typecode: "ab00", Name: c.label("recovery"), Hybrid: c.HybridMBR},
+		)
+	}
+	if c.Swap != nil && c.Swap.Disk == "" {
+		parts = append(parts, gptPartition{Size: 4 << 30, Typecode: "8200", Name: c.Swap.Name})
+	}
+	root := gptPartition{Typecode: "8300", Name: c.Root.Name}
+	if c.DPS {
+		t, err := c.dpsRootType()
+		if err != nil {
+			return nil, err
+		}
+		root.Typecode = t
+	}
+	return append(parts, root), nil
+}
+
+// Create GPT for system, using sgdisk unless Config.GPT is set.
 func (c *Config) GptSetup(kill chan bool) error {
 	if c.Disk == "" {
 		return errNoDiskSpecified
 	}
+	parts, err := c.gptLayout()
+	if err != nil {
+		return err
+	}
+	if err := c.partition(c.Disk, parts, kill); err != nil {
+		return err
+	}
+	return waitForDevice(c.Root.Device)
+}
 
-	zcmd := exec.Command("sgdisk", "--zap-all", c.Disk)
-	if err := run(zcmd, kill); err != nil {
+// Create the GPT of a swap disk of its own, with swap using all of it.
+func (c *Config) SwapGptSetup(kill chan bool) error {
+	if c.Swap == nil || c.Swap.Disk == "" {
+		return nil
+	}
+	parts := []gptPartition{{Typecode: "8200", Name: c.Swap.Name}}
+	if err := c.partition(c.Swap.Disk, parts, kill); err != nil {
 		return err
 	}
+	return waitForDevice(c.Swap.Device)
+}
 
-	part := 0
-	entry := func(size, typecode, name string) []string {
-		part = part + 1
-		return []string{
-			"--new", fmt.Sprintf("%d:0:%s", part, size),
-			"--typecode", fmt.Sprintf("%d:%s", part, typecode),
-			"--change-name", fmt.Sprintf("%d:%s", part, name),
+// Replace the partition table of the disk with the partitions, and check the
+// partition types were written as asked.
+func (c *Config) partition(disk string, parts []gptPartition, kill chan bool) error {
+	parts = c.customize(parts)
+	if c.GPT != nil {
+		if err := c.GPT.write(disk, parts); err != nil {
+			return err
 		}
+		return verifyGPT(disk, parts)
+	}
+	zcmd := exec.Command("sgdisk", "--zap-all", disk)
+	if err := run(zcmd, kill); err != nil {
+		return err
 	}
-
 	var args []string
-	efisize := "+100M"
-	if c.EnableOSX {
-		efisize = "+256M"
+	for i, p := range parts {
+		args = append(args, p.sgdiskArgs(i+1)...)
 	}
-	args = append(args, entry(efisize, "ef00", c.EFI.Name)...)
-	if c.EnableOSX {
-		args = append(args, entry("+30G", "af00", c.label("osx"))...)
-		args = append(args, entry("+620M", "ab00", c.label("recovery"))...)
+	ccmd := exec.Command("sgdisk", append(args, disk)...)
+	if err := run(ccmd, kill); err != nil {
+		return err
 	}
-	if c.Swap != nil {
-		args = append(args, entry("+4G", "8200", c.Swap.Name)...)
+	if hybrid := hybridPartitions(parts); len(hybrid) > 0 {
+		hcmd := exec.Command("sgdisk", "--hybrid="+strings.Join(hybrid, ":"), disk)
+		if err := run(hcmd, kill); err != nil {
+			return err
+		}
 	}
-	args = append(args, entry("0", "8300", c.Root.Name)...)
-	args = append(args, c.Disk)
+	return verifyGPT(disk, parts)
+}
 
-	ccmd := exec.Command("sgdisk", args...)
-	if err := run(ccmd, kill); err != nil {
-		return err
+// The partitions with the types, as sgdisk typecodes or GUIDs, and fixed
+// PARTUUIDs from Config.PartitionTypes and Config.PartUUIDs by partition name.
+func (c *Config) customize(parts []gptPartition) []gptPartition {
+	custom := make([]gptPartition, len(parts))
+	for i, p := range parts {
+		if t := c.PartitionTypes[p.Name]; t != "" {
+			p.Typecode = t
+		}
+		p.GUID = c.PartUUIDs[p.Name]
+		custom[i] = p
 	}
+	return custom
+}
 
+// Wait for udev to create the device of a new partition.
+func waitForDevice(device string) error {
 	max := time.Second * 2
 	sleep := time.Millisecond * 50
 	current := time.Millisecond
 	for {
-		_, err := os.Stat(c.Root.Device)
-		if err == nil {
-			break
-		}
-		if os.IsNotExist(err) {
-			time.Sleep(sleep)
-		} else {
+		found, err := exists(device)
+		if err != nil {
 			return err
 		}
+		if found {
+			return nil
+		}
+		time.Sleep(sleep)
 		if current > max {
-			return fmt.Errorf("failed to find %s", c.Root.Device)
+			return fmt.Errorf("%w: %s", ErrDeviceNotFound, device)
 		}
 		current = current + sleep
 	}
-
-	return nil
 }
 
-// Install system.
+// Install the minimal file system, before virtual file systems are mounted.
+// With a BuildCache, the cached base system is extracted instead if there is
+// one for this configuration.
 func (c *Config) InstallFileSystem(kill chan bool) error {
-	dirs := []string{"var/lib/pacman", "var/cache/pacman/pkg"}
-	for _, d := range dirs {
-		full := path.Join(c.Root.Dir, d)
-		if err := os.MkdirAll(full, os.FileMode(755)); err != nil {
-			return err
-		}
-	}
-
-	cmd := exec.Command(
-		"pacman",
-		"--refresh",
-		"--root", c.Root.Dir,
-		"--asdeps",
-		"--noconfirm",
-		"--quiet",
-		"--sync",
-		"filesystem",
-	)
-	if err := run(cmd, kill); err != nil {
+	restored, err := c.restoreBase(kill)
+	if err != nil {
 		return err
 	}
-	return nil
+	if restored {
+		c.cachedBase = true
+		return nil
+	}
+	return c.installer().InstallFileSystem(c, kill)
 }
 
-// Install system.
+// Install system, and add it to the BuildCache if one is configured.
 func (c *Config) InstallSystem(kill chan bool) error {
-	pkg := c.Package
-	if pkg == "" {
-		pkg = fmt.Sprintf("%s-system", c.Name)
-	}
-
-	rcmd := exec.Command(
-		"pacman",
-		"--root", c.Root.Dir,
-		"--noconfirm",
-		"--quiet",
-		"--sync",
-		pkg,
-	)
-	if err := run(rcmd, kill); err != nil {
+	if c.cachedBase {
+		return nil
+	}
+	if err := c.installer().InstallSystem(c, kill); err != nil {
 		return err
 	}
-	return nil
+	return c.saveBase(kill)
 }
 
-// Post install steps.
+// Post install steps. With chroot, the host resolv.conf is made available to
+// them like systemd-nspawn does.
 func (c *Config) PostInstall(kill chan bool) error {
-	r := c.Root.Dir
-	cmds := [][]string{
-		{r, "/usr/bin/pacman-key", "--init"},
-		{r, "/usr/bin/pacman-key", "--populate", "archlinux"},
-		{r, "/usr/bin/locale-gen"},
-		{r, "/usr/bin/mkinitcpio", "-p", "linux"},
-		{r, "/usr/bin/cp", "/boot/vmlinuz-linux", "/boot/efi/EFI/archlinux/vmlinuz.efi"},
-		{r, "/usr/bin/cp", "/boot/initramfs-linux.img", "/boot/efi/EFI/archlinux/initrd.img"},
-	}
-
-	mandb := "/usr/bin/mandb"
-	if _, err := os.Stat(filepath.Join(r, mandb)); err == nil {
-		cmds = append(cmds, []string{r, mandb, "--quiet"})
+	if !c.useChroot() {
+		return c.installer().PostInstall(c, kill)
 	}
-
-	for _, cmd := range cmds {
-		if err := run(exec.Command("chroot", cmd...), kill); err != nil {
-			return err
-		}
+	unbind, err := c.bindResolvConf()
+	if err != nil {
+		return err
 	}
-	return nil
+	return errgroup.NewMultiError(c.installer().PostInstall(c, kill), unbind())
 }
 
-// Setup password.
+// Setup password. The password is checked against the Config.PasswordPolicy
+// by CheckPasswords, as well as when the step runs.
 func (c *Config) Passwd(user, pass string) func(kill chan bool) error {
+	summon.AddSecret(pass)
+	if c.passwds == nil {
+		c.passwds = map[string]string{}
+	}
+	c.passwds[user] = pass
 	return func(kill chan bool) error {
-		cmd := exec.Command("chroot", c.Root.Dir, "/usr/bin/passwd", user)
+		if c.PasswordPolicy != nil {
+			if err := c.PasswordPolicy.Check(pass, c.Name, user); err != nil {
+				return fmt.Errorf("%v: user %s", err, user)
+			}
+		}
+		cmd := c.targetCmd(nil, "/usr/bin/passwd", user)
 		cmd.Stdin = strings.NewReader(pass + "\n" + pass + "\n")
 		if err := run(cmd, kill); err != nil {
 			return err
@@ -593,34 +936,14 @@ func (c *Config) Exec(args []string) func(kill chan bool) error {
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		if err := cmd.Start(); err != nil {
-			return err
-		}
-
-		ec := make(chan error)
-		go func() {
-			if err := cmd.Wait(); err != nil {
-				ec <- err
-				return
-			}
-			ec <- nil
-		}()
-		select {
-		case <-kill:
-			e1 := cmd.Process.Kill()
-			e2 := <-ec
-			if e2 != nil {
-				return e2
-			}
-			return e1
-		case err := <-ec:
-			return err
-		}
-		panic("not reached")
+		ctx, cancel := killContext(kill)
+		defer cancel()
+		return summon.RunCommand(ctx, cmd)
 	}
 }
 
-// Run a rsync command and backup some data.
+// Run a rsync command and backup some data. The BackupExcludes and any
+// .summon-ignore files are excluded.
 func (c *Config) Backup(args []string) func(kill chan bool) error {
 	return func(kill chan bool) error {
 		cargs := []string{
@@ -631,8 +954,17 @@ func (c *Config) Backup(args []string) func(kill chan bool) error {
 			"--partial",
 			"--xattrs",
 		}
+		excludes, remove, err := c.rsyncExcludeArgs()
+		if err != nil {
+			return err
+		}
+		defer remove()
+		cargs = append(cargs, excludes...)
 		cargs = append(cargs, args...)
-		if err := run(exec.Command("rsync", cargs...), kill); err != nil {
+		if err := c.waitBackupWindow(kill); err != nil {
+			return err
+		}
+		if _, err := c.runRsync("Backup", cargs, true, kill); err != nil {
 			return err
 		}
 		return nil
@@ -641,37 +973,60 @@ func (c *Config) Backup(args []string) func(kill chan bool) error {
 
 // Generate the hostname file.
 func (c *Config) GenEtcHostname(kill chan bool) error {
-	f, err := os.OpenFile(
-		filepath.Join(c.Root.Dir, "etc", "hostname"),
-		os.O_WRONLY|os.O_CREATE,
-		os.FileMode(0o644),
-	)
-	if err != nil {
-		return err
+	return c.writeTargetFile("etc/hostname", c.Name+"\n", os.FileMode(0o644))
+}
+
+// Generate the hosts file, with the hostname resolving to 127.0.1.1 and the
+// configured Hosts.
+func (c *Config) GenEtcHosts(kill chan bool) error {
+	hosts := []Host{
+		{Address: "127.0.0.1", Names: []string{"localhost"}},
+		{Address: "::1", Names: []string{"localhost"}},
+		{Address: "127.0.1.1", Names: []string{c.Name}},
 	}
-	defer f.Close()
+	var b strings.Builder
+	for _, h := range append(hosts, c.Hosts...) {
+		fmt.Fprintf(&b, "%s %s\n", h.Address, strings.Join(h.Names, " "))
+	}
+	return c.writeTargetFile("etc/hosts", b.String(), os.FileMode(0o644))
+}
 
-	if _, err := f.WriteString(c.Name + "\n"); err != nil {
-		return err
+// Apply the MachineID policy. This must run after RestoreIdentity.
+func (c *Config) GenMachineID(kill chan bool) error {
+	name := filepath.Join(c.Root.Dir, "etc", "machine-id")
+	switch c.MachineID {
+	case MachineIDBlank:
+		return writeFile(name, nil, os.FileMode(0o444))
+	case MachineIDRestored:
+		id, err := readFile(name)
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(id)) != 32 {
+			return fmt.Errorf("invalid restored machine-id in %s", name)
+		}
 	}
 	return nil
 }
 
-// Generate /boot/efi/EFI/archlinux/refind_linux.conf.
+// Generate <esp>/EFI/<vendor>/refind_linux.conf.
 func (c *Config) GenRefind(kill chan bool) error {
-	f, err := os.OpenFile(
-		filepath.Join(c.EFI.Dir, "EFI", "archlinux", "refind_linux.conf"),
-		os.O_WRONLY|os.O_CREATE,
-		os.FileMode(0o755),
+	options := c.kernelOptions()
+	contentsTemplate := `"Boot with defaults"  "%s"
+"Boot single user"    "%s single"
+`
+	return writeFile(
+		filepath.Join(c.EFI.Dir, "EFI", c.efiVendor(), "refind_linux.conf"),
+		[]byte(fmt.Sprintf(contentsTemplate, options, options)),
+		os.FileMode(0o644),
 	)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+}
 
+// The kernel command line.
+func (c *Config) kernelOptions() string {
 	extra := ""
-	if c.Root.Password != "" {
-		extra += " cryptdevice=/dev/disk/by-partlabel/" + c.Root.Name + `:` + c.Root.Name
+	for _, p := range c.installer().KernelParams(c) {
+		extra += " " + p
 	}
 	if c.Root.FSType == Btrfs {
 		extra += " rootflags=subvol=" + btrfsActive
@@ -679,103 +1034,194 @@ func (c *Config) GenRefind(kill chan bool) error {
 	if c.Swap != nil {
 		extra += " resume=" + c.Swap.fsDev()
 	}
-	options := `init=/usr/lib/systemd/systemd` +
-		` ro` +
+	if c.Laptop != nil {
+		for _, p := range c.Laptop.KernelParams {
+			extra += " " + p
+		}
+	}
+	// with DPS, systemd-gpt-auto-generator finds the root by its type
+	root := ` root=` + c.Root.fsDev()
+	if c.DPS {
+		root = ""
+	}
+	return `ro` +
 		` plymouth.enable=0` +
-		` root=` + c.Root.fsDev() +
+		root +
 		extra
+}
 
-	contentsTemplate := `"Boot with defaults"  "%s"
-"Boot single user"    "%s single"
-`
-	if _, err := fmt.Fprintf(f, contentsTemplate, options, options); err != nil {
-		return err
+// Generate /etc/crypttab, for initramfs implementations which use it to
+// unlock the encrypted root, and for the encrypted data disks.
+func (c *Config) genCrypttab() error {
+	if c.Root.Password == "" {
+		return nil
+	}
+	line := fmt.Sprintf(
+		"%s %s none luks,discard\n",
+		c.Root.Name,
+		filepath.Join("/dev/disk/by-partlabel", c.Root.Name),
+	)
+	for _, d := range c.Data {
+		line += d.crypttabLine()
+	}
+	return c.writeTargetFile("etc/crypttab", line, os.FileMode(0o600))
+}
+
+// Generate /etc/crypttab if there are encrypted data disks, which are
+// unlocked after the root using the same passphrase.
+func (c *Config) GenCrypttab(kill chan bool) error {
+	for _, d := range c.Data {
+		if d.Encrypt {
+			return c.genCrypttab()
+		}
 	}
 	return nil
 }
 
 // Generate fstab.
 func (c *Config) GenFstab(kill chan bool) error {
-	f, err := os.OpenFile(
-		filepath.Join(c.Root.Dir, "etc", "fstab"),
-		os.O_WRONLY|os.O_CREATE,
-		os.FileMode(0o755),
-	)
+	root, err := c.fstabSource(c.Root.fsDev())
+	if err != nil {
+		return err
+	}
+	efi, err := c.fstabSource(filepath.Join("/dev/disk/by-partlabel", c.EFI.Name))
+	if err != nil {
+		return err
+	}
+
+	options, err := c.rootMountOptions()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	var lines [][]string
-	rootOptions := "noatime"
+	rootOptions := options
 	rootSuffix := "0 1"
 	if c.Root.FSType == Btrfs {
-		rootOptions += ",compress=lzo,subvol=__active"
+		rootOptions += ",subvol=" + btrfsActive
 		rootSuffix = "0 0"
 	}
 
-	lines = append(
-		lines,
-		[]string{
-			c.Root.fsDev(),
-			"/",
-			string(c.Root.FSType),
-			rootOptions,
-			rootSuffix,
-		},
-	)
+	if !c.DPS {
+		lines = append(
+			lines,
+			[]string{
+				root,
+				"/",
+				string(c.Root.FSType),
+				rootOptions,
+				rootSuffix,
+			},
+		)
+	}
 
 	if c.Root.FSType == Btrfs {
 		lines = append(
 			lines,
 			[]string{
-				c.Root.fsDev(),
-				"/mnt/root",
+				root,
+				btrfsTopLevel,
 				string(Btrfs),
-				"noatime,compress=lzo",
+				options,
 				"0 0",
 			},
 		)
 	}
 
-	if c.Swap != nil {
+	for _, s := range c.Subvolumes {
 		lines = append(
 			lines,
 			[]string{
-				c.Swap.fsDev(),
+				root,
+				s.Mountpoint,
+				string(Btrfs),
+				options + ",subvol=" + s.Name,
+				"0 0",
+			},
+		)
+	}
+
+	if c.Swap != nil && !c.dpsSwap() {
+		swap, err := c.fstabSource(c.Swap.fsDev())
+		if err != nil {
+			return err
+		}
+		lines = append(
+			lines,
+			[]string{
+				swap,
 				"none",
 				"swap",
-				"defaults",
+				swapOptions(c.Swap.Priority),
 				"0 0",
 			},
 		)
 	}
+	lines = append(lines, c.swapFileLines()...)
+	lines = append(lines, c.Tmp.fstabLines()...)
 
-	lines = append(
-		lines,
-		[]string{
-			filepath.Join("/dev/disk/by-partlabel", c.EFI.Name),
-			"/boot/efi",
-			"vfat",
-			"defaults",
-			"0 0",
-		},
-	)
-
-	for _, l := range lines {
-		for pi, p := range l {
-			if pi != 0 {
-				if _, err := f.WriteString(" "); err != nil {
-					return err
-				}
-			}
-			if _, err := f.WriteString(p); err != nil {
-				return err
-			}
-		}
-		if _, err := f.WriteString("\n"); err != nil {
+	for _, d := range c.Data {
+		line, err := d.fstabLine()
+		if err != nil {
 			return err
 		}
+		lines = append(lines, line)
+	}
+
+	if !c.dpsESP() {
+		lines = append(
+			lines,
+			[]string{
+				efi,
+				c.espPath(),
+				"vfat",
+				c.espOptions(),
+				"0 0",
+			},
+		)
+	}
+
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(strings.Join(l, " "))
+		b.WriteString("\n")
+	}
+	return c.writeTargetFile("etc/fstab", b.String(), os.FileMode(0o644))
+}
+
+// The fstab source for the device, which is UUID=... if Config.FstabUUID is
+// set and the device has one.
+func (c *Config) fstabSource(device string) (string, error) {
+	if !c.FstabUUID {
+		return device, nil
+	}
+	info, err := Probe(device)
+	if err != nil {
+		return "", err
+	}
+	if info.UUID == "" {
+		return device, nil
+	}
+	return "UUID=" + info.UUID, nil
+}
+
+// The configured Installer, defaulting to Arch.
+func (c *Config) installer() Installer {
+	if c.Installer == nil {
+		return Arch{}
+	}
+	return c.Installer
+}
+
+// Enable a service in the target, using systemctl unless the Installer
+// implements ServiceEnabler.
+func (c *Config) enableService(name string, kill chan bool) error {
+	if e, ok := c.installer().(ServiceEnabler); ok {
+		return e.EnableService(c, name, kill)
+	}
+	cmd := exec.Command("systemctl", "--root", c.Root.Dir, "enable", name)
+	if err := run(cmd, kill); err != nil {
+		return err
 	}
 	return nil
 }
@@ -784,68 +1230,62 @@ func (c *Config) label(thing string) string {
 	return fmt.Sprintf("%s-%s", c.Name, thing)
 }
 
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
 func mountBtrfsRoot(device string, kill chan bool) (string, error) {
-	dir, err := os.MkdirTemp("", path.Base(device))
+	dir, err := mkdirTemp(path.Base(device))
 	if err != nil {
 		return "", err
 	}
 
-	mcmd := exec.Command(
-		"mount",
-		"-t", string(Btrfs),
-		"-o", "noatime,compress=lzo",
-		device,
-		dir,
-	)
-	if err := run(mcmd, kill); err != nil {
+	if err := mount(device, dir, string(Btrfs), MountNoatime+","+MountCompressLZO); err != nil {
 		return "", err
 	}
 	return dir, nil
 }
 
 func umountBtrfsRoot(dir string, kill chan bool) error {
-	cmd := exec.Command("umount", dir)
-	if err := run(cmd, kill); err != nil {
-		return err
-	}
-	if err := os.Remove(dir); err != nil {
+	if err := umount(dir); err != nil {
 		return err
 	}
-	return nil
+	return remove(dir)
 }
 
 func run(cmd *exec.Cmd, kill chan bool) error {
+	return runTee(cmd, kill, nil)
+}
+
+// Like run, but the stdout is also written to w as the command runs.
+func runTee(cmd *exec.Cmd, kill chan bool, w io.Writer) error {
+	return runStreams(cmd, kill, w, nil)
+}
+
+// Like runTee, with separate writers for stdout and stderr, either of which
+// may be nil.
+func runStreams(cmd *exec.Cmd, kill chan bool, stdout, stderr io.Writer) error {
 	if cmd.Stdout != nil {
 		return errors.New("summon: Stdout already set")
 	}
 	if cmd.Stderr != nil {
 		return errors.New("summon: Stderr already set")
 	}
-	var b bytes.Buffer
-	cmd.Stdout = &b
-	cmd.Stderr = &b
-	if err := cmd.Start(); err != nil {
-		return err
-	}
-
-	ec := make(chan error)
-	go func() {
-		if err := cmd.Wait(); err != nil {
-			ec <- fmt.Errorf("error running command: %q: %v\n%s", cmd, err, b.Bytes())
-			return
-		}
-		ec <- nil
-	}()
-	select {
-	case <-kill:
-		e1 := cmd.Process.Kill()
-		e2 := <-ec
-		if e2 != nil {
-			return e2
-		}
-		return e1
-	case err := <-ec:
-		return err
-	}
-	panic("not reached")
+	ctx, cancel := killContext(kill)
+	defer cancel()
+	return withCondition(summon.RunStreaming(ctx, cmd, stdout, stderr))
 }
@@ -0,0 +1,392 @@
+package system
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/daaku/ensure"
+	"github.com/daaku/summon"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetIgnorePkg(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		want     string
+	}{
+		{
+			name:     "added",
+			contents: "[options]\n#IgnorePkg   =\nHoldPkg = pacman\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n",
+			want:     "[options]\nIgnorePkg = linux nvidia\n#IgnorePkg   =\nHoldPkg = pacman\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n",
+		},
+		{
+			name:     "replaced",
+			contents: "[options]\nIgnorePkg = linux nvidia\nHoldPkg = pacman\nIgnorePkg=old\n",
+			want:     "[options]\nIgnorePkg = linux nvidia\nHoldPkg = pacman\n",
+		},
+		{
+			name:     "other sections kept",
+			contents: "[options]\n[custom]\nIgnorePkg = kept\n",
+			want:     "[options]\nIgnorePkg = linux nvidia\n[custom]\nIgnorePkg = kept\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := setIgnorePkg([]byte(c.contents), []string{"linux", "nvidia"})
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, string(got), c.want)
+		})
+	}
+	_, err := setIgnorePkg([]byte("[core]\n"), []string{"linux"})
+	ensure.Err(t, err, regexp.MustCompile("no \\[options\\] section"))
+}
+
+func TestSudoers(t *testing.T) {
+	c := &Config{
+		AdminGroups: []string{"wheel"},
+		Users: []User{
+			{Name: "naitik", Admin: true, Password: "secret"},
+			{Name: "deploy", Admin: true, NoPasswd: true},
+			{Name: "guest"},
+		},
+	}
+	ensure.Nil(t, c.checkAdminPasswords())
+	ensure.DeepEqual(t, c.sudoers(), "%wheel ALL=(ALL:ALL) ALL\nnaitik ALL=(ALL:ALL) ALL\ndeploy ALL=(ALL:ALL) NOPASSWD: ALL\n")
+	ensure.DeepEqual(t, c.doasConf(), "permit persist :wheel\npermit persist naitik\npermit nopass deploy\n")
+
+	c.Users = append(c.Users, User{Name: "oops", Admin: true})
+	ensure.Err(t, c.checkAdminPasswords(), regexp.MustCompile("admin oops has no password"))
+}
+
+func TestParseRsyncProgress(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		want summon.Event
+		ok   bool
+	}{
+		{
+			name: "progress",
+			line: "      1,234,567  45%   12.34MB/s    0:01:23 (xfr#12, to-chk=100/200)",
+			want: summon.Event{Message: "1,234,567 45% 12.34MB/s 0:01:23", Percent: 45},
+			ok:   true,
+		},
+		{
+			name: "done",
+			line: "  9,876,543 100%   20.00MB/s    0:00:00 (xfr#200, to-chk=0/200)",
+			want: summon.Event{Message: "9,876,543 100% 20.00MB/s 0:00:00", Percent: 100},
+			ok:   true,
+		},
+		{name: "file list", line: "sending incremental file list"},
+		{name: "stats", line: "Number of files: 1,234 (reg: 1,000, dir: 234)"},
+		{name: "bad percent", line: "1,234 x% 1.00MB/s 0:00:01"},
+		{name: "short", line: "1,234 45%"},
+		{name: "empty"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := parseRsyncProgress(c.line)
+			ensure.DeepEqual(t, ok, c.ok)
+			ensure.DeepEqual(t, got, c.want)
+		})
+	}
+}
+
+func TestParseRsyncStats(t *testing.T) {
+	var stats BackupStats
+	for _, line := range []string{
+		"Number of files: 1,234 (reg: 1,000, dir: 234)",
+		"Number of created files: 10",
+		"Total file size: 99,999,999 bytes",
+		"Total transferred file size: 12,345,678 bytes",
+		"sent 12,400,000 bytes  received 1,234 bytes  1.23M bytes/sec",
+	} {
+		parseRsyncStats(line, &stats)
+	}
+	ensure.DeepEqual(t, stats, BackupStats{Files: 1234, Bytes: 12345678})
+}
+
+func TestRetentionKeep(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		ensure.Nil(t, err)
+		return v
+	}
+	cases := []struct {
+		name      string
+		retention Retention
+		times     []string
+		want      []bool
+	}{
+		{
+			name: "none",
+			want: []bool{},
+		},
+		{
+			name:  "newest always kept",
+			times: []string{"2024-03-15 18:00", "2024-03-14 18:00", "2024-03-13 18:00"},
+			want:  []bool{true, false, false},
+		},
+		{
+			name:      "last",
+			retention: Retention{Last: 2},
+			times:     []string{"2024-03-15 18:00", "2024-03-15 09:00", "2024-03-14 18:00"},
+			want:      []bool{true, true, false},
+		},
+		{
+			name:      "daily",
+			retention: Retention{Daily: 2},
+			times:     []string{"2024-03-15 18:00", "2024-03-15 09:00", "2024-03-14 20:00", "2024-03-13 20:00"},
+			want:      []bool{true, false, true, false},
+		},
+		{
+			name:      "weekly",
+			retention: Retention{Weekly: 2},
+			times:     []string{"2024-03-15 18:00", "2024-03-12 18:00", "2024-03-08 18:00", "2024-03-01 18:00"},
+			want:      []bool{true, false, true, false},
+		},
+		{
+			name:      "monthly",
+			retention: Retention{Monthly: 2},
+			times:     []string{"2024-03-15 18:00", "2024-03-01 18:00", "2024-02-20 18:00", "2024-01-10 18:00"},
+			want:      []bool{true, false, true, false},
+		},
+		{
+			name:      "rules share backups",
+			retention: Retention{Daily: 1, Monthly: 2},
+			times:     []string{"2024-03-15 18:00", "2024-03-15 09:00", "2024-02-28 18:00", "2024-02-10 18:00", "2024-01-05 18:00"},
+			want:      []bool{true, false, true, false, false},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			times := []time.Time{}
+			for _, s := range c.times {
+				times = append(times, at(s))
+			}
+			ensure.DeepEqual(t, c.retention.keep(times), c.want)
+		})
+	}
+}
+
+func TestParseMountOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		options string
+		flags   uintptr
+		data    string
+	}{
+		{name: "empty"},
+		{name: "defaults", options: "defaults,rw,exec"},
+		{
+			name:    "flags and data",
+			options: "noatime,compress=lzo,nodev",
+			flags:   unix.MS_NOATIME | unix.MS_NODEV,
+			data:    "compress=lzo",
+		},
+		{name: "bind", options: "bind", flags: unix.MS_BIND},
+		{name: "rbind", options: "rbind,ro", flags: unix.MS_BIND | unix.MS_REC | unix.MS_RDONLY},
+		{
+			name:    "subvol",
+			options: "noatime,subvol=__active,compress=zstd:3",
+			flags:   unix.MS_NOATIME,
+			data:    "subvol=__active,compress=zstd:3",
+		},
+		{name: "empty options", options: ",noatime,,", flags: unix.MS_NOATIME},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			flags, data := parseMountOptions(c.options)
+			ensure.DeepEqual(t, flags, c.flags)
+			ensure.DeepEqual(t, data, c.data)
+		})
+	}
+}
+
+func TestGPTLayout(t *testing.T) {
+	const sector, size = 512, 64 << 20
+	g := &GPT{DiskGUID: "0B2F5C2E-7D4A-4F57-9C1B-5B0F6E9A3D21"}
+	parts := []gptPartition{
+		{Size: 8 << 20, Typecode: "ef00", Name: "boe-efi"},
+		{Typecode: "8304", Name: "boe-root", GUID: "6D8A5E33-8C4E-4B8B-9A62-3C5D1F8E2A10"},
+	}
+	writes, err := g.layout(parts, sector, size)
+	ensure.Nil(t, err)
+
+	mbr := writes[0]
+	ensure.DeepEqual(t, mbr[510:], []byte{0x55, 0xaa})
+	ensure.DeepEqual(t, mbr[446+4], byte(0xee))
+
+	lastLBA := int64(size/sector - 1)
+	entries := writes[2*sector]
+	checkHeader := func(h []byte, my, alternate, entriesLBA int64) {
+		ensure.DeepEqual(t, string(h[:8]), "EFI PART")
+		ensure.DeepEqual(t, int64(binary.LittleEndian.Uint64(h[24:])), my)
+		ensure.DeepEqual(t, int64(binary.LittleEndian.Uint64(h[32:])), alternate)
+		ensure.DeepEqual(t, int64(binary.LittleEndian.Uint64(h[72:])), entriesLBA)
+		ensure.DeepEqual(t, binary.LittleEndian.Uint32(h[88:]), crc32.ChecksumIEEE(entries))
+		unsummed := slices.Clone(h[:92])
+		binary.LittleEndian.PutUint32(unsummed[16:], 0)
+		ensure.DeepEqual(t, binary.LittleEndian.Uint32(h[16:]), crc32.ChecksumIEEE(unsummed))
+	}
+	checkHeader(writes[sector], 1, lastLBA, 2)
+	backupEntries := lastLBA - gptEntries*gptEntrySize/sector
+	checkHeader(writes[lastLBA*sector], lastLBA, 1, backupEntries)
+	ensure.DeepEqual(t, writes[backupEntries*sector], entries)
+
+	lastUsable := int64(binary.LittleEndian.Uint64(writes[sector][48:]))
+	for i := range parts {
+		e := entries[i*gptEntrySize:]
+		start := int64(binary.LittleEndian.Uint64(e[32:]))
+		end := int64(binary.LittleEndian.Uint64(e[40:]))
+		ensure.DeepEqual(t, start%(gptAlign/sector), int64(0))
+		ensure.True(t, end >= start && end <= lastUsable)
+	}
+	ensure.DeepEqual(t, int64(binary.LittleEndian.Uint64(entries[40:])), int64(2048+(8<<20)/sector-1))
+	ensure.DeepEqual(t, int64(binary.LittleEndian.Uint64(entries[gptEntrySize+40:])), lastUsable)
+
+	image := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(image)
+	ensure.Nil(t, err)
+	ensure.Nil(t, f.Truncate(size))
+	ensure.Nil(t, f.Close())
+	ensure.Nil(t, g.write(image, parts))
+	ensure.Nil(t, verifyGPT(image, parts))
+	read, err := readGPT(image)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, read, []gptEntry{
+		{Type: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", GUID: read[0].GUID, Name: "boe-efi"},
+		{Type: "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709", GUID: "6D8A5E33-8C4E-4B8B-9A62-3C5D1F8E2A10", Name: "boe-root"},
+	})
+
+	// a header claiming more entries than there are is refused
+	f, err = os.OpenFile(image, os.O_RDWR, 0)
+	ensure.Nil(t, err)
+	_, err = f.WriteAt(binary.LittleEndian.AppendUint32(nil, 1<<30), sector+80)
+	ensure.Nil(t, err)
+	ensure.Nil(t, f.Close())
+	_, err = readGPT(image)
+	ensure.Err(t, err, regexp.MustCompile("invalid GPT entry count"))
+
+	// type codes are case insensitive, like with sgdisk
+	hybrid := []gptPartition{{Size: 8 << 20, Typecode: "AF00", Name: "boe-osx", Hybrid: true}, parts[1]}
+	writes, err = g.layout(hybrid, sector, size)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, writes[0][446+16+4], byte(0xaf))
+}
+
+func TestProbe(t *testing.T) {
+	uuid := []byte{0x6d, 0x8a, 0x5e, 0x33, 0x8c, 0x4e, 0x4b, 0x8b, 0x9a, 0x62, 0x3c, 0x5d, 0x1f, 0x8e, 0x2a, 0x10}
+	const uuidString = "6d8a5e33-8c4e-4b8b-9a62-3c5d1f8e2a10"
+	superblock := func(writes map[int][]byte) []byte {
+		b := make([]byte, probeSize)
+		for off, data := range writes {
+			copy(b[off:], data)
+		}
+		return b
+	}
+	le16 := func(v uint16) []byte { return binary.LittleEndian.AppendUint16(nil, v) }
+	le32 := func(v uint32) []byte { return binary.LittleEndian.AppendUint32(nil, v) }
+	ext := func(compat, incompat uint32) []byte {
+		return superblock(map[int][]byte{
+			1024 + 56:  le16(0xef53),
+			1024 + 92:  le32(compat),
+			1024 + 96:  le32(incompat),
+			1024 + 104: uuid,
+			1024 + 120: []byte("boe-root"),
+		})
+	}
+	cases := []struct {
+		name string
+		b    []byte
+		want BlockInfo
+	}{
+		{
+			name: "luks1",
+			b: superblock(map[int][]byte{
+				0:   []byte("LUKS\xba\xbe\x00\x01"),
+				168: []byte(uuidString),
+			}),
+			want: BlockInfo{Type: "crypto_LUKS", UUID: uuidString},
+		},
+		{
+			name: "luks2",
+			b: superblock(map[int][]byte{
+				0:   []byte("LUKS\xba\xbe\x00\x02"),
+				24:  []byte("boe-root"),
+				168: []byte(uuidString),
+			}),
+			want: BlockInfo{Type: "crypto_LUKS", UUID: uuidString, Label: "boe-root"},
+		},
+		{
+			name: "btrfs",
+			b: superblock(map[int][]byte{
+				0x10020: uuid,
+				0x10040: []byte("_BHRfS_M"),
+				0x1012b: []byte("boe-root"),
+			}),
+			want: BlockInfo{Type: "btrfs", UUID: uuidString, Label: "boe-root"},
+		},
+		{name: "ext2", b: ext(0, 0x2), want: BlockInfo{Type: "ext2", UUID: uuidString, Label: "boe-root"}},
+		{name: "ext3", b: ext(0x4, 0x2), want: BlockInfo{Type: "ext3", UUID: uuidString, Label: "boe-root"}},
+		{name: "ext4", b: ext(0x4, 0x2|0x40|0x200), want: BlockInfo{Type: "ext4", UUID: uuidString, Label: "boe-root"}},
+		{
+			name: "xfs",
+			b: superblock(map[int][]byte{
+				0:   []byte("XFSB"),
+				32:  uuid,
+				108: []byte("boe-root"),
+			}),
+			want: BlockInfo{Type: "xfs", UUID: uuidString, Label: "boe-root"},
+		},
+		{
+			name: "swap",
+			b: superblock(map[int][]byte{
+				1036:      uuid,
+				1052:      []byte("boe-swap"),
+				4096 - 10: []byte("SWAPSPACE2"),
+			}),
+			want: BlockInfo{Type: "swap", UUID: uuidString, Label: "boe-swap"},
+		},
+		{
+			name: "fat32",
+			b: superblock(map[int][]byte{
+				0x43: le32(0x1234abcd),
+				0x47: []byte("BOE-EFI    "),
+				0x52: []byte("FAT32   "),
+				510:  {0x55, 0xaa},
+			}),
+			want: BlockInfo{Type: "vfat", UUID: "1234-ABCD", Label: "BOE-EFI"},
+		},
+		{
+			name: "fat16",
+			b: superblock(map[int][]byte{
+				0x27: le32(0x00c0ffee),
+				0x2b: []byte("NO NAME    "),
+				0x36: []byte("FAT16   "),
+				510:  {0x55, 0xaa},
+			}),
+			want: BlockInfo{Type: "vfat", UUID: "00C0-FFEE"},
+		},
+		{name: "unknown", b: superblock(nil)},
+		{name: "short", b: []byte("LUKS")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ensure.DeepEqual(t, probe(c.b), c.want)
+		})
+	}
+
+	image := filepath.Join(t.TempDir(), "ext4.img")
+	ensure.Nil(t, os.WriteFile(image, ext(0x4, 0x40), os.FileMode(0o600)))
+	info, err := Probe(image)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, info, BlockInfo{Type: "ext4", UUID: uuidString, Label: "boe-root"})
+}
@@ -0,0 +1,168 @@
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/daaku/errgroup"
+	"github.com/daaku/summon"
+	"github.com/kballard/go-shellquote"
+)
+
+// The baseline environment for commands run inside the target, which does not
+// inherit the host environment. Config.TargetEnv is added to this.
+var targetEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=/root",
+	"LANG=C.UTF-8",
+}
+
+// ChrootExec runs a command inside the target. The output is captured, and
+// included in the error if the command fails.
+func (c *Config) ChrootExec(argv ...string) summon.Task {
+	return summon.Task{
+		Name: fmt.Sprintf("In %s: %s", c.Name, shellquote.Join(argv...)),
+		Do: func(ctx context.Context) error {
+			return c.inTarget(ctx, func() error {
+				return summon.VerboseRun(c.targetCmdContext(ctx, nil, argv...))
+			})
+		},
+	}
+}
+
+// ChrootShell runs a shell script inside the target, stopping at the first
+// failing command.
+func (c *Config) ChrootShell(script string) summon.Task {
+	t := c.ChrootExec("/bin/sh", "-e", "-c", script)
+	t.Name = fmt.Sprintf("In %s: shell script", c.Name)
+	return t
+}
+
+// Run f with the target prepared for commands, which is only necessary when
+// using chroot.
+func (c *Config) inTarget(ctx context.Context, f func() error) error {
+	if !c.useChroot() {
+		return f()
+	}
+	cleanup, err := c.prepareChroot(ctx)
+	if err != nil {
+		return err
+	}
+	return errgroup.NewMultiError(f(), cleanup())
+}
+
+// Unlike systemd-nspawn, chroot does not set up the target. Mount the virtual
+// file systems unless they're already mounted, and bind mount the host
+// resolv.conf. The returned function undoes this.
+func (c *Config) prepareChroot(ctx context.Context) (func() error, error) {
+	var undo []func() error
+	cleanup := func() error {
+		var errs []error
+		for i := len(undo) - 1; i >= 0; i-- {
+			errs = append(errs, undo[i]())
+		}
+		return errgroup.NewMultiError(errs...)
+	}
+
+	mounted, err := exists(filepath.Join(c.Root.Dir, "proc", "self"))
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		if err := c.VirtualFS.Mount(nil); err != nil {
+			return nil, err
+		}
+		undo = append(undo, func() error { return c.VirtualFS.Umount(nil) })
+	}
+
+	unbind, err := c.bindResolvConf()
+	if err != nil {
+		return nil, errgroup.NewMultiError(err, cleanup())
+	}
+	undo = append(undo, unbind)
+	return cleanup, nil
+}
+
+// Bind mount the host resolv.conf over the one of the target, or over what it
+// links to, like the stub of systemd-resolved, which nothing provides in a
+// chroot. The returned function undoes this.
+func (c *Config) bindResolvConf() (func() error, error) {
+	resolv := filepath.Join(c.Root.Dir, "etc", "resolv.conf")
+	if dest, err := readlink(resolv); err == nil {
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join("/etc", dest)
+		}
+		resolv = filepath.Join(c.Root.Dir, dest)
+	}
+	found, err := exists(resolv)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if err := writeFile(resolv, nil, os.FileMode(0o644)); err != nil {
+			return nil, err
+		}
+	}
+	unlink := func() error {
+		if !found {
+			return remove(resolv)
+		}
+		return nil
+	}
+	if err := bindMount("/etc/resolv.conf", resolv, false); err != nil {
+		return nil, errgroup.NewMultiError(err, unlink())
+	}
+	return func() error {
+		if err := umount(resolv); err != nil {
+			return err
+		}
+		return unlink()
+	}, nil
+}
+
+func (c *Config) useChroot() bool {
+	return c.Chroot || !haveNSpawn()
+}
+
+// Create a command to run inside the target. systemd-nspawn is used when
+// available, which provides a proper /dev and /proc and isolates the
+// target from the host. The ESP is bind mounted, and the host resolv.conf is
+// made available without overwriting the target's own. chroot is used as a
+// fallback, or if Config.Chroot is set. The env entries are in the form of
+// "key=value".
+func (c *Config) targetCmd(env []string, args ...string) *exec.Cmd {
+	return c.targetCmdContext(context.Background(), env, args...)
+}
+
+func (c *Config) targetCmdContext(ctx context.Context, env []string, args ...string) *exec.Cmd {
+	env = append(append(append(append([]string{}, targetEnv...), c.Proxy.env()...), c.TargetEnv...), env...)
+	if c.useChroot() {
+		cmd := exec.CommandContext(ctx, "chroot", append([]string{c.Root.Dir}, args...)...)
+		cmd.Env = env
+		return cmd
+	}
+
+	nargs := []string{
+		"--quiet",
+		"--directory", c.Root.Dir,
+		"--bind", c.EFI.Dir + ":" + c.espPath(),
+		"--resolv-conf", "bind-host",
+		"--timezone", "off",
+		"--link-journal", "no",
+		"--register", "no",
+		"--console", "pipe",
+	}
+	for _, e := range env {
+		nargs = append(nargs, "--setenv", e)
+	}
+	nargs = append(nargs, "--")
+	return exec.CommandContext(ctx, "systemd-nspawn", append(nargs, args...)...)
+}
+
+func haveNSpawn() bool {
+	_, err := exec.LookPath("systemd-nspawn")
+	return err == nil
+}
@@ -0,0 +1,108 @@
+package system
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errClockNotSynchronized = errors.New("summon: system clock was not synchronized using NTP")
+	errNTPWithoutSystemd    = errors.New("summon: NTP servers require chrony without systemd")
+)
+
+// How long SyncClock waits for the clock to be synchronized.
+const clockSyncTimeout = 30 * time.Second
+
+// Enable NTP in the live environment and wait for the clock to be
+// synchronized, since a wrong clock breaks verifying package signatures.
+// Offline installs are skipped, since there may be no NTP server to reach,
+// leaving the clock as it is.
+func (c *Config) SyncClock(kill chan bool) error {
+	if c.Offline != nil {
+		return nil
+	}
+	if err := run(exec.Command("timedatectl", "set-ntp", "true"), kill); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(clockSyncTimeout)
+	for {
+		out, err := output(exec.Command(
+			"timedatectl", "show", "--property", "NTPSynchronized", "--value",
+		), kill)
+		if err != nil {
+			return err
+		}
+		if string(bytes.TrimSpace(out)) == "yes" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errClockNotSynchronized
+		}
+		select {
+		case <-kill:
+			return errClockNotSynchronized
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Generate the time synchronization configuration for the configured
+// NTPServers, and enable the service. systemd-timesyncd is used unless
+// Config.Chrony is set, in which case chrony must be installed using the
+// Packages. Without systemd, nothing is done unless Config.Chrony is set.
+func (c *Config) GenTimesync(kill chan bool) error {
+	if c.Chrony {
+		return c.genChrony(kill)
+	}
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		if len(c.NTPServers) > 0 {
+			return errNTPWithoutSystemd
+		}
+		return nil
+	}
+	if len(c.NTPServers) > 0 {
+		dir := filepath.Join(c.Root.Dir, "etc", "systemd", "timesyncd.conf.d")
+		conf := "[Time]\nNTP=" + strings.Join(c.NTPServers, " ") + "\n"
+		err := writeFile(filepath.Join(dir, "summon.conf"), []byte(conf), os.FileMode(0o644))
+		if err != nil {
+			return err
+		}
+	}
+	return c.enableService("systemd-timesyncd.service", kill)
+}
+
+func (c *Config) genChrony(kill chan bool) error {
+	servers := c.NTPServers
+	if len(servers) == 0 {
+		servers = []string{"pool.ntp.org"}
+	}
+
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "server %s iburst\n", s)
+	}
+	b.WriteString("driftfile /var/lib/chrony/drift\n")
+	b.WriteString("makestep 1.0 3\n")
+	b.WriteString("rtcsync\n")
+
+	name := filepath.Join(c.Root.Dir, "etc", "chrony.conf")
+	if _, ok := c.installer().(Debootstrap); ok {
+		name = filepath.Join(c.Root.Dir, "etc", "chrony", "chrony.conf")
+	}
+	if err := writeFile(name, []byte(b.String()), os.FileMode(0o644)); err != nil {
+		return err
+	}
+
+	service := "chronyd.service"
+	if _, ok := c.installer().(Debootstrap); ok {
+		service = "chrony.service"
+	}
+	return c.enableService(service, kill)
+}
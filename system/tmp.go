@@ -0,0 +1,48 @@
+package system
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// How /tmp and /var/tmp are handled in the target. With Tmpfs, /tmp is a
+// tmpfs of the Size, like 2G or 50% of the memory, defaulting to the kernel's
+// half, and the Mode, defaulting to 1777. VarTmpAge is how long unused files
+// are kept in /var/tmp, like 30d, using the age format of tmpfiles.d(5).
+type TmpPolicy struct {
+	Tmpfs     bool
+	Size      string
+	Mode      string
+	VarTmpAge string
+}
+
+// The fstab line for a tmpfs /tmp, if there is one.
+func (t *TmpPolicy) fstabLines() [][]string {
+	if t == nil || !t.Tmpfs {
+		return nil
+	}
+	mode := t.Mode
+	if mode == "" {
+		mode = "1777"
+	}
+	options := []string{"mode=" + mode, "nosuid", "nodev"}
+	if t.Size != "" {
+		options = append([]string{"size=" + t.Size}, options...)
+	}
+	return [][]string{{"tmpfs", "/tmp", "tmpfs", strings.Join(options, ","), "0 0"}}
+}
+
+// Generate the tmpfiles.d configuration cleaning up /var/tmp, if an age is
+// configured. The name sorts before the tmp.conf systemd ships, so its line
+// for /var/tmp is the one used.
+func (c *Config) GenTmpfiles(kill chan bool) error {
+	if c.Tmp == nil || c.Tmp.VarTmpAge == "" {
+		return nil
+	}
+	return c.writeTargetFile(
+		"/etc/tmpfiles.d/summon-tmp.conf",
+		fmt.Sprintf("q /var/tmp 1777 root root %s\n", c.Tmp.VarTmpAge),
+		os.FileMode(0o644),
+	)
+}
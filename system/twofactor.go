@@ -0,0 +1,161 @@
+package system
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errTwoFactorNoPassword = errors.New("summon: two factor unlock requires a disk password")
+
+// Size of a generated keyfile.
+const keyfileSize = 4096
+
+// TwoFactor unlocks the root disk with a key derived from the passphrase and
+// a keyfile at Path on the removable Device, like /dev/disk/by-label/KEYS,
+// so that booting requires both. The keyfile is created if it doesn't exist.
+// FSType is the file system on the Device, and may be left for mount to
+// detect. It requires the busybox based encrypt hook of mkinitcpio, which is
+// replaced by a generated hook.
+type TwoFactor struct {
+	Device string
+	FSType string
+	Path   string
+}
+
+// The LUKS key is the passphrase followed by the hex encoded SHA-256 of the
+// keyfile, which the initramfs hook computes the same way.
+func twoFactorKey(passphrase string, keyfile []byte) string {
+	sum := sha256.Sum256(keyfile)
+	return passphrase + hex.EncodeToString(sum[:])
+}
+
+// Read the keyfile from the Device, creating it if necessary.
+func (t *TwoFactor) readKeyfile(kill chan bool) ([]byte, error) {
+	dir, err := mkdirTemp("summon-key-")
+	if err != nil {
+		return nil, err
+	}
+	defer remove(dir)
+	if err := mount(t.Device, dir, t.FSType, ""); err != nil {
+		return nil, err
+	}
+
+	name := filepath.Join(dir, t.Path)
+	key, err := readFile(name)
+	if os.IsNotExist(err) {
+		key = make([]byte, keyfileSize)
+		if _, err = rand.Read(key); err == nil {
+			err = writeFile(name, key, os.FileMode(0o400))
+		}
+	}
+	if uerr := umount(dir); err == nil {
+		err = uerr
+	}
+	return key, err
+}
+
+// Combine the root disk password with the keyfile for Config.TwoFactor, if
+// it is configured. This must run after the password is set and checked,
+// and before the disk is formatted or opened.
+func (c *Config) CombineKeyfile(kill chan bool) error {
+	if c.TwoFactor == nil {
+		return nil
+	}
+	if c.Root.Password == "" {
+		return errTwoFactorNoPassword
+	}
+	key, err := c.TwoFactor.readKeyfile(kill)
+	if err != nil {
+		return err
+	}
+	c.Root.Password = twoFactorKey(c.Root.Password, key)
+	return nil
+}
+
+const twoFactorInstall = `#!/bin/bash
+
+build() {
+	add_module dm-crypt
+	add_module dm-mod
+	add_all_modules /crypto/
+	add_checked_modules '/drivers/usb/storage/'
+	add_module vfat
+	add_binary cryptsetup
+	add_binary sha256sum
+	add_runscript
+}
+
+help() {
+	echo "Unlocks the root disk with a passphrase and a keyfile on removable media."
+}
+`
+
+const twoFactorHook = `#!/usr/bin/ash
+
+run_hook() {
+	modprobe -a -q dm-crypt >/dev/null 2>&1
+	mkdir -p /key
+	echo "Waiting for the key device %[1]s"
+	until [ -e %[1]q ]; do
+		sleep 1
+	done
+	mount -o ro %[2]s %[1]q /key || return 1
+	sum=$(sha256sum /key/%[3]s | cut -d ' ' -f 1)
+	umount /key
+	[ -n "$sum" ] || return 1
+	until {
+		read -rsp "Passphrase for %[4]s: " pass
+		echo
+		printf '%%s%%s' "$pass" "$sum" | cryptsetup open --type luks --key-file=- %[5]q %[4]q
+	}; do
+		:
+	done
+	unset pass sum
+}
+`
+
+// Sourced after mkinitcpio.conf, keeping the rest of the configured HOOKS.
+const twoFactorConf = `for i in "${!HOOKS[@]}"; do
+	[[ ${HOOKS[i]} == encrypt ]] && HOOKS[i]=summon-2fa
+done
+`
+
+// Generate the mkinitcpio hook for Config.TwoFactor, and a configuration
+// drop-in replacing the encrypt hook with it. PostInstall regenerates the
+// initramfs, so this must run before it.
+func (c *Config) GenTwoFactorHook(kill chan bool) error {
+	if c.TwoFactor == nil {
+		return nil
+	}
+	var fsType string
+	if c.TwoFactor.FSType != "" {
+		fsType = "-t " + c.TwoFactor.FSType
+	}
+	files := []struct {
+		name     string
+		contents string
+		mode     os.FileMode
+	}{
+		{"etc/initcpio/install/summon-2fa", twoFactorInstall, os.FileMode(0o644)},
+		{"etc/initcpio/hooks/summon-2fa", fmt.Sprintf(
+			twoFactorHook,
+			c.TwoFactor.Device,
+			fsType,
+			c.TwoFactor.Path,
+			c.Root.Name,
+			filepath.Join("/dev/disk/by-partlabel", c.Root.Name),
+		), os.FileMode(0o644)},
+		{"etc/mkinitcpio.conf.d/summon-2fa.conf", twoFactorConf, os.FileMode(0o644)},
+	}
+	for _, f := range files {
+		if err := c.writeTargetFile(f.name, f.contents, f.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package system
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errMaskWithoutSystemd = errors.New("summon: masking units requires systemd")
+
+// Enable the EnableUnits and mask the MaskUnits in the target. This uses
+// `systemctl --root`, which does not run anything inside the target.
+func (c *Config) ConfigureUnits(kill chan bool) error {
+	for _, u := range c.EnableUnits {
+		if err := c.enableService(u, kill); err != nil {
+			return err
+		}
+	}
+
+	if len(c.MaskUnits) == 0 {
+		return nil
+	}
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return errMaskWithoutSystemd
+	}
+	args := append([]string{"--root", c.Root.Dir, "mask"}, c.MaskUnits...)
+	if err := run(exec.Command("systemctl", args...), kill); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/daaku/summon"
+)
+
+// A user account to create in the target. Either a plain text Password, a
+// crypt(3) PasswordHash, or a PasswordSecret reference resolved by
+// ResolveSecrets may be specified, otherwise the account is left without a
+// password. An Admin is allowed to use sudo or doas, without a password only
+// with NoPasswd, like for one logging in with SSH keys only. The Dotfiles are
+// deployed into the home by InstallDotfiles.
+type User struct {
+	Name           string
+	Admin          bool
+	UID            int
+	Groups         []string
+	Shell          string
+	SSHKeys        []string
+	Password       string
+	PasswordHash   string
+	PasswordSecret string
+	NoPasswd       bool
+	Dotfiles       *Dotfiles
+}
+
+// Create or update the configured Users in the target.
+func (c *Config) CreateUsers(kill chan bool) error {
+	existing, err := c.targetUsers()
+	if err != nil {
+		return err
+	}
+	for _, u := range c.Users {
+		_, exists := existing[u.Name]
+		if err := c.createUser(u, exists, kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) createUser(u User, exists bool, kill chan bool) error {
+	var args []string
+	if exists {
+		args = append(args, "/usr/sbin/usermod")
+	} else {
+		args = append(args, "/usr/sbin/useradd", "--create-home", "--user-group")
+	}
+	if u.UID != 0 {
+		args = append(args, "--uid", strconv.Itoa(u.UID))
+	}
+	if len(u.Groups) > 0 {
+		args = append(args, "--groups", strings.Join(u.Groups, ","))
+	}
+	if u.Shell != "" {
+		args = append(args, "--shell", u.Shell)
+	}
+	args = append(args, u.Name)
+	if err := run(c.targetCmd(nil, args...), kill); err != nil {
+		return err
+	}
+
+	summon.AddSecret(u.Password)
+	switch {
+	case u.PasswordHash != "":
+		return c.chpasswd(u.Name+":"+u.PasswordHash, true, kill)
+	case u.Password != "":
+		return c.chpasswd(u.Name+":"+u.Password, false, kill)
+	}
+	return nil
+}
+
+func (c *Config) chpasswd(entry string, encrypted bool, kill chan bool) error {
+	args := []string{"/usr/sbin/chpasswd"}
+	if encrypted {
+		args = append(args, "--encrypted")
+	}
+	cmd := c.targetCmd(nil, args...)
+	cmd.Stdin = strings.NewReader(entry + "\n")
+	return run(cmd, kill)
+}
+
+// An entry from the target's /etc/passwd.
+type passwdEntry struct {
+	UID  int
+	GID  int
+	Home string
+}
+
+// The users which already exist in the target.
+func (c *Config) targetUsers() (map[string]passwdEntry, error) {
+	passwd, err := readFile(filepath.Join(c.Root.Dir, "etc", "passwd"))
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]passwdEntry{}
+	s := bufio.NewScanner(bytes.NewReader(passwd))
+	for s.Scan() {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(s.Text(), ":")
+		if len(fields) != 7 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		users[fields[0]] = passwdEntry{UID: uid, GID: gid, Home: fields[5]}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
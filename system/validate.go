@@ -0,0 +1,234 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Check is an item of the post-install checklist, which passed if the Err
+// is nil.
+type Check struct {
+	Name string
+	Err  error
+}
+
+// Installers which boot from other files than the kernel and initramfs in the
+// vendor directory implement BootFiler, returning glob patterns relative to
+// the ESP which must each match a file.
+type BootFiler interface {
+	BootFiles(c *Config) []string
+}
+
+var (
+	errMissing     = errors.New("missing")
+	errNotLUKS     = errors.New("not a LUKS device")
+	errNoCryptHook = errors.New("no hook to unlock the encrypted root")
+)
+
+// The cryptsetup support in the initramfs, for the initramfs listing tools.
+var initramfsCrypt = map[string][]string{
+	"lsinitcpio":  {"hooks/encrypt", "hooks/summon-2fa", "systemd-cryptsetup"},
+	"lsinitramfs": {"sbin/cryptsetup"},
+}
+
+func (c *Config) bootFiles() []string {
+	if b, ok := c.installer().(BootFiler); ok {
+		return b.BootFiles(c)
+	}
+	vendor := path.Join("EFI", c.efiVendor())
+	return []string{
+		path.Join(vendor, "vmlinuz.efi"),
+		path.Join(vendor, "initrd.img"),
+		path.Join(vendor, "refind_linux.conf"),
+	}
+}
+
+func (c *Config) checkBootFiles() []Check {
+	var checks []Check
+	for _, pattern := range c.bootFiles() {
+		check := Check{Name: "ESP has " + pattern}
+		matches, err := glob(filepath.Join(c.EFI.Dir, pattern))
+		switch {
+		case err != nil:
+			check.Err = err
+		case len(matches) == 0:
+			check.Err = errMissing
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// Check the initramfs can unlock the encrypted root, for the installers
+// whose initramfs can be listed.
+func (c *Config) checkInitramfs() []Check {
+	if c.Root.Password == "" {
+		return nil
+	}
+	var tool, image string
+	switch c.installer().(type) {
+	case Arch, ALARM:
+		tool, image = "lsinitcpio", "/boot/initramfs-linux.img"
+	case Debootstrap:
+		tool, image = "lsinitramfs", "/initrd.img"
+	default:
+		return nil
+	}
+	check := Check{Name: "initramfs can unlock the root"}
+	out, err := output(c.targetCmd(nil, "/usr/bin/"+tool, image), nil)
+	if err != nil {
+		check.Err = err
+		return []Check{check}
+	}
+	check.Err = errNoCryptHook
+	for _, f := range initramfsCrypt[tool] {
+		if strings.Contains(string(out), f) {
+			check.Err = nil
+		}
+	}
+	return []Check{check}
+}
+
+// The device for an fstab or crypttab source like UUID=... or a path.
+func sourceDevice(source string) string {
+	for _, tag := range []string{"UUID", "PARTUUID", "LABEL", "PARTLABEL"} {
+		if v, ok := strings.CutPrefix(source, tag+"="); ok {
+			return path.Join("/dev/disk/by-"+strings.ToLower(tag), v)
+		}
+	}
+	return source
+}
+
+// The fields of the lines in a table like the fstab, without comments.
+func (c *Config) readTable(name string) ([][]string, error) {
+	b, err := readFile(filepath.Join(c.Root.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	return lines, s.Err()
+}
+
+func (c *Config) checkFstab() []Check {
+	lines, err := c.readTable("/etc/fstab")
+	if err != nil {
+		return []Check{{Name: "fstab", Err: err}}
+	}
+	var checks []Check
+	for _, l := range lines {
+		device := sourceDevice(l[0])
+		if !strings.HasPrefix(device, "/dev/") {
+			continue
+		}
+		check := Check{Name: "fstab source " + l[0] + " exists"}
+		if ok, err := exists(device); !ok {
+			if err == nil {
+				err = os.ErrNotExist
+			}
+			check.Err = err
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func (c *Config) checkCrypttab() []Check {
+	lines, err := c.readTable("/etc/crypttab")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return []Check{{Name: "crypttab", Err: err}}
+	}
+	var checks []Check
+	for _, l := range lines {
+		if len(l) < 2 {
+			continue
+		}
+		check := Check{Name: "crypttab " + l[0] + " is LUKS on " + l[1]}
+		info, err := Probe(sourceDevice(l[1]))
+		switch {
+		case err != nil:
+			check.Err = err
+		case info.Type != "crypto_LUKS":
+			check.Err = errNotLUKS
+		case strings.HasPrefix(l[1], "UUID=") && !strings.EqualFold(info.UUID, strings.TrimPrefix(l[1], "UUID=")):
+			check.Err = fmt.Errorf("the LUKS UUID is %s", info.UUID)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// The directories systemd loads units from in the target.
+var unitDirs = []string{"etc/systemd/system", "usr/lib/systemd/system", "lib/systemd/system"}
+
+func (c *Config) checkUnits() []Check {
+	if _, ok := c.installer().(ServiceEnabler); ok {
+		return nil
+	}
+	var checks []Check
+	for _, u := range c.EnableUnits {
+		check := Check{Name: "unit " + u + " exists", Err: errMissing}
+		if !strings.Contains(u, ".") {
+			u += ".service"
+		}
+		names := []string{u}
+		// instances are loaded from the template
+		if prefix, rest, ok := strings.Cut(u, "@"); ok {
+			names = append(names, prefix+"@"+path.Ext(rest))
+		}
+		for _, dir := range unitDirs {
+			for _, n := range names {
+				if ok, _ := exists(filepath.Join(c.Root.Dir, dir, n)); ok {
+					check.Err = nil
+				}
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// Validate the installed system before it is first booted: the ESP has the
+// kernel, initramfs and boot loader configuration, the initramfs can unlock
+// the root, the fstab and crypttab refer to the devices, and the enabled
+// units exist. It runs once the install is complete, failing with the
+// checklist if any check failed.
+func (c *Config) Validate(kill chan bool) error {
+	var checks []Check
+	checks = append(checks, c.checkBootFiles()...)
+	checks = append(checks, c.checkInitramfs()...)
+	checks = append(checks, c.checkFstab()...)
+	checks = append(checks, c.checkCrypttab()...)
+	checks = append(checks, c.checkUnits()...)
+
+	var b strings.Builder
+	failed := false
+	for _, check := range checks {
+		if check.Err == nil {
+			fmt.Fprintf(&b, "\n  ok   %s", check.Name)
+			continue
+		}
+		failed = true
+		fmt.Fprintf(&b, "\n  FAIL %s: %v", check.Name, check.Err)
+	}
+	if failed {
+		return fmt.Errorf("summon: the installed system failed validation:%s", b.String())
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package system
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const defaultVoidMirror = "https://repo-default.voidlinux.org"
+
+// Void installs Void Linux using xbps-install from the host. The
+// Config.Packages are installed along with base-system, and the Services are
+// enabled in the default runit runlevel.
+type Void struct {
+	Mirror   string
+	Musl     bool
+	Services []string
+}
+
+func (Void) EFIVendor() string {
+	return "void"
+}
+
+// Link the runit service into the default runsvdir. A systemd style .service
+// suffix is ignored.
+func (Void) EnableService(c *Config, name string, kill chan bool) error {
+	name = strings.TrimSuffix(name, ".service")
+	link := filepath.Join(c.Root.Dir, "etc", "runit", "runsvdir", "default", name)
+	if err := remove(link); err != nil {
+		return err
+	}
+	return symlink(filepath.Join("/etc/sv", name), link)
+}
+
+// dracut unlocks the encrypted root based on the generated crypttab.
+func (Void) KernelParams(c *Config) []string {
+	return nil
+}
+
+func (v Void) repository() string {
+	mirror := v.Mirror
+	if mirror == "" {
+		mirror = defaultVoidMirror
+	}
+	if v.Musl {
+		return mirror + "/current/musl"
+	}
+	return mirror + "/current"
+}
+
+func (v Void) xbpsInstall(c *Config, pkgs ...string) *exec.Cmd {
+	args := []string{
+		"--sync",
+		"--yes",
+		"--rootdir", c.Root.Dir,
+		"--repository", v.repository(),
+	}
+	cmd := exec.Command("xbps-install", append(args, pkgs...)...)
+	if v.Musl {
+		cmd.Env = append(os.Environ(), "XBPS_ARCH=x86_64-musl")
+	}
+	return cmd
+}
+
+// Install base-files.
+func (v Void) InstallFileSystem(c *Config, kill chan bool) error {
+	if err := run(v.xbpsInstall(c, "base-files"), kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Install base-system and the configured packages.
+func (v Void) InstallSystem(c *Config, kill chan bool) error {
+	if err := c.genCrypttab(); err != nil {
+		return err
+	}
+
+	pkgs := []string{"base-system"}
+	if c.Root.Password != "" {
+		pkgs = append(pkgs, "cryptsetup")
+	}
+	if c.Root.FSType == Btrfs {
+		pkgs = append(pkgs, "btrfs-progs")
+	}
+	pkgs = append(pkgs, c.Packages...)
+	if err := run(v.xbpsInstall(c, pkgs...), kill); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Enable the runit services, reconfigure all packages which regenerates the
+// initramfs for the kernel, and copy the kernel and initramfs into the ESP.
+func (v Void) PostInstall(c *Config, kill chan bool) error {
+	r := c.Root.Dir
+	for _, s := range v.Services {
+		if err := v.EnableService(c, s, kill); err != nil {
+			return err
+		}
+	}
+
+	modules, err := readDirNames(filepath.Join(r, "lib", "modules"))
+	if err != nil {
+		return err
+	}
+	if len(modules) == 0 {
+		return errNoKernelModules
+	}
+	kver := modules[len(modules)-1]
+	vendor := c.vendorDir()
+	if err := mkdirAll(filepath.Join(r, vendor), os.FileMode(0o755)); err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		{"/usr/bin/xbps-reconfigure", "--force", "--all"},
+		{"/usr/bin/cp", "/boot/vmlinuz-" + kver, filepath.Join(vendor, "vmlinuz.efi")},
+		{"/usr/bin/cp", "/boot/initramfs-" + kver + ".img", filepath.Join(vendor, "initrd.img")},
+	}
+	for _, cmd := range cmds {
+		if err := run(c.targetCmd(nil, cmd...), kill); err != nil {
+			return err
+		}
+	}
+	return nil
+}
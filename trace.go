@@ -0,0 +1,112 @@
+package summon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Tracer is told when each Task and command starts, and calls the returned
+// function once it's done, like to record OpenTelemetry spans. The returned
+// context is passed on to nested tasks and commands, so they can be recorded
+// as children.
+type Tracer interface {
+	StartTask(ctx context.Context, name string) (context.Context, func(err error))
+	StartCommand(ctx context.Context, args []string) (context.Context, func(CommandResult))
+}
+
+// The outcome of a command for a Tracer. ExitCode is -1 if the command didn't
+// exit normally, and OutputBytes counts both stdout and stderr.
+type CommandResult struct {
+	ExitCode    int
+	OutputBytes int
+	Duration    time.Duration
+	Err         error
+}
+
+type nopTracer struct{}
+
+func (nopTracer) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+func (nopTracer) StartCommand(ctx context.Context, args []string) (context.Context, func(CommandResult)) {
+	return ctx, func(CommandResult) {}
+}
+
+var tracer = struct {
+	sync.Mutex
+	t Tracer
+}{t: nopTracer{}}
+
+// SetTracer replaces the Tracer told about all tasks and commands, and
+// returns a function to restore the previous one. A nil Tracer disables
+// tracing.
+func SetTracer(t Tracer) (restore func()) {
+	if t == nil {
+		t = nopTracer{}
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	prev := tracer.t
+	tracer.t = t
+	return func() {
+		tracer.Lock()
+		defer tracer.Unlock()
+		tracer.t = prev
+	}
+}
+
+func currentTracer() Tracer {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.t
+}
+
+type tracers []Tracer
+
+// Tracers tells each of the Tracers about every task and command.
+func Tracers(ts ...Tracer) Tracer {
+	return tracers(ts)
+}
+
+func (ts tracers) StartTask(ctx context.Context, name string) (context.Context, func(error)) {
+	ends := make([]func(error), len(ts))
+	for i, t := range ts {
+		ctx, ends[i] = t.StartTask(ctx, name)
+	}
+	return ctx, func(err error) {
+		for i := len(ends) - 1; i >= 0; i-- {
+			ends[i](err)
+		}
+	}
+}
+
+func (ts tracers) StartCommand(ctx context.Context, args []string) (context.Context, func(CommandResult)) {
+	ends := make([]func(CommandResult), len(ts))
+	for i, t := range ts {
+		ctx, ends[i] = t.StartCommand(ctx, args)
+	}
+	return ctx, func(r CommandResult) {
+		for i := len(ends) - 1; i >= 0; i-- {
+			ends[i](r)
+		}
+	}
+}
+
+// Run the Task's Do, traced with its Name.
+func (t Task) do(ctx context.Context) error {
+	ctx, end := currentTracer().StartTask(ctx, t.Name)
+	err := protect(ctx, t.Name, t.Do)
+	end(RedactError(err))
+	return tag(t.Name, err)
+}
+
+// The command line with registered secrets masked, for tracing.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, a := range args {
+		redacted[i] = Redact(a)
+	}
+	return redacted
+}